@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/ThomasHabets/cmdg/pkg/cmdg"
+	"github.com/ThomasHabets/cmdg/pkg/display"
+	"github.com/ThomasHabets/cmdg/pkg/input"
+)
+
+// account is a connected account, with its own connection, caches,
+// and settings.
+type account struct {
+	name      string
+	conn      *cmdg.CmdG
+	signature string
+}
+
+var (
+	accountsM sync.Mutex
+	accounts  = map[string]*account{}
+
+	// All configured account names.
+	accountNames []string
+
+	// Name of the account being shown. Only changed by the UI thread.
+	currentAccount string
+)
+
+// accountDir returns the directory for per-account state. The
+// default account uses the config directory itself, as it did before
+// there were multiple accounts.
+func accountDir(name string) string {
+	d := path.Join(os.Getenv("HOME"), defaultConfigDir)
+	if name == cmdg.DefaultAccount {
+		return d
+	}
+	return path.Join(d, "accounts", name)
+}
+
+// connectAccount connects to an account, without loading anything.
+func connectAccount(ctx context.Context, name string) (*account, error) {
+	a := &account{name: name}
+	if *fixtures != "" {
+		b, err := cmdg.NewMemBackendFromDir(*fixtures, "me@example.com")
+		if err != nil {
+			return nil, errors.Wrapf(err, "loading fixtures from %q", *fixtures)
+		}
+		a.conn = cmdg.NewWithBackend(b)
+		log.Infof("Loaded fixtures from %q", *fixtures)
+		return a, nil
+	}
+
+	var err error
+	a.conn, err = cmdg.NewAccount(configFilePath(), name)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Connected account %q", name)
+	d := accountDir(name)
+	if err := os.MkdirAll(d, 0700); err != nil {
+		return nil, errors.Wrapf(err, "creating account directory %q", d)
+	}
+	if err := a.conn.UseJournal(path.Join(d, journalFileName)); err != nil {
+		return nil, errors.Wrap(err, "opening offline journal")
+	}
+	if *offline {
+		a.conn.SetOffline(ctx, true)
+	}
+	// Exporting and importing would only fill the cache with
+	// messages and lists that won't be looked at again.
+	if *diskCache && *exportFlag == "" && *importFlag == "" {
+		if err := a.conn.UseDiskCache(path.Join(d, cacheDirName)); err != nil {
+			return nil, errors.Wrap(err, "opening disk cache")
+		}
+		if err := a.conn.UseContactsCache(path.Join(d, cacheDirName, contactsFileName)); err != nil {
+			return nil, errors.Wrap(err, "loading cached contacts")
+		}
+	}
+	go a.conn.RunJournal(ctx)
+	return a, nil
+}
+
+func (a *account) loadSignature(ctx context.Context) error {
+	b, err := a.conn.GetFile(ctx, signatureFilename)
+	if err == os.ErrNotExist {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	a.signature = string(b)
+	return nil
+}
+
+// load loads signature, labels, send-as aliases, settings, and contacts.
+func (a *account) load(ctx context.Context) error {
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := a.loadSignature(ctx); cmdg.IsNetworkError(err) {
+			log.Warningf("Offline, not loading signature: %v", err)
+		} else if err != nil {
+			errs <- errors.Wrap(err, "loading signature from Drive appdata")
+		}
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := a.conn.LoadLabels(ctx); cmdg.IsNetworkError(err) {
+			log.Warningf("Offline, and no cached labels: %v", err)
+		} else if err != nil {
+			errs <- errors.Wrap(err, "loading labels")
+		} else {
+			log.Infof("Labels loaded")
+		}
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := a.conn.LoadSendAs(ctx); cmdg.IsNetworkError(err) {
+			log.Warningf("Offline, and no cached send-as aliases: %v", err)
+		} else if err != nil {
+			errs <- errors.Wrap(err, "loading send-as aliases")
+		} else {
+			log.Infof("Send-as aliases loaded")
+		}
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := a.conn.LoadSettings(ctx); err != nil {
+			log.Errorf("Failed to load settings: %v", err)
+		} else {
+			log.Infof("Settings loaded")
+		}
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := a.conn.LoadContacts(ctx); cmdg.IsNetworkError(err) {
+			log.Warningf("Offline, not loading contacts: %v", err)
+		} else if err != nil {
+			errs <- errors.Wrap(err, "loading contacts")
+		} else {
+			log.Infof("Contacts loaded")
+		}
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := a.conn.SyncCache(ctx); err != nil {
+			log.Errorf("Syncing disk cache: %v", err)
+		}
+	}()
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+// reload reloads labels and contacts, and syncs the cache.
+func (a *account) reload(ctx context.Context) {
+	if err := a.conn.LoadLabels(ctx); err != nil {
+		log.Errorf("Loading labels for %q: %v", a.name, err)
+	} else {
+		log.Infof("Reloaded labels for %q", a.name)
+	}
+	if err := a.conn.LoadContacts(ctx); err != nil {
+		log.Errorf("Loading contacts for %q: %v", a.name, err)
+	} else {
+		log.Infof("Reloaded contacts for %q", a.name)
+	}
+	if err := a.conn.SyncCache(ctx); err != nil {
+		log.Errorf("Syncing disk cache for %q: %v", a.name, err)
+	}
+}
+
+// loadedAccounts returns all connected accounts.
+func loadedAccounts() []*account {
+	accountsM.Lock()
+	defer accountsM.Unlock()
+	var ret []*account
+	for _, a := range accounts {
+		ret = append(ret, a)
+	}
+	return ret
+}
+
+// useAccount makes an account the current one.
+func useAccount(a *account) {
+	accountsM.Lock()
+	accounts[a.name] = a
+	accountsM.Unlock()
+	conn = a.conn
+	signature = a.signature
+	currentAccount = a.name
+	fmt.Print(display.TerminalTitle(terminalTitle()))
+}
+
+// switchAccount switches to another account, connecting to it if needed.
+//
+// Connecting may ask for a passphrase or run a credential command on
+// the terminal, so keyboard input is stopped while it does.
+func switchAccount(ctx context.Context, name string, keys *input.Input) error {
+	accountsM.Lock()
+	a, found := accounts[name]
+	accountsM.Unlock()
+	if !found {
+		keys.Stop()
+		var err error
+		a, err = connectAccount(ctx, name)
+		if serr := keys.Start(); serr != nil {
+			return errors.Wrap(serr, "restarting keyboard input")
+		}
+		if err != nil {
+			return errors.Wrapf(err, "connecting to account %q", name)
+		}
+		if err := a.load(ctx); err != nil {
+			return errors.Wrapf(err, "loading account %q", name)
+		}
+	}
+	useAccount(a)
+	return nil
+}
+
+func terminalTitle() string {
+	if len(accountNames) > 1 {
+		return "cmdg - " + currentAccount
+	}
+	return "cmdg"
+}
@@ -32,7 +32,6 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
-	"sync"
 	"syscall"
 	"time"
 
@@ -60,11 +59,29 @@ var (
 	verbose         = flag.Bool("verbose", false, "Turn on verbose logging.")
 	shell           = flag.String("shell", "/bin/sh", "Shell to shell out to.")
 	versionFlag     = flag.Bool("version", false, "Show version and exit.")
-	lynx            = flag.String("lynx", "lynx", "HTML render binary.")
+	lynx            = flag.String("lynx", "", "External HTML render binary, e.g. lynx. Default is to use the built-in renderer.")
+	htmlSandbox     = flag.String("html_sandbox", "", "Render HTML in a sandbox: native (new namespaces without network, but with your own file access; no privileges needed), or the path to a setuid wrapper such as html-renderer/render.c. Default is a child process with only CPU and memory limits.")
 	enableSign      = flag.Bool("sign", false, "Send signed emails by default.")
-
-	updateSender = flag.String("update_sender", "", `Update default sender address. E.g.: "John Doe" <john.doe@example.com>`)
-
+	fixtures        = flag.String("fixtures", "", "Instead of GMail, use an in-memory store loaded from this directory of RFC822 files. Subdirectories are labels.")
+	accountFlag     = flag.String("account", "", "Account to configure, or to start with. Default is the first account in the config.")
+	offline         = flag.Bool("offline", false, "Start in offline mode, queueing changes until going back online.")
+	threads         = flag.Bool("threads", false, "Start with the inbox grouped into threads. Toggle with T.")
+	diskCache       = flag.Bool("disk_cache", true, "Cache messages on disk in ~/"+path.Join(defaultConfigDir, cacheDirName)+", or ~/"+path.Join(defaultConfigDir, "accounts", "<name>", cacheDirName)+". Not used by -export and -import.")
+
+	updateSender      = flag.String("update_sender", "", `Update default sender address. E.g.: "John Doe" <john.doe@example.com>`)
+	exportFiltersFlag = flag.String("export_filters", "", "Export server side filters as JSON to this file (- for stdout), and exit.")
+	vacation          = flag.String("vacation", "", "Show (show), enable (on), or disable (off) the vacation responder, and exit.")
+	exportFlag        = flag.String("export", "", "Export messages to this mbox file or Maildir, and exit. Run again to resume an interrupted export.")
+	exportFormat      = flag.String("export_format", "mbox", "Format for -export: mbox (mboxrd) or maildir.")
+	exportLabel       = flag.String("export_label", "", "Label (name or ID) to -export.")
+	exportQuery       = flag.String("export_query", "", "Gmail search query to -export. E.g. 'from:alice before:2019/01/01'.")
+	rpcStatsFlag      = flag.Bool("rpc_stats", false, "Print RPC stats to stderr on exit.")
+	importFiltersFlag = flag.String("import_filters", "", "Import server side filters from this JSON file (- for stdin), and exit. Existing filters are skipped.")
+	importFlag        = flag.String("import", "", "Import messages from this mbox file, Maildir, .eml file, or directory of .eml files, and exit. Run again to resume an interrupted import.")
+	importLabel       = flag.String("import_label", "", "Label (name or ID) to add to messages from -import. Created if missing.")
+	importRead        = flag.Bool("import_read", false, "Mark all messages from -import as read. Default is to keep read status from the source.")
+
+	// conn is the connection of the current account.
 	conn *cmdg.CmdG
 
 	// Relative to configDir.
@@ -73,11 +90,21 @@ var (
 	// Relative to $HOME.
 	defaultConfigDir = ".cmdg"
 
+	// Relative to accountDir().
+	cacheDirName = "cache"
+
+	// Relative to accountDir().
+	journalFileName = "journal.json"
+
+	// Relative to the cache dir.
+	contactsFileName = "contacts.json"
+
 	pagerBinary  string
 	visualBinary string
 
 	labelReloadTime = time.Minute
 
+	// signature of the current account.
 	signature string
 
 	// The way to build API keys in at build time is to build with
@@ -103,33 +130,25 @@ func configFilePath() string {
 	return path.Join(os.Getenv("HOME"), defaultConfigDir, configFileName)
 }
 
-func loadSignature(ctx context.Context) error {
-	b, err := conn.GetFile(ctx, signatureFilename)
-	if err == os.ErrNotExist {
-		return nil
-	}
-	if err != nil {
-		return err
-	}
-	signature = string(b)
-	return nil
-}
-
 func run(ctx context.Context) error {
 	defer func() {
 		display.Exit()
 		fmt.Print(display.TerminalTitle("Terminal"))
 	}()
 	// TODO: maybe change the title when there's new mail?
-	fmt.Print(display.TerminalTitle("cmdg"))
+	fmt.Print(display.TerminalTitle(terminalTitle()))
 	keys := input.New()
 	if err := keys.Start(); err != nil {
 		return err
 	}
 
-	v := NewMessageView(ctx, "INBOX", "", keys)
-
-	if err := v.Run(ctx); err != nil {
+	var err error
+	if *threads {
+		err = NewThreadListView(ctx, cmdg.Inbox, "", keys).Run(ctx)
+	} else {
+		err = NewMessageView(ctx, cmdg.Inbox, "", keys).Run(ctx)
+	}
+	if err != nil {
 		log.Errorf("Bailing due to error: %v", err)
 	}
 	log.Infof("MessageView returned, stopping keys")
@@ -139,6 +158,9 @@ func run(ctx context.Context) error {
 }
 
 func main() {
+	if cmdg.IsHTMLRenderChild() {
+		os.Exit(cmdg.HTMLRenderChild())
+	}
 	if InitID != "" {
 		cmdg.DefaultClientID = InitID
 		cmdg.DefaultClientSecret = InitSecret
@@ -148,12 +170,19 @@ func main() {
 	cmdg.Version = version
 
 	cmdg.Lynx = *lynx
+	cmdg.HTMLSandbox = *htmlSandbox
+	cmdg.HTMLInProcess = false
 
 	log.Infof("cmdg %s", version)
 
 	if flag.NArg() != 0 {
 		log.Fatalf("Trailing args on cmdline: %q", flag.Args())
 	}
+	if *rpcStatsFlag {
+		// log.Fatal skips deferred calls, but runs exit handlers.
+		defer printRPCStats()
+		log.RegisterExitHandler(printRPCStats)
+	}
 
 	if *verbose {
 		log.SetLevel(log.DebugLevel)
@@ -170,7 +199,7 @@ func main() {
 	}
 
 	if *configure {
-		if err := cmdg.Configure(configFilePath()); err != nil {
+		if err := cmdg.Configure(configFilePath(), *accountFlag); err != nil {
 			log.Fatalf("Configuring: %v", err)
 		}
 		return
@@ -193,12 +222,26 @@ func main() {
 
 	cmdg.GPG = gpg.New(*gpgFlag)
 
-	var err error
-	conn, err = cmdg.New(configFilePath())
+	if *fixtures != "" {
+		accountNames = []string{cmdg.DefaultAccount}
+	} else {
+		var err error
+		accountNames, err = cmdg.AccountNames(configFilePath())
+		if err != nil {
+			log.Fatalf("Failed to read config: %v", err)
+		}
+		if len(accountNames) == 0 {
+			log.Fatalf("No accounts configured. Run with -configure")
+		}
+	}
+	name := *accountFlag
+	if name == "" {
+		name = accountNames[0]
+	}
+	a, err := connectAccount(ctx, name)
 	if err != nil {
 		log.Fatalf("Failed to connect: %v", err)
 	}
-	log.Infof("Connected")
 
 	if *updateSignature {
 		p := path.Join(os.Getenv("HOME"), ".signature")
@@ -206,71 +249,64 @@ func main() {
 		if err != nil {
 			log.Fatalf("Reading %q: %v", p, err)
 		}
-		if err := conn.UpdateFile(ctx, signatureFilename, b); err != nil {
+		if err := a.conn.UpdateFile(ctx, signatureFilename, b); err != nil {
 			log.Fatalf("Uploading signature file: %v", err)
 		}
 	}
 
+	if *updateSender != "" {
+		a.conn.SetDefaultSender(*updateSender)
+		if err := a.conn.SaveSettings(ctx); err != nil {
+			log.Errorf("Failed to save settings: %v", err)
+		}
+	}
+
 	log.Infof("Loading settings…")
 	log.Infof("For \"Token has been expired or revoked\": re-run cmdg with -configure")
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		if err := loadSignature(ctx); err != nil {
-			log.Fatalf("Failed to load signature from Drive appdata: %v", err)
-		}
-	}()
+	if err := a.load(ctx); err != nil {
+		log.Fatalf("Loading account %q: %v", name, err)
+	}
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		if err := conn.LoadLabels(ctx); err != nil {
-			log.Fatalf("Loading labels: %v", err)
+	if *vacation != "" {
+		if err := vacationCommand(ctx, a.conn, *vacation); err != nil {
+			log.Fatalf("Vacation responder: %v", err)
 		}
-		log.Infof("Labels loaded")
-	}()
-
-	if *updateSender != "" {
-		conn.SetDefaultSender(*updateSender)
-		if err := conn.SaveSettings(ctx); err != nil {
-			log.Errorf("Failed to save settings: %v", err)
+		return
+	}
+	if *exportFiltersFlag != "" {
+		if err := exportFilters(ctx, a.conn, *exportFiltersFlag); err != nil {
+			log.Fatalf("Exporting filters: %v", err)
 		}
+		return
 	}
-
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		if err := conn.LoadSettings(ctx); err != nil {
-			log.Errorf("Failed to load settings: %v", err)
-		} else {
-			log.Infof("Settings loaded")
+	if *exportFlag != "" {
+		if err := exportCommand(ctx, a.conn, *exportLabel, *exportQuery, *exportFormat, *exportFlag); err != nil {
+			log.Fatalf("Exporting: %v", err)
 		}
-	}()
-
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		if err := conn.LoadContacts(ctx); err != nil {
-			log.Fatalf("Loading contacts: %v", err)
+		return
+	}
+	if *importFiltersFlag != "" {
+		n, err := importFilters(ctx, a.conn, *importFiltersFlag)
+		if err != nil {
+			log.Fatalf("Importing filters: %v", err)
 		}
-		log.Infof("Contacts loaded")
-	}()
-	wg.Wait()
+		log.Infof("Imported %d new filters", n)
+		return
+	}
+	if *importFlag != "" {
+		if err := importCommand(ctx, a.conn, *importLabel, *importRead, *importFlag); err != nil {
+			log.Fatalf("Importing: %v", err)
+		}
+		return
+	}
+	useAccount(a)
 
 	go func() {
 		ch := time.Tick(labelReloadTime)
 		for {
 			<-ch
-			if err := conn.LoadLabels(ctx); err != nil {
-				log.Errorf("Loading labels: %v", err)
-			} else {
-				log.Infof("Reloaded labels")
-			}
-			if err := conn.LoadContacts(ctx); err != nil {
-				log.Errorf("Loading contacts: %v", err)
-			} else {
-				log.Infof("Reloaded contacts")
+			for _, a := range loadedAccounts() {
+				a.reload(ctx)
 			}
 		}
 	}()
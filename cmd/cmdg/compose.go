@@ -15,6 +15,7 @@ import (
 
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	gmail "google.golang.org/api/gmail/v1"
 
 	"github.com/ThomasHabets/cmdg/pkg/cmdg"
 	"github.com/ThomasHabets/cmdg/pkg/dialog"
@@ -73,7 +74,7 @@ func getInput(ctx context.Context, prefill string, keys *input.Input) (string, e
 
 func composeNew(ctx context.Context, conn *cmdg.CmdG, keys *input.Input) error {
 	toOpt, err := dialog.Selection(dialog.Strings2Options(conn.Contacts()), "To> ", true, keys)
-	if err == dialog.ErrAborted {
+	if errors.Cause(err) == dialog.ErrAborted {
 		return nil
 	} else if err != nil {
 		return err
@@ -88,16 +89,18 @@ func composeNew(ctx context.Context, conn *cmdg.CmdG, keys *input.Input) error {
 		to = p.EmailAddress
 	}
 
-	var sig string
-	if signature != "" {
-		sig = "--\n" + signature + "\n"
+	from, err := selectSendAs(conn, keys)
+	if errors.Cause(err) == dialog.ErrAborted {
+		return nil
+	} else if err != nil {
+		return err
 	}
 
-	prefill := fmt.Sprintf(`To: %s
+	prefill := fmt.Sprintf(`%sTo: %s
 CC:
 Subject:
 
-%s`, to, sig)
+%s`, fromHeader(conn, from), to, signatureFor(from))
 
 	headOps := []headOp{
 		func(h *mail.Header) {
@@ -113,6 +116,56 @@ Subject:
 	return compose(ctx, conn, headOps, keys, cmdg.NewThread, prefill)
 }
 
+// selectSendAs asks which alias to send as, if there's more than one.
+func selectSendAs(conn *cmdg.CmdG, keys *input.Input) (*gmail.SendAs, error) {
+	ss := conn.SendAs()
+	if len(ss) < 2 {
+		return conn.DefaultSendAs(), nil
+	}
+	def := conn.DefaultSendAs()
+	var opts []*dialog.Option
+	for n, s := range ss {
+		o := &dialog.Option{
+			Key:    s.SendAsEmail,
+			KeyInt: n,
+			Label:  cmdg.FormatSendAs(s),
+		}
+		if s == def {
+			opts = append([]*dialog.Option{o}, opts...)
+		} else {
+			opts = append(opts, o)
+		}
+	}
+	o, err := dialog.Selection(opts, "From> ", false, keys)
+	if err != nil {
+		return nil, err
+	}
+	return ss[o.KeyInt], nil
+}
+
+// fromHeader returns the From line to prefill for an alias. Empty if
+// there's no choice to be made.
+func fromHeader(conn *cmdg.CmdG, s *gmail.SendAs) string {
+	if s == nil || len(conn.SendAs()) < 2 {
+		return ""
+	}
+	return fmt.Sprintf("From: %s\n", cmdg.FormatSendAs(s))
+}
+
+// signatureFor returns the signature block for sending as an alias.
+// The alias' own signature in Gmail wins over the one uploaded with
+// -update_signature.
+func signatureFor(s *gmail.SendAs) string {
+	sig := cmdg.SendAsSignature(s)
+	if sig == "" {
+		sig = signature
+	}
+	if sig == "" {
+		return ""
+	}
+	return "--\n" + sig + "\n"
+}
+
 func createSig(ctx context.Context, msg string) (string, error) {
 	var out bytes.Buffer
 	cmd := exec.CommandContext(ctx, *gpgFlag, "--no-tty", "--batch", "-s", "-a", "-b")
@@ -135,7 +188,7 @@ type preparedMessage struct {
 }
 
 // take message text and attachments, and turn it into mail headers and parts
-func prepareMessage(ctx context.Context, msg string, attachments []*file) (*preparedMessage, error) {
+func prepareMessage(ctx context.Context, msg string, attachments []*file, sign bool) (*preparedMessage, error) {
 	head, part, err := cmdg.ParseUserMessage(msg)
 	if err != nil {
 		// TODO: ask to retry
@@ -146,7 +199,7 @@ func prepareMessage(ctx context.Context, msg string, attachments []*file) (*prep
 	mp := "mixed"
 
 	// Add signature.
-	if *enableSign {
+	if sign {
 		sig, err := createSig(ctx, part.FullString())
 		if err != nil {
 			// TODO: ask to retry or something
@@ -163,14 +216,11 @@ func prepareMessage(ctx context.Context, msg string, attachments []*file) (*prep
 		}
 	}
 	for _, att := range attachments {
-		parts = append(parts, &cmdg.Part{
-			// TODO: set better content-type.
-			Header: map[string][]string{
-				"Content-Type":        {fmt.Sprintf("application/octet-stream; name=%q", att.name)},
-				"Content-Disposition": {fmt.Sprintf("attachment; filename=%q", att.name)},
-			},
-			Contents: string(att.content),
-		})
+		p, err := cmdg.NewAttachmentPart(att.path, att.name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "attaching %q", att.name)
+		}
+		parts = append(parts, p)
 	}
 	return &preparedMessage{
 		head:  head,
@@ -179,18 +229,48 @@ func prepareMessage(ctx context.Context, msg string, attachments []*file) (*prep
 	}, nil
 }
 
+// uploadContext returns a context that shows upload progress of a
+// message, since big attachments can take a while.
+func uploadContext(ctx context.Context, title string) context.Context {
+	return cmdg.WithUploadProgress(ctx, func(sent, total int64) {
+		// Total is a bit off, since it doesn't count all MIME overhead.
+		pct := 100 * sent / (total + 1)
+		if pct > 99 {
+			pct = 99
+		}
+		dialog.Status(title, fmt.Sprintf("%d%%  (%.1f of about %.1f MB)", pct, float64(sent)/1e6, float64(total)/1e6))
+	})
+}
+
 // take message text and attachments, and turn it into mail headers and parts
 func sendMessage(ctx context.Context, conn *cmdg.CmdG, headOps []headOp, msg string, threadID cmdg.ThreadID, attachments []*file) error {
-	prep, err := prepareMessage(ctx, msg, attachments)
+	prep, err := prepareMessage(ctx, msg, attachments, *enableSign)
 	if err != nil {
 		return errors.Wrap(err, "preparing message")
 	}
 	for _, op := range headOps {
 		op(&prep.head)
 	}
+	ctx = uploadContext(ctx, "Sending")
 	return errors.Wrap(conn.SendParts(ctx, threadID, prep.mp, prep.head, prep.parts), "sending parts")
 }
 
+// saveDraft saves the message as a draft, with any attachments.
+func saveDraft(ctx context.Context, conn *cmdg.CmdG, headOps []headOp, msg string, attachments []*file) error {
+	if len(attachments) == 0 {
+		return conn.MakeDraft(ctx, msg)
+	}
+	prep, err := prepareMessage(ctx, msg, attachments, false)
+	if err != nil {
+		return errors.Wrap(err, "preparing draft")
+	}
+	for _, op := range headOps {
+		op(&prep.head)
+	}
+	ctx = uploadContext(ctx, "Saving draft")
+	return errors.Wrap(conn.MakeDraftParts(ctx, prep.mp, prep.head, prep.parts), "saving draft")
+}
+
 // compose() is used for compose, replies, and forwards.
 func compose(ctx context.Context, conn *cmdg.CmdG, headOps []headOp, keys *input.Input, threadID cmdg.ThreadID, msg string) error {
 	doEdit := true
@@ -267,6 +347,9 @@ func compose(ctx context.Context, conn *cmdg.CmdG, headOps []headOp, keys *input
 					}
 				} else {
 					log.Infof("Took %v to send message", time.Since(st))
+					if off, n := conn.Offline(); off {
+						dialog.Message("Queued", fmt.Sprintf("Offline. Message will be sent when back online (%d operations queued).", n), keys)
+					}
 					break
 				}
 			}
@@ -276,7 +359,7 @@ func compose(ctx context.Context, conn *cmdg.CmdG, headOps []headOp, keys *input
 			return nil
 		case "d":
 			st := time.Now()
-			if err := conn.MakeDraft(ctx, msg); err != nil {
+			if err := saveDraft(ctx, conn, headOps, msg, attachments); err != nil {
 				// TODO: ask to save on local filesystem.
 				return err
 			}
@@ -288,10 +371,11 @@ func compose(ctx context.Context, conn *cmdg.CmdG, headOps []headOp, keys *input
 				doEdit = false
 				break
 			}
+			doEdit = false
 			if err != nil {
 				dialog.Message("Failed to attach", fmt.Sprintf("Failed to attach file: %v", err), keys)
+				break
 			}
-			doEdit = false
 			attachments = append(attachments, f)
 		default:
 			return fmt.Errorf("can't happen! Got %q from compose question", a)
@@ -299,9 +383,12 @@ func compose(ctx context.Context, conn *cmdg.CmdG, headOps []headOp, keys *input
 	}
 }
 
+// file is an attachment. It's read from disk when sending, so that
+// big files don't need to be kept in memory.
 type file struct {
-	name    string
-	content []byte
+	name string
+	path string
+	size int64
 }
 
 func chooseFile(ctx context.Context, keys *input.Input) (*file, error) {
@@ -363,11 +450,14 @@ func chooseFile(ctx context.Context, keys *input.Input) (*file, error) {
 		}
 		// File chosen.
 		full := path.Join(startDir, fis[o.KeyInt].Name())
-		// TODO: attach a ReadCloser?
-		b, err := ioutil.ReadFile(full)
+		st, err := os.Stat(full)
+		if err != nil {
+			return nil, err
+		}
 		return &file{
-			name:    fis[o.KeyInt].Name(),
-			content: b,
+			name: fis[o.KeyInt].Name(),
+			path: full,
+			size: st.Size(),
 		}, nil
 	}
 }
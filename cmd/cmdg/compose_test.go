@@ -2,13 +2,16 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path"
 	"regexp"
 	"strings"
 	"testing"
@@ -31,30 +34,33 @@ func (fs *fakeSend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		fs.bad(w, "bad method. got %q, want %q", got, want)
 		return
 	}
-	if got, want := r.URL.String(), "/gmail/v1/users/me/messages/send?alt=json&prettyPrint=false"; got != want {
+	if got, want := r.URL.String(), "/upload/gmail/v1/users/me/messages/send?alt=json&prettyPrint=false&uploadType=multipart"; got != want {
 		fs.bad(w, "bad URL. got %q, want %q", got, want)
 		return
 	}
-	if err := r.ParseForm(); err != nil {
-		fs.bad(w, "failed to parse form: %v", err)
+	// Metadata and media.
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		fs.bad(w, "failed to parse content type: %v", err)
 		return
 	}
-	content, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		fs.bad(w, "failed to read body: %v", err)
+	mr := multipart.NewReader(r.Body, params["boundary"])
+	if _, err := mr.NextPart(); err != nil {
+		fs.bad(w, "failed to read metadata: %v", err)
 		return
 	}
-	type data struct {
-		Raw string `json:"raw"`
+	p, err := mr.NextPart()
+	if err != nil {
+		fs.bad(w, "failed to read media: %v", err)
+		return
 	}
-	var d data
-	if err := json.Unmarshal(content, &d); err != nil {
-		fs.bad(w, "failed to parse json: %v", err)
+	if got, want := p.Header.Get("Content-Type"), "message/rfc822"; got != want {
+		fs.bad(w, "bad media type. got %q, want %q", got, want)
 		return
 	}
-	raw, err := cmdg.MIMEDecode(d.Raw)
+	raw, err := ioutil.ReadAll(p)
 	if err != nil {
-		fs.bad(w, "failed to base64 decode %q: %v", d.Raw, err)
+		fs.bad(w, "failed to read body: %v", err)
 		return
 	}
 	fs.msg = string(raw)
@@ -84,6 +90,16 @@ func crnl(s string) string {
 }
 
 func TestSendMessage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cmdg-compose-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	attachment := path.Join(dir, "hello.txt")
+	if err := ioutil.WriteFile(attachment, []byte("Hello from disk"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
 	tests := []struct {
 		name        string
 		msg         string // This is what comes from $VISUAL
@@ -103,6 +119,7 @@ Content-Disposition: inline
 
 --[a-z0-9]+
 Content-Disposition: inline
+Content-Transfer-Encoding: 7bit
 Content-Type: text/plain; charset="UTF-8"
 
 World
@@ -119,6 +136,7 @@ Content-Disposition: inline
 
 --[a-z0-9]+
 Content-Disposition: inline
+Content-Transfer-Encoding: 7bit
 Content-Type: text/plain; charset="UTF-8"
 
 World
@@ -135,6 +153,7 @@ Content-Disposition: inline
 
 --[a-z0-9]+
 Content-Disposition: inline
+Content-Transfer-Encoding: 7bit
 Content-Type: text/plain; charset="UTF-8"
 
 World
@@ -152,6 +171,7 @@ Content-Disposition: inline
 
 --[a-z0-9]+
 Content-Disposition: inline
+Content-Transfer-Encoding: 7bit
 Content-Type: text/plain; charset="UTF-8"
 
 World
@@ -169,6 +189,7 @@ Content-Disposition: inline
 
 --[a-z0-9]+
 Content-Disposition: inline
+Content-Transfer-Encoding: 7bit
 Content-Type: text/plain; charset="UTF-8"
 
 World
@@ -185,6 +206,7 @@ Content-Disposition: inline
 
 --[a-z0-9]+
 Content-Disposition: inline
+Content-Transfer-Encoding: 7bit
 Content-Type: text/plain; charset="UTF-8"
 
 World
@@ -201,9 +223,31 @@ Content-Disposition: inline
 
 --[a-z0-9]+
 Content-Disposition: inline
+Content-Transfer-Encoding: 7bit
+Content-Type: text/plain; charset="UTF-8"
+
+World
+--[a-z0-9]+--`)),
+		},
+		{
+			name:        "Attachment",
+			msg:         "To: foo@bar.com\nSubject: hello\n\nWorld",
+			attachments: []*file{{name: "hello.txt", path: attachment, size: 15}},
+			matching: regexp.MustCompile(crnl(`Content-Type: multipart/mixed; boundary="[a-z0-9]+"
+Content-Disposition: inline
+
+--[a-z0-9]+
+Content-Disposition: inline
+Content-Transfer-Encoding: 7bit
 Content-Type: text/plain; charset="UTF-8"
 
 World
+--[a-z0-9]+
+Content-Disposition: attachment; filename=hello.txt
+Content-Transfer-Encoding: base64
+Content-Type: text/plain; charset=utf-8; name=hello.txt
+
+SGVsbG8gZnJvbSBkaXNr
 --[a-z0-9]+--`)),
 		},
 	}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/ThomasHabets/cmdg/pkg/cmdg"
+)
+
+const exportProgressInterval = time.Second
+
+// exportLabelID finds a label by ID (e.g. INBOX) or name, for -export
+// and -import.
+func exportLabelID(c *cmdg.CmdG, s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	for _, l := range c.Labels() {
+		if l.ID == s {
+			return l.ID, nil
+		}
+	}
+	if l := c.LabelByName(s); l != nil {
+		return l.ID, nil
+	}
+	return "", fmt.Errorf("no such label %q", s)
+}
+
+// exportCommand does what the -export flag asks for, showing progress
+// on stderr.
+func exportCommand(ctx context.Context, c *cmdg.CmdG, label, query, format, dest string) error {
+	if label == "" && query == "" {
+		return fmt.Errorf("-export needs -export_label and/or -export_query")
+	}
+	labelID, err := exportLabelID(c, label)
+	if err != nil {
+		return err
+	}
+	var last time.Time
+	show := func(p cmdg.ExportProgress) {
+		fmt.Fprintf(os.Stderr, "\rExported %d, skipped %d already exported, listed %d of about %d", p.Exported, p.Skipped, p.Listed, p.Estimate)
+	}
+	p, err := c.Export(ctx, labelID, query, cmdg.ExportFormat(format), dest, func(p cmdg.ExportProgress) {
+		if time.Since(last) > exportProgressInterval {
+			last = time.Now()
+			show(p)
+		}
+	})
+	show(p)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return errors.Wrap(err, "export interrupted, run the same command again to resume")
+	}
+	return nil
+}
+
+// importCommand does what the -import flag asks for, showing progress
+// on stderr.
+func importCommand(ctx context.Context, c *cmdg.CmdG, label string, read bool, source string) error {
+	opt := cmdg.ImportOptions{MarkRead: read}
+	if label != "" {
+		id, err := exportLabelID(c, label)
+		if err != nil {
+			l, err := c.CreateLabel(ctx, label)
+			if err != nil {
+				return err
+			}
+			id = l.ID
+		}
+		opt.LabelIDs = []string{id}
+	}
+	var last time.Time
+	show := func(p cmdg.ImportProgress) {
+		fmt.Fprintf(os.Stderr, "\rRead %d, imported %d, skipped %d duplicates and %d already imported, %d failed", p.Read, p.Imported, p.Duplicates, p.Skipped, p.Failed)
+	}
+	p, err := c.Import(ctx, source, opt, func(p cmdg.ImportProgress) {
+		if time.Since(last) > exportProgressInterval {
+			last = time.Now()
+			show(p)
+		}
+	})
+	show(p)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return errors.Wrap(err, "import interrupted, run the same command again to resume")
+	}
+	if p.Failed > 0 {
+		return fmt.Errorf("%d messages rejected by Gmail, see log", p.Failed)
+	}
+	return nil
+}
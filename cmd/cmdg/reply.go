@@ -64,9 +64,12 @@ func replyOrForward(ctx context.Context, conn *cmdg.CmdG, keys *input.Input, to,
 	if err != nil {
 		return err
 	}
-	headers := []string{
-		fmt.Sprintf("To: %s", to),
+	from := conn.ReplySendAs(ctx, msg)
+	var headers []string
+	if f := fromHeader(conn, from); f != "" {
+		headers = append(headers, strings.TrimSuffix(f, "\n"))
 	}
+	headers = append(headers, fmt.Sprintf("To: %s", to))
 	if len(cc) != 0 {
 		headers = append(headers, fmt.Sprintf("CC: %s", cc))
 	}
@@ -76,8 +79,8 @@ func replyOrForward(ctx context.Context, conn *cmdg.CmdG, keys *input.Input, to,
 		fmt.Sprintf("On %s, %s said:", date.Format("Mon, 2 Jan 2006 15:04:05 -0700"), orig),
 		replyQuoted(b),
 	}
-	if signature != "" {
-		body = append(body, "\n--\n"+signature+"\n")
+	if sig := signatureFor(from); sig != "" {
+		body = append(body, "\n"+sig)
 	}
 
 	threadID, err := msg.ThreadID(ctx)
@@ -22,50 +22,76 @@ var (
 	openWait   = flag.Bool("open_wait", false, "Wait after opening attachment. If using X, then makes sense to say no.")
 )
 
-func listAttachments(ctx context.Context, keys *input.Input, msg *cmdg.Message) error {
+// listAttachments lets the user choose an attachment and what to do
+// with it. Returns true if the user quit from an attached message.
+func listAttachments(ctx context.Context, keys *input.Input, msg *cmdg.Message) (bool, error) {
 	as, err := msg.Attachments(ctx)
 	if err != nil {
-		return err
+		return false, err
 	}
 	ass := make([]string, len(as), len(as))
 	for n, a := range as {
-		ass[n] = a.Part.Filename
+		ass[n] = a.Name()
 	}
 	which, err := dialog.Selection(dialog.Strings2Options(ass), "Attachment> ", false, keys)
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	chosen := as[which.KeyInt]
 
 	for {
-		sendQ := []dialog.Option{
-			{Key: "s", Label: "s — Save"},
-			{Key: "o", Label: "o — Open"},
-			{Key: "a", Label: "a — Abort"},
+		var sendQ []dialog.Option
+		if chosen.IsMessage() {
+			sendQ = append(sendQ, dialog.Option{Key: "v", Label: "v — View"})
 		}
+		if chosen.Secret() {
+			// Opening writes a tempfile, so only save decrypted
+			// attachments when the user asks for it.
+			sendQ = append(sendQ, dialog.Option{Key: "s", Label: "s — Save decrypted"})
+		} else {
+			sendQ = append(sendQ, []dialog.Option{
+				{Key: "s", Label: "s — Save"},
+				{Key: "o", Label: "o — Open"},
+			}...)
+		}
+		sendQ = append(sendQ, dialog.Option{Key: "a", Label: "a — Abort"})
 		a, err := dialog.Question("Action to do on attachment", sendQ, keys)
 		if err != nil {
-			return err
+			return false, err
 		}
 
 		switch a {
 		case "a": // Abort
-			return nil
+			return false, nil
+		case "v": // View
+			m, err := chosen.Message(ctx)
+			if err != nil {
+				return false, err
+			}
+			ov, err := NewOpenMessageView(ctx, m, keys)
+			if err != nil {
+				return false, err
+			}
+			op, err := ov.Run(ctx)
+			return op != nil && op.quit, err
 		case "o": // Open
+			if chosen.Secret() {
+				return false, errors.Errorf("refusing to write decrypted attachment %q to a tempfile", chosen.Name())
+			}
 			// TODO: show download status
 			data, err := chosen.Download(ctx)
 			if err != nil {
-				return err
+				return false, err
 			}
-			return openFile(ctx, data, path.Ext(chosen.Part.Filename))
+			return false, openFile(ctx, data, path.Ext(chosen.Name()))
 		case "s":
 			// TODO: show download status
 			data, err := chosen.Download(ctx)
 			if err != nil {
-				return err
+				return false, err
 			}
-			return saveFile(ctx, data, chosen.Part.Filename)
+			return false, saveFile(ctx, data, chosen.Name())
 		}
 
 	}
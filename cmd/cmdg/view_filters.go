@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	gmail "google.golang.org/api/gmail/v1"
+
+	"github.com/ThomasHabets/cmdg/pkg/cmdg"
+	"github.com/ThomasHabets/cmdg/pkg/dialog"
+	"github.com/ThomasHabets/cmdg/pkg/input"
+)
+
+const (
+	newFilterKey        = "\x00new"
+	newFilterMessageKey = "\x00message"
+	newFilterQueryKey   = "\x00query"
+	exportFiltersKey    = "\x00export"
+	importFiltersKey    = "\x00import"
+)
+
+// exportFilters writes filters as JSON to a file, or stdout if "-".
+func exportFilters(ctx context.Context, c *cmdg.CmdG, fn string) error {
+	if fn == "-" {
+		return c.ExportFilters(ctx, os.Stdout)
+	}
+	var b bytes.Buffer
+	if err := c.ExportFilters(ctx, &b); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fn, b.Bytes(), 0600)
+}
+
+// importFilters creates filters from a JSON file, or stdin if "-".
+func importFilters(ctx context.Context, c *cmdg.CmdG, fn string) (int, error) {
+	if fn == "-" {
+		return c.ImportFilters(ctx, os.Stdin)
+	}
+	f, err := os.Open(fn)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return c.ImportFilters(ctx, f)
+}
+
+// manageFilters lists, creates, and deletes server side filters. New
+// filters can be seeded from msg or query, if set.
+func manageFilters(ctx context.Context, keys *input.Input, msg *cmdg.Message, query string) error {
+	for {
+		fs, err := conn.ListFilters(ctx)
+		if err != nil {
+			return err
+		}
+		opts := []*dialog.Option{{Key: newFilterKey, Label: "<Create new filter>"}}
+		if msg != nil {
+			opts = append(opts, &dialog.Option{Key: newFilterMessageKey, Label: "<Create filter from current message>"})
+		}
+		if query != "" {
+			opts = append(opts, &dialog.Option{Key: newFilterQueryKey, Label: fmt.Sprintf("<Create filter from search %q>", query)})
+		}
+		opts = append(opts,
+			&dialog.Option{Key: exportFiltersKey, Label: "<Export filters to file>"},
+			&dialog.Option{Key: importFiltersKey, Label: "<Import filters from file>"},
+		)
+		for _, f := range fs {
+			opts = append(opts, &dialog.Option{
+				Key:   f.Id,
+				Label: conn.DescribeFilter(f),
+			})
+		}
+		which, err := dialog.Selection(opts, "Filter> ", false, keys)
+		if errors.Cause(err) == dialog.ErrAborted {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := manageFilter(ctx, which.Key, keys, msg, query); errors.Cause(err) == dialog.ErrAborted {
+			// Back to list.
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// manageFilter does one thing chosen in the filter list.
+func manageFilter(ctx context.Context, key string, keys *input.Input, msg *cmdg.Message, query string) error {
+	switch key {
+	case newFilterKey:
+		q, err := dialog.Entry("Match (search query)> ", keys)
+		if err != nil {
+			return err
+		}
+		if q == "" {
+			return nil
+		}
+		return newFilter(ctx, keys, &gmail.FilterCriteria{Query: q})
+	case newFilterMessageKey:
+		by, err := dialog.Question("Filter messages with the same", []dialog.Option{
+			{Key: "f", Label: "f — Sender"},
+			{Key: "l", Label: "l — Mailing list"},
+			{Key: "s", Label: "s — Subject"},
+		}, keys)
+		if err != nil {
+			return err
+		}
+		m := map[string]string{
+			"f": cmdg.FilterByFrom,
+			"l": cmdg.FilterByList,
+			"s": cmdg.FilterBySubject,
+		}
+		if _, found := m[by]; !found {
+			return nil
+		}
+		cr, err := cmdg.FilterCriteriaFromMessage(ctx, msg, m[by])
+		if err != nil {
+			return err
+		}
+		return newFilter(ctx, keys, cr)
+	case newFilterQueryKey:
+		return newFilter(ctx, keys, &gmail.FilterCriteria{Query: query})
+	case exportFiltersKey:
+		fn, err := dialog.Entry("Export to file> ", keys)
+		if err != nil {
+			return err
+		}
+		if fn == "" {
+			return nil
+		}
+		if err := exportFilters(ctx, conn, fn); err != nil {
+			return err
+		}
+		return dialog.Message("Filters", fmt.Sprintf("Filters exported to %q", fn), keys)
+	case importFiltersKey:
+		fn, err := dialog.Entry("Import from file> ", keys)
+		if err != nil {
+			return err
+		}
+		if fn == "" {
+			return nil
+		}
+		n, err := importFilters(ctx, conn, fn)
+		if err != nil {
+			return err
+		}
+		return dialog.Message("Filters", fmt.Sprintf("Imported %d new filters from %q", n, fn), keys)
+	}
+
+	a, err := dialog.Question("Action to do on filter", []dialog.Option{
+		{Key: "d", Label: "d — Delete"},
+		{Key: "a", Label: "a — Abort"},
+	}, keys)
+	if err != nil {
+		return err
+	}
+	if a != "d" {
+		return nil
+	}
+	log.Infof("Deleting filter %q", key)
+	return conn.DeleteFilter(ctx, key)
+}
+
+// newFilter asks for actions, and creates a filter.
+func newFilter(ctx context.Context, keys *input.Input, cr *gmail.FilterCriteria) error {
+	act := &gmail.FilterAction{}
+	for {
+		title := fmt.Sprintf("%s → %s", cmdg.DescribeCriteria(cr), conn.DescribeAction(act))
+		a, err := dialog.Question(title, []dialog.Option{
+			{Key: "e", Label: "e — Archive"},
+			{Key: "I", Label: "I — Mark as read"},
+			{Key: "*", Label: "* — Star"},
+			{Key: "l", Label: "l — Add label"},
+			{Key: "d", Label: "d — Delete"},
+			{Key: "f", Label: "f — Forward"},
+			{Key: "c", Label: "c — Create filter"},
+			{Key: "a", Label: "a — Abort"},
+		}, keys)
+		if err != nil {
+			return err
+		}
+		switch a {
+		case "e":
+			act.RemoveLabelIds = addString(act.RemoveLabelIds, cmdg.Inbox)
+		case "I":
+			act.RemoveLabelIds = addString(act.RemoveLabelIds, cmdg.Unread)
+		case "*":
+			act.AddLabelIds = addString(act.AddLabelIds, cmdg.Starred)
+		case "d":
+			act.AddLabelIds = addString(act.AddLabelIds, cmdg.Trash)
+		case "l":
+			label, err := selectOrCreateLabel(ctx, keys)
+			if errors.Cause(err) == dialog.ErrAborted {
+				break
+			} else if err != nil {
+				return err
+			}
+			act.AddLabelIds = addString(act.AddLabelIds, label.Key)
+		case "f":
+			to, err := dialog.Selection(dialog.Strings2Options(conn.Contacts()), "Forward to> ", true, keys)
+			if errors.Cause(err) == dialog.ErrAborted {
+				break
+			} else if err != nil {
+				return err
+			}
+			act.Forward = to.Key
+		case "c":
+			if len(act.AddLabelIds)+len(act.RemoveLabelIds) == 0 && act.Forward == "" {
+				break
+			}
+			_, err := conn.CreateFilter(ctx, &gmail.Filter{
+				Criteria: cr,
+				Action:   act,
+			})
+			return err
+		case "a", "^C":
+			return nil
+		}
+	}
+}
+
+// addString adds s to ss, unless already there.
+func addString(ss []string, s string) []string {
+	for _, t := range ss {
+		if t == s {
+			return ss
+		}
+	}
+	return append(ss, s)
+}
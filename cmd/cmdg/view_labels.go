@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/ThomasHabets/cmdg/pkg/cmdg"
+	"github.com/ThomasHabets/cmdg/pkg/dialog"
+	"github.com/ThomasHabets/cmdg/pkg/input"
+)
+
+const (
+	newLabelKey = "\x00new"
+)
+
+// labelOptions returns all labels as dialog options.
+func labelOptions() []*dialog.Option {
+	var opts []*dialog.Option
+	for _, l := range conn.Labels() {
+		opts = append(opts, &dialog.Option{
+			Key:   l.ID,
+			Label: l.Label,
+		})
+	}
+	return opts
+}
+
+// selectOrCreateLabel asks for a label, creating it if the name typed
+// doesn't exist.
+func selectOrCreateLabel(ctx context.Context, keys *input.Input) (*dialog.Option, error) {
+	label, isNew, err := dialog.SelectionOrNew(labelOptions(), "Label> ", keys)
+	if err != nil {
+		return nil, err
+	}
+	if !isNew {
+		return label, nil
+	}
+	l, err := conn.CreateLabel(ctx, label.Key)
+	if err != nil {
+		return nil, err
+	}
+	return &dialog.Option{Key: l.ID, Label: l.Label}, nil
+}
+
+// selectLabelColor asks for a color from the palette. The samples
+// are shown on top of the given background, or if empty as the
+// background.
+func selectLabelColor(prompt, bg string, keys *input.Input) (string, error) {
+	var opts []*dialog.Option
+	for _, c := range cmdg.LabelPalette {
+		sample := cmdg.LabelColorSample("#000000", c, " Sample ")
+		if bg != "" {
+			sample = cmdg.LabelColorSample(c, bg, " Sample ")
+		}
+		opts = append(opts, &dialog.Option{
+			Key:   c,
+			Label: fmt.Sprintf("%s %s", c, sample),
+		})
+	}
+	o, err := dialog.Selection(opts, prompt, false, keys)
+	if err != nil {
+		return "", err
+	}
+	return o.Key, nil
+}
+
+// manageLabels lets the user create, rename, recolor and delete labels.
+func manageLabels(ctx context.Context, keys *input.Input) error {
+	for {
+		opts := []*dialog.Option{{Key: newLabelKey, Label: "<Create new label>"}}
+		for _, l := range conn.Labels() {
+			if l.IsSystem() {
+				continue
+			}
+			opts = append(opts, &dialog.Option{
+				Key:   l.ID,
+				Label: l.LabelString(),
+			})
+		}
+		which, err := dialog.Selection(opts, "Manage label> ", false, keys)
+		if errors.Cause(err) == dialog.ErrAborted {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := manageLabel(ctx, which.Key, keys); errors.Cause(err) == dialog.ErrAborted {
+			// Back to list.
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// manageLabel does one action on one label, or creates a new one.
+func manageLabel(ctx context.Context, id string, keys *input.Input) error {
+	if id == newLabelKey {
+		name, err := dialog.Entry("New label (use / to nest)> ", keys)
+		if err != nil {
+			return err
+		}
+		if name == "" {
+			return nil
+		}
+		_, err = conn.CreateLabel(ctx, name)
+		return err
+	}
+
+	q := []dialog.Option{
+		{Key: "r", Label: "r — Rename"},
+		{Key: "c", Label: "c — Set color"},
+		{Key: "C", Label: "C — Remove color"},
+		{Key: "d", Label: "d — Delete"},
+		{Key: "a", Label: "a — Abort"},
+	}
+	a, err := dialog.Question("Action to do on label", q, keys)
+	if err != nil {
+		return err
+	}
+	switch a {
+	case "r":
+		name, err := dialog.Entry("New name> ", keys)
+		if err != nil {
+			return err
+		}
+		if name == "" {
+			return nil
+		}
+		return conn.RenameLabel(ctx, id, name)
+	case "c":
+		bg, err := selectLabelColor("Background> ", "", keys)
+		if err != nil {
+			return err
+		}
+		fg, err := selectLabelColor("Text color> ", bg, keys)
+		if err != nil {
+			return err
+		}
+		return conn.SetLabelColor(ctx, id, fg, bg)
+	case "C":
+		return conn.SetLabelColor(ctx, id, "", "")
+	case "d":
+		yn, err := dialog.Question("Really delete label? Messages will not be deleted.", []dialog.Option{
+			{Key: "y", Label: "y — Yes, delete it"},
+			{Key: "n", Label: "n — No"},
+		}, keys)
+		if err != nil {
+			return err
+		}
+		if yn != "y" {
+			return nil
+		}
+		log.Infof("Deleting label %q", id)
+		return conn.DeleteLabel(ctx, id)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/ThomasHabets/cmdg/pkg/cmdg"
+	"github.com/ThomasHabets/cmdg/pkg/dialog"
+	"github.com/ThomasHabets/cmdg/pkg/input"
+)
+
+// listView is a message or thread list.
+type listView interface {
+	Run(ctx context.Context) error
+}
+
+// listKey handles the keys that the message list and thread list
+// share. open makes a new list of the same kind. Returns false if
+// the key is not one of them, and a view if it should be switched to.
+func listKey(ctx context.Context, key string, keys *input.Input, errs chan<- error, open func(label, query string) listView) (listView, bool) {
+	switch key {
+	case "g":
+		var opts []*dialog.Option
+		for _, l := range conn.Labels() {
+			if strings.HasPrefix(l.ID, "CATEGORY_") || l.ID == "IMPORTANT" {
+				continue
+			}
+			opts = append(opts, &dialog.Option{
+				Key:   l.ID,
+				Label: l.LabelString(),
+			})
+		}
+		label, err := dialog.Selection(opts, "Label> ", false, keys)
+		if errors.Cause(err) == dialog.ErrAborted {
+			// No-op.
+		} else if err != nil {
+			errs <- errors.Wrapf(err, "Selecting label")
+		} else {
+			// TODO: not optimal, since it adds a
+			// stack frame on every navigation.
+			return open(label.Key, ""), true
+		}
+	case "1":
+		return open(cmdg.Inbox, ""), true
+	case "s", input.CtrlS:
+		q, err := dialog.Entry("Query> ", keys)
+		if errors.Cause(err) == dialog.ErrAborted {
+			// That's fine.
+		} else if err != nil {
+			errs <- errors.Wrapf(err, "Getting query")
+		} else {
+			return open("", q), true
+		}
+	case "A":
+		var opts []*dialog.Option
+		for _, n := range accountNames {
+			opts = append(opts, &dialog.Option{
+				Key:   n,
+				Label: n,
+			})
+		}
+		a, err := dialog.Selection(opts, "Account> ", false, keys)
+		if errors.Cause(err) == dialog.ErrAborted {
+			// No-op.
+		} else if err != nil {
+			errs <- errors.Wrapf(err, "Selecting account")
+		} else if a.Key != currentAccount {
+			if err := switchAccount(ctx, a.Key, keys); err != nil {
+				errs <- err
+			} else {
+				return open(cmdg.Inbox, ""), true
+			}
+		}
+	case "M":
+		if err := manageLabels(ctx, keys); err != nil {
+			errs <- errors.Wrapf(err, "Managing labels")
+		}
+	case "S":
+		if err := settingsScreen(ctx, keys); err != nil {
+			errs <- errors.Wrapf(err, "Settings")
+		}
+	case "D": // Hidden diagnostics screen.
+		if err := rpcStatsScreen(ctx, keys); err != nil {
+			errs <- errors.Wrapf(err, "RPC stats")
+		}
+	case "O":
+		off, _ := conn.Offline()
+		conn.SetOffline(ctx, !off)
+	default:
+		return nil, false
+	}
+	return nil, true
+}
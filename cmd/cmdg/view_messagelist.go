@@ -29,7 +29,7 @@ X                  — Mark message and step up
 e                  — Archive marked messages
 d                  — Move marked messages to trash
 I                  — Mark marked mails as read
-l                  — Label marked messages
+l                  — Label marked messages, creating the label if needed
 L                  — Unlabel marked messages
 *                  — Toggle starred on highlighted message
 c                  — Compose new message
@@ -38,9 +38,15 @@ N, n, ^N, j, Down  — Next message
 P, p, ^P, k, Up    — Previous message
 r, ^R              — Reload current view
 g                  — Go to label
+M                  — Manage labels
+F                  — Manage filters
+S                  — Settings, e.g. vacation responder
 1                  — Go to inbox
 U                  — Mark marked mails as unread
+O                  — Toggle offline mode
+A                  — Switch account
 s, ^s              — Search
+T                  — Switch to thread list
 q                  — Quit
 ^L                 — Refresh screen
 
@@ -91,6 +97,7 @@ type MessageView struct {
 	keys            *input.Input
 	errors          chan error
 	pageCh          chan *cmdg.Page
+	preloadedCh     chan *cmdg.Page
 	messageCh       chan *cmdg.Message
 	historyUpdateCh chan historyUpdate
 	removeMessage   chan string
@@ -107,6 +114,7 @@ func NewMessageView(ctx context.Context, label, q string, in *input.Input) *Mess
 		label:           label,
 		errors:          make(chan error, 20),
 		pageCh:          make(chan *cmdg.Page),
+		preloadedCh:     make(chan *cmdg.Page, 20),
 		historyUpdateCh: make(chan historyUpdate, 20),
 		messageCh:       make(chan *cmdg.Message),
 		keys:            in,
@@ -161,14 +169,16 @@ func (mv *MessageView) fetchPage(ctx context.Context, token string) {
 		return
 	}
 	log.Infof("Listing messages took %v", time.Since(st))
-	go func() {
-		defer cancel()
-		if err := page.PreloadSubjects(ctx); err != nil {
-			mv.errors <- err
-			return
-		}
-	}()
 	mv.pageCh <- page
+
+	// The view leaves the page's messages to this until it's told
+	// the preload is done, instead of loading them one by one. The
+	// channel is buffered, since the view may be gone by then.
+	if err := page.PreloadSubjects(ctx); err != nil {
+		mv.errors <- err
+	}
+	cancel()
+	mv.preloadedCh <- page
 }
 
 // MessageViewOp is an operation to perform as the message closes.
@@ -366,6 +376,7 @@ func (mv *MessageView) Run(ctx context.Context) error {
 	var pages []*cmdg.Page
 	messagePos := map[string]int{}
 	marked := map[string]bool{}
+	preloading := map[string]bool{}
 	var scroll int
 	var screen *display.Screen
 
@@ -397,6 +408,7 @@ func (mv *MessageView) Run(ctx context.Context) error {
 		screen.Printf(0, 0, "Loading…")
 		screen.Draw()
 		pages = nil
+		preloading = map[string]bool{}
 		mv.messages = nil
 		mkMessagePos()
 		mv.pos = 0
@@ -452,7 +464,7 @@ func (mv *MessageView) Run(ctx context.Context) error {
 				s += colors
 			}
 			s += reset
-		} else {
+		} else if !preloading[curmsg.ID] {
 			go func(cur int) {
 				if err := curmsg.Preload(ctx, cmdg.LevelMetadata); err != nil {
 					log.Warningf("Failed to load metadata for email ID %s: %v", curmsg.ID, err)
@@ -672,6 +684,10 @@ func (mv *MessageView) Run(ctx context.Context) error {
 			showError(screen, mv.keys, err.Error())
 			screen.Draw()
 			continue
+		case err := <-conn.Conflicts():
+			showError(screen, mv.keys, err.Error())
+			screen.Draw()
+			continue
 		case m := <-mv.messageCh:
 			cur := messagePos[m.ID]
 			if err := drawMessage(cur); err != nil {
@@ -683,6 +699,11 @@ func (mv *MessageView) Run(ctx context.Context) error {
 			log.Printf("MessageListView: Got page!")
 			pages = append(pages, p)
 			mv.messages = append(mv.messages, p.Messages...)
+			for _, m := range p.Messages {
+				if !m.HasData(cmdg.LevelMetadata) {
+					preloading[m.ID] = true
+				}
+			}
 			want := contentHeight
 			if p.Response.NextPageToken == "" {
 				log.Infof("All pages loaded")
@@ -700,6 +721,13 @@ func (mv *MessageView) Run(ctx context.Context) error {
 			}
 			mkMessagePos()
 
+		case p := <-mv.preloadedCh:
+			// Messages that failed to preload get loaded one by one
+			// when drawn.
+			for _, m := range p.Messages {
+				delete(preloading, m.ID)
+			}
+
 		case id := <-mv.removeMessage:
 			mv.messages, mv.pos = filterMessage(mv.messages, id, mv.pos)
 			mkMessagePos()
@@ -846,14 +874,7 @@ func (mv *MessageView) Run(ctx context.Context) error {
 				// TODO: can this be partially merged with 'L' code?
 				ids, _, _ := filterMarked(mv.messages, marked, mv.pos)
 				if len(ids) != 0 {
-					var opts []*dialog.Option
-					for _, l := range conn.Labels() {
-						opts = append(opts, &dialog.Option{
-							Key:   l.ID,
-							Label: l.Label,
-						})
-					}
-					label, err := dialog.Selection(opts, "Label> ", false, mv.keys)
+					label, err := selectOrCreateLabel(ctx, mv.keys)
 					if errors.Cause(err) == dialog.ErrAborted {
 						// No-op.
 					} else if err != nil {
@@ -949,51 +970,27 @@ func (mv *MessageView) Run(ctx context.Context) error {
 				empty()
 				screen.Clear()
 				go mv.fetchPage(ctx, "")
-			case "g":
-				var opts []*dialog.Option
-				for _, l := range conn.Labels() {
-					if strings.HasPrefix(l.ID, "CATEGORY_") {
-						continue
-					}
-					if l.ID == "IMPORTANT" {
-						continue
-					}
-					opts = append(opts, &dialog.Option{
-						Key:   l.ID,
-						Label: l.LabelString(),
-					})
-				}
-				label, err := dialog.Selection(opts, "Label> ", false, mv.keys)
-				if errors.Cause(err) == dialog.ErrAborted {
-					// No-op.
-				} else if err != nil {
-					mv.errors <- errors.Wrapf(err, "Selecting label")
-				} else {
-					nv := NewMessageView(ctx, label.Key, "", mv.keys)
-					// TODO: not optimal, since it adds a
-					// stack frame on every navigation.
-					return nv.Run(ctx)
+			case "T":
+				return NewThreadListView(ctx, mv.label, mv.query, mv.keys).Run(ctx)
+			case "F":
+				var msg *cmdg.Message
+				if mv.pos < len(mv.messages) {
+					msg = mv.messages[mv.pos]
 				}
-			case "1":
-				// TODO: not optimal, since it adds a
-				// stack frame on every navigation.
-				return NewMessageView(ctx, cmdg.Inbox, "", mv.keys).Run(ctx)
-			case "s", input.CtrlS:
-				q, err := dialog.Entry("Query> ", mv.keys)
-				if err == dialog.ErrAborted {
-					// That's fine.
-				} else if err != nil {
-					mv.errors <- errors.Wrapf(err, "Getting query")
-				} else {
-					nv := NewMessageView(ctx, "", q, mv.keys)
-					// TODO: not optimal, since it adds a
-					// stack frame on every navigation.
-					return nv.Run(ctx)
+				if err := manageFilters(ctx, mv.keys, msg, mv.query); err != nil {
+					mv.errors <- errors.Wrapf(err, "Managing filters")
 				}
 			case "q":
 				return nil
 			default:
-				log.Infof("MessageListView got unknown key %q %v", key, []byte(key))
+				v, ok := listKey(ctx, key, mv.keys, mv.errors, func(label, query string) listView {
+					return NewMessageView(ctx, label, query, mv.keys)
+				})
+				if !ok {
+					log.Infof("MessageListView got unknown key %q %v", key, []byte(key))
+				} else if v != nil {
+					return v.Run(ctx)
+				}
 			}
 		}
 		if mv.messages != nil {
@@ -1020,6 +1017,12 @@ func (mv *MessageView) Run(ctx context.Context) error {
 			log.Debugf("Print took %v", time.Since(st))
 		}
 		// Print status.
+		if len(accountNames) > 1 {
+			status += display.Bold + currentAccount + display.Reset + " "
+		}
+		if off, n := conn.Offline(); off {
+			status += display.Color(196) + fmt.Sprintf("Offline (%d queued) ", n) + display.Reset
+		}
 		if theresMore {
 			status += display.Color(50) + "Loading…"
 		}
@@ -26,7 +26,7 @@ const (
 
 	openMessageViewHelp = `?, F1     — Help
 ^R             — Reload
-l              — Add label
+l              — Add label, creating it if needed
 L              — Remove label
 *              — Toggle "starred"
 u, ←           — Exit message
@@ -43,15 +43,30 @@ s, ^s          — Search within message
 a              — Reply all
 d              — Delete
 e              — Archive
-t, →           — Browse attachments (if any)
+t, →           — Browse attachments (if any), and view attached messages
 H              — Force HTML view
 \              — Show raw message source
 |              — Pipe to command
+F              — Manage filters, or create one from this message
 
 Press [enter] to exit
 `
 )
 
+// attachedMessageDisabled are the keys that don't work in attached
+// messages, since they're not in the mailbox.
+var attachedMessageDisabled = map[string]bool{
+	input.CtrlR: true,
+	"*":         true,
+	"l":         true,
+	"L":         true,
+	"U":         true,
+	"e":         true,
+	"d":         true,
+	input.CtrlP: true,
+	input.CtrlN: true,
+}
+
 var (
 	enableDottime = flag.Bool("dottime", false, "Enable dottime.")
 	showMessageID = flag.Bool("show_message_id", false, "Show message ID in a message.")
@@ -259,12 +274,20 @@ func (ov *OpenMessageView) Draw(lines []string, scroll int) error {
 	line++
 
 	// Labels
-	labels, err := ov.msg.GetLabelsString(ctx)
-	if err != nil {
-		ov.errors <- err
-		labels = fmt.Sprintf("Unknown: %q", err)
+	if p := ov.msg.Parent(); p != nil {
+		subj, err := p.GetSubject(ctx)
+		if err != nil {
+			subj = fmt.Sprintf("Unknown: %q", err)
+		}
+		ov.screen.Printlnf(line, "Attached to: %s", subj)
+	} else {
+		labels, err := ov.msg.GetLabelsString(ctx)
+		if err != nil {
+			ov.errors <- err
+			labels = fmt.Sprintf("Unknown: %q", err)
+		}
+		ov.screen.Printlnf(line, "Labels: %s", labels)
 	}
-	ov.screen.Printlnf(line, "Labels: %s", labels)
 	line++
 
 	// Message ID
@@ -452,6 +475,10 @@ func (ov *OpenMessageView) Run(ctx context.Context) (*MessageViewOp, error) {
 				ov.screen.Draw()
 			}
 			continue
+		case err := <-conn.Conflicts():
+			showError(ov.screen, ov.keys, err.Error())
+			ov.screen.Draw()
+			continue
 		case <-ov.update:
 			log.Infof("Message arrived")
 			gb := ov.msg.GetBody
@@ -505,6 +532,10 @@ func (ov *OpenMessageView) Run(ctx context.Context) (*MessageViewOp, error) {
 				continue
 			}
 
+			if ov.msg.Parent() != nil && attachedMessageDisabled[key] {
+				ov.errors <- fmt.Errorf("Not possible in an attached message. Press 'u' to go back")
+				continue
+			}
 			switch key {
 			case input.CtrlR:
 				go func() {
@@ -530,14 +561,7 @@ func (ov *OpenMessageView) Run(ctx context.Context) (*MessageViewOp, error) {
 				}
 				ov.Draw(lines, scroll)
 			case "l":
-				var opts []*dialog.Option
-				for _, l := range conn.Labels() {
-					opts = append(opts, &dialog.Option{
-						Key:   l.ID,
-						Label: l.Label,
-					})
-				}
-				label, err := dialog.Selection(opts, "Label> ", false, ov.keys)
+				label, err := selectOrCreateLabel(ctx, ov.keys)
 				if errors.Cause(err) == dialog.ErrAborted {
 					// No-op.
 				} else if err != nil {
@@ -592,6 +616,11 @@ func (ov *OpenMessageView) Run(ctx context.Context) (*MessageViewOp, error) {
 				return OpPrev(), nil
 			case input.CtrlN:
 				return OpNext(), nil
+			case "F":
+				if err := manageFilters(ctx, ov.keys, ov.msg, ""); err != nil {
+					ov.errors <- errors.Wrapf(err, "Managing filters")
+				}
+				ov.Draw(lines, scroll)
 			case "U":
 				if err := ov.msg.AddLabelID(ctx, cmdg.Unread); err != nil {
 					ov.errors <- fmt.Errorf("Failed to mark unread : %v", err)
@@ -659,10 +688,12 @@ func (ov *OpenMessageView) Run(ctx context.Context) (*MessageViewOp, error) {
 				if err != nil {
 					ov.errors <- fmt.Errorf("Listing attachments failed: %v", err)
 				} else if len(as) > 0 {
-					if err := listAttachments(ctx, ov.keys, ov.msg); errors.Cause(err) == dialog.ErrAborted {
+					if quit, err := listAttachments(ctx, ov.keys, ov.msg); errors.Cause(err) == dialog.ErrAborted {
 						log.Infof("View attachment aborted")
 					} else if err != nil {
 						ov.errors <- fmt.Errorf("Attachment browser action failed: %v", err)
+					} else if quit {
+						return OpQuit(), nil
 					}
 				}
 			case "\\":
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mattn/go-runewidth"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/ThomasHabets/cmdg/pkg/cmdg"
+	"github.com/ThomasHabets/cmdg/pkg/dialog"
+	"github.com/ThomasHabets/cmdg/pkg/display"
+	"github.com/ThomasHabets/cmdg/pkg/input"
+)
+
+const (
+	openThreadViewHelp = `?, F1          — Help
+^R             — Reload
+enter          — Expand/collapse message
+E              — Expand all messages
+C              — Collapse all messages
+j, Tab         — Next message in thread
+k              — Previous message in thread
+n, Down        — Scroll down
+p, Up          — Scroll up
+space          — Page down
+backspace      — Page up
+u, ←           — Exit thread
+^P             — Previous thread
+^N             — Next thread
+r              — Reply to message
+a              — Reply all to message
+f              — Forward message
+t, →           — Browse attachments of message (if any)
+e              — Archive thread
+d              — Delete thread
+l              — Add label to thread, creating it if needed
+L              — Remove label from thread
+*              — Toggle "starred" on thread
+U              — Mark thread unread
+F              — Manage filters, or create one from this message
+
+Press [enter] to exit
+`
+)
+
+// OpenThreadView is the view for an open thread, showing all its messages.
+type OpenThreadView struct {
+	thread *cmdg.Thread
+	keys   *input.Input
+	screen *display.Screen
+
+	update chan error // Load done, with any error.
+	errors chan error
+
+	// Main goroutine only.
+	msgs     []*cmdg.Message
+	expanded map[string]bool
+	cur      int
+	lines    []string
+	starts   []int // Line where each message starts.
+}
+
+// NewOpenThreadView creates a new open thread view.
+func NewOpenThreadView(ctx context.Context, thread *cmdg.Thread, in *input.Input) (*OpenThreadView, error) {
+	screen, err := display.NewScreen()
+	if err != nil {
+		return nil, err
+	}
+	tv := &OpenThreadView{
+		thread:   thread,
+		keys:     in,
+		screen:   screen,
+		update:   make(chan error, 1),
+		errors:   make(chan error, 20),
+		expanded: make(map[string]bool),
+	}
+	go tv.load(ctx, false)
+	return tv, nil
+}
+
+func (tv *OpenThreadView) load(ctx context.Context, reload bool) {
+	st := time.Now()
+	f := tv.thread.Preload
+	if reload {
+		f = tv.thread.Reload
+	}
+	err := f(ctx, cmdg.LevelFull)
+	log.Infof("Got full thread in %v: %v", time.Since(st), err)
+	// Buffered, so that this doesn't block if the view is gone.
+	select {
+	case tv.update <- err:
+	default:
+		log.Infof("Thread view update already pending, dropping: %v", err)
+	}
+}
+
+// render turns the thread into lines. Collapsed messages are just
+// the one line header.
+func (tv *OpenThreadView) render(ctx context.Context) {
+	tv.lines = nil
+	tv.starts = nil
+	for n, m := range tv.msgs {
+		tv.starts = append(tv.starts, len(tv.lines))
+
+		from, err := m.GetFrom(ctx)
+		if err != nil {
+			from = fmt.Sprintf("Unknown: %q", err)
+		}
+		tm, err := m.GetTimeFmt(ctx)
+		if err != nil {
+			tm = "???"
+		}
+		marker := "▸"
+		if tv.expanded[m.ID] {
+			marker = "▾"
+		}
+		attr := ""
+		if m.IsUnread() {
+			attr = display.Bold
+		}
+		if n == tv.cur {
+			attr += display.Reverse
+		}
+		tv.lines = append(tv.lines, fmt.Sprintf("%s%s %s — %s%s", attr, marker, from, tm, display.Reset))
+		if !tv.expanded[m.ID] {
+			continue
+		}
+
+		for _, h := range []string{"To", "CC"} {
+			if s, err := m.GetHeader(ctx, h); err == nil && s != "" {
+				tv.lines = append(tv.lines, fmt.Sprintf("  %s: %s", h, s))
+			}
+		}
+		body, err := m.GetBody(ctx)
+		if err != nil {
+			body = fmt.Sprintf("%sGetting message body: %v%s", display.Red, err, display.Reset)
+		}
+		tv.lines = append(tv.lines, "")
+		tv.lines = append(tv.lines, wrapLines(body, tv.screen.Width)...)
+		tv.lines = append(tv.lines, "")
+	}
+}
+
+// wrapLines splits text into lines no wider than width columns,
+// breaking after spaces where possible.
+func wrapLines(s string, width int) []string {
+	var ret []string
+	for _, l := range strings.Split(s, "\n") {
+		l = strings.TrimRight(l, "\r ")
+		if len(l) == 0 {
+			ret = append(ret, "")
+			continue
+		}
+		for len(l) > 0 {
+			n := fitWidth(l, width)
+			if n < len(l) {
+				// A space right after what fits is fine too.
+				if sp := strings.LastIndex(l[:n+1], " "); sp > 0 && strings.TrimLeft(l[:sp], " ") != "" {
+					n = sp + 1
+				}
+			}
+			ret = append(ret, strings.TrimRight(l[:n], " "))
+			l = l[n:]
+		}
+	}
+	return ret
+}
+
+// fitWidth returns how many bytes of s fit in width columns, but at
+// least one rune. ANSI escapes take no space.
+func fitWidth(s string, width int) int {
+	w := 0
+	for i := 0; i < len(s); {
+		if s[i] == '\033' {
+			// Skip to the end of the escape.
+			j := i + 1
+			if j < len(s) && s[j] == '[' {
+				for j++; j < len(s) && !isASCIILetter(s[j]); j++ {
+				}
+				j++
+			}
+			i = j
+			continue
+		}
+		r, n := utf8.DecodeRuneInString(s[i:])
+		rw := runewidth.RuneWidth(r)
+		if w+rw > width && i > 0 {
+			return i
+		}
+		w += rw
+		i += n
+	}
+	return len(s)
+}
+
+func isASCIILetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// Draw draws the open thread.
+func (tv *OpenThreadView) Draw(scroll int) {
+	ctx := cancelledContext()
+	subject, err := tv.thread.GetSubject(ctx)
+	if err != nil {
+		subject = "(No subject)"
+	}
+	labels, err := tv.thread.GetLabelsString(ctx)
+	if err != nil {
+		labels = fmt.Sprintf("Unknown: %q", err)
+	}
+	tv.screen.Printlnf(0, "Subject: %s", subject)
+	tv.screen.Printlnf(1, "Labels: %s", labels)
+	tv.screen.Printlnf(2, "%s", strings.Repeat("—", tv.screen.Width))
+	line := 3
+	for n := scroll; n < len(tv.lines) && line < tv.screen.Height-2; n++ {
+		tv.screen.Printlnf(line, "%s", tv.lines[n])
+		line++
+	}
+	for ; line < tv.screen.Height-2; line++ {
+		tv.screen.Printlnf(line, "")
+	}
+	tv.screen.Printlnf(tv.screen.Height-2, "%s", strings.Repeat("—", tv.screen.Width))
+	tv.screen.Printlnf(tv.screen.Height-1, "Message %d of %d", tv.cur+1, len(tv.msgs))
+}
+
+func (tv *OpenThreadView) contentHeight() int {
+	return tv.screen.Height - 5
+}
+
+func (tv *OpenThreadView) scroll(scroll, inc int) int {
+	scroll += inc
+	if maxscroll := len(tv.lines) - tv.contentHeight(); scroll > maxscroll {
+		scroll = maxscroll
+	}
+	if scroll < 0 {
+		scroll = 0
+	}
+	return scroll
+}
+
+// gotoMessage makes message n current, and scrolls to it.
+func (tv *OpenThreadView) gotoMessage(ctx context.Context, n int) int {
+	if n < 0 || n >= len(tv.msgs) {
+		n = tv.cur
+	}
+	tv.cur = n
+	tv.render(ctx)
+	return tv.scroll(tv.starts[n], 0)
+}
+
+// Run runs the open thread view event loop.
+func (tv *OpenThreadView) Run(ctx context.Context) (*ThreadViewOp, error) {
+	log.Infof("Running OpenThreadView")
+	scroll := 0
+	tv.screen.Printf(0, 0, "Loading…")
+	tv.screen.Draw()
+	for {
+		select {
+		case <-tv.keys.Winch():
+			var err error
+			tv.screen, err = display.NewScreen()
+			if err != nil {
+				return nil, err
+			}
+			tv.render(ctx)
+			scroll = tv.scroll(scroll, 0)
+			tv.Draw(scroll)
+		case err := <-tv.errors:
+			showError(tv.screen, tv.keys, err.Error())
+			tv.screen.Draw()
+			continue
+		case err := <-conn.Conflicts():
+			showError(tv.screen, tv.keys, err.Error())
+			tv.screen.Draw()
+			continue
+		case err := <-tv.update:
+			msgs := tv.thread.Messages()
+			if len(msgs) == 0 {
+				if err != nil {
+					return nil, errors.Wrapf(err, "loading thread %q", tv.thread.ID)
+				}
+				return nil, fmt.Errorf("thread %q has no messages", tv.thread.ID)
+			}
+			if err != nil {
+				tv.errors <- errors.Wrapf(err, "Reloading thread")
+			}
+			tv.msgs = msgs
+			// Expand unread messages and the last one. Start at
+			// the first unread one.
+			tv.cur = -1
+			for n, m := range tv.msgs {
+				if m.IsUnread() || n == len(tv.msgs)-1 {
+					tv.expanded[m.ID] = true
+					if tv.cur < 0 {
+						tv.cur = n
+					}
+				}
+			}
+			scroll = tv.gotoMessage(ctx, tv.cur)
+			if tv.thread.IsUnread() {
+				go func() {
+					if err := tv.thread.RemoveLabelID(ctx, cmdg.Unread); err != nil {
+						tv.errors <- errors.Wrapf(err, "Failed to remove unread label")
+					}
+				}()
+			}
+			tv.screen.Clear()
+			tv.Draw(scroll)
+		case key, ok := <-tv.keys.Chan():
+			if !ok {
+				log.Errorf("OpenThread: Input channel closed!")
+				continue
+			}
+			if tv.msgs == nil {
+				// Not loaded yet. Only allow getting out.
+				switch key {
+				case "u", input.Left:
+					return nil, nil
+				case "q":
+					return &ThreadViewOp{quit: true}, nil
+				}
+				continue
+			}
+			curmsg := tv.msgs[tv.cur]
+			switch key {
+			case "?", input.F1:
+				help(openThreadViewHelp, tv.keys)
+			case input.CtrlR:
+				go tv.load(ctx, true)
+			case input.Enter:
+				tv.expanded[curmsg.ID] = !tv.expanded[curmsg.ID]
+				scroll = tv.gotoMessage(ctx, tv.cur)
+			case "E", "C":
+				for _, m := range tv.msgs {
+					tv.expanded[m.ID] = key == "E"
+				}
+				scroll = tv.gotoMessage(ctx, tv.cur)
+			case "j", input.Tab:
+				scroll = tv.gotoMessage(ctx, tv.cur+1)
+			case "k":
+				scroll = tv.gotoMessage(ctx, tv.cur-1)
+			case input.Home, input.XHome:
+				scroll = 0
+			case "n", input.Down:
+				scroll = tv.scroll(scroll, 1)
+			case "p", input.Up:
+				scroll = tv.scroll(scroll, -1)
+			case " ", input.CtrlV, input.PgDown:
+				scroll = tv.scroll(scroll, tv.contentHeight())
+			case input.Backspace, input.CtrlH, input.PgUp, "Meta-v":
+				scroll = tv.scroll(scroll, -tv.contentHeight())
+			case "u", input.Left:
+				return nil, nil
+			case "q":
+				return &ThreadViewOp{quit: true}, nil
+			case input.CtrlP:
+				return &ThreadViewOp{prev: true}, nil
+			case input.CtrlN:
+				return &ThreadViewOp{next: true}, nil
+			case "r":
+				if err := reply(ctx, conn, tv.keys, curmsg); err != nil {
+					tv.errors <- fmt.Errorf("Failed to reply: %v", err)
+				}
+			case "a":
+				if err := replyAll(ctx, conn, tv.keys, curmsg); err != nil {
+					tv.errors <- fmt.Errorf("Failed to replyAll: %v", err)
+				}
+			case "f":
+				if err := forward(ctx, conn, tv.keys, curmsg); err != nil {
+					tv.errors <- fmt.Errorf("Failed to forward: %v", err)
+				}
+			case "t", input.Right:
+				as, err := curmsg.Attachments(ctx)
+				if err != nil {
+					tv.errors <- fmt.Errorf("Listing attachments failed: %v", err)
+				} else if len(as) > 0 {
+					if quit, err := listAttachments(ctx, tv.keys, curmsg); errors.Cause(err) == dialog.ErrAborted {
+						log.Infof("View attachment aborted")
+					} else if err != nil {
+						tv.errors <- fmt.Errorf("Attachment browser action failed: %v", err)
+					} else if quit {
+						return &ThreadViewOp{quit: true}, nil
+					}
+				}
+			case "e":
+				if err := tv.thread.RemoveLabelID(ctx, cmdg.Inbox); err != nil {
+					tv.errors <- fmt.Errorf("Failed to archive thread: %v", err)
+				} else {
+					return &ThreadViewOp{remove: true}, nil
+				}
+			case "d":
+				if err := tv.thread.AddLabelID(ctx, cmdg.Trash); err != nil {
+					tv.errors <- fmt.Errorf("Failed to delete thread: %v", err)
+				} else {
+					return &ThreadViewOp{remove: true}, nil
+				}
+			case "F":
+				if err := manageFilters(ctx, tv.keys, curmsg, ""); err != nil {
+					tv.errors <- errors.Wrapf(err, "Managing filters")
+				}
+			case "U":
+				if err := tv.thread.AddLabelID(ctx, cmdg.Unread); err != nil {
+					tv.errors <- fmt.Errorf("Failed to mark thread unread: %v", err)
+				} else {
+					return nil, nil
+				}
+			case "*":
+				if tv.thread.HasLabel(cmdg.Starred) {
+					if err := tv.thread.RemoveLabelID(ctx, cmdg.Starred); err != nil {
+						tv.errors <- errors.Wrap(err, "Removing STARRED label")
+					}
+				} else if err := tv.thread.AddLabelID(ctx, cmdg.Starred); err != nil {
+					tv.errors <- errors.Wrap(err, "Adding STARRED label")
+				}
+			case "l":
+				label, err := selectOrCreateLabel(ctx, tv.keys)
+				if errors.Cause(err) == dialog.ErrAborted {
+					// No-op.
+				} else if err != nil {
+					tv.errors <- errors.Wrapf(err, "Selecting label")
+				} else if err := tv.thread.AddLabelID(ctx, label.Key); err != nil {
+					tv.errors <- errors.Wrapf(err, "Failed to label")
+				}
+			case "L":
+				labels, err := tv.thread.GetLabels(ctx, true)
+				if err != nil {
+					tv.errors <- errors.Wrapf(err, "Getting thread labels")
+					break
+				}
+				var opts []*dialog.Option
+				for _, l := range labels {
+					opts = append(opts, &dialog.Option{
+						Key:   l.ID,
+						Label: l.Label,
+					})
+				}
+				label, err := dialog.Selection(opts, "Label> ", false, tv.keys)
+				if errors.Cause(err) == dialog.ErrAborted {
+					// No-op.
+				} else if err != nil {
+					tv.errors <- errors.Wrapf(err, "Selecting label")
+				} else if err := tv.thread.RemoveLabelID(ctx, label.Key); err != nil {
+					tv.errors <- errors.Wrapf(err, "Failed to unlabel")
+				}
+			default:
+				log.Infof("Unknown key: %q", key)
+			}
+			tv.render(ctx)
+			tv.Draw(scroll)
+		}
+		tv.screen.Draw()
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ThomasHabets/cmdg/pkg/display"
+)
+
+func TestWrapLines(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		in    string
+		width int
+		want  []string
+	}{
+		{"short", "hello\r\n\nworld ", 10, []string{"hello", "", "world"}},
+		{"words", "aaa bbb ccc ddd", 8, []string{"aaa bbb", "ccc ddd"}},
+		{"long word", "aaaaaaaaaa bb", 4, []string{"aaaa", "aaaa", "aa", "bb"}},
+		{"indented", "    aaaaaaaa", 6, []string{"    aa", "aaaaaa"}},
+		{"wide", "日本語のテキスト", 7, []string{"日本語", "のテキ", "スト"}},
+		{"utf8", "ååååå", 2, []string{"åå", "åå", "å"}},
+		{"ansi", display.Red + "abc def" + display.Reset, 3, []string{display.Red + "abc", "def" + display.Reset}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got := wrapLines(test.in, test.width)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Got %q, want %q", got, test.want)
+			}
+			for _, l := range got {
+				if w := display.StringWidth(l); w > test.width {
+					t.Errorf("Line %q is %d wide, want at most %d", l, w, test.width)
+				}
+			}
+		})
+	}
+}
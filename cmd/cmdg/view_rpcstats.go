@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ThomasHabets/cmdg/pkg/cmdg"
+	"github.com/ThomasHabets/cmdg/pkg/display"
+	"github.com/ThomasHabets/cmdg/pkg/input"
+)
+
+const rpcStatsRefresh = time.Second
+
+// printRPCStats prints RPC stats, for -rpc_stats.
+func printRPCStats() {
+	fmt.Fprint(os.Stderr, cmdg.FormatRPCStats(cmdg.RPCCounters()))
+}
+
+// rpcStatsScreen is a diagnostics screen showing RPC stats and the
+// most recent RPCs, updated live.
+func rpcStatsScreen(ctx context.Context, keys *input.Input) error {
+	screen, err := display.NewScreen()
+	if err != nil {
+		return err
+	}
+	tick := time.NewTicker(rpcStatsRefresh)
+	defer tick.Stop()
+	for {
+		screen.Clear()
+		line := 0
+		screen.Printlnf(line, "RPC stats. Latencies include retries. Press q to return.")
+		line++
+		for _, l := range strings.Split(strings.TrimRight(cmdg.FormatRPCStats(cmdg.RPCCounters()), "\n"), "\n") {
+			if line >= screen.Height-1 {
+				break
+			}
+			screen.Printlnf(line, "%s", l)
+			line++
+		}
+		if line < screen.Height-2 {
+			line++
+			screen.Printlnf(line, "Recent RPCs, newest first:")
+			line++
+			trace := cmdg.RPCTrace()
+			for n := len(trace) - 1; n >= 0 && line < screen.Height; n-- {
+				screen.Printlnf(line, "%s", display.FixedANSIWidthRight(cmdg.FormatRPCTraceEntry(trace[n]), screen.Width))
+				line++
+			}
+		}
+		screen.Draw()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-tick.C:
+		case k := <-keys.Chan():
+			switch k {
+			case "q", input.Enter, input.Esc:
+				return nil
+			}
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	gmail "google.golang.org/api/gmail/v1"
+
+	"github.com/ThomasHabets/cmdg/pkg/cmdg"
+	"github.com/ThomasHabets/cmdg/pkg/dialog"
+	"github.com/ThomasHabets/cmdg/pkg/input"
+)
+
+// vacationCommand does what the -vacation flag asks for.
+func vacationCommand(ctx context.Context, c *cmdg.CmdG, cmd string) error {
+	switch cmd {
+	case "show":
+		v, err := c.Vacation(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Println(cmdg.FormatVacation(v))
+		return nil
+	case "on", "off":
+		v, err := c.SetVacationEnabled(ctx, cmd == "on")
+		if err != nil {
+			return err
+		}
+		fmt.Println(cmdg.DescribeVacation(v))
+		return nil
+	}
+	return fmt.Errorf("unknown vacation command %q, want show, on, or off", cmd)
+}
+
+// settingsScreen shows and changes account settings.
+func settingsScreen(ctx context.Context, keys *input.Input) error {
+	for {
+		v, err := conn.Vacation(ctx)
+		if err != nil {
+			return err
+		}
+		toggle := "v — Turn vacation responder on"
+		if v.EnableAutoReply {
+			toggle = "v — Turn vacation responder off"
+		}
+		a, err := dialog.Question(cmdg.DescribeVacation(v), []dialog.Option{
+			{Key: "v", Label: toggle},
+			{Key: "E", Label: "E — Edit vacation responder message, dates, and restrictions"},
+			{Key: "q", Label: "q — Return"},
+		}, keys)
+		if err != nil {
+			return err
+		}
+		switch a {
+		case "v":
+			if _, err := conn.SetVacationEnabled(ctx, !v.EnableAutoReply); err != nil {
+				return err
+			}
+		case "E":
+			if err := editVacation(ctx, v, keys); err != nil {
+				return err
+			}
+		case "q", "^C":
+			return nil
+		}
+	}
+}
+
+// editVacation edits vacation settings in $EDITOR until they parse.
+func editVacation(ctx context.Context, v *gmail.VacationSettings, keys *input.Input) error {
+	s := cmdg.FormatVacation(v)
+	for {
+		var err error
+		s, err = getInput(ctx, s, keys)
+		if err != nil {
+			return err
+		}
+		nv, err := cmdg.ParseVacationEdit(v, s)
+		if err == nil {
+			_, err = conn.UpdateVacation(ctx, nv)
+			if err == nil {
+				return nil
+			}
+		}
+		log.Errorf("Failed to update vacation settings: %v", err)
+		a, err := dialog.Question(fmt.Sprintf("Failed to update vacation settings (%q)", err.Error()), []dialog.Option{
+			{Key: "r", Label: "r — Return to editor"},
+			{Key: "a", Label: "a — Abort, discarding changes"},
+		}, keys)
+		if err != nil {
+			return err
+		}
+		if a != "r" {
+			return nil
+		}
+	}
+}
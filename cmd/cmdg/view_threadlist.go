@@ -0,0 +1,513 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/ThomasHabets/cmdg/pkg/cmdg"
+	"github.com/ThomasHabets/cmdg/pkg/dialog"
+	"github.com/ThomasHabets/cmdg/pkg/display"
+	"github.com/ThomasHabets/cmdg/pkg/input"
+)
+
+const (
+	threadListViewHelp = `?, F1              — Help
+enter, →           — Open thread
+space, x           — Mark thread and advance
+X                  — Mark thread and step up
+e                  — Archive marked threads
+d                  — Move marked threads to trash
+I                  — Mark marked threads as read
+U                  — Mark marked threads as unread
+l                  — Label marked threads, creating the label if needed
+L                  — Unlabel marked threads
+*                  — Toggle starred on highlighted thread
+c                  — Compose new message
+N, n, ^N, j, Down  — Next thread
+P, p, ^P, k, Up    — Previous thread
+r, ^R              — Reload current view
+g                  — Go to label
+M                  — Manage labels
+F                  — Manage filters
+S                  — Settings, e.g. vacation responder
+1                  — Go to inbox
+O                  — Toggle offline mode
+A                  — Switch account
+s, ^s              — Search
+T                  — Switch to message list
+q                  — Quit
+^L                 — Refresh screen
+
+Press [enter] to exit
+`
+)
+
+// ThreadViewOp is what to do with the thread list after an open thread closes.
+type ThreadViewOp struct {
+	quit   bool
+	remove bool
+	next   bool
+	prev   bool
+}
+
+// ThreadListView lists threads, as opposed to MessageView which lists messages.
+type ThreadListView struct {
+	label string
+	query string
+
+	keys     *input.Input
+	errors   chan error
+	pageCh   chan *cmdg.ThreadPage
+	threadCh chan *cmdg.Thread
+
+	// Only for use by main thread.
+	threads []*cmdg.Thread
+	pos     int
+}
+
+// NewThreadListView creates a new thread list view.
+func NewThreadListView(ctx context.Context, label, q string, in *input.Input) *ThreadListView {
+	v := &ThreadListView{
+		label:    label,
+		query:    q,
+		keys:     in,
+		errors:   make(chan error, 20),
+		pageCh:   make(chan *cmdg.ThreadPage),
+		threadCh: make(chan *cmdg.Thread),
+	}
+	go v.fetchPage(ctx, "")
+	return v
+}
+
+func (tv *ThreadListView) fetchPage(ctx context.Context, token string) {
+	ctx, cancel := context.WithTimeout(ctx, messageListReloadTimeout)
+	defer cancel()
+	log.Infof("Listing threads on label %q query %q with token %q…", tv.label, tv.query, token)
+	st := time.Now()
+	page, err := conn.ListThreads(ctx, tv.label, tv.query, token)
+	if err != nil {
+		tv.errors <- err
+		return
+	}
+	if err := page.PreloadSubjects(ctx); err != nil {
+		tv.errors <- err
+	}
+	log.Infof("Listing threads took %v", time.Since(st))
+	tv.pageCh <- page
+}
+
+// markedThreads returns the marked threads, and the ones not marked.
+func markedThreads(threads []*cmdg.Thread, marked map[cmdg.ThreadID]bool) ([]*cmdg.Thread, []*cmdg.Thread) {
+	var yes []*cmdg.Thread
+	no := []*cmdg.Thread{}
+	for _, t := range threads {
+		if marked[t.ID] {
+			yes = append(yes, t)
+		} else {
+			no = append(no, t)
+		}
+	}
+	return yes, no
+}
+
+// applyMarked runs an operation on all marked threads in the background.
+func (tv *ThreadListView) applyMarked(ctx context.Context, name string, ts []*cmdg.Thread, op func(context.Context, *cmdg.Thread) error) {
+	go func() {
+		st := time.Now()
+		for _, t := range ts {
+			if err := op(ctx, t); err != nil {
+				tv.errors <- errors.Wrapf(err, "thread operation %q failed", name)
+				return
+			}
+		}
+		log.Infof("Thread operation %q on %d threads: %v", name, len(ts), time.Since(st))
+	}()
+}
+
+// Run runs the thread list view.
+func (tv *ThreadListView) Run(ctx context.Context) error {
+	log.Infof("Running ThreadListView")
+	theresMore := true
+	var contentHeight int
+	var scroll int
+	var screen *display.Screen
+	marked := map[cmdg.ThreadID]bool{}
+
+	initScreen := func() error {
+		var err error
+		screen, err = display.NewScreen()
+		if err != nil {
+			return err
+		}
+		contentHeight = screen.Height - 2
+		scroll = 0
+		return nil
+	}
+	if err := initScreen(); err != nil {
+		return err
+	}
+	defer func() {
+		screen.Clear()
+		screen.Draw()
+	}()
+	empty := func() {
+		screen.Printf(0, 0, "Loading…")
+		screen.Draw()
+		tv.threads = nil
+		tv.pos = 0
+		scroll = 0
+		theresMore = true
+	}
+	empty()
+
+	drawThread := func(cur int) error {
+		t := tv.threads[cur]
+		s := "Loading…"
+		prefix := " "
+		reset := display.Reset
+		if cur == tv.pos {
+			reset = display.Reverse
+			prefix = "*"
+		}
+		if t.HasData(cmdg.LevelMetadata) && t.Len() > 0 {
+			subj, err := t.GetSubject(ctx)
+			if errors.Cause(err) == cmdg.ErrMissing || subj == "" {
+				subj = "(No subject)"
+			} else if err != nil {
+				return err
+			}
+			tm, err := t.Last().GetTimeFmt(ctx)
+			if err != nil {
+				log.Infof("Failed to parse mail date: %v", err)
+				tm = "???"
+			}
+			from, err := t.GetFrom(ctx)
+			if err != nil {
+				return err
+			}
+			if n := t.Len(); n > 1 {
+				from = fmt.Sprintf("%s (%d)", from, n)
+			}
+			colors, fullColors, err := t.GetLabelColors(ctx, tv.label)
+			if err != nil {
+				return err
+			}
+			if len(colors) > 0 {
+				colors = " | " + colors
+				fullColors = " | " + fullColors
+			}
+			from = display.FixedWidth(from, 25)
+			s = fmt.Sprintf("%[1]*.[1]*[2]s | %[3]s | %[4]s", 6, tm, from, subj)
+			if display.StringWidth(s)+display.StringWidth(fullColors) < screen.Width {
+				s += fullColors
+			} else {
+				s += colors
+			}
+			s += reset
+		} else {
+			go func() {
+				if err := t.Preload(ctx, cmdg.LevelMetadata); err != nil {
+					log.Warningf("Failed to load thread %s: %v", t.ID, err)
+					return
+				}
+				tv.threadCh <- t
+			}()
+		}
+		if marked[t.ID] {
+			prefix += "X"
+		} else {
+			prefix += " "
+		}
+		if t.IsUnread() {
+			prefix = display.Bold + prefix + ">"
+		} else {
+			prefix += " "
+		}
+		star := " "
+		if t.HasLabel(cmdg.Starred) {
+			star = "*"
+			prefix = display.Yellow + prefix
+		}
+		screen.Printlnf(cur-scroll, "%s%s%s%s", reset, prefix, star, s)
+		return nil
+	}
+
+	prev := func() bool {
+		if tv.pos <= 0 {
+			return false
+		}
+		tv.pos--
+		if scroll > 0 && tv.pos < scroll+scrollLimit {
+			scroll--
+		}
+		return true
+	}
+	next := func() bool {
+		if tv.pos >= len(tv.threads)-1 {
+			return false
+		}
+		if tv.pos-scroll > contentHeight-scrollLimit {
+			scroll++
+		}
+		tv.pos++
+		return true
+	}
+	removeMarked := func() []*cmdg.Thread {
+		ts, rest := markedThreads(tv.threads, marked)
+		if len(ts) == 0 {
+			return nil
+		}
+		tv.threads = rest
+		marked = map[cmdg.ThreadID]bool{}
+		if tv.pos >= len(tv.threads) {
+			tv.pos = len(tv.threads) - 1
+		}
+		if tv.pos < 0 {
+			tv.pos = 0
+		}
+		if scroll > tv.pos {
+			scroll = tv.pos
+		}
+		return ts
+	}
+
+	for {
+		select {
+		case <-tv.keys.Winch():
+			if err := initScreen(); err != nil {
+				return err
+			}
+		case err := <-tv.errors:
+			showError(screen, tv.keys, err.Error())
+			screen.Draw()
+			continue
+		case err := <-conn.Conflicts():
+			showError(screen, tv.keys, err.Error())
+			screen.Draw()
+			continue
+		case t := <-tv.threadCh:
+			for n := range tv.threads {
+				if tv.threads[n] == t && n >= scroll && n < scroll+contentHeight {
+					if err := drawThread(n); err != nil {
+						log.Errorf("Drawing thread: %v", err)
+					}
+				}
+			}
+			screen.Draw()
+			continue
+		case p := <-tv.pageCh:
+			tv.threads = append(tv.threads, p.Threads...)
+			theresMore = false
+			if p.Response.NextPageToken != "" && len(tv.threads) < contentHeight {
+				theresMore = true
+				go tv.fetchPage(ctx, p.Response.NextPageToken)
+			}
+		case key, ok := <-tv.keys.Chan():
+			if !ok {
+				log.Errorf("ThreadList: Input channel closed!")
+				continue
+			}
+			switch key {
+			case "?", input.F1:
+				help(threadListViewHelp, tv.keys)
+			case input.Enter, input.Right:
+				for tv.pos < len(tv.threads) {
+					ov, err := NewOpenThreadView(ctx, tv.threads[tv.pos], tv.keys)
+					if err != nil {
+						tv.errors <- errors.Wrapf(err, "Opening thread")
+						break
+					}
+					op, err := ov.Run(ctx)
+					if err != nil {
+						tv.errors <- errors.Wrapf(err, "Running OpenThreadView")
+					}
+					if op == nil {
+						break
+					}
+					if op.quit {
+						return nil
+					}
+					if op.remove {
+						tv.threads = append(tv.threads[:tv.pos], tv.threads[tv.pos+1:]...)
+						if tv.pos >= len(tv.threads) && tv.pos > 0 {
+							tv.pos--
+						}
+						break
+					}
+					if op.prev && prev() {
+						continue
+					}
+					if op.next && next() {
+						continue
+					}
+					break
+				}
+			case input.CtrlL:
+				if err := initScreen(); err != nil {
+					return err
+				}
+			case "x", " ":
+				if tv.pos < len(tv.threads) {
+					marked[tv.threads[tv.pos].ID] = !marked[tv.threads[tv.pos].ID]
+					next()
+				}
+			case "X":
+				if tv.pos < len(tv.threads) {
+					marked[tv.threads[tv.pos].ID] = !marked[tv.threads[tv.pos].ID]
+					prev()
+				}
+			case "e":
+				var ts []*cmdg.Thread
+				if tv.label == cmdg.Inbox {
+					ts = removeMarked()
+				} else {
+					ts, _ = markedThreads(tv.threads, marked)
+				}
+				tv.applyMarked(ctx, "archive", ts, func(ctx context.Context, t *cmdg.Thread) error {
+					return t.RemoveLabelID(ctx, cmdg.Inbox)
+				})
+			case "d":
+				tv.applyMarked(ctx, "delete", removeMarked(), func(ctx context.Context, t *cmdg.Thread) error {
+					return t.AddLabelID(ctx, cmdg.Trash)
+				})
+			case "I", "U":
+				ts, _ := markedThreads(tv.threads, marked)
+				name, f := "mark-read", (*cmdg.Thread).RemoveLabelID
+				if key == "U" {
+					name, f = "mark-unread", (*cmdg.Thread).AddLabelID
+				}
+				tv.applyMarked(ctx, name, ts, func(ctx context.Context, t *cmdg.Thread) error {
+					return f(t, ctx, cmdg.Unread)
+				})
+			case "*":
+				if tv.pos >= len(tv.threads) {
+					break
+				}
+				t := tv.threads[tv.pos]
+				f := t.AddLabelID
+				if t.HasLabel(cmdg.Starred) {
+					f = t.RemoveLabelID
+				}
+				go func() {
+					if err := f(ctx, cmdg.Starred); err != nil {
+						tv.errors <- errors.Wrapf(err, "Toggling STARRED label")
+					}
+					tv.threadCh <- t
+				}()
+			case "l", "L":
+				ts, _ := markedThreads(tv.threads, marked)
+				if len(ts) == 0 {
+					break
+				}
+				var label *dialog.Option
+				var err error
+				if key == "l" {
+					label, err = selectOrCreateLabel(ctx, tv.keys)
+				} else {
+					var opts []*dialog.Option
+					for _, l := range conn.Labels() {
+						has := false
+						for _, t := range ts {
+							has = has || t.HasLabel(l.ID)
+						}
+						if !has {
+							continue
+						}
+						opts = append(opts, &dialog.Option{
+							Key:   l.ID,
+							Label: l.Label,
+						})
+					}
+					label, err = dialog.Selection(opts, "Label> ", false, tv.keys)
+				}
+				if errors.Cause(err) == dialog.ErrAborted {
+					break
+				} else if err != nil {
+					tv.errors <- errors.Wrapf(err, "Selecting label")
+					break
+				}
+				tv.applyMarked(ctx, "label", ts, func(ctx context.Context, t *cmdg.Thread) error {
+					if key == "L" {
+						return t.RemoveLabelID(ctx, label.Key)
+					}
+					return t.AddLabelID(ctx, label.Key)
+				})
+			case "c":
+				if err := composeNew(ctx, conn, tv.keys); err != nil {
+					tv.errors <- errors.Wrapf(err, "Composing new message")
+				}
+			case input.Home, input.XHome:
+				tv.pos = 0
+				scroll = 0
+			case "N", "n", "j", input.CtrlN, input.Down:
+				screen.UseCache()
+				if !next() {
+					continue
+				}
+			case "P", "p", "k", input.CtrlP, input.Up:
+				screen.UseCache()
+				if !prev() {
+					continue
+				}
+			case "r", input.CtrlR:
+				empty()
+				screen.Clear()
+				go tv.fetchPage(ctx, "")
+			case "T":
+				return NewMessageView(ctx, tv.label, tv.query, tv.keys).Run(ctx)
+			case "F":
+				var msg *cmdg.Message
+				if tv.pos < len(tv.threads) {
+					msg = tv.threads[tv.pos].Last()
+				}
+				if err := manageFilters(ctx, tv.keys, msg, tv.query); err != nil {
+					tv.errors <- errors.Wrapf(err, "Managing filters")
+				}
+			case "q":
+				return nil
+			default:
+				v, ok := listKey(ctx, key, tv.keys, tv.errors, func(label, query string) listView {
+					return NewThreadListView(ctx, label, query, tv.keys)
+				})
+				if !ok {
+					log.Infof("ThreadListView got unknown key %q", key)
+				} else if v != nil {
+					return v.Run(ctx)
+				}
+			}
+		}
+
+		// Draw to buffer.
+		for n := 0; n < contentHeight; n++ {
+			cur := n + scroll
+			if cur >= len(tv.threads) {
+				screen.Printlnf(n, "")
+				continue
+			}
+			if err := drawThread(cur); err != nil {
+				log.Errorf("Drawing thread: %v", err)
+			}
+		}
+		if !theresMore && len(tv.threads) == 0 {
+			screen.Printlnf(0, "<empty>")
+		}
+		status := "Threads "
+		if len(accountNames) > 1 {
+			status += display.Bold + currentAccount + display.Reset + " "
+		}
+		if off, n := conn.Offline(); off {
+			status += display.Color(196) + fmt.Sprintf("Offline (%d queued) ", n) + display.Reset
+		}
+		if theresMore {
+			status += display.Color(50) + "Loading…"
+		}
+		screen.Printlnf(screen.Height-2, "%s", strings.Repeat("—", screen.Width))
+		screen.Printlnf(screen.Height-1, "%s", status)
+		screen.Draw()
+	}
+}
@@ -0,0 +1,136 @@
+package cmdg
+
+import (
+	"context"
+
+	drive "google.golang.org/api/drive/v3"
+	gmail "google.golang.org/api/gmail/v1"
+	people "google.golang.org/api/people/v1"
+)
+
+// Backend is the mail store that CmdG talks to. The normal one is the
+// live Gmail API (with Drive for app data and People for contacts),
+// but anything that can answer these calls can be plugged in.
+//
+// Data is passed around using the Gmail API types, since that's what
+// the rest of cmdg already understands.
+type Backend interface {
+	// ListMessages lists one page of messages in a label and/or matching a query.
+	ListMessages(ctx context.Context, label, query, token string, max int64) (*gmail.ListMessagesResponse, error)
+
+	// GetMessage gets a message at a given level of detail.
+	GetMessage(ctx context.Context, id string, level DataLevel) (*gmail.Message, error)
+
+	// BatchGetMessages gets many messages at a given level of detail,
+	// in as few round trips as possible. Both returned slices are
+	// the same length as ids, and an entry has either a message or
+	// an error.
+	BatchGetMessages(ctx context.Context, ids []string, level DataLevel) ([]*gmail.Message, []error)
+
+	// GetRawMessage gets a message with the Raw field populated.
+	GetRawMessage(ctx context.Context, id string) (*gmail.Message, error)
+
+	// GetAttachment gets the body of an attachment.
+	GetAttachment(ctx context.Context, msgID, attachmentID string) (*gmail.MessagePartBody, error)
+
+	// ModifyMessage adds and removes labels on one message, returning the new state.
+	ModifyMessage(ctx context.Context, id string, add, remove []string) (*gmail.Message, error)
+
+	// BatchModify adds and removes labels on many messages.
+	BatchModify(ctx context.Context, ids, add, remove []string) error
+
+	// BatchDelete permanently deletes messages.
+	BatchDelete(ctx context.Context, ids []string) error
+
+	// ListThreads lists one page of threads in a label and/or matching a query.
+	ListThreads(ctx context.Context, label, query, token string, max int64) (*gmail.ListThreadsResponse, error)
+
+	// GetThread gets a thread, with all its messages at a given level of detail.
+	GetThread(ctx context.Context, id ThreadID, level DataLevel) (*gmail.Thread, error)
+
+	// ModifyThread adds and removes labels on all messages in a thread.
+	ModifyThread(ctx context.Context, id ThreadID, add, remove []string) error
+
+	// Send sends a raw RFC822 message.
+	Send(ctx context.Context, threadID ThreadID, msg RawMessage) error
+
+	// ImportMessage adds a raw RFC822 message to the mailbox, as if
+	// it had been received, with the given labels.
+	ImportMessage(ctx context.Context, msg string, labelIDs []string) (*gmail.Message, error)
+
+	// History returns all history since startID, and the current history ID.
+	History(ctx context.Context, startID HistoryID, labelID string) ([]*gmail.History, HistoryID, error)
+
+	// GetProfile returns the profile of the user.
+	GetProfile(ctx context.Context) (*gmail.Profile, error)
+
+	// ListLabels lists all labels.
+	ListLabels(ctx context.Context) ([]*gmail.Label, error)
+
+	// GetLabel gets one label.
+	GetLabel(ctx context.Context, id string) (*gmail.Label, error)
+
+	// CreateLabel creates a label.
+	CreateLabel(ctx context.Context, l *gmail.Label) (*gmail.Label, error)
+
+	// UpdateLabel replaces the name, color, and visibility of a label.
+	UpdateLabel(ctx context.Context, l *gmail.Label) (*gmail.Label, error)
+
+	// DeleteLabel deletes a label, removing it from all messages.
+	DeleteLabel(ctx context.Context, id string) error
+
+	// ListFilters lists all server side filters.
+	ListFilters(ctx context.Context) ([]*gmail.Filter, error)
+
+	// CreateFilter creates a filter. Filters can't be changed, only
+	// deleted and created.
+	CreateFilter(ctx context.Context, f *gmail.Filter) (*gmail.Filter, error)
+
+	// DeleteFilter deletes a filter.
+	DeleteFilter(ctx context.Context, id string) error
+
+	// GetVacation gets the vacation responder settings.
+	GetVacation(ctx context.Context) (*gmail.VacationSettings, error)
+
+	// UpdateVacation replaces the vacation responder settings.
+	UpdateVacation(ctx context.Context, v *gmail.VacationSettings) (*gmail.VacationSettings, error)
+
+	// ListSendAs lists the addresses the user can send as.
+	ListSendAs(ctx context.Context) ([]*gmail.SendAs, error)
+
+	// ListDrafts lists all drafts, with only IDs populated.
+	ListDrafts(ctx context.Context) ([]*gmail.Draft, error)
+
+	// GetDraft gets a draft at a given level of detail.
+	GetDraft(ctx context.Context, id string, level DataLevel) (*gmail.Draft, error)
+
+	// CreateDraft creates a draft from a raw RFC822 message.
+	CreateDraft(ctx context.Context, msg RawMessage) error
+
+	// UpdateDraft replaces a draft with a raw RFC822 message.
+	UpdateDraft(ctx context.Context, id string, msg RawMessage) error
+
+	// SendDraft sends a draft.
+	SendDraft(ctx context.Context, d *gmail.Draft) error
+
+	// DeleteDraft deletes a draft.
+	DeleteDraft(ctx context.Context, id string) error
+
+	// ListConnections lists contacts. With an empty sync token
+	// all contacts are listed, otherwise only the ones changed since
+	// the token was issued, with deleted ones marked in their
+	// metadata. Returns the token to use for the next sync.
+	ListConnections(ctx context.Context, syncToken string) ([]*people.Person, string, error)
+
+	// ListFiles lists files in the app data folder.
+	ListFiles(ctx context.Context) ([]*drive.File, error)
+
+	// DownloadFile downloads a file from the app data folder.
+	DownloadFile(ctx context.Context, id string) ([]byte, error)
+
+	// CreateFile creates a new file in the app data folder.
+	CreateFile(ctx context.Context, name string, contents []byte) error
+
+	// UpdateFile replaces the contents of an existing file in the app data folder.
+	UpdateFile(ctx context.Context, id, name string, contents []byte) error
+}
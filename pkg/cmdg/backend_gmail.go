@@ -0,0 +1,522 @@
+package cmdg
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	drive "google.golang.org/api/drive/v3"
+	gmail "google.golang.org/api/gmail/v1"
+	people "google.golang.org/api/people/v1"
+)
+
+var _ Backend = &gmailBackend{}
+
+// gmailBackend is the Backend talking to the real Gmail, Drive, and People APIs.
+type gmailBackend struct {
+	client *http.Client
+	gmail  *gmail.Service
+	drive  *drive.Service
+	people *people.Service
+}
+
+// newGmailBackend creates the RPC clients using an already authenticated http.Client.
+func newGmailBackend(client *http.Client) (*gmailBackend, error) {
+	b := &gmailBackend{client: client}
+
+	// Set up gmail client.
+	{
+		var err error
+		b.gmail, err = gmail.New(client)
+		if err != nil {
+			return nil, errors.Wrap(err, "creating GMail client")
+		}
+		b.gmail.UserAgent = userAgent()
+	}
+
+	// Set up drive client.
+	{
+		var err error
+		b.drive, err = drive.New(client)
+		if err != nil {
+			return nil, errors.Wrap(err, "creating Drive client")
+		}
+		b.drive.UserAgent = userAgent()
+	}
+	// Set up people client.
+	{
+		var err error
+		b.people, err = people.New(client)
+		if err != nil {
+			return nil, errors.Wrap(err, "creating People client")
+		}
+		b.people.UserAgent = userAgent()
+	}
+	return b, nil
+}
+
+// ListMessages implements Backend.
+func (b *gmailBackend) ListMessages(ctx context.Context, label, query, token string, max int64) (*gmail.ListMessagesResponse, error) {
+	const fields = "messages,resultSizeEstimate,nextPageToken"
+	var res *gmail.ListMessagesResponse
+	err := wrapLogRPC(ctx, "gmail.Users.Messages.List", func(ctx context.Context) (err error) {
+		q := b.gmail.Users.Messages.List(email).
+			PageToken(token).
+			MaxResults(max).
+			Context(ctx).
+			Fields(fields)
+		if query != "" {
+			q = q.Q(query)
+		}
+		if label != "" {
+			q = q.LabelIds(label)
+		}
+		res, err = q.Do()
+		return
+	}, "email=%q token=%v labelID=%q query=%q size=%d fields=%q)", email, token, label, query, max, fields)
+	return res, err
+}
+
+// GetMessage implements Backend.
+func (b *gmailBackend) GetMessage(ctx context.Context, id string, level DataLevel) (*gmail.Message, error) {
+	var ret *gmail.Message
+	err := wrapLogRPC(ctx, "gmail.Users.Messages.Get", func(ctx context.Context) (err error) {
+		ret, err = b.gmail.Users.Messages.Get(email, id).
+			Format(string(level)).
+			Context(ctx).
+			Do()
+		return
+	}, "email=%q msgID=%v level=%s", email, id, level)
+	return ret, err
+}
+
+// GetRawMessage implements Backend.
+func (b *gmailBackend) GetRawMessage(ctx context.Context, id string) (*gmail.Message, error) {
+	var ret *gmail.Message
+	err := wrapLogRPC(ctx, "gmail.Users.Messages.Get", func(ctx context.Context) (err error) {
+		ret, err = b.gmail.Users.Messages.Get(email, id).Format(levelRaw).Context(ctx).Do()
+		return
+	}, "email=%q msg=%v level=%s", email, id, levelRaw)
+	return ret, err
+}
+
+// GetAttachment implements Backend.
+func (b *gmailBackend) GetAttachment(ctx context.Context, msgID, attachmentID string) (*gmail.MessagePartBody, error) {
+	var body *gmail.MessagePartBody
+	err := wrapLogRPC(ctx, "gmail.Users.Messages.Attachments.Get", func(ctx context.Context) (err error) {
+		body, err = b.gmail.Users.Messages.Attachments.Get(email, msgID, attachmentID).Context(ctx).Do()
+		return
+	}, "email=%q msg=%v attachment=%v", email, msgID, attachmentID)
+	return body, err
+}
+
+// ModifyMessage implements Backend.
+func (b *gmailBackend) ModifyMessage(ctx context.Context, id string, add, remove []string) (*gmail.Message, error) {
+	var nm *gmail.Message
+	err := wrapLogRPC(ctx, "gmail.Users.Messages.Modify", func(ctx context.Context) (err error) {
+		nm, err = b.gmail.Users.Messages.Modify(email, id, &gmail.ModifyMessageRequest{
+			AddLabelIds:    add,
+			RemoveLabelIds: remove,
+		}).Context(ctx).Do()
+		return
+	}, "email=%q msg=%v add_labelIDs=%v remove_labelIDs=%v", email, id, add, remove)
+	return nm, err
+}
+
+// BatchModify implements Backend.
+func (b *gmailBackend) BatchModify(ctx context.Context, ids, add, remove []string) error {
+	return wrapLogRPC(ctx, "gmail.Users.Messages.BatchModify", func(ctx context.Context) error {
+		return b.gmail.Users.Messages.BatchModify(email, &gmail.BatchModifyMessagesRequest{
+			Ids:            ids,
+			AddLabelIds:    add,
+			RemoveLabelIds: remove,
+		}).Context(ctx).Do()
+	}, "email=%q add_labelIDs=%v remove_labelIDs=%v ids=%v", email, add, remove, ids)
+}
+
+// BatchDelete implements Backend.
+func (b *gmailBackend) BatchDelete(ctx context.Context, ids []string) error {
+	return wrapLogRPC(ctx, "gmail.Users.Messages.BatchDelete", func(ctx context.Context) error {
+		return b.gmail.Users.Messages.BatchDelete(email, &gmail.BatchDeleteMessagesRequest{
+			Ids: ids,
+		}).Context(ctx).Do()
+	}, "email=%q ids=%v", email, ids)
+}
+
+// ListThreads implements Backend.
+func (b *gmailBackend) ListThreads(ctx context.Context, label, query, token string, max int64) (*gmail.ListThreadsResponse, error) {
+	const fields = "threads,resultSizeEstimate,nextPageToken"
+	var res *gmail.ListThreadsResponse
+	err := wrapLogRPC(ctx, "gmail.Users.Threads.List", func(ctx context.Context) (err error) {
+		q := b.gmail.Users.Threads.List(email).
+			PageToken(token).
+			MaxResults(max).
+			Context(ctx).
+			Fields(fields)
+		if query != "" {
+			q = q.Q(query)
+		}
+		if label != "" {
+			q = q.LabelIds(label)
+		}
+		res, err = q.Do()
+		return
+	}, "email=%q token=%v labelID=%q query=%q size=%d fields=%q)", email, token, label, query, max, fields)
+	return res, err
+}
+
+// GetThread implements Backend.
+func (b *gmailBackend) GetThread(ctx context.Context, id ThreadID, level DataLevel) (*gmail.Thread, error) {
+	var ret *gmail.Thread
+	err := wrapLogRPC(ctx, "gmail.Users.Threads.Get", func(ctx context.Context) (err error) {
+		ret, err = b.gmail.Users.Threads.Get(email, string(id)).
+			Format(string(level)).
+			Context(ctx).
+			Do()
+		return
+	}, "email=%q threadID=%v level=%s", email, id, level)
+	return ret, err
+}
+
+// ModifyThread implements Backend.
+func (b *gmailBackend) ModifyThread(ctx context.Context, id ThreadID, add, remove []string) error {
+	return wrapLogRPC(ctx, "gmail.Users.Threads.Modify", func(ctx context.Context) error {
+		_, err := b.gmail.Users.Threads.Modify(email, string(id), &gmail.ModifyThreadRequest{
+			AddLabelIds:    add,
+			RemoveLabelIds: remove,
+		}).Context(ctx).Do()
+		return err
+	}, "email=%q threadID=%v add_labelIDs=%v remove_labelIDs=%v", email, id, add, remove)
+}
+
+// Send implements Backend.
+func (b *gmailBackend) Send(ctx context.Context, threadID ThreadID, msg RawMessage) error {
+	return wrapLogRPC(ctx, "gmail.Users.Messages.Send", func(ctx context.Context) error {
+		r, err := msg.Open()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		_, err = b.gmail.Users.Messages.Send(email, &gmail.Message{
+			ThreadId: string(threadID),
+		}).Media(r, uploadOptions()...).ProgressUpdater(uploadProgress(ctx, msg)).Context(ctx).Do()
+		return err
+	}, "email=%q threadID=%q size=%d", email, threadID, msg.Size())
+}
+
+// ImportMessage implements Backend.
+func (b *gmailBackend) ImportMessage(ctx context.Context, msg string, labelIDs []string) (*gmail.Message, error) {
+	var ret *gmail.Message
+	err := wrapLogRPC(ctx, "gmail.Users.Messages.Import", func(ctx context.Context) (err error) {
+		// Uploaded as media, since large messages are too big for Raw.
+		ret, err = b.gmail.Users.Messages.Import(email, &gmail.Message{
+			LabelIds: labelIDs,
+		}).InternalDateSource("dateHeader").NeverMarkSpam(true).
+			Media(strings.NewReader(msg), uploadOptions()...).
+			ProgressUpdater(uploadProgress(ctx, StringMessage(msg))).
+			Context(ctx).Do()
+		return
+	}, "email=%q labelIDs=%v size=%d", email, labelIDs, len(msg))
+	return ret, err
+}
+
+// History implements Backend.
+func (b *gmailBackend) History(ctx context.Context, startID HistoryID, labelID string) ([]*gmail.History, HistoryID, error) {
+	var ret []*gmail.History
+	var h HistoryID
+	err := wrapLogRPC(ctx, "gmail.Users.History.List", func(ctx context.Context) error {
+		ret = nil // Start over on retry.
+		q := b.gmail.Users.History.List(email).Context(ctx).StartHistoryId(uint64(startID))
+		if labelID != "" {
+			q = q.LabelId(labelID)
+		}
+		return q.Pages(ctx, func(r *gmail.ListHistoryResponse) error {
+			ret = append(ret, r.History...)
+			h = HistoryID(r.HistoryId)
+			return nil
+		})
+	}, "email=%q historyID=%v labelID=%q", email, startID, labelID)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ret, h, nil
+}
+
+// GetProfile implements Backend.
+func (b *gmailBackend) GetProfile(ctx context.Context) (*gmail.Profile, error) {
+	var ret *gmail.Profile
+	err := wrapLogRPC(ctx, "gmail.Users.GetProfile", func(ctx context.Context) (err error) {
+		ret, err = b.gmail.Users.GetProfile(email).Context(ctx).Do()
+		return
+	}, "email=%q", email)
+	return ret, err
+}
+
+// ListLabels implements Backend.
+func (b *gmailBackend) ListLabels(ctx context.Context) ([]*gmail.Label, error) {
+	var res *gmail.ListLabelsResponse
+	err := wrapLogRPC(ctx, "gmail.Users.Labels.List", func(ctx context.Context) (err error) {
+		res, err = b.gmail.Users.Labels.List(email).Context(ctx).Do()
+		return
+	}, "email=%q", email)
+	if err != nil {
+		return nil, err
+	}
+	return res.Labels, nil
+}
+
+// GetLabel implements Backend.
+func (b *gmailBackend) GetLabel(ctx context.Context, id string) (*gmail.Label, error) {
+	var ret *gmail.Label
+	err := wrapLogRPC(ctx, "gmail.Users.Labels.Get", func(ctx context.Context) (err error) {
+		ret, err = b.gmail.Users.Labels.Get(email, id).Context(ctx).Do()
+		return
+	}, "email=%q labelID=%v", email, id)
+	return ret, err
+}
+
+// CreateLabel implements Backend.
+func (b *gmailBackend) CreateLabel(ctx context.Context, l *gmail.Label) (*gmail.Label, error) {
+	var ret *gmail.Label
+	err := wrapLogRPC(ctx, "gmail.Users.Labels.Create", func(ctx context.Context) (err error) {
+		ret, err = b.gmail.Users.Labels.Create(email, l).Context(ctx).Do()
+		return
+	}, "email=%q name=%q", email, l.Name)
+	return ret, err
+}
+
+// UpdateLabel implements Backend.
+func (b *gmailBackend) UpdateLabel(ctx context.Context, l *gmail.Label) (*gmail.Label, error) {
+	var ret *gmail.Label
+	err := wrapLogRPC(ctx, "gmail.Users.Labels.Update", func(ctx context.Context) (err error) {
+		ret, err = b.gmail.Users.Labels.Update(email, l.Id, l).Context(ctx).Do()
+		return
+	}, "email=%q labelID=%v name=%q", email, l.Id, l.Name)
+	return ret, err
+}
+
+// DeleteLabel implements Backend.
+func (b *gmailBackend) DeleteLabel(ctx context.Context, id string) error {
+	return wrapLogRPC(ctx, "gmail.Users.Labels.Delete", func(ctx context.Context) error {
+		return b.gmail.Users.Labels.Delete(email, id).Context(ctx).Do()
+	}, "email=%q labelID=%v", email, id)
+}
+
+// ListFilters implements Backend.
+func (b *gmailBackend) ListFilters(ctx context.Context) ([]*gmail.Filter, error) {
+	var ret []*gmail.Filter
+	err := wrapLogRPC(ctx, "gmail.Users.Settings.Filters.List", func(ctx context.Context) error {
+		res, err := b.gmail.Users.Settings.Filters.List(email).Context(ctx).Do()
+		if err != nil {
+			return err
+		}
+		ret = res.Filter
+		return nil
+	}, "email=%q", email)
+	return ret, err
+}
+
+// CreateFilter implements Backend.
+func (b *gmailBackend) CreateFilter(ctx context.Context, f *gmail.Filter) (*gmail.Filter, error) {
+	var ret *gmail.Filter
+	err := wrapLogRPC(ctx, "gmail.Users.Settings.Filters.Create", func(ctx context.Context) (err error) {
+		ret, err = b.gmail.Users.Settings.Filters.Create(email, f).Context(ctx).Do()
+		return
+	}, "email=%q", email)
+	return ret, err
+}
+
+// DeleteFilter implements Backend.
+func (b *gmailBackend) DeleteFilter(ctx context.Context, id string) error {
+	return wrapLogRPC(ctx, "gmail.Users.Settings.Filters.Delete", func(ctx context.Context) error {
+		return b.gmail.Users.Settings.Filters.Delete(email, id).Context(ctx).Do()
+	}, "email=%q filterID=%v", email, id)
+}
+
+// GetVacation implements Backend.
+func (b *gmailBackend) GetVacation(ctx context.Context) (*gmail.VacationSettings, error) {
+	var ret *gmail.VacationSettings
+	err := wrapLogRPC(ctx, "gmail.Users.Settings.GetVacation", func(ctx context.Context) (err error) {
+		ret, err = b.gmail.Users.Settings.GetVacation(email).Context(ctx).Do()
+		return
+	}, "email=%q", email)
+	return ret, err
+}
+
+// UpdateVacation implements Backend.
+func (b *gmailBackend) UpdateVacation(ctx context.Context, v *gmail.VacationSettings) (*gmail.VacationSettings, error) {
+	var ret *gmail.VacationSettings
+	err := wrapLogRPC(ctx, "gmail.Users.Settings.UpdateVacation", func(ctx context.Context) (err error) {
+		ret, err = b.gmail.Users.Settings.UpdateVacation(email, v).Context(ctx).Do()
+		return
+	}, "email=%q enable=%v", email, v.EnableAutoReply)
+	return ret, err
+}
+
+// ListSendAs implements Backend.
+func (b *gmailBackend) ListSendAs(ctx context.Context) ([]*gmail.SendAs, error) {
+	var ret []*gmail.SendAs
+	err := wrapLogRPC(ctx, "gmail.Users.Settings.SendAs.List", func(ctx context.Context) error {
+		res, err := b.gmail.Users.Settings.SendAs.List(email).Context(ctx).Do()
+		if err != nil {
+			return err
+		}
+		ret = res.SendAs
+		return nil
+	}, "email=%q", email)
+	return ret, err
+}
+
+// ListDrafts implements Backend.
+func (b *gmailBackend) ListDrafts(ctx context.Context) ([]*gmail.Draft, error) {
+	var ret []*gmail.Draft
+	err := wrapLogRPC(ctx, "gmail.Users.Drafts.List", func(ctx context.Context) error {
+		ret = nil // Start over on retry.
+		return b.gmail.Users.Drafts.List(email).Pages(ctx, func(r *gmail.ListDraftsResponse) error {
+			ret = append(ret, r.Drafts...)
+			return nil
+		})
+	}, "email=%q", email)
+	return ret, err
+}
+
+// GetDraft implements Backend.
+func (b *gmailBackend) GetDraft(ctx context.Context, id string, level DataLevel) (*gmail.Draft, error) {
+	var r *gmail.Draft
+	err := wrapLogRPC(ctx, "gmail.Users.Drafts.Get", func(ctx context.Context) (err error) {
+		r, err = b.gmail.Users.Drafts.Get(email, id).Context(ctx).Format(string(level)).Do()
+		return
+	}, "email=%q msgID=%v level=%v", email, id, level)
+	return r, err
+}
+
+// CreateDraft implements Backend.
+func (b *gmailBackend) CreateDraft(ctx context.Context, msg RawMessage) error {
+	return wrapLogRPC(ctx, "gmail.Users.Drafts.Create", func(ctx context.Context) error {
+		r, err := msg.Open()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		_, err = b.gmail.Users.Drafts.Create(email, &gmail.Draft{
+			Message: &gmail.Message{},
+		}).Media(r, uploadOptions()...).ProgressUpdater(uploadProgress(ctx, msg)).Context(ctx).Do()
+		return err
+	}, "email=%q size=%d", email, msg.Size())
+}
+
+// UpdateDraft implements Backend.
+func (b *gmailBackend) UpdateDraft(ctx context.Context, id string, msg RawMessage) error {
+	return wrapLogRPC(ctx, "gmail.Users.Drafts.Update", func(ctx context.Context) error {
+		r, err := msg.Open()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		_, err = b.gmail.Users.Drafts.Update(email, id, &gmail.Draft{
+			Message: &gmail.Message{},
+		}).Media(r, uploadOptions()...).ProgressUpdater(uploadProgress(ctx, msg)).Context(ctx).Do()
+		return err
+	}, "email=%q msgID=%v size=%d", email, id, msg.Size())
+}
+
+// SendDraft implements Backend.
+func (b *gmailBackend) SendDraft(ctx context.Context, d *gmail.Draft) error {
+	return wrapLogRPC(ctx, "gmail.Users.Drafts.Send", func(ctx context.Context) error {
+		_, err := b.gmail.Users.Drafts.Send(email, d).Context(ctx).Do()
+		return err
+	}, "email=%q draftID=%v", email, d.Id)
+}
+
+// DeleteDraft implements Backend.
+func (b *gmailBackend) DeleteDraft(ctx context.Context, id string) error {
+	return wrapLogRPC(ctx, "gmail.Users.Drafts.Delete", func(ctx context.Context) error {
+		return b.gmail.Users.Drafts.Delete(email, id).Context(ctx).Do()
+	}, "email=%q draftID=%v", email, id)
+}
+
+// ListConnections implements Backend.
+func (b *gmailBackend) ListConnections(ctx context.Context, syncToken string) ([]*people.Person, string, error) {
+	var ret []*people.Person
+	var next string
+	err := wrapLogRPC(ctx, "people.People.Connections.List", func(ctx context.Context) error {
+		ret = nil // Start over on retry.
+		q := b.people.People.Connections.List("people/me").
+			Context(ctx).
+			PageSize(contactBatchSize).
+			PersonFields("names,emailAddresses,metadata").
+			RequestSyncToken(true)
+		if syncToken != "" {
+			q = q.SyncToken(syncToken)
+		}
+		return q.Pages(ctx, func(r *people.ListConnectionsResponse) error {
+			ret = append(ret, r.Connections...)
+			if r.NextSyncToken != "" {
+				next = r.NextSyncToken
+			}
+			return nil
+		})
+	}, "resource=people/me incremental=%v", syncToken != "")
+	return ret, next, err
+}
+
+// ListFiles implements Backend.
+func (b *gmailBackend) ListFiles(ctx context.Context) ([]*drive.File, error) {
+	var ret []*drive.File
+	var token string
+	for {
+		var l *drive.FileList
+		err := wrapLogRPC(ctx, "drive.Files.List", func(ctx context.Context) (err error) {
+			l, err = b.drive.Files.List().Context(ctx).Spaces(appDataFolder).PageToken(token).Do()
+			return
+		}, "spaces=%q token=%q", appDataFolder, token)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, l.Files...)
+		token = l.NextPageToken
+		if token == "" {
+			break
+		}
+	}
+	return ret, nil
+}
+
+// DownloadFile implements Backend.
+func (b *gmailBackend) DownloadFile(ctx context.Context, id string) ([]byte, error) {
+	var data []byte
+	err := wrapLogRPC(ctx, "drive.Files.Get", func(ctx context.Context) error {
+		r, err := b.drive.Files.Get(id).Context(ctx).Download()
+		if err != nil {
+			return err
+		}
+		defer r.Body.Close()
+		data, err = ioutil.ReadAll(r.Body)
+		return err
+	}, "fileID=%v", id)
+	return data, err
+}
+
+// CreateFile implements Backend.
+func (b *gmailBackend) CreateFile(ctx context.Context, name string, contents []byte) error {
+	return wrapLogRPC(ctx, "drive.Files.Create", func(ctx context.Context) error {
+		_, err := b.drive.Files.Create(&drive.File{
+			Name:    name,
+			Parents: []string{appDataFolder},
+		}).Context(ctx).Media(bytes.NewBuffer(contents)).Do()
+		return err
+	}, "name=%q parent=%q", name, appDataFolder)
+}
+
+// UpdateFile implements Backend.
+func (b *gmailBackend) UpdateFile(ctx context.Context, id, name string, contents []byte) error {
+	return wrapLogRPC(ctx, "drive.Files.Update", func(ctx context.Context) error {
+		_, err := b.drive.Files.Update(id, &drive.File{
+			Name: name,
+		}).Context(ctx).Media(bytes.NewBuffer(contents)).Do()
+		return err
+	}, "name=%q", name)
+}
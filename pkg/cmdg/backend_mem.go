@@ -0,0 +1,981 @@
+package cmdg
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	drive "google.golang.org/api/drive/v3"
+	gmail "google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+	people "google.golang.org/api/people/v1"
+)
+
+var _ Backend = &MemBackend{}
+
+// MemBackend is a Backend that keeps everything in memory. It's
+// useful for tests, and for running the UI against fixtures.
+//
+// Sent messages and drafts end up as messages with the SENT or DRAFT
+// labels, like they do in Gmail.
+type MemBackend struct {
+	m sync.Mutex
+
+	// Newest first.
+	order    []string
+	messages map[string]*memMessage
+	labels   map[string]*gmail.Label
+	drafts   map[string]string // Draft ID -> message ID.
+	files    map[string]*memFile
+	contacts []*people.Person
+	filters  []*gmail.Filter
+	vacation gmail.VacationSettings
+	sendAs   []*gmail.SendAs
+	profile  gmail.Profile
+
+	// Sequence number of the last change to each contact, for sync tokens.
+	contactVersions []int
+	contactSeq      int
+
+	history   []*gmail.History
+	historyID HistoryID
+	nextID    int
+}
+
+type memMessage struct {
+	raw      string
+	threadID string
+	labels   []string
+	payload  *gmail.MessagePart
+}
+
+type memFile struct {
+	name     string
+	contents []byte
+}
+
+// NewMemBackend creates a new empty in-memory backend.
+func NewMemBackend(emailAddress string) *MemBackend {
+	b := &MemBackend{
+		messages:  make(map[string]*memMessage),
+		labels:    make(map[string]*gmail.Label),
+		drafts:    make(map[string]string),
+		files:     make(map[string]*memFile),
+		historyID: 1,
+		profile: gmail.Profile{
+			EmailAddress: emailAddress,
+		},
+	}
+	b.sendAs = []*gmail.SendAs{{
+		SendAsEmail: emailAddress,
+		IsPrimary:   true,
+		IsDefault:   true,
+	}}
+	for _, l := range []string{Inbox, Trash, Unread, Starred, "SENT", "DRAFT", "SPAM", "IMPORTANT"} {
+		b.labels[l] = &gmail.Label{
+			Id:   l,
+			Name: l,
+			Type: "system",
+		}
+	}
+	return b
+}
+
+// NewMemBackendFromDir loads a directory of fixtures.
+//
+// Every file in a subdirectory is an RFC822 message with the label
+// named as the subdirectory (created if it's not a system label).
+// Files directly in the directory go into the inbox.
+func NewMemBackendFromDir(dir, emailAddress string) (*MemBackend, error) {
+	b := NewMemBackend(emailAddress)
+	err := filepath.Walk(dir, func(fn string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, fn)
+		if err != nil {
+			return err
+		}
+		label := Inbox
+		if d := filepath.Dir(rel); d != "." {
+			label = b.ensureLabel(filepath.ToSlash(d))
+		}
+		raw, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return err
+		}
+		if _, err := b.AddMessage(string(raw), "", []string{label, Unread}); err != nil {
+			return errors.Wrapf(err, "adding fixture %q", fn)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// ensureLabel returns the label ID for a name, creating it if needed.
+func (b *MemBackend) ensureLabel(name string) string {
+	b.m.Lock()
+	defer b.m.Unlock()
+	for _, l := range b.labels {
+		if l.Name == name {
+			return l.Id
+		}
+	}
+	id := fmt.Sprintf("Label_%d", len(b.labels))
+	b.labels[id] = &gmail.Label{
+		Id:   id,
+		Name: name,
+		Type: "user",
+	}
+	return id
+}
+
+// AddMessage adds a raw RFC822 message with the given labels. An
+// empty thread ID starts a new thread.
+func (b *MemBackend) AddMessage(raw, threadID string, labelIDs []string) (string, error) {
+	payload, err := parseRawMessage(raw)
+	if err != nil {
+		return "", err
+	}
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.nextID++
+	id := fmt.Sprintf("%016x", b.nextID)
+	if threadID == "" {
+		threadID = id
+	}
+	b.messages[id] = &memMessage{
+		raw:      raw,
+		threadID: threadID,
+		labels:   append([]string{}, labelIDs...),
+		payload:  payload,
+	}
+	b.order = append([]string{id}, b.order...)
+	b.addHistoryLocked(&gmail.History{
+		MessagesAdded: []*gmail.HistoryMessageAdded{{Message: b.minimalLocked(id)}},
+	})
+	return id, nil
+}
+
+func (b *MemBackend) addHistoryLocked(h *gmail.History) {
+	b.historyID++
+	h.Id = uint64(b.historyID)
+	b.history = append(b.history, h)
+}
+
+func (b *MemBackend) minimalLocked(id string) *gmail.Message {
+	m := b.messages[id]
+	return &gmail.Message{
+		Id:       id,
+		ThreadId: m.threadID,
+		LabelIds: append([]string{}, m.labels...),
+	}
+}
+
+func notFound(what, id string) error {
+	return &googleapi.Error{
+		Code:    http.StatusNotFound,
+		Message: fmt.Sprintf("%s %q not found", what, id),
+	}
+}
+
+func hasString(ss []string, s string) bool {
+	for _, t := range ss {
+		if t == s {
+			return true
+		}
+	}
+	return false
+}
+
+// matches does a very simplified version of Gmail search: every word
+// in the query must be in the raw message, except rfc822msgid: which
+// must be the Message-ID, and in:anywhere which matches all.
+func (m *memMessage) matches(query string) bool {
+	raw := strings.ToLower(m.raw)
+	for _, w := range strings.Fields(strings.ToLower(query)) {
+		if w == "in:anywhere" {
+			continue
+		}
+		if id := strings.TrimPrefix(w, "rfc822msgid:"); id != w {
+			if strings.ToLower(strings.Trim(headerValue(m.payload, "Message-ID"), "<>")) != strings.Trim(id, "<>") {
+				return false
+			}
+			continue
+		}
+		if !strings.Contains(raw, w) {
+			return false
+		}
+	}
+	return true
+}
+
+// ListMessages implements Backend.
+func (b *MemBackend) ListMessages(ctx context.Context, label, query, token string, max int64) (*gmail.ListMessagesResponse, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	start := 0
+	if token != "" {
+		var err error
+		start, err = strconv.Atoi(token)
+		if err != nil {
+			return nil, errors.Wrapf(err, "bad page token %q", token)
+		}
+	}
+	var ids []string
+	for _, id := range b.order {
+		m := b.messages[id]
+		if label != "" && !hasString(m.labels, label) {
+			continue
+		}
+		if query != "" && !m.matches(query) {
+			continue
+		}
+		// Like Gmail, spam and trash are only listed if asked for.
+		if (hasString(m.labels, Trash) || hasString(m.labels, "SPAM")) && label != Trash && label != "SPAM" && !strings.Contains(strings.ToLower(query), "in:anywhere") {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	ret := &gmail.ListMessagesResponse{
+		ResultSizeEstimate: int64(len(ids)),
+	}
+	for n := start; n < len(ids) && int64(n-start) < max; n++ {
+		ret.Messages = append(ret.Messages, &gmail.Message{
+			Id:       ids[n],
+			ThreadId: b.messages[ids[n]].threadID,
+		})
+		if int64(n-start+1) == max && n+1 < len(ids) {
+			ret.NextPageToken = strconv.Itoa(n + 1)
+		}
+	}
+	return ret, nil
+}
+
+// metadataOnly returns a copy of the part tree without bodies.
+func metadataOnly(p *gmail.MessagePart) *gmail.MessagePart {
+	return &gmail.MessagePart{
+		PartId:   p.PartId,
+		MimeType: p.MimeType,
+		Headers:  p.Headers,
+		Body:     &gmail.MessagePartBody{},
+	}
+}
+
+// GetMessage implements Backend.
+func (b *MemBackend) GetMessage(ctx context.Context, id string, level DataLevel) (*gmail.Message, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.getLocked(id, level)
+}
+
+func (b *MemBackend) getLocked(id string, level DataLevel) (*gmail.Message, error) {
+	if _, found := b.messages[id]; !found {
+		return nil, notFound("message", id)
+	}
+	ret := b.minimalLocked(id)
+	ret.HistoryId = uint64(b.historyID)
+	switch level {
+	case LevelFull:
+		ret.Payload = b.messages[id].payload
+	case LevelMetadata:
+		ret.Payload = metadataOnly(b.messages[id].payload)
+	}
+	if ret.Payload != nil {
+		ret.Snippet = ret.Payload.MimeType
+	}
+	return ret, nil
+}
+
+// BatchGetMessages implements Backend.
+func (b *MemBackend) BatchGetMessages(ctx context.Context, ids []string, level DataLevel) ([]*gmail.Message, []error) {
+	msgs := make([]*gmail.Message, len(ids))
+	errs := make([]error, len(ids))
+	for n, id := range ids {
+		msgs[n], errs[n] = b.GetMessage(ctx, id, level)
+	}
+	return msgs, errs
+}
+
+// GetRawMessage implements Backend.
+func (b *MemBackend) GetRawMessage(ctx context.Context, id string) (*gmail.Message, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	m, found := b.messages[id]
+	if !found {
+		return nil, notFound("message", id)
+	}
+	ret := b.minimalLocked(id)
+	ret.Raw = MIMEEncode(m.raw)
+	return ret, nil
+}
+
+// GetAttachment implements Backend.
+//
+// All parts are inline in the in-memory backend, so this is never needed.
+func (b *MemBackend) GetAttachment(ctx context.Context, msgID, attachmentID string) (*gmail.MessagePartBody, error) {
+	return nil, notFound("attachment", attachmentID)
+}
+
+func (b *MemBackend) modifyLocked(id string, add, remove []string) (*gmail.Message, error) {
+	m, found := b.messages[id]
+	if !found {
+		return nil, notFound("message", id)
+	}
+	var added, removed []string
+	for _, l := range add {
+		if !hasString(m.labels, l) {
+			m.labels = append(m.labels, l)
+			added = append(added, l)
+		}
+	}
+	for _, l := range remove {
+		if hasString(m.labels, l) {
+			removed = append(removed, l)
+		}
+	}
+	var nl []string
+	for _, l := range m.labels {
+		if !hasString(remove, l) {
+			nl = append(nl, l)
+		}
+	}
+	m.labels = nl
+	if len(added) > 0 {
+		b.addHistoryLocked(&gmail.History{
+			LabelsAdded: []*gmail.HistoryLabelAdded{{Message: b.minimalLocked(id), LabelIds: added}},
+		})
+	}
+	if len(removed) > 0 {
+		b.addHistoryLocked(&gmail.History{
+			LabelsRemoved: []*gmail.HistoryLabelRemoved{{Message: b.minimalLocked(id), LabelIds: removed}},
+		})
+	}
+	return b.minimalLocked(id), nil
+}
+
+// ModifyMessage implements Backend.
+func (b *MemBackend) ModifyMessage(ctx context.Context, id string, add, remove []string) (*gmail.Message, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.modifyLocked(id, add, remove)
+}
+
+// BatchModify implements Backend.
+func (b *MemBackend) BatchModify(ctx context.Context, ids, add, remove []string) error {
+	b.m.Lock()
+	defer b.m.Unlock()
+	for _, id := range ids {
+		if _, err := b.modifyLocked(id, add, remove); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BatchDelete implements Backend.
+func (b *MemBackend) BatchDelete(ctx context.Context, ids []string) error {
+	b.m.Lock()
+	defer b.m.Unlock()
+	for _, id := range ids {
+		if _, found := b.messages[id]; !found {
+			continue
+		}
+		b.addHistoryLocked(&gmail.History{
+			MessagesDeleted: []*gmail.HistoryMessageDeleted{{Message: b.minimalLocked(id)}},
+		})
+		delete(b.messages, id)
+		var no []string
+		for _, o := range b.order {
+			if o != id {
+				no = append(no, o)
+			}
+		}
+		b.order = no
+	}
+	return nil
+}
+
+// threadLocked returns the message IDs of a thread, oldest first.
+func (b *MemBackend) threadLocked(id ThreadID) []string {
+	var ret []string
+	for n := len(b.order) - 1; n >= 0; n-- {
+		if b.messages[b.order[n]].threadID == string(id) {
+			ret = append(ret, b.order[n])
+		}
+	}
+	return ret
+}
+
+// ListThreads implements Backend.
+//
+// Like in Gmail, a thread matches if any of its messages match.
+func (b *MemBackend) ListThreads(ctx context.Context, label, query, token string, max int64) (*gmail.ListThreadsResponse, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	start := 0
+	if token != "" {
+		var err error
+		start, err = strconv.Atoi(token)
+		if err != nil {
+			return nil, errors.Wrapf(err, "bad page token %q", token)
+		}
+	}
+	var ids []string
+	seen := make(map[string]bool)
+	for _, id := range b.order {
+		m := b.messages[id]
+		if seen[m.threadID] {
+			continue
+		}
+		if label != "" && !hasString(m.labels, label) {
+			continue
+		}
+		if query != "" && !m.matches(query) {
+			continue
+		}
+		seen[m.threadID] = true
+		ids = append(ids, m.threadID)
+	}
+	ret := &gmail.ListThreadsResponse{
+		ResultSizeEstimate: int64(len(ids)),
+	}
+	for n := start; n < len(ids) && int64(n-start) < max; n++ {
+		ret.Threads = append(ret.Threads, &gmail.Thread{Id: ids[n]})
+		if int64(n-start+1) == max && n+1 < len(ids) {
+			ret.NextPageToken = strconv.Itoa(n + 1)
+		}
+	}
+	return ret, nil
+}
+
+// GetThread implements Backend.
+func (b *MemBackend) GetThread(ctx context.Context, id ThreadID, level DataLevel) (*gmail.Thread, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	ids := b.threadLocked(id)
+	if len(ids) == 0 {
+		return nil, notFound("thread", string(id))
+	}
+	ret := &gmail.Thread{
+		Id:        string(id),
+		HistoryId: uint64(b.historyID),
+	}
+	for _, mid := range ids {
+		m, err := b.getLocked(mid, level)
+		if err != nil {
+			return nil, err
+		}
+		ret.Messages = append(ret.Messages, m)
+	}
+	return ret, nil
+}
+
+// ModifyThread implements Backend.
+func (b *MemBackend) ModifyThread(ctx context.Context, id ThreadID, add, remove []string) error {
+	b.m.Lock()
+	defer b.m.Unlock()
+	ids := b.threadLocked(id)
+	if len(ids) == 0 {
+		return notFound("thread", string(id))
+	}
+	for _, mid := range ids {
+		if _, err := b.modifyLocked(mid, add, remove); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Send implements Backend.
+func (b *MemBackend) Send(ctx context.Context, threadID ThreadID, msg RawMessage) error {
+	raw, err := readRawMessage(msg)
+	if err != nil {
+		return err
+	}
+	_, err = b.AddMessage(raw, string(threadID), []string{"SENT"})
+	return err
+}
+
+// ImportMessage implements Backend.
+func (b *MemBackend) ImportMessage(ctx context.Context, msg string, labelIDs []string) (*gmail.Message, error) {
+	b.m.Lock()
+	for _, l := range labelIDs {
+		if _, found := b.labels[l]; !found {
+			b.m.Unlock()
+			return nil, notFound("label", l)
+		}
+	}
+	b.m.Unlock()
+	id, err := b.AddMessage(msg, "", labelIDs)
+	if err != nil {
+		return nil, &googleapi.Error{
+			Code:    http.StatusBadRequest,
+			Message: err.Error(),
+		}
+	}
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.minimalLocked(id), nil
+}
+
+// History implements Backend.
+func (b *MemBackend) History(ctx context.Context, startID HistoryID, labelID string) ([]*gmail.History, HistoryID, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	var ret []*gmail.History
+	for _, h := range b.history {
+		if HistoryID(h.Id) <= startID {
+			continue
+		}
+		// Filtering on label is done on current state, which is close enough.
+		if labelID != "" {
+			keep := false
+			for _, m := range historyMessages(h) {
+				if mm, found := b.messages[m.Id]; !found || hasString(mm.labels, labelID) {
+					keep = true
+				}
+			}
+			if !keep {
+				continue
+			}
+		}
+		ret = append(ret, h)
+	}
+	return ret, b.historyID, nil
+}
+
+// historyMessages returns all messages referenced by a history entry.
+func historyMessages(h *gmail.History) []*gmail.Message {
+	var ret []*gmail.Message
+	for _, m := range h.MessagesAdded {
+		ret = append(ret, m.Message)
+	}
+	for _, m := range h.MessagesDeleted {
+		ret = append(ret, m.Message)
+	}
+	for _, m := range h.LabelsAdded {
+		ret = append(ret, m.Message)
+	}
+	for _, m := range h.LabelsRemoved {
+		ret = append(ret, m.Message)
+	}
+	return ret
+}
+
+// GetProfile implements Backend.
+func (b *MemBackend) GetProfile(ctx context.Context) (*gmail.Profile, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	p := b.profile
+	p.HistoryId = uint64(b.historyID)
+	p.MessagesTotal = int64(len(b.messages))
+	return &p, nil
+}
+
+// ListLabels implements Backend.
+func (b *MemBackend) ListLabels(ctx context.Context) ([]*gmail.Label, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	var ret []*gmail.Label
+	for _, l := range b.labels {
+		ret = append(ret, l)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Id < ret[j].Id
+	})
+	return ret, nil
+}
+
+// GetLabel implements Backend.
+func (b *MemBackend) GetLabel(ctx context.Context, id string) (*gmail.Label, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	l, found := b.labels[id]
+	if !found {
+		return nil, notFound("label", id)
+	}
+	return l, nil
+}
+
+// CreateLabel implements Backend.
+func (b *MemBackend) CreateLabel(ctx context.Context, l *gmail.Label) (*gmail.Label, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	for _, o := range b.labels {
+		if o.Name == l.Name {
+			return nil, &googleapi.Error{
+				Code:    http.StatusConflict,
+				Message: fmt.Sprintf("label name %q exists", l.Name),
+			}
+		}
+	}
+	nl := *l
+	for n := len(b.labels); ; n++ {
+		nl.Id = fmt.Sprintf("Label_%d", n)
+		if _, found := b.labels[nl.Id]; !found {
+			break
+		}
+	}
+	nl.Type = "user"
+	b.labels[nl.Id] = &nl
+	ret := nl
+	return &ret, nil
+}
+
+// UpdateLabel implements Backend.
+func (b *MemBackend) UpdateLabel(ctx context.Context, l *gmail.Label) (*gmail.Label, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	old, found := b.labels[l.Id]
+	if !found {
+		return nil, notFound("label", l.Id)
+	}
+	if old.Type == "system" {
+		return nil, &googleapi.Error{
+			Code:    http.StatusBadRequest,
+			Message: fmt.Sprintf("label %q is a system label", l.Id),
+		}
+	}
+	nl := *l
+	nl.Type = old.Type
+	b.labels[l.Id] = &nl
+	ret := nl
+	return &ret, nil
+}
+
+// DeleteLabel implements Backend.
+func (b *MemBackend) DeleteLabel(ctx context.Context, id string) error {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if _, found := b.labels[id]; !found {
+		return notFound("label", id)
+	}
+	delete(b.labels, id)
+	for mid, m := range b.messages {
+		if hasString(m.labels, id) {
+			if _, err := b.modifyLocked(mid, nil, []string{id}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ListFilters implements Backend.
+func (b *MemBackend) ListFilters(ctx context.Context) ([]*gmail.Filter, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return append([]*gmail.Filter{}, b.filters...), nil
+}
+
+// CreateFilter implements Backend.
+func (b *MemBackend) CreateFilter(ctx context.Context, f *gmail.Filter) (*gmail.Filter, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if f.Criteria == nil || f.Action == nil {
+		return nil, &googleapi.Error{
+			Code:    http.StatusBadRequest,
+			Message: "filter needs both criteria and action",
+		}
+	}
+	for _, l := range append(append([]string{}, f.Action.AddLabelIds...), f.Action.RemoveLabelIds...) {
+		if _, found := b.labels[l]; !found {
+			return nil, notFound("label", l)
+		}
+	}
+	b.nextID++
+	nf := *f
+	nf.Id = fmt.Sprintf("filter%d", b.nextID)
+	b.filters = append(b.filters, &nf)
+	ret := nf
+	return &ret, nil
+}
+
+// DeleteFilter implements Backend.
+func (b *MemBackend) DeleteFilter(ctx context.Context, id string) error {
+	b.m.Lock()
+	defer b.m.Unlock()
+	for n, f := range b.filters {
+		if f.Id == id {
+			b.filters = append(b.filters[:n], b.filters[n+1:]...)
+			return nil
+		}
+	}
+	return notFound("filter", id)
+}
+
+// GetVacation implements Backend.
+func (b *MemBackend) GetVacation(ctx context.Context) (*gmail.VacationSettings, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	ret := b.vacation
+	return &ret, nil
+}
+
+// UpdateVacation implements Backend.
+func (b *MemBackend) UpdateVacation(ctx context.Context, v *gmail.VacationSettings) (*gmail.VacationSettings, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if v.StartTime != 0 && v.EndTime != 0 && v.EndTime < v.StartTime {
+		return nil, &googleapi.Error{
+			Code:    http.StatusBadRequest,
+			Message: "vacation end time before start time",
+		}
+	}
+	b.vacation = *v
+	ret := b.vacation
+	return &ret, nil
+}
+
+// AddSendAs adds an alias the user can send as.
+func (b *MemBackend) AddSendAs(s *gmail.SendAs) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if s.IsDefault {
+		for _, o := range b.sendAs {
+			o.IsDefault = false
+		}
+	}
+	ns := *s
+	b.sendAs = append(b.sendAs, &ns)
+}
+
+// ListSendAs implements Backend.
+func (b *MemBackend) ListSendAs(ctx context.Context) ([]*gmail.SendAs, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	var ret []*gmail.SendAs
+	for _, s := range b.sendAs {
+		ns := *s
+		ret = append(ret, &ns)
+	}
+	return ret, nil
+}
+
+// ListDrafts implements Backend.
+func (b *MemBackend) ListDrafts(ctx context.Context) ([]*gmail.Draft, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	var ret []*gmail.Draft
+	for id := range b.drafts {
+		ret = append(ret, &gmail.Draft{Id: id})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Id < ret[j].Id
+	})
+	return ret, nil
+}
+
+// GetDraft implements Backend.
+func (b *MemBackend) GetDraft(ctx context.Context, id string, level DataLevel) (*gmail.Draft, error) {
+	b.m.Lock()
+	msgID, found := b.drafts[id]
+	b.m.Unlock()
+	if !found {
+		return nil, notFound("draft", id)
+	}
+	m, err := b.GetMessage(ctx, msgID, level)
+	if err != nil {
+		return nil, err
+	}
+	return &gmail.Draft{
+		Id:      id,
+		Message: m,
+	}, nil
+}
+
+// CreateDraft implements Backend.
+func (b *MemBackend) CreateDraft(ctx context.Context, msg RawMessage) error {
+	raw, err := readRawMessage(msg)
+	if err != nil {
+		return err
+	}
+	id, err := b.AddMessage(raw, "", []string{"DRAFT"})
+	if err != nil {
+		return err
+	}
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.drafts["r"+id] = id
+	return nil
+}
+
+// UpdateDraft implements Backend.
+func (b *MemBackend) UpdateDraft(ctx context.Context, id string, msg RawMessage) error {
+	raw, err := readRawMessage(msg)
+	if err != nil {
+		return err
+	}
+	payload, err := parseRawMessage(raw)
+	if err != nil {
+		return err
+	}
+	b.m.Lock()
+	defer b.m.Unlock()
+	msgID, found := b.drafts[id]
+	if !found {
+		return notFound("draft", id)
+	}
+	b.messages[msgID].raw = raw
+	b.messages[msgID].payload = payload
+	return nil
+}
+
+// SendDraft implements Backend.
+func (b *MemBackend) SendDraft(ctx context.Context, d *gmail.Draft) error {
+	b.m.Lock()
+	defer b.m.Unlock()
+	msgID, found := b.drafts[d.Id]
+	if !found {
+		return notFound("draft", d.Id)
+	}
+	delete(b.drafts, d.Id)
+	_, err := b.modifyLocked(msgID, []string{"SENT"}, []string{"DRAFT"})
+	return err
+}
+
+// DeleteDraft implements Backend.
+func (b *MemBackend) DeleteDraft(ctx context.Context, id string) error {
+	b.m.Lock()
+	msgID, found := b.drafts[id]
+	delete(b.drafts, id)
+	b.m.Unlock()
+	if !found {
+		return notFound("draft", id)
+	}
+	return b.BatchDelete(ctx, []string{msgID})
+}
+
+// AddContact adds a contact.
+func (b *MemBackend) AddContact(name string, emails ...string) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	p := &people.Person{
+		ResourceName: fmt.Sprintf("people/c%d", len(b.contacts)),
+		Names:        []*people.Name{{DisplayName: name}},
+	}
+	for _, e := range emails {
+		p.EmailAddresses = append(p.EmailAddresses, &people.EmailAddress{Value: e})
+	}
+	b.contactSeq++
+	b.contacts = append(b.contacts, p)
+	b.contactVersions = append(b.contactVersions, b.contactSeq)
+}
+
+// DeleteContact deletes all contacts with the given name.
+func (b *MemBackend) DeleteContact(name string) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	for n, p := range b.contacts {
+		if p.Names[0].DisplayName != name || (p.Metadata != nil && p.Metadata.Deleted) {
+			continue
+		}
+		b.contactSeq++
+		b.contacts[n] = &people.Person{
+			ResourceName: p.ResourceName,
+			Metadata:     &people.PersonMetadata{Deleted: true},
+		}
+		b.contactVersions[n] = b.contactSeq
+	}
+}
+
+// ListConnections implements Backend.
+func (b *MemBackend) ListConnections(ctx context.Context, syncToken string) ([]*people.Person, string, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	since := 0
+	if syncToken != "" {
+		var err error
+		since, err = strconv.Atoi(syncToken)
+		if err != nil || since > b.contactSeq {
+			// What the People API returns.
+			return nil, "", &googleapi.Error{
+				Code:    http.StatusBadRequest,
+				Message: "Sync token is expired. Clear local cache and retry call without the sync token.",
+				Details: []interface{}{map[string]interface{}{
+					"@type":  "type.googleapis.com/google.rpc.ErrorInfo",
+					"reason": "EXPIRED_SYNC_TOKEN",
+					"domain": "people.googleapis.com",
+				}},
+				Errors: []googleapi.ErrorItem{{
+					Reason:  "failedPrecondition",
+					Message: "Sync token is expired. Clear local cache and retry call without the sync token.",
+				}},
+			}
+		}
+	}
+	var ret []*people.Person
+	for n, p := range b.contacts {
+		deleted := p.Metadata != nil && p.Metadata.Deleted
+		if b.contactVersions[n] <= since || (deleted && syncToken == "") {
+			continue
+		}
+		ret = append(ret, p)
+	}
+	return ret, strconv.Itoa(b.contactSeq), nil
+}
+
+// ListFiles implements Backend.
+func (b *MemBackend) ListFiles(ctx context.Context) ([]*drive.File, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	var ret []*drive.File
+	for id, f := range b.files {
+		ret = append(ret, &drive.File{
+			Id:   id,
+			Name: f.name,
+		})
+	}
+	return ret, nil
+}
+
+// DownloadFile implements Backend.
+func (b *MemBackend) DownloadFile(ctx context.Context, id string) ([]byte, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	f, found := b.files[id]
+	if !found {
+		return nil, notFound("file", id)
+	}
+	return append([]byte{}, f.contents...), nil
+}
+
+// CreateFile implements Backend.
+func (b *MemBackend) CreateFile(ctx context.Context, name string, contents []byte) error {
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.files[fmt.Sprintf("file%d", len(b.files))] = &memFile{
+		name:     name,
+		contents: append([]byte{}, contents...),
+	}
+	return nil
+}
+
+// UpdateFile implements Backend.
+func (b *MemBackend) UpdateFile(ctx context.Context, id, name string, contents []byte) error {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if _, found := b.files[id]; !found {
+		return notFound("file", id)
+	}
+	b.files[id] = &memFile{
+		name:     name,
+		contents: append([]byte{}, contents...),
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package cmdg
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+const testMultipartMessage = "From: Alice <alice@example.com>\r\n" +
+	"To: bob@example.com\r\n" +
+	"Subject: Report\r\n" +
+	"Date: Mon, 2 Jan 2006 15:04:05 -0700\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=\"XXX\"\r\n" +
+	"\r\n" +
+	"--XXX\r\n" +
+	"Content-Type: text/plain; charset=\"UTF-8\"\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"Hello=20there, r=C3=A4ksm=C3=B6rg=C3=A5s\r\n" +
+	"--XXX\r\n" +
+	"Content-Type: application/octet-stream; name=\"data.bin\"\r\n" +
+	"Content-Disposition: attachment; filename=\"data.bin\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"AAECAw==\r\n" +
+	"--XXX--\r\n"
+
+func TestMemBackend(t *testing.T) {
+	ctx := context.Background()
+	b := NewMemBackend("bob@example.com")
+	id, err := b.AddMessage(testMultipartMessage, "", []string{Inbox, Unread})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.AddMessage("Subject: other\r\n\r\nbody\r\n", "", []string{"SENT"}); err != nil {
+		t.Fatal(err)
+	}
+	c := NewWithBackend(b)
+
+	page, err := c.ListMessages(ctx, Inbox, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(page.Messages), 1; got != want {
+		t.Fatalf("Got %d messages in inbox, want %d", got, want)
+	}
+	msg := page.Messages[0]
+	if got, want := msg.ID, id; got != want {
+		t.Errorf("Got message ID %q, want %q", got, want)
+	}
+	if subj, err := msg.GetSubject(ctx); err != nil {
+		t.Error(err)
+	} else if got, want := subj, "Report"; got != want {
+		t.Errorf("Got subject %q, want %q", got, want)
+	}
+	body, err := msg.GetBody(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Hello there, räksmörgås"; !strings.Contains(body, want) {
+		t.Errorf("Body %q does not contain %q", body, want)
+	}
+	as, err := msg.Attachments(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(as), 1; got != want {
+		t.Fatalf("Got %d attachments, want %d", got, want)
+	}
+	data, err := as[0].Download(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), "\x00\x01\x02\x03"; got != want {
+		t.Errorf("Got attachment data %q, want %q", got, want)
+	}
+
+	// Archive and check history.
+	hid, err := c.HistoryID(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.BatchArchive(ctx, []string{id}); err != nil {
+		t.Fatal(err)
+	}
+	hs, _, err := c.History(ctx, hid, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(hs), 1; got != want {
+		t.Fatalf("Got %d history entries, want %d", got, want)
+	}
+	if got, want := len(hs[0].LabelsRemoved), 1; got != want {
+		t.Errorf("Got %d labels removed, want %d", got, want)
+	}
+	page, err = c.ListMessages(ctx, Inbox, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(page.Messages), 0; got != want {
+		t.Errorf("Got %d messages in inbox after archive, want %d", got, want)
+	}
+}
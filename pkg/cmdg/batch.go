@@ -0,0 +1,162 @@
+package cmdg
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	gmail "google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	// Gmail allows 100 calls per batch, but recommends no more than
+	// 50 to not get rate limited.
+	batchSize = 50
+
+	batchPath = "batch/gmail/v1"
+)
+
+// BatchGetMessages implements Backend.
+//
+// Uses the Gmail batch endpoint, which takes a multipart/mixed body
+// with one HTTP request per part, and replies the same way.
+func (b *gmailBackend) BatchGetMessages(ctx context.Context, ids []string, level DataLevel) ([]*gmail.Message, []error) {
+	msgs := make([]*gmail.Message, len(ids))
+	errs := make([]error, len(ids))
+	for start := 0; start < len(ids); start += batchSize {
+		end := start + batchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		var m []*gmail.Message
+		var e []error
+		err := wrapLogRPC(ctx, "gmail.Batch.Messages.Get", func(ctx context.Context) (err error) {
+			m, e, err = b.batchGet(ctx, ids[start:end], level)
+			return
+		}, "email=%q msgIDs=%v level=%s", email, ids[start:end], level)
+		if err != nil {
+			for n := start; n < end; n++ {
+				errs[n] = err
+			}
+			continue
+		}
+		copy(msgs[start:end], m)
+		copy(errs[start:end], e)
+	}
+
+	// Individual calls may fail with e.g. rate limiting. Retry those one by one.
+	for n := range ids {
+		if errs[n] != nil && retryable(errs[n]) {
+			msgs[n], errs[n] = b.GetMessage(ctx, ids[n], level)
+		}
+	}
+	return msgs, errs
+}
+
+// batchGet does one batch request. A returned error means the whole batch failed.
+func (b *gmailBackend) batchGet(ctx context.Context, ids []string, level DataLevel) ([]*gmail.Message, []error, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for n, id := range ids {
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {"application/http"},
+			"Content-Id":   {fmt.Sprintf("<item%d>", n)},
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		fmt.Fprintf(pw, "GET /gmail/v1/users/%s/messages/%s?format=%s&alt=json HTTP/1.1\r\n\r\n",
+			url.PathEscape(email), url.PathEscape(id), url.QueryEscape(string(level)))
+	}
+	if err := mw.Close(); err != nil {
+		return nil, nil, err
+	}
+
+	req, err := http.NewRequest("POST", strings.TrimSuffix(b.gmail.BasePath, "/")+"/"+batchPath, &body)
+	if err != nil {
+		return nil, nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	req.Header.Set("User-Agent", userAgent())
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if err := googleapi.CheckResponse(resp); err != nil {
+		return nil, nil, err
+	}
+	return parseBatchResponse(resp.Header.Get("Content-Type"), resp.Body, len(ids))
+}
+
+// parseBatchResponse parses a batch reply of messages. Replies are
+// matched to requests using Content-ID.
+func parseBatchResponse(ct string, r io.Reader, num int) ([]*gmail.Message, []error, error) {
+	mt, params, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "parsing batch reply content type %q", ct)
+	}
+	if mt != "multipart/mixed" {
+		return nil, nil, fmt.Errorf("batch reply has content type %q, want multipart/mixed", mt)
+	}
+	msgs := make([]*gmail.Message, num)
+	errs := make([]error, num)
+	for n := range errs {
+		errs[n] = fmt.Errorf("no reply in batch")
+	}
+	mr := multipart.NewReader(r, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "reading batch reply")
+		}
+		cid := strings.Trim(p.Header.Get("Content-Id"), "<>")
+		i := strings.LastIndex(cid, "item")
+		if i < 0 {
+			return nil, nil, fmt.Errorf("unexpected Content-ID %q in batch reply", cid)
+		}
+		n, err := strconv.Atoi(cid[i+len("item"):])
+		if err != nil || n < 0 || n >= num {
+			return nil, nil, fmt.Errorf("unexpected Content-ID %q in batch reply", cid)
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(p), nil)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "parsing batch reply part %q", cid)
+		}
+		if err := googleapi.CheckResponse(resp); err != nil {
+			errs[n] = err
+			resp.Body.Close()
+			continue
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			errs[n] = err
+			continue
+		}
+		var m gmail.Message
+		if err := json.Unmarshal(data, &m); err != nil {
+			errs[n] = errors.Wrapf(err, "parsing batch reply part %q", cid)
+			continue
+		}
+		msgs[n], errs[n] = &m, nil
+	}
+	return msgs, errs, nil
+}
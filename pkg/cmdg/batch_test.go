@@ -0,0 +1,201 @@
+package cmdg
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+
+	gmail "google.golang.org/api/gmail/v1"
+)
+
+// fakeBatch answers Gmail batch requests, in reverse order to check
+// that Content-ID is used for matching.
+type fakeBatch struct {
+	m         sync.Mutex
+	batches   int
+	singles   int
+	sizes     []int
+	missing   map[string]bool
+	rateLimit map[string]bool
+}
+
+func (f *fakeBatch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	if r.URL.Path != "/batch/gmail/v1" {
+		// Single message get, for retries.
+		f.singles++
+		id := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"id":%q,"labelIds":["INBOX"]}`, id)
+		return
+	}
+	f.batches++
+	mt, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mt != "multipart/mixed" {
+		http.Error(w, "bad content type", http.StatusBadRequest)
+		return
+	}
+	type item struct {
+		cid string
+		req *http.Request
+	}
+	var items []item
+	mr := multipart.NewReader(r.Body, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if got, want := p.Header.Get("Content-Type"), "application/http"; got != want {
+			http.Error(w, "bad part content type "+got, http.StatusBadRequest)
+			return
+		}
+		req, err := http.ReadRequest(bufio.NewReader(p))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		items = append(items, item{cid: strings.Trim(p.Header.Get("Content-Id"), "<>"), req: req})
+	}
+	f.sizes = append(f.sizes, len(items))
+
+	mw := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	for n := len(items) - 1; n >= 0; n-- {
+		it := items[n]
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {"application/http"},
+			"Content-Id":   {"<response-" + it.cid + ">"},
+		})
+		if err != nil {
+			return
+		}
+		id := it.req.URL.Path[strings.LastIndex(it.req.URL.Path, "/")+1:]
+		switch {
+		case f.missing[id]:
+			fmt.Fprintf(pw, "HTTP/1.1 404 Not Found\r\nContent-Type: application/json\r\n\r\n{\"error\":{\"code\":404,\"message\":\"Not Found\"}}")
+		case f.rateLimit[id]:
+			fmt.Fprintf(pw, "HTTP/1.1 429 Too Many Requests\r\nContent-Type: application/json\r\n\r\n{\"error\":{\"code\":429,\"message\":\"slow down\"}}")
+		default:
+			body := fmt.Sprintf(`{"id":%q,"labelIds":["INBOX"],"payload":{"headers":[{"name":"Subject","value":"Subject of %s"}]}}`, id, id)
+			fmt.Fprintf(pw, "HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+		}
+	}
+	mw.Close()
+}
+
+func TestBatchGetMessages(t *testing.T) {
+	ctx := context.Background()
+	fb := &fakeBatch{
+		missing:   map[string]bool{"m2": true},
+		rateLimit: map[string]bool{"m3": true},
+	}
+	b, done := newTestGmailBackend(t, fb)
+	defer done()
+
+	var ids []string
+	for n := 0; n < batchSize+10; n++ {
+		ids = append(ids, fmt.Sprintf("m%d", n))
+	}
+	msgs, errs := b.BatchGetMessages(ctx, ids, LevelMetadata)
+	if got, want := fb.batches, 2; got != want {
+		t.Errorf("Got %d batch requests, want %d", got, want)
+	}
+	if got, want := fmt.Sprint(fb.sizes), fmt.Sprintf("[%d 10]", batchSize); got != want {
+		t.Errorf("Got batch sizes %s, want %s", got, want)
+	}
+	if got, want := fb.singles, 1; got != want {
+		t.Errorf("Got %d single requests, want %d (for the rate limited one)", got, want)
+	}
+	for n, id := range ids {
+		switch id {
+		case "m2":
+			if errs[n] == nil {
+				t.Errorf("Expected error for missing message %q", id)
+			}
+		default:
+			if errs[n] != nil {
+				t.Errorf("Message %q: %v", id, errs[n])
+				continue
+			}
+			if got := msgs[n].Id; got != id {
+				t.Errorf("Got message %q in position %d, want %q", got, n, id)
+			}
+		}
+	}
+
+	// Through CmdG.
+	c := NewWithBackend(b)
+	fb.batches = 0
+	page := &Page{conn: c}
+	for _, id := range []string{"a", "b", "c"} {
+		page.Messages = append(page.Messages, NewMessage(c, id))
+	}
+	if err := page.PreloadSubjects(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fb.batches, 1; got != want {
+		t.Errorf("Got %d batch requests, want %d", got, want)
+	}
+	for _, m := range page.Messages {
+		if !m.HasData(LevelMetadata) {
+			t.Errorf("Message %q not preloaded", m.ID)
+			continue
+		}
+		if got, err := m.GetSubject(ctx); err != nil {
+			t.Error(err)
+		} else if want := "Subject of " + m.ID; got != want {
+			t.Errorf("Got subject %q, want %q", got, want)
+		}
+	}
+}
+
+func TestPreloadAfterFullLoad(t *testing.T) {
+	ctx := context.Background()
+	m := NewMessage(NewWithBackend(NewMemBackend("alice@example.com")), "late")
+	headers := []*gmail.MessagePartHeader{{Name: "Subject", Value: "Hello"}}
+	if err := m.setResponse(ctx, &gmail.Message{
+		Id:        m.ID,
+		HistoryId: 1,
+		LabelIds:  []string{Inbox},
+		Payload: &gmail.MessagePart{
+			MimeType: "text/plain",
+			Headers:  headers,
+			Body:     &gmail.MessagePartBody{Data: MIMEEncode("Body")},
+		},
+	}, LevelFull); err != nil {
+		t.Fatal(err)
+	}
+
+	// A batch result that lands after the full load.
+	if err := m.setResponse(ctx, &gmail.Message{
+		Id:        m.ID,
+		HistoryId: 2,
+		LabelIds:  []string{Inbox, Starred},
+		Payload:   &gmail.MessagePart{Headers: headers},
+	}, LevelMetadata); err != nil {
+		t.Fatal(err)
+	}
+	if !m.HasData(LevelFull) {
+		t.Fatalf("Full message downgraded")
+	}
+	if got, err := m.GetBody(ctx); err != nil || got != "Body" {
+		t.Errorf("Got body %q, %v, want %q", got, err, "Body")
+	}
+	if !m.HasLabel(Starred) {
+		t.Errorf("Newer labels not applied")
+	}
+}
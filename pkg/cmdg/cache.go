@@ -0,0 +1,610 @@
+package cmdg
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	gmail "google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	cacheStateFileName = "state.json"
+	cacheMessageDir    = "messages"
+	cacheListDir       = "lists"
+	cacheLabelsFile    = "labels.json"
+	cacheSendAsFile    = "sendas.json"
+)
+
+var (
+	// Levels that are cached on disk. Minimal is not, since it's
+	// only used to refresh labels.
+	cachedLevels = []string{string(LevelFull), string(LevelMetadata), levelRaw}
+
+	// Message IDs are hex, but let's not trust that blindly when building file names.
+	cacheSafeIDRE = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+)
+
+// DiskCache is a Backend that stores message responses on disk, and
+// passes everything through to another Backend.
+//
+// Message contents never change in Gmail, but labels do. Labels
+// are kept up to date from the history records that pass through
+// it, and by Sync().
+//
+// Message lists and labels are also stored, but only used when the
+// network is down.
+type DiskCache struct {
+	Backend
+	dir string
+
+	m     sync.Mutex
+	state cacheState
+}
+
+type cacheState struct {
+	// HistoryID is the point in history where the cache is known to be up to date.
+	HistoryID HistoryID
+}
+
+// NewDiskCache creates a new disk cache in a directory, wrapping another backend.
+func NewDiskCache(b Backend, dir string) (*DiskCache, error) {
+	for _, d := range []string{cacheMessageDir, cacheListDir} {
+		if err := os.MkdirAll(path.Join(dir, d), 0700); err != nil {
+			return nil, errors.Wrapf(err, "creating cache directory %q", dir)
+		}
+	}
+	c := &DiskCache{
+		Backend: b,
+		dir:     dir,
+	}
+	if b, err := ioutil.ReadFile(path.Join(dir, cacheStateFileName)); err == nil {
+		if err := json.Unmarshal(b, &c.state); err != nil {
+			log.Warningf("Cache state %q corrupt, starting over: %v", dir, err)
+			c.state = cacheState{}
+			if err := c.wipe(); err != nil {
+				return nil, err
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "reading cache state in %q", dir)
+	}
+	return c, nil
+}
+
+// UseDiskCache puts a disk cache in front of the current backend.
+func (c *CmdG) UseDiskCache(dir string) error {
+	dc, err := NewDiskCache(c.backend, dir)
+	if err != nil {
+		return err
+	}
+	c.backend = dc
+	return nil
+}
+
+// uncachedBackend returns the backend behind the disk cache, if any,
+// for lookups that would only fill the cache with things never used.
+func (c *CmdG) uncachedBackend() Backend {
+	if dc, ok := c.backend.(*DiskCache); ok {
+		return dc.Backend
+	}
+	return c.backend
+}
+
+// SyncCache brings the disk cache, if any, up to date.
+func (c *CmdG) SyncCache(ctx context.Context) error {
+	dc, ok := c.backend.(*DiskCache)
+	if !ok {
+		return nil
+	}
+	return dc.Sync(ctx)
+}
+
+// Sync applies all history since last sync. If that history is no
+// longer available, then the cache is cleared.
+func (c *DiskCache) Sync(ctx context.Context) error {
+	c.m.Lock()
+	start := c.state.HistoryID
+	c.m.Unlock()
+
+	if start == 0 {
+		// Empty cache, or nothing known about it. Start over.
+		if err := c.wipe(); err != nil {
+			return err
+		}
+		p, err := c.Backend.GetProfile(ctx)
+		if err != nil {
+			return err
+		}
+		return c.saveState(HistoryID(p.HistoryId))
+	}
+
+	hs, hid, err := c.Backend.History(ctx, start, "")
+	if e, ok := errors.Cause(err).(*googleapi.Error); ok && e.Code == http.StatusNotFound {
+		log.Infof("Cache history ID %d too old. Clearing cache", start)
+		c.m.Lock()
+		c.state.HistoryID = 0
+		c.m.Unlock()
+		return c.Sync(ctx)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "getting history since %d", start)
+	}
+	c.applyHistory(hs)
+	log.Infof("Cache synced %d history entries since %d", len(hs), start)
+	if hid == 0 {
+		return nil
+	}
+	return c.saveState(hid)
+}
+
+func (c *DiskCache) saveState(hid HistoryID) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.state.HistoryID = hid
+	b, err := json.Marshal(&c.state)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path.Join(c.dir, cacheStateFileName), b)
+}
+
+// wipe removes all cached messages and lists.
+func (c *DiskCache) wipe() error {
+	for _, d := range []string{cacheMessageDir, cacheListDir} {
+		d := path.Join(c.dir, d)
+		if err := os.RemoveAll(d); err != nil {
+			return errors.Wrapf(err, "clearing cache %q", d)
+		}
+		if err := os.MkdirAll(d, 0700); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFileAtomic writes a file so that readers never see a partial file.
+func writeFileAtomic(fn string, data []byte) error {
+	f, err := ioutil.TempFile(path.Dir(fn), ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), fn)
+}
+
+// readJSON reads a cache file, returning false if missing or broken.
+func readJSON(fn string, v interface{}) bool {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warningf("Failed to read cache file %q: %v", fn, err)
+		}
+		return false
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		log.Warningf("Cache file %q corrupt: %v", fn, err)
+		return false
+	}
+	return true
+}
+
+// writeJSON writes a cache file, logging any errors.
+func writeJSON(fn string, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Errorf("Failed to marshal %q for cache: %v", fn, err)
+		return
+	}
+	if err := writeFileAtomic(fn, b); err != nil {
+		log.Errorf("Failed to write %q to cache: %v", fn, err)
+	}
+}
+
+func (c *DiskCache) fileName(id, level string) string {
+	return path.Join(c.dir, cacheMessageDir, fmt.Sprintf("%s.%s.json", id, level))
+}
+
+// get returns a message from the cache, or nil.
+func (c *DiskCache) get(id, level string) *gmail.Message {
+	if !cacheSafeIDRE.MatchString(id) {
+		return nil
+	}
+	var ret gmail.Message
+	if !readJSON(c.fileName(id, level), &ret) {
+		return nil
+	}
+	return &ret
+}
+
+func (c *DiskCache) put(id, level string, msg *gmail.Message) {
+	if !cacheSafeIDRE.MatchString(id) {
+		return
+	}
+	writeJSON(c.fileName(id, level), msg)
+}
+
+// getAny returns the message at any cached level, or nil.
+func (c *DiskCache) getAny(id string) *gmail.Message {
+	for _, l := range cachedLevels {
+		if m := c.get(id, l); m != nil {
+			return m
+		}
+	}
+	return nil
+}
+
+// evict removes a message from the cache.
+func (c *DiskCache) evict(id string) {
+	if !cacheSafeIDRE.MatchString(id) {
+		return
+	}
+	for _, l := range cachedLevels {
+		if err := os.Remove(c.fileName(id, l)); err != nil && !os.IsNotExist(err) {
+			log.Errorf("Failed to evict %q level %q from cache: %v", id, l, err)
+		}
+	}
+}
+
+// updateLabels changes labels on all cached levels of a message.
+// If `set` is non-nil then it replaces the labels, else add and
+// remove are applied. hid is the history ID the change is from, if
+// known. Cached copies newer than that are left alone.
+func (c *DiskCache) updateLabels(id string, hid HistoryID, set, add, remove []string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.updateLabelsLocked(id, hid, set, add, remove)
+}
+
+func (c *DiskCache) updateLabelsLocked(id string, hid HistoryID, set, add, remove []string) {
+	for _, l := range cachedLevels {
+		m := c.get(id, l)
+		if m == nil || (hid != 0 && HistoryID(m.HistoryId) > hid) {
+			continue
+		}
+		if set != nil {
+			m.LabelIds = set
+		} else {
+			var nl []string
+			for _, t := range m.LabelIds {
+				if !hasString(remove, t) {
+					nl = append(nl, t)
+				}
+			}
+			for _, t := range add {
+				if !hasString(nl, t) {
+					nl = append(nl, t)
+				}
+			}
+			m.LabelIds = nl
+		}
+		if hid > HistoryID(m.HistoryId) {
+			m.HistoryId = uint64(hid)
+		}
+		c.put(id, l, m)
+	}
+}
+
+// putFetched stores a message fetched from the backend. History may
+// have been applied to the cache while it was being fetched, so if
+// any cached level has newer labels, then those are kept, and also
+// returned in msg. Otherwise the labels of msg replace the cached ones.
+func (c *DiskCache) putFetched(id, level string, msg *gmail.Message) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	for _, l := range cachedLevels {
+		if m := c.get(id, l); m != nil && m.HistoryId > msg.HistoryId {
+			msg.LabelIds = m.LabelIds
+			msg.HistoryId = m.HistoryId
+		}
+	}
+	c.updateLabelsLocked(id, HistoryID(msg.HistoryId), msg.LabelIds, nil, nil)
+	c.put(id, level, msg)
+}
+
+// applyHistory updates cached labels and evicts deleted messages.
+func (c *DiskCache) applyHistory(hs []*gmail.History) {
+	for _, h := range hs {
+		for _, m := range h.MessagesDeleted {
+			c.evict(m.Message.Id)
+		}
+		for _, m := range h.LabelsAdded {
+			c.updateLabels(m.Message.Id, HistoryID(h.Id), nil, m.LabelIds, nil)
+		}
+		for _, m := range h.LabelsRemoved {
+			c.updateLabels(m.Message.Id, HistoryID(h.Id), nil, nil, m.LabelIds)
+		}
+	}
+}
+
+// GetMessage implements Backend.
+func (c *DiskCache) GetMessage(ctx context.Context, id string, level DataLevel) (*gmail.Message, error) {
+	switch level {
+	case LevelFull:
+		if m := c.get(id, string(LevelFull)); m != nil {
+			return m, nil
+		}
+	case LevelMetadata:
+		// Full is a superset of metadata.
+		for _, l := range []DataLevel{LevelMetadata, LevelFull} {
+			if m := c.get(id, string(l)); m != nil {
+				return m, nil
+			}
+		}
+	default:
+		// Minimal is only asked for when labels are wanted fresh.
+		m, err := c.Backend.GetMessage(ctx, id, level)
+		if IsNetworkError(err) {
+			if m := c.getAny(id); m != nil {
+				return &gmail.Message{Id: m.Id, ThreadId: m.ThreadId, LabelIds: m.LabelIds}, nil
+			}
+		}
+		if err == nil {
+			c.updateLabels(id, HistoryID(m.HistoryId), m.LabelIds, nil, nil)
+		}
+		return m, err
+	}
+	m, err := c.Backend.GetMessage(ctx, id, level)
+	if err != nil {
+		return nil, err
+	}
+	c.putFetched(id, string(level), m)
+	return m, nil
+}
+
+// BatchGetMessages implements Backend. Only messages not in the cache are fetched.
+func (c *DiskCache) BatchGetMessages(ctx context.Context, ids []string, level DataLevel) ([]*gmail.Message, []error) {
+	if level != LevelMetadata && level != LevelFull {
+		return c.Backend.BatchGetMessages(ctx, ids, level)
+	}
+	msgs := make([]*gmail.Message, len(ids))
+	errs := make([]error, len(ids))
+	var missing []string
+	var missingPos []int
+	for n, id := range ids {
+		m := c.get(id, string(level))
+		if m == nil && level == LevelMetadata {
+			m = c.get(id, string(LevelFull))
+		}
+		if m != nil {
+			msgs[n] = m
+			continue
+		}
+		missing = append(missing, id)
+		missingPos = append(missingPos, n)
+	}
+	if len(missing) == 0 {
+		return msgs, errs
+	}
+	ms, es := c.Backend.BatchGetMessages(ctx, missing, level)
+	for i, n := range missingPos {
+		msgs[n], errs[n] = ms[i], es[i]
+		if es[i] == nil {
+			c.putFetched(missing[i], string(level), ms[i])
+		}
+	}
+	return msgs, errs
+}
+
+// GetThread implements Backend. Threads are not cached as such,
+// but the messages in them are.
+func (c *DiskCache) GetThread(ctx context.Context, id ThreadID, level DataLevel) (*gmail.Thread, error) {
+	t, err := c.Backend.GetThread(ctx, id, level)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range t.Messages {
+		if level == LevelMetadata || level == LevelFull {
+			c.putFetched(m.Id, string(level), m)
+		} else {
+			c.updateLabels(m.Id, HistoryID(m.HistoryId), m.LabelIds, nil, nil)
+		}
+	}
+	return t, nil
+}
+
+// GetRawMessage implements Backend.
+func (c *DiskCache) GetRawMessage(ctx context.Context, id string) (*gmail.Message, error) {
+	if m := c.get(id, levelRaw); m != nil {
+		return m, nil
+	}
+	m, err := c.Backend.GetRawMessage(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	c.putFetched(id, levelRaw, m)
+	return m, nil
+}
+
+// ModifyMessage implements Backend.
+func (c *DiskCache) ModifyMessage(ctx context.Context, id string, add, remove []string) (*gmail.Message, error) {
+	m, err := c.Backend.ModifyMessage(ctx, id, add, remove)
+	if errors.Cause(err) == ErrQueued {
+		c.updateLabels(id, 0, nil, add, remove)
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.updateLabels(id, HistoryID(m.HistoryId), m.LabelIds, nil, nil)
+	return m, nil
+}
+
+// BatchModify implements Backend.
+func (c *DiskCache) BatchModify(ctx context.Context, ids, add, remove []string) error {
+	if err := c.Backend.BatchModify(ctx, ids, add, remove); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		c.updateLabels(id, 0, nil, add, remove)
+	}
+	return nil
+}
+
+// ModifyThread implements Backend.
+//
+// The new labels are fetched for the whole thread. If offline, the
+// change is instead applied to the cached messages of the thread.
+func (c *DiskCache) ModifyThread(ctx context.Context, id ThreadID, add, remove []string) error {
+	if err := c.Backend.ModifyThread(ctx, id, add, remove); err != nil {
+		return err
+	}
+	_, err := c.GetThread(ctx, id, LevelMinimal)
+	if err == nil {
+		return nil
+	}
+	if !IsNetworkError(err) {
+		log.Warningf("Failed to reload labels of thread %q: %v", id, err)
+	}
+	for _, mid := range c.threadMessages(id) {
+		c.updateLabels(mid, 0, nil, add, remove)
+	}
+	return nil
+}
+
+// threadMessages returns the IDs of the cached messages in a thread.
+func (c *DiskCache) threadMessages(id ThreadID) []string {
+	fs, err := ioutil.ReadDir(path.Join(c.dir, cacheMessageDir))
+	if err != nil {
+		log.Errorf("Failed to list cached messages: %v", err)
+		return nil
+	}
+	seen := make(map[string]bool)
+	var ret []string
+	for _, f := range fs {
+		parts := strings.SplitN(strings.TrimSuffix(f.Name(), ".json"), ".", 2)
+		if len(parts) != 2 || seen[parts[0]] {
+			continue
+		}
+		seen[parts[0]] = true
+		if m := c.get(parts[0], parts[1]); m != nil && ThreadID(m.ThreadId) == id {
+			ret = append(ret, parts[0])
+		}
+	}
+	return ret
+}
+
+// BatchDelete implements Backend.
+func (c *DiskCache) BatchDelete(ctx context.Context, ids []string) error {
+	if err := c.Backend.BatchDelete(ctx, ids); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		c.evict(id)
+	}
+	return nil
+}
+
+// History implements Backend.
+//
+// Any history passing through is applied to the cache. Only
+// unfiltered history moves the cache state forward though, since
+// history for one label doesn't say anything about other labels.
+func (c *DiskCache) History(ctx context.Context, startID HistoryID, labelID string) ([]*gmail.History, HistoryID, error) {
+	hs, hid, err := c.Backend.History(ctx, startID, labelID)
+	if err != nil {
+		return nil, 0, err
+	}
+	c.applyHistory(hs)
+	return hs, hid, nil
+}
+
+func (c *DiskCache) listFileName(label, query, token string, max int64) string {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%q %q %q %d", label, query, token, max)))
+	return path.Join(c.dir, cacheListDir, hex.EncodeToString(h[:])+".json")
+}
+
+// ListMessages implements Backend.
+//
+// If the network is down, the last seen list is returned, minus
+// messages that have since lost the label.
+func (c *DiskCache) ListMessages(ctx context.Context, label, query, token string, max int64) (*gmail.ListMessagesResponse, error) {
+	fn := c.listFileName(label, query, token, max)
+	res, err := c.Backend.ListMessages(ctx, label, query, token, max)
+	if err == nil {
+		writeJSON(fn, res)
+		return res, nil
+	}
+	if !IsNetworkError(err) {
+		return nil, err
+	}
+	var cached gmail.ListMessagesResponse
+	if !readJSON(fn, &cached) {
+		return nil, err
+	}
+	log.Infof("Offline. Using cached message list for label %q query %q", label, query)
+	var msgs []*gmail.Message
+	for _, m := range cached.Messages {
+		if label != "" {
+			if cm := c.getAny(m.Id); cm != nil && !hasString(cm.LabelIds, label) {
+				continue
+			}
+		}
+		msgs = append(msgs, m)
+	}
+	cached.Messages = msgs
+	return &cached, nil
+}
+
+// ListLabels implements Backend.
+func (c *DiskCache) ListLabels(ctx context.Context) ([]*gmail.Label, error) {
+	fn := path.Join(c.dir, cacheLabelsFile)
+	ls, err := c.Backend.ListLabels(ctx)
+	if err == nil {
+		writeJSON(fn, ls)
+		return ls, nil
+	}
+	if !IsNetworkError(err) {
+		return nil, err
+	}
+	var cached []*gmail.Label
+	if !readJSON(fn, &cached) {
+		return nil, err
+	}
+	log.Infof("Offline. Using cached labels")
+	return cached, nil
+}
+
+// ListSendAs implements Backend.
+func (c *DiskCache) ListSendAs(ctx context.Context) ([]*gmail.SendAs, error) {
+	fn := path.Join(c.dir, cacheSendAsFile)
+	ss, err := c.Backend.ListSendAs(ctx)
+	if err == nil {
+		writeJSON(fn, ss)
+		return ss, nil
+	}
+	if !IsNetworkError(err) {
+		return nil, err
+	}
+	var cached []*gmail.SendAs
+	if !readJSON(fn, &cached) {
+		return nil, err
+	}
+	log.Infof("Offline. Using cached send-as aliases")
+	return cached, nil
+}
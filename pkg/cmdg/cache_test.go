@@ -0,0 +1,217 @@
+package cmdg
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	gmail "google.golang.org/api/gmail/v1"
+)
+
+// countingBackend counts message fetches that reach the real backend.
+type countingBackend struct {
+	Backend
+	gets int
+}
+
+func (b *countingBackend) GetMessage(ctx context.Context, id string, level DataLevel) (*gmail.Message, error) {
+	b.gets++
+	return b.Backend.GetMessage(ctx, id, level)
+}
+
+func TestDiskCache(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cmdg-cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mem := NewMemBackend("bob@example.com")
+	id, err := mem.AddMessage(testMultipartMessage, "", []string{Inbox, Unread})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cb := &countingBackend{Backend: mem}
+	c, err := NewDiskCache(cb, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.GetMessage(ctx, id, LevelFull); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Metadata is served from full.
+	if _, err := c.GetMessage(ctx, id, LevelMetadata); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cb.gets, 1; got != want {
+		t.Errorf("Got %d backend fetches, want %d", got, want)
+	}
+
+	// Change labels behind the cache's back, and start a new cache on the same dir.
+	if err := mem.BatchModify(ctx, []string{id}, nil, []string{Inbox}); err != nil {
+		t.Fatal(err)
+	}
+	c, err = NewDiskCache(cb, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	m, err := c.GetMessage(ctx, id, LevelFull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cb.gets, 1; got != want {
+		t.Errorf("Got %d backend fetches after restart, want %d", got, want)
+	}
+	if hasString(m.LabelIds, Inbox) {
+		t.Errorf("Cached message still has label %q: %v", Inbox, m.LabelIds)
+	}
+	if !hasString(m.LabelIds, Unread) {
+		t.Errorf("Cached message lost label %q: %v", Unread, m.LabelIds)
+	}
+
+	// Deletions evict.
+	if err := mem.BatchDelete(ctx, []string{id}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if m := c.get(id, string(LevelFull)); m != nil {
+		t.Errorf("Deleted message still in cache")
+	}
+}
+
+// racingBackend runs a function after fetching a message, but before
+// returning it.
+type racingBackend struct {
+	Backend
+	after func()
+}
+
+func (b *racingBackend) GetMessage(ctx context.Context, id string, level DataLevel) (*gmail.Message, error) {
+	m, err := b.Backend.GetMessage(ctx, id, level)
+	if f := b.after; f != nil {
+		b.after = nil
+		f()
+	}
+	return m, err
+}
+
+func TestDiskCacheStaleFetch(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cmdg-cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mem := NewMemBackend("bob@example.com")
+	id, err := mem.AddMessage(testMultipartMessage, "", []string{Inbox, Unread})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rb := &racingBackend{Backend: mem}
+	c, err := NewDiskCache(rb, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetMessage(ctx, id, LevelMetadata); err != nil {
+		t.Fatal(err)
+	}
+
+	// The message is read while the full version is being fetched.
+	rb.after = func() {
+		if err := mem.BatchModify(ctx, []string{id}, nil, []string{Unread}); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Sync(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m, err := c.GetMessage(ctx, id, LevelFull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []*gmail.Message{m, c.get(id, string(LevelFull)), c.get(id, string(LevelMetadata))} {
+		if hasString(m.LabelIds, Unread) {
+			t.Errorf("Stale label %q: %v", Unread, m.LabelIds)
+		}
+	}
+}
+
+func TestDiskCacheModifyThread(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cmdg-cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mem := NewMemBackend("bob@example.com")
+	first, err := mem.AddMessage(testMultipartMessage, "", []string{Inbox})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := mem.AddMessage(testMultipartMessage, first, []string{Inbox})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := mem.AddMessage(testMultipartMessage, "", []string{Inbox})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewWithBackend(mem)
+	if err := c.UseJournal(path.Join(dir, "journal.json")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.UseDiskCache(path.Join(dir, "cache")); err != nil {
+		t.Fatal(err)
+	}
+	dc := c.backend.(*DiskCache)
+	for _, id := range []string{first, second, other} {
+		if _, err := dc.GetMessage(ctx, id, LevelFull); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(what, label string, want bool) {
+		t.Helper()
+		for _, id := range []string{first, second} {
+			if got := hasString(dc.get(id, string(LevelFull)).LabelIds, label); got != want {
+				t.Errorf("%s: message %q has label %q: %v, want %v", what, id, label, got, want)
+			}
+		}
+		if !hasString(dc.get(other, string(LevelFull)).LabelIds, Inbox) || hasString(dc.get(other, string(LevelFull)).LabelIds, Starred) {
+			t.Errorf("%s: message in other thread changed", what)
+		}
+	}
+
+	if err := dc.ModifyThread(ctx, ThreadID(first), nil, []string{Inbox}); err != nil {
+		t.Fatal(err)
+	}
+	check("online", Inbox, false)
+
+	c.SetOffline(ctx, true)
+	if err := dc.ModifyThread(ctx, ThreadID(first), []string{Starred}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, n := c.Offline(); n != 1 {
+		t.Errorf("Got %d queued, want 1", n)
+	}
+	check("offline", Starred, true)
+}
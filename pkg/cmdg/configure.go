@@ -2,16 +2,22 @@ package cmdg
 
 import (
 	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"html"
-	"io/ioutil"
+	"io"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
+	"regexp"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
@@ -33,20 +39,119 @@ var (
 )
 
 var (
-	// TODO: Listen to a dynamic port.
 	oauthListenPort = flag.Int("oauth_listen_port", 0, "Oauth port to listen to. 0 means pick dynamically.")
+	oauthTimeout    = flag.Duration("oauth_timeout", 5*time.Minute, "With -configure: how long to wait for the browser to be redirected back.")
+	oauthManual     = flag.Bool("oauth_manual", false, "With -configure: don't listen for the OAuth redirect, but ask for the URL the browser was redirected to. For configuring over SSH.")
+
+	// oauthEndpoint is where to get tokens. Changed by tests.
+	oauthEndpoint = oauth2.Endpoint{
+		AuthURL:  "https://accounts.google.com/o/oauth2/auth",
+		TokenURL: "https://accounts.google.com/o/oauth2/token",
+	}
 )
 
+// manualRedirectURL is where the browser is sent when -oauth_manual is
+// used. Nothing listens there, so the browser shows an error page and
+// the user copies the URL from the address bar.
+const manualRedirectURL = "http://localhost:1/"
+
 // ConfigOAuth contains the config for the oauth.
 type ConfigOAuth struct {
 	ClientID, ClientSecret, RefreshToken, AccessToken, APIKey string
+	Expiry                                                    time.Time `json:",omitzero"`
+
+	// Secrets, if set, says where ClientSecret, RefreshToken, and
+	// AccessToken are stored instead of in this file.
+	Secrets *ConfigSecrets `json:",omitempty"`
+}
+
+// configured returns true if the account has been configured.
+func (o *ConfigOAuth) configured() bool {
+	return o.RefreshToken != "" || o.Secrets != nil
+}
+
+// secrets returns the secrets stored in the config.
+func (o *ConfigOAuth) secrets() *Secrets {
+	return &Secrets{
+		ClientSecret: o.ClientSecret,
+		RefreshToken: o.RefreshToken,
+		AccessToken:  o.AccessToken,
+		Expiry:       o.Expiry,
+	}
+}
+
+// setSecrets sets the secrets stored in the config.
+func (o *ConfigOAuth) setSecrets(s *Secrets) {
+	o.ClientSecret = s.ClientSecret
+	o.RefreshToken = s.RefreshToken
+	o.AccessToken = s.AccessToken
+	o.Expiry = s.Expiry
 }
 
 // Config is… hmm… this should probably be cleand up.
 type Config struct {
+	// OAuth is the default account.
+	OAuth ConfigOAuth
+
+	// Accounts are any other named accounts.
+	Accounts []ConfigAccount `json:",omitempty"`
+}
+
+// ConfigAccount is a named account.
+type ConfigAccount struct {
+	Name  string
 	OAuth ConfigOAuth
 }
 
+// DefaultAccount is the name of the account in Config.OAuth.
+const DefaultAccount = "default"
+
+var accountNameRE = regexp.MustCompile(`^[A-Za-z0-9_@+-][A-Za-z0-9._@+-]*$`)
+
+// account returns the OAuth config for an account.
+func (c *Config) account(name string) (ConfigOAuth, bool) {
+	if name == "" || name == DefaultAccount {
+		return c.OAuth, c.OAuth.configured()
+	}
+	for _, a := range c.Accounts {
+		if a.Name == name {
+			return a.OAuth, true
+		}
+	}
+	return ConfigOAuth{}, false
+}
+
+// setAccount adds or replaces the OAuth config for an account.
+func (c *Config) setAccount(name string, o ConfigOAuth) {
+	if name == "" || name == DefaultAccount {
+		c.OAuth = o
+		return
+	}
+	for n := range c.Accounts {
+		if c.Accounts[n].Name == name {
+			c.Accounts[n].OAuth = o
+			return
+		}
+	}
+	c.Accounts = append(c.Accounts, ConfigAccount{Name: name, OAuth: o})
+}
+
+// AccountNames returns the names of all configured accounts, default first.
+func AccountNames(fn string) ([]string, error) {
+	conf, err := readConf(fn)
+	if err != nil {
+		return nil, err
+	}
+	var ret []string
+	if conf.OAuth.configured() {
+		ret = append(ret, DefaultAccount)
+	}
+	for _, a := range conf.Accounts {
+		ret = append(ret, a.Name)
+	}
+	return ret, nil
+}
+
 func readLine(s string) (string, error) {
 	reader := bufio.NewReader(os.Stdin)
 	fmt.Print(s)
@@ -58,61 +163,182 @@ func readLine(s string) (string, error) {
 	return id, nil
 }
 
-func auth(cfg ConfigOAuth) (string, error) {
-	at := oauth2.AccessTypeOffline
-	if accessType == "online" {
-		at = oauth2.AccessTypeOnline
+// oauthConfig returns the oauth2 config for an account.
+func oauthConfig(cfg ConfigOAuth, redirect string) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     cfg.ClientID,
+		ClientSecret: cfg.ClientSecret,
+		Endpoint:     oauthEndpoint,
+		Scopes:       []string{scope},
+		RedirectURL:  redirect,
 	}
+}
 
-	//
-	// Start a webserver.
-	//
-	ln, err := net.Listen("tcp", ":0")
+// parseAuthCode gets the code out of what the user pasted, which is
+// either the URL the browser was redirected to, or just the code. A
+// pasted URL must have the expected state.
+func parseAuthCode(s, state string) (string, error) {
+	s = strings.Trim(s, spaces)
+	if s == "" {
+		return "", fmt.Errorf("nothing pasted")
+	}
+	if !strings.Contains(s, "://") && !strings.HasPrefix(s, "/") && !strings.HasPrefix(s, "?") {
+		return s, nil
+	}
+	u, err := url.Parse(s)
 	if err != nil {
-		log.Fatalf("Failed to listen to TCP port 0 (any): %v", err)
+		return "", errors.Wrapf(err, "parsing pasted URL")
 	}
-	port := ln.Addr().(*net.TCPAddr).Port
-	fmt.Printf("Listening to port %d\n", port)
+	return codeFromQuery(u.Query(), state)
+}
 
-	codeCh := make(chan string)
-	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		r.ParseForm()
-		codes := r.URL.Query()["code"]
-		if len(codes) == 0 {
-			fmt.Fprintf(w, "Did not get a code. Something's wrong.")
-			return
-		}
-		defer close(codeCh)
-		fmt.Fprintf(w, "Got code %q. You can close this tab now.", html.EscapeString(codes[0]))
-		codeCh <- codes[0]
-	}))
-	// No need to clean up. This is run in -configure and will soon exit.
+// codeFromQuery checks the state, and returns the code of an auth redirect.
+func codeFromQuery(q url.Values, state string) (string, error) {
+	if got := q.Get("state"); got != state {
+		return "", fmt.Errorf("wrong state %q in redirect, possible forgery", got)
+	}
+	if e := q.Get("error"); e != "" {
+		return "", fmt.Errorf("authorization failed: %s", e)
+	}
+	code := q.Get("code")
+	if code == "" {
+		return "", fmt.Errorf("no code in redirect")
+	}
+	return code, nil
+}
 
-	ocfg := oauth2.Config{
-		ClientID:     cfg.ClientID,
-		ClientSecret: cfg.ClientSecret,
-		Endpoint: oauth2.Endpoint{
-			AuthURL:  "https://accounts.google.com/o/oauth2/auth",
-			TokenURL: "https://accounts.google.com/o/oauth2/token",
-		},
-		Scopes:      []string{scope},
-		RedirectURL: fmt.Sprintf("http://localhost:%d/", port),
-	}
-	fmt.Printf("Cut and paste this URL into your browser:\n  %s\n", ocfg.AuthCodeURL("", at))
-	line := <-codeCh
-	fmt.Printf("Returned code: %s\n", line)
-	token, err := ocfg.Exchange(oauth2.NoContext, line)
-	if err != nil {
+// randomState returns a new random OAuth state parameter.
+func randomState() (string, error) {
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
 		return "", err
 	}
-	return token.RefreshToken, nil
+	return base64.RawURLEncoding.EncodeToString(b), nil
 }
 
-// Make a config, possibly by asking the user.
+// manualAuth asks the user to open the auth URL anywhere, and paste
+// back where the browser ended up.
+func manualAuth(ctx context.Context, ocfg *oauth2.Config, at oauth2.AuthCodeOption, in io.Reader, out io.Writer) (*oauth2.Token, error) {
+	state, err := randomState()
+	if err != nil {
+		return nil, err
+	}
+	verifier := oauth2.GenerateVerifier()
+	fmt.Fprintf(out, "Cut and paste this URL into a browser, on any machine:\n  %s\n", ocfg.AuthCodeURL(state, at, oauth2.S256ChallengeOption(verifier)))
+	fmt.Fprintf(out, "After allowing access the browser will fail to load a page on %s.\n", ocfg.RedirectURL)
+	fmt.Fprintf(out, "Paste that URL from the address bar (or just the code) here: ")
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && !(err == io.EOF && line != "") {
+		return nil, errors.Wrap(err, "reading pasted URL")
+	}
+	code, err := parseAuthCode(line, state)
+	if err != nil {
+		return nil, err
+	}
+	return ocfg.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+}
+
+// listenLoopback listens on the loopback interface only, IPv4 if possible.
+func listenLoopback(port int) (net.Listener, error) {
+	ln, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", fmt.Sprint(port)))
+	if err == nil {
+		return ln, nil
+	}
+	ln, err6 := net.Listen("tcp", net.JoinHostPort("::1", fmt.Sprint(port)))
+	if err6 != nil {
+		return nil, errors.Wrapf(err, "listening to loopback port %d", port)
+	}
+	return ln, nil
+}
+
+// loopbackAuth has the browser redirected back to a temporary web
+// server on the loopback interface. show is given the URL for the user
+// to open.
+func loopbackAuth(ctx context.Context, cfg ConfigOAuth, at oauth2.AuthCodeOption, port int, timeout time.Duration, show func(string)) (*oauth2.Token, error) {
+	ln, err := listenLoopback(port)
+	if err != nil {
+		return nil, err
+	}
+	state, err := randomState()
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	type result struct {
+		code string
+		err  error
+	}
+	resCh := make(chan result, 1)
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/" {
+				http.NotFound(w, r)
+				return
+			}
+			code, err := codeFromQuery(r.URL.Query(), state)
+			if err != nil {
+				log.Warningf("Bad OAuth redirect: %v", err)
+				http.Error(w, html.EscapeString(err.Error()), http.StatusBadRequest)
+				if r.URL.Query().Get("state") != state {
+					// Not from our auth URL. Keep waiting.
+					return
+				}
+			} else {
+				fmt.Fprintf(w, "Got code. You can close this tab now.")
+			}
+			select {
+			case resCh <- result{code: code, err: err}:
+			default:
+			}
+		}),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go srv.Serve(ln)
+	defer func() {
+		sctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(sctx); err != nil {
+			log.Warningf("Failed to shut down OAuth redirect server: %v", err)
+		}
+	}()
+
+	ocfg := oauthConfig(cfg, fmt.Sprintf("http://%s/", ln.Addr()))
+	show(ocfg.AuthCodeURL(state, at, oauth2.S256ChallengeOption(verifier)))
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var res result
+	select {
+	case res = <-resCh:
+	case <-ctx.Done():
+		return nil, errors.Wrap(ctx.Err(), "waiting for the browser to be redirected back")
+	}
+	if res.err != nil {
+		return nil, res.err
+	}
+	return ocfg.Exchange(ctx, res.code, oauth2.VerifierOption(verifier))
+}
+
+func auth(cfg ConfigOAuth) (*oauth2.Token, error) {
+	at := oauth2.AccessTypeOffline
+	if accessType == "online" {
+		at = oauth2.AccessTypeOnline
+	}
+	if *oauthManual {
+		return manualAuth(context.Background(), oauthConfig(cfg, manualRedirectURL), at, os.Stdin, os.Stdout)
+	}
+	return loopbackAuth(context.Background(), cfg, at, *oauthListenPort, *oauthTimeout, func(u string) {
+		fmt.Printf("Cut and paste this URL into your browser:\n  %s\n", u)
+	})
+}
+
+// Make an account config, possibly by asking the user.
 //
 // If there's a default client ID/secret, then scrub that before
-// returning the blob.
-func makeConfig(id, secret string) ([]byte, error) {
+// returning it.
+func makeConfig(id, secret string) (ConfigOAuth, error) {
 	var err error
 
 	// Use default, if available.
@@ -127,13 +353,13 @@ func makeConfig(id, secret string) ([]byte, error) {
 	if id == "" {
 		id, err = readLine("ClientID: ")
 		if err != nil {
-			return nil, err
+			return ConfigOAuth{}, err
 		}
 	}
 	if secret == "" {
 		secret, err = readLine("ClientSecret: ")
 		if err != nil {
-			return nil, err
+			return ConfigOAuth{}, err
 		}
 	}
 
@@ -142,42 +368,87 @@ func makeConfig(id, secret string) ([]byte, error) {
 		ClientSecret: secret,
 	})
 	if err != nil {
-		return nil, err
+		return ConfigOAuth{}, err
 	}
-	conf := &Config{
-		OAuth: ConfigOAuth{
-			ClientID:     id,
-			ClientSecret: secret,
-			RefreshToken: token,
-		},
+	conf := ConfigOAuth{
+		ClientID:     id,
+		ClientSecret: secret,
+		RefreshToken: token.RefreshToken,
+		AccessToken:  token.AccessToken,
+		Expiry:       token.Expiry,
 	}
 	// Don't store default ID/secret.
 	if id == DefaultClientID {
-		conf.OAuth.ClientID = "";
-		conf.OAuth.ClientSecret = "";
+		conf.ClientID = "";
+		conf.ClientSecret = "";
 	}
-	b, err := json.Marshal(conf)
-	if err != nil {
-		return nil, err
-	}
-	return b, nil
+	return conf, nil
 }
 
-// Configure sets up configuration with oauth and stuff.
-func Configure(fn string) error {
+// Configure sets up configuration with oauth and stuff, for the
+// named account. Other accounts in the config are kept.
+func Configure(fn, account string) error {
+	if account != "" && !accountNameRE.MatchString(account) {
+		return fmt.Errorf("invalid account name %q", account)
+	}
 	conf, err := readConf(fn)
 	if err != nil {
 		log.Infof("Failed to read config %q: %v", fn, err)
-	} else {
+	}
+	old, found := conf.account(account)
+	if !found {
+		// New account. Reuse client ID/secret of default account.
+		old = conf.OAuth
+	}
+	if old.ClientID != "" {
 		log.Infof("Reusing ClientID/ClientSecret from %q", fn)
 		log.Infof("If you want to change ClientID/Secret then delete %q", fn)
 	}
-	b, err := makeConfig(conf.OAuth.ClientID, conf.OAuth.ClientSecret)
+	oc, err := makeConfig(old.ClientID, old.ClientSecret)
+	if err != nil {
+		return err
+	}
+	if sc := configSecretFlags(); sc != nil {
+		oc.Secrets = sc
+		store, err := newSecretStore(fn, account, &oc)
+		if err != nil {
+			return err
+		}
+		if sc.Command != "" && sc.StoreCommand == "" {
+			b, err := json.Marshal(oc.secrets())
+			if err != nil {
+				return err
+			}
+			fmt.Printf("No -secret_store_command. Store this where %q can print it:\n%s\n", sc.Command, b)
+		} else if err := store.Put(oc.secrets()); err != nil {
+			return errors.Wrap(err, "storing secrets")
+		}
+		oc.setSecrets(&Secrets{})
+	}
+	confM.Lock()
+	defer confM.Unlock()
+	unlock, err := lockFile(fn)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	// Other accounts may have changed while configuring, e.g. a
+	// refreshed token saved by another cmdg.
+	if c, err := readConf(fn); err == nil {
+		conf = c
+	}
+	conf.setAccount(account, oc)
+	return writeConf(fn, &conf)
+}
+
+// writeConf writes the config file.
+func writeConf(fn string, conf *Config) error {
+	b, err := json.Marshal(conf)
 	if err != nil {
 		return err
 	}
 	if err := os.MkdirAll(path.Dir(fn), 0700); err != nil {
 		return errors.Wrapf(err, "creating config directory %q", path.Dir(fn))
 	}
-	return ioutil.WriteFile(fn, b, 0600)
+	return writeFileAtomic(fn, b)
 }
@@ -0,0 +1,296 @@
+package cmdg
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+)
+
+func TestConfigAccounts(t *testing.T) {
+	var conf Config
+	conf.setAccount(DefaultAccount, ConfigOAuth{RefreshToken: "default-token"})
+	conf.setAccount("work", ConfigOAuth{RefreshToken: "work-token"})
+	conf.setAccount("home", ConfigOAuth{RefreshToken: "home-token"})
+	conf.setAccount("work", ConfigOAuth{RefreshToken: "new-work-token"})
+
+	for _, test := range []struct {
+		name  string
+		token string
+		found bool
+	}{
+		{"", "default-token", true},
+		{DefaultAccount, "default-token", true},
+		{"work", "new-work-token", true},
+		{"home", "home-token", true},
+		{"other", "", false},
+	} {
+		oc, found := conf.account(test.name)
+		if found != test.found || oc.RefreshToken != test.token {
+			t.Errorf("account(%q) = %q/%v, want %q/%v", test.name, oc.RefreshToken, found, test.token, test.found)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "cmdg-config-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "cmdg.conf")
+	b, err := json.Marshal(&conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fn, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	names, err := AccountNames(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := names, []string{DefaultAccount, "work", "home"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Got account names %q, want %q", got, want)
+	}
+
+	// Old style config, with just the one account.
+	if err := ioutil.WriteFile(fn, []byte(`{"OAuth":{"RefreshToken":"x"}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	names, err = AccountNames(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := names, []string{DefaultAccount}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Got account names %q, want %q", got, want)
+	}
+}
+
+func TestParseAuthCode(t *testing.T) {
+	for _, test := range []struct {
+		in, want string
+		err      bool
+	}{
+		{"4/abc-def\n", "4/abc-def", false},
+		{"http://localhost:1/?state=st&code=4/abc-def&scope=x", "4/abc-def", false},
+		{"  http://localhost:1/?state=st&code=4%2Fabc\r\n", "4/abc", false},
+		{"/?code=xyz&state=st", "xyz", false},
+		{"http://localhost:1/?code=xyz&state=other", "", true},
+		{"http://localhost:1/?code=xyz", "", true},
+		{"http://localhost:1/?state=st&error=access_denied", "", true},
+		{"http://localhost:1/?state=st", "", true},
+		{"\n", "", true},
+	} {
+		got, err := parseAuthCode(test.in, "st")
+		if (err != nil) != test.err {
+			t.Errorf("parseAuthCode(%q) error %v, want error %v", test.in, err, test.err)
+		}
+		if got != test.want {
+			t.Errorf("parseAuthCode(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+// fakeAuthServer is an OAuth authorization server that redirects
+// straight back with a code, and checks PKCE on exchange.
+type fakeAuthServer struct {
+	t   *testing.T
+	srv *httptest.Server
+
+	m           sync.Mutex
+	challenge   string
+	redirectURI string
+}
+
+func newFakeAuthServer(t *testing.T) *fakeAuthServer {
+	f := &fakeAuthServer{t: t}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/auth", f.auth)
+	mux.HandleFunc("/token", f.token)
+	f.srv = httptest.NewServer(mux)
+	return f
+}
+
+func (f *fakeAuthServer) endpoint() oauth2.Endpoint {
+	return oauth2.Endpoint{
+		AuthURL:  f.srv.URL + "/auth",
+		TokenURL: f.srv.URL + "/token",
+	}
+}
+
+func (f *fakeAuthServer) auth(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if got, want := q.Get("code_challenge_method"), "S256"; got != want {
+		f.t.Errorf("Got code_challenge_method %q, want %q", got, want)
+	}
+	if q.Get("state") == "" {
+		f.t.Errorf("No state in auth request")
+	}
+	f.m.Lock()
+	f.challenge = q.Get("code_challenge")
+	f.redirectURI = q.Get("redirect_uri")
+	f.m.Unlock()
+	u, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil {
+		f.t.Errorf("Bad redirect_uri: %v", err)
+		return
+	}
+	u.RawQuery = url.Values{"code": {"the-code"}, "state": {q.Get("state")}}.Encode()
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+func (f *fakeAuthServer) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		f.t.Errorf("Parsing token request: %v", err)
+	}
+	f.m.Lock()
+	defer f.m.Unlock()
+	if got, want := r.Form.Get("code"), "the-code"; got != want {
+		f.t.Errorf("Got code %q, want %q", got, want)
+	}
+	if got, want := r.Form.Get("redirect_uri"), f.redirectURI; got != want {
+		f.t.Errorf("Got redirect_uri %q, want %q", got, want)
+	}
+	sum := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+	if got := base64.RawURLEncoding.EncodeToString(sum[:]); got != f.challenge {
+		f.t.Errorf("PKCE verifier doesn't match challenge %q", f.challenge)
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, `{"access_token":"access","refresh_token":"refresh","token_type":"Bearer","expires_in":3600}`)
+}
+
+// noRedirects is a browser that stops at the redirect back.
+var noRedirects = &http.Client{
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// lazyReader is stdin that is typed after reading stdout.
+type lazyReader struct {
+	f func() string
+	r io.Reader
+}
+
+func (l *lazyReader) Read(b []byte) (int, error) {
+	if l.r == nil {
+		l.r = strings.NewReader(l.f())
+	}
+	return l.r.Read(b)
+}
+
+func TestManualAuth(t *testing.T) {
+	fake := newFakeAuthServer(t)
+	defer fake.srv.Close()
+	defer func(e oauth2.Endpoint) { oauthEndpoint = e }(oauthEndpoint)
+	oauthEndpoint = fake.endpoint()
+
+	ocfg := oauthConfig(ConfigOAuth{ClientID: "id", ClientSecret: "secret"}, manualRedirectURL)
+	var out bytes.Buffer
+	in := &lazyReader{f: func() string {
+		var authURL string
+		for _, line := range strings.Split(out.String(), "\n") {
+			if strings.HasPrefix(line, "  "+fake.srv.URL+"/auth?") {
+				authURL = strings.TrimSpace(line)
+			}
+		}
+		if authURL == "" {
+			t.Fatalf("Auth URL not printed: %q", out.String())
+		}
+		resp, err := noRedirects.Get(authURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.Header.Get("Location") + "\n"
+	}}
+	token, err := manualAuth(context.Background(), ocfg, oauth2.AccessTypeOffline, in, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.AccessToken != "access" || token.RefreshToken != "refresh" || token.Expiry.IsZero() {
+		t.Errorf("Got token %+v", token)
+	}
+}
+
+func TestLoopbackAuth(t *testing.T) {
+	fake := newFakeAuthServer(t)
+	defer fake.srv.Close()
+	defer func(e oauth2.Endpoint) { oauthEndpoint = e }(oauthEndpoint)
+	oauthEndpoint = fake.endpoint()
+
+	var redirectURI string
+	token, err := loopbackAuth(context.Background(), ConfigOAuth{ClientID: "id"}, oauth2.AccessTypeOffline, 0, time.Minute, func(authURL string) {
+		u, err := url.Parse(authURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		redirectURI = u.Query().Get("redirect_uri")
+
+		// Forged redirects are rejected, and don't end the flow.
+		for _, q := range []string{"?code=evil", "?code=evil&state=wrong"} {
+			resp, err := http.Get(redirectURI + q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("Forged redirect %q got status %d", q, resp.StatusCode)
+			}
+		}
+		go func() {
+			resp, err := http.Get(authURL)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+		}()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.AccessToken != "access" || token.RefreshToken != "refresh" {
+		t.Errorf("Got token %+v", token)
+	}
+
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := net.ParseIP(u.Hostname()); ip == nil || !ip.IsLoopback() {
+		t.Errorf("Redirect URI %q is not loopback", redirectURI)
+	}
+	if _, err := http.Get(redirectURI); err == nil {
+		t.Errorf("Redirect server still running")
+	}
+}
+
+func TestLoopbackAuthTimeout(t *testing.T) {
+	_, err := loopbackAuth(context.Background(), ConfigOAuth{ClientID: "id"}, oauth2.AccessTypeOffline, 0, 50*time.Millisecond, func(string) {})
+	if err == nil {
+		t.Fatal("Did not time out")
+	}
+	if errors.Cause(err) != context.DeadlineExceeded {
+		t.Errorf("Got error %v, want deadline exceeded", err)
+	}
+}
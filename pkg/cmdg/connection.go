@@ -9,6 +9,7 @@ import (
 	"io/ioutil"
 	"mime"
 	"mime/multipart"
+	"mime/quotedprintable"
 	"net/http"
 	"net/mail"
 	"net/textproto"
@@ -22,7 +23,6 @@ import (
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/net/proxy"
 	"golang.org/x/oauth2"
-	drive "google.golang.org/api/drive/v3"
 	gmail "google.golang.org/api/gmail/v1"
 	"google.golang.org/api/googleapi/transport"
 	people "google.golang.org/api/people/v1"
@@ -77,17 +77,22 @@ type (
 	ThreadID string
 )
 
-// CmdG is the main app for cmdg. It holds both rpc clients and various caches. Everything except the UI.
+// CmdG is the main app for cmdg. It holds the backend and various caches. Everything except the UI.
 type CmdG struct {
 	m            sync.RWMutex
-	authedClient *http.Client
-	gmail        *gmail.Service
-	drive        *drive.Service
-	people       *people.Service
+	backend      Backend
+	journal      *Journal
 	messageCache map[string]*Message
 	labelCache   map[string]*Label
 	contacts     []string
 	settings     Settings
+	sendAs       []*gmail.SendAs
+
+	// Contact sync state. contactsM serializes syncs.
+	contactsM        sync.Mutex
+	people           map[string]*people.Person
+	contactSyncToken string
+	contactsFile     string
 }
 
 func userAgent() string {
@@ -118,10 +123,25 @@ func (c *CmdG) LabelCache(label *Label) *Label {
 
 // NewFake creates a fake client, used for testing.
 func NewFake(client *http.Client) (*CmdG, error) {
-	conn := &CmdG{
-		authedClient: client,
+	b, err := newGmailBackend(client)
+	if err != nil {
+		return nil, err
 	}
-	return conn, conn.setupClients()
+	return NewWithBackend(b), nil
+}
+
+// NewWithBackend creates a CmdG using the given backend instead of Gmail.
+func NewWithBackend(b Backend) *CmdG {
+	return &CmdG{
+		backend:      b,
+		messageCache: make(map[string]*Message),
+		labelCache:   make(map[string]*Label),
+	}
+}
+
+// Backend returns the backend used.
+func (c *CmdG) Backend() Backend {
+	return c.backend
 }
 
 func readConf(fn string) (Config, error) {
@@ -133,25 +153,42 @@ func readConf(fn string) (Config, error) {
 	if err := json.Unmarshal(f, &conf); err != nil {
 		return Config{}, errors.Wrapf(err, "unmarshalling config")
 	}
-	if conf.OAuth.ClientID == "" {
-		conf.OAuth.ClientID = DefaultClientID
-		conf.OAuth.ClientSecret = DefaultClientSecret
-	}
 	return conf, nil
 }
 
-// New creates a new CmdG.
+// New creates a new CmdG for the default account.
 func New(fn string) (*CmdG, error) {
-	conn := &CmdG{
-		messageCache: make(map[string]*Message),
-		labelCache:   make(map[string]*Label),
-	}
+	return NewAccount(fn, DefaultAccount)
+}
 
+// NewAccount creates a new CmdG for a named account.
+func NewAccount(fn, account string) (*CmdG, error) {
 	// Read config.
 	conf, err := readConf(fn)
 	if err != nil {
 		return nil, err
 	}
+	oc, found := conf.account(account)
+	if !found {
+		return nil, fmt.Errorf("account %q not configured in %q. Run with -configure -account %s", account, fn, account)
+	}
+	store, err := newSecretStore(fn, account, &oc)
+	if err != nil {
+		return nil, err
+	}
+	sec, err := store.Get()
+	if err != nil {
+		return nil, errors.Wrapf(err, "getting secrets for account %q", account)
+	}
+	oc.setSecrets(sec)
+	if oc.Expiry.IsZero() {
+		// Without expiry it would never be refreshed.
+		oc.AccessToken = ""
+	}
+	if oc.ClientID == "" {
+		oc.ClientID = DefaultClientID
+		oc.ClientSecret = DefaultClientSecret
+	}
 
 	var tp http.RoundTripper
 
@@ -173,79 +210,60 @@ func New(fn string) (*CmdG, error) {
 	}
 
 	// Attach APIkey, if any.
-	if conf.OAuth.APIKey != "" {
+	if oc.APIKey != "" {
 		newtp := &transport.APIKey{
-			Key:       conf.OAuth.APIKey,
+			Key:       oc.APIKey,
 			Transport: tp,
 		}
 		tp = newtp
 	}
 
+	// Count bytes for RPC stats.
+	tp = &countingTransport{base: tp}
+
 	// Set up google http.Client.
 	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{
 		Transport: tp,
 	})
 
 	// Connect.
+	var authedClient *http.Client
 	{
 		token := &oauth2.Token{
-			AccessToken:  conf.OAuth.AccessToken,
-			RefreshToken: conf.OAuth.RefreshToken,
+			AccessToken:  oc.AccessToken,
+			RefreshToken: oc.RefreshToken,
+			Expiry:       oc.Expiry,
 		}
 		cfg := oauth2.Config{
-			ClientID:     conf.OAuth.ClientID,
-			ClientSecret: conf.OAuth.ClientSecret,
-			Endpoint: oauth2.Endpoint{
-				AuthURL:  "https://accounts.google.com/o/oauth2/auth",
-				TokenURL: "https://accounts.google.com/o/oauth2/token",
-			},
-			Scopes: []string{scope},
+			ClientID:     oc.ClientID,
+			ClientSecret: oc.ClientSecret,
+			Endpoint:     oauthEndpoint,
+			Scopes:       []string{scope},
 
 			// TODO: This method doesn't work anymore, so
 			// why is this code still here?
 			//
 			// RedirectURL: oauthRedirectOffline,
 		}
-		conn.authedClient = cfg.Client(ctx, token)
-	}
-	return conn, conn.setupClients()
-}
-
-func (c *CmdG) setupClients() error {
-	// Set up gmail client.
-	{
-		var err error
-		c.gmail, err = gmail.New(c.authedClient)
-		if err != nil {
-			return errors.Wrap(err, "creating GMail client")
-		}
-		c.gmail.UserAgent = userAgent()
-	}
-
-	// Set up drive client.
-	{
-		var err error
-		c.drive, err = drive.New(c.authedClient)
-		if err != nil {
-			return errors.Wrap(err, "creating Drive client")
-		}
-		c.drive.UserAgent = userAgent()
+		authedClient = oauth2.NewClient(ctx, &persistingTokenSource{
+			src:   cfg.TokenSource(ctx, token),
+			store: store,
+			sec:   *sec,
+			last:  sec.AccessToken,
+		})
 	}
-	// Set up people client.
-	{
-		var err error
-		c.people, err = people.New(c.authedClient)
-		if err != nil {
-			return errors.Wrap(err, "creating People client")
-		}
-		c.drive.UserAgent = userAgent()
+	b, err := newGmailBackend(authedClient)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	return NewWithBackend(b), nil
 }
 
-func wrapLogRPC(fn string, cb func() error, af string, args ...interface{}) error {
+func wrapLogRPC(ctx context.Context, fn string, cb func(context.Context) error, af string, args ...interface{}) error {
 	st := time.Now()
-	err := cb()
+	ctx, b := withRPCBytes(ctx)
+	err := withRetry(ctx, fn, func() error { return cb(ctx) })
+	recordRPC(fn, st, b, err, af, args...)
 	logRPC(st, err, fmt.Sprintf("%s(%s)", fn, af), args...)
 	return err
 }
@@ -260,18 +278,14 @@ func logRPC(st time.Time, err error, s string, args ...interface{}) {
 func (c *CmdG) LoadLabels(ctx context.Context) error {
 	// Load initial labels.
 	st := time.Now()
-	var res *gmail.ListLabelsResponse
-	err := wrapLogRPC("gmail.Users.Labels.List", func() (err error) {
-		res, err = c.gmail.Users.Labels.List(email).Context(ctx).Do()
-		return
-	}, "email=%q", email)
+	labels, err := c.backend.ListLabels(ctx)
 	if err != nil {
 		return err
 	}
 	log.Infof("Loaded labels in %v", time.Since(st))
 	c.m.Lock()
 	defer c.m.Unlock()
-	for _, l := range res.Labels {
+	for _, l := range labels {
 		c.labelCache[l.Id] = &Label{
 			ID:       l.Id,
 			Label:    l.Name,
@@ -309,18 +323,16 @@ func (c *CmdG) Labels() []*Label {
 
 // GetProfile returns the profile for the current user.
 func (c *CmdG) GetProfile(ctx context.Context) (*gmail.Profile, error) {
-	var ret *gmail.Profile
-	err := wrapLogRPC("gmail.Users.GetProfile", func() (err error) {
-		ret, err = c.gmail.Users.GetProfile(email).Context(ctx).Do()
-		return
-	}, "email=%q", email)
-	return ret, err
+	return c.backend.GetProfile(ctx)
 }
 
 // Part is a part of a message. Contents and header.
 type Part struct {
 	Contents string
 	Header   textproto.MIMEHeader
+
+	// File, if set, is streamed from disk instead of using Contents.
+	File string
 }
 
 // FullString returns the "serialized" part.
@@ -352,38 +364,75 @@ func ParseUserMessage(in string) (mail.Header, *Part, error) {
 		return nil, nil, errors.Wrapf(err, "failed to read user message")
 	}
 	m.Header["MIME-Version"] = []string{"1.0"}
+	body, cte, err := encodeText(string(b))
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to encode user message")
+	}
 	return m.Header, &Part{
 		Header: map[string][]string{
-			"Content-Type":        []string{`text/plain; charset="UTF-8"`},
-			"Content-Disposition": []string{"inline"},
+			"Content-Type":              []string{`text/plain; charset="UTF-8"`},
+			"Content-Disposition":       []string{"inline"},
+			"Content-Transfer-Encoding": []string{cte},
 		},
-		Contents: string(b),
+		Contents: body,
 	}, nil
 }
 
-// SendParts sends a multipart message.
+// encodeText encodes a text part, and returns its Content-Transfer-Encoding.
+// ASCII with short enough lines is sent as is, anything else as
+// quoted-printable.
+func encodeText(s string) (string, string, error) {
+	plain := true
+	for _, l := range strings.Split(s, "\n") {
+		if len(l) > 998 {
+			plain = false
+		}
+	}
+	for i := 0; plain && i < len(s); i++ {
+		if s[i] >= 0x80 {
+			plain = false
+		}
+	}
+	if plain {
+		return s, "7bit", nil
+	}
+	var buf bytes.Buffer
+	w := quotedprintable.NewWriter(&buf)
+	if _, err := w.Write([]byte(s)); err != nil {
+		return "", "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", "", err
+	}
+	return buf.String(), "quoted-printable", nil
+}
+
+// SendParts sends a multipart message. Parts with a File are read
+// from disk while uploading.
 // Args:
 //   mp:    multipart type. "mixed" is a typical type.
 //   head:  Email header.
 //   parts: Email parts.
 func (c *CmdG) SendParts(ctx context.Context, threadID ThreadID, mp string, head mail.Header, parts []*Part) error {
-	var mbuf bytes.Buffer
-	w := multipart.NewWriter(&mbuf)
-
-	// Create mail contents.
-	for _, p := range parts {
-		p2, err := w.CreatePart(p.Header)
-		if err != nil {
-			return errors.Wrapf(err, "failed to create part")
-		}
-		if _, err := p2.Write([]byte(p.Contents)); err != nil {
-			return errors.Wrapf(err, "assembling part")
-		}
+	m, err := newPartsMessage(mp, head, parts)
+	if err != nil {
+		return err
 	}
-	if err := w.Close(); err != nil {
-		return errors.Wrapf(err, "closing multipart")
+	return c.send(ctx, threadID, m)
+}
+
+// MakeDraftParts creates a new draft from a multipart message, like SendParts.
+func (c *CmdG) MakeDraftParts(ctx context.Context, mp string, head mail.Header, parts []*Part) error {
+	m, err := newPartsMessage(mp, head, parts)
+	if err != nil {
+		return err
 	}
+	return c.backend.CreateDraft(ctx, m)
+}
 
+// newPartsMessage creates the message headers for a multipart message.
+func newPartsMessage(mp string, head mail.Header, parts []*Part) (*partsMessage, error) {
+	boundary := multipart.NewWriter(ioutil.Discard).Boundary()
 	addrHeader := map[string]bool{
 		"to":       true,
 		"cc":       true,
@@ -401,7 +450,7 @@ func (c *CmdG) SendParts(ctx context.Context, threadID ThreadID, mp string, head
 				}
 				as, err := mail.ParseAddressList(v)
 				if err != nil {
-					return errors.Wrapf(err, "parsing address list %q, which is %q", k, v)
+					return nil, errors.Wrapf(err, "parsing address list %q, which is %q", k, v)
 				}
 				var ass []string
 				for _, a := range as {
@@ -421,60 +470,37 @@ func (c *CmdG) SendParts(ctx context.Context, threadID ThreadID, mp string, head
 		}
 	}
 	sort.Strings(hlines)
-	hlines = append(hlines, fmt.Sprintf(`Content-Type: multipart/%s; boundary="%s"`, mp, w.Boundary()))
+	hlines = append(hlines, fmt.Sprintf(`Content-Type: multipart/%s; boundary="%s"`, mp, boundary))
 	hlines = append(hlines, `Content-Disposition: inline`)
-	msgs := strings.Join(hlines, "\r\n") + "\r\n\r\n" + mbuf.String()
-
-	log.Infof("Final message: %q", msgs)
-	return c.send(ctx, threadID, msgs)
+	m := &partsMessage{
+		head:     strings.Join(hlines, "\r\n") + "\r\n\r\n",
+		boundary: boundary,
+		parts:    parts,
+	}
+	log.Infof("Final message headers: %q, with %d parts", m.head, len(parts))
+	return m, nil
 }
 
-func (c *CmdG) send(ctx context.Context, threadID ThreadID, msg string) (err error) {
-	return wrapLogRPC("gmail.Users.Messages.Send", func() error {
-		_, err = c.gmail.Users.Messages.Send(email, &gmail.Message{
-			Raw:      MIMEEncode(msg),
-			ThreadId: string(threadID),
-		}).Context(ctx).Do()
-		return err
-	}, "email=%q threadID=%q msg=%q", email, threadID, msg)
+func (c *CmdG) send(ctx context.Context, threadID ThreadID, msg RawMessage) error {
+	return c.backend.Send(ctx, threadID, msg)
 }
 
 // PutFile uploads a file into the config dir on Google drive.
 func (c *CmdG) PutFile(ctx context.Context, fn string, contents []byte) error {
-	const name = "signature.txt"
-	const folder = appDataFolder
-	err := wrapLogRPC("drive.Files.Create", func() error {
-		_, err := c.drive.Files.Create(&drive.File{
-			Name:    name,
-			Parents: []string{folder},
-		}).Context(ctx).Media(bytes.NewBuffer(contents)).Do()
-		return err
-	}, "name=%q parents=%s", name, folder)
-	if err != nil {
+	if err := c.backend.CreateFile(ctx, fn, contents); err != nil {
 		return errors.Wrapf(err, "creating file %q with %d bytes of data", fn, len(contents))
 	}
 	return nil
 }
 
 func (c *CmdG) getFileID(ctx context.Context, fn string) (string, error) {
-	var token string
-	for {
-		var l *drive.FileList
-		err := wrapLogRPC("drive.Files.List", func() (err error) {
-			l, err = c.drive.Files.List().Context(ctx).Spaces(appDataFolder).PageToken(token).Do()
-			return
-		}, "folder=%q token=%q", appDataFolder, token)
-		if err != nil {
-			return "", err
-		}
-		for _, f := range l.Files {
-			if f.Name == fn {
-				return f.Id, nil
-			}
-		}
-		token = l.NextPageToken
-		if token == "" {
-			break
+	fs, err := c.backend.ListFiles(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, f := range fs {
+		if f.Name == fn {
+			return f.Id, nil
 		}
 	}
 	return "", os.ErrNotExist
@@ -485,13 +511,7 @@ func (c *CmdG) UpdateFile(ctx context.Context, fn string, contents []byte) error
 	id, err := c.getFileID(ctx, fn)
 	if err != nil {
 		if err == os.ErrNotExist {
-			if err := wrapLogRPC("drive.Files.Create", func() error {
-				_, err := c.drive.Files.Create(&drive.File{
-					Name:    fn,
-					Parents: []string{appDataFolder},
-				}).Context(ctx).Media(bytes.NewBuffer(contents)).Do()
-				return err
-			}, "name=%q parent=%q", fn, appDataFolder); err != nil {
+			if err := c.backend.CreateFile(ctx, fn, contents); err != nil {
 				return errors.Wrapf(err, "creating file %q with %d bytes of data", fn, len(contents))
 			}
 			return nil
@@ -499,12 +519,7 @@ func (c *CmdG) UpdateFile(ctx context.Context, fn string, contents []byte) error
 		return errors.Wrapf(err, "getting file ID for %q", fn)
 	}
 
-	if err := wrapLogRPC("drive.Files.Update", func() error {
-		_, err := c.drive.Files.Update(id, &drive.File{
-			Name: fn,
-		}).Context(ctx).Media(bytes.NewBuffer(contents)).Do()
-		return err
-	}, "name=%q", fn); err != nil {
+	if err := c.backend.UpdateFile(ctx, id, fn, contents); err != nil {
 		return errors.Wrapf(err, "updating file %q, id %q", fn, id)
 	}
 	return nil
@@ -512,37 +527,11 @@ func (c *CmdG) UpdateFile(ctx context.Context, fn string, contents []byte) error
 
 // GetFile downloads a file from the config folder.
 func (c *CmdG) GetFile(ctx context.Context, fn string) ([]byte, error) {
-	var token string
-	for {
-		var l *drive.FileList
-		err := wrapLogRPC("drive.Files.List", func() (err error) {
-			l, err = c.drive.Files.List().Context(ctx).Spaces(appDataFolder).PageToken(token).Do()
-			return
-		}, "spaces=%q token=%q", appDataFolder, token)
-		if err != nil {
-			return nil, err
-		}
-		for _, f := range l.Files {
-			if f.Name == fn {
-				var r *http.Response
-				err := wrapLogRPC("drive.Files.Get", func() (err error) {
-					r, err = c.drive.Files.Get(f.Id).Context(ctx).Download()
-					return
-				}, "fileID=%v", f.Id)
-				if err != nil {
-					return nil, err
-				}
-				defer r.Body.Close()
-				return ioutil.ReadAll(r.Body)
-			}
-		}
-		token = l.NextPageToken
-		if token == "" {
-			break
-		}
+	id, err := c.getFileID(ctx, fn)
+	if err != nil {
+		return nil, err
 	}
-
-	return nil, os.ErrNotExist
+	return c.backend.DownloadFile(ctx, id)
 }
 
 // Settings stores settings in the app specific folder on Google Drive.
@@ -584,24 +573,12 @@ func (c *CmdG) SaveSettings(ctx context.Context) error {
 
 // MakeDraft creates a new draft.
 func (c *CmdG) MakeDraft(ctx context.Context, msg string) error {
-	return wrapLogRPC("gmail.Users.Drafts.Create", func() error {
-		_, err := c.gmail.Users.Drafts.Create(email, &gmail.Draft{
-			Message: &gmail.Message{
-				Raw: MIMEEncode(msg),
-			},
-		}).Context(ctx).Do()
-		return err
-	}, "email=%q msg=%q", email, msg)
+	return c.backend.CreateDraft(ctx, StringMessage(msg))
 }
 
 // BatchArchive archives all the given message IDs.
 func (c *CmdG) BatchArchive(ctx context.Context, ids []string) error {
-	return wrapLogRPC("gmail.Users.Messages.BatchModify", func() error {
-		return c.gmail.Users.Messages.BatchModify(email, &gmail.BatchModifyMessagesRequest{
-			Ids:            ids,
-			RemoveLabelIds: []string{Inbox},
-		}).Context(ctx).Do()
-	}, "email=%q remove=INBOX ids=%v)", email, ids)
+	return c.backend.BatchModify(ctx, ids, nil, []string{Inbox})
 }
 
 // BatchDelete deletes. Does not put in trash. Does not pass go:
@@ -610,11 +587,7 @@ func (c *CmdG) BatchArchive(ctx context.Context, ids []string) error {
 // cmdg doesn't actually request oauth permission to do this, so this function is never used.
 // Instead BatchTrash is used.
 func (c *CmdG) BatchDelete(ctx context.Context, ids []string) error {
-	return wrapLogRPC("gmail.Users.Messages.BatchDelete", func() error {
-		return c.gmail.Users.Messages.BatchDelete(email, &gmail.BatchDeleteMessagesRequest{
-			Ids: ids,
-		}).Context(ctx).Do()
-	}, "email=%q ids=%v", email, ids)
+	return c.backend.BatchDelete(ctx, ids)
 }
 
 // BatchTrash trashes the messages.
@@ -626,31 +599,17 @@ func (c *CmdG) BatchTrash(ctx context.Context, ids []string) error {
 
 // BatchLabel adds one new label to many messages.
 func (c *CmdG) BatchLabel(ctx context.Context, ids []string, labelID string) error {
-	return wrapLogRPC("gmail.Users.Messages.BatchModify", func() error {
-		return c.gmail.Users.Messages.BatchModify(email, &gmail.BatchModifyMessagesRequest{
-			Ids:         ids,
-			AddLabelIds: []string{labelID},
-		}).Context(ctx).Do()
-	}, "email=%q add_labelID=%v ids=%v", email, labelID, ids)
+	return c.backend.BatchModify(ctx, ids, []string{labelID}, nil)
 }
 
 // BatchUnlabel removes one label from many messages.
-func (c *CmdG) BatchUnlabel(ctx context.Context, ids []string, labelID string) (err error) {
-	return wrapLogRPC("gmail.Users.Messages.BatchModify", func() error {
-		return c.gmail.Users.Messages.BatchModify(email, &gmail.BatchModifyMessagesRequest{
-			Ids:            ids,
-			RemoveLabelIds: []string{labelID},
-		}).Context(ctx).Do()
-	}, "email=%q remove_labelID=%v ids=%v", email, labelID, ids)
+func (c *CmdG) BatchUnlabel(ctx context.Context, ids []string, labelID string) error {
+	return c.backend.BatchModify(ctx, ids, nil, []string{labelID})
 }
 
 // HistoryID returns the current history ID.
 func (c *CmdG) HistoryID(ctx context.Context) (HistoryID, error) {
-	var p *gmail.Profile
-	err := wrapLogRPC("gmail.Users.GetProfile", func() (err error) {
-		p, err = c.gmail.Users.GetProfile(email).Context(ctx).Do()
-		return
-	}, "email=%q", email)
+	p, err := c.backend.GetProfile(ctx)
 	if err != nil {
 		return 0, err
 	}
@@ -659,58 +618,22 @@ func (c *CmdG) HistoryID(ctx context.Context) (HistoryID, error) {
 
 // MoreHistory returns if stuff happened since start ID.
 func (c *CmdG) MoreHistory(ctx context.Context, start HistoryID, labelID string) (bool, error) {
-	log.Infof("History for %d %s", start, labelID)
-	var r *gmail.ListHistoryResponse
-	err := wrapLogRPC("gmail.Users.History.List", func() (err error) {
-
-		r, err = c.gmail.Users.History.List(email).Context(ctx).StartHistoryId(uint64(start)).LabelId(labelID).Do()
-		return
-	}, "email=%q historyID=%v labelID=%q", email, start, labelID)
+	hs, _, err := c.History(ctx, start, labelID)
 	if err != nil {
 		return false, err
 	}
-	return len(r.History) > 0, nil
+	return len(hs) > 0, nil
 }
 
 // History returns history since startID (all pages).
 func (c *CmdG) History(ctx context.Context, startID HistoryID, labelID string) ([]*gmail.History, HistoryID, error) {
 	log.Infof("History for %d %s", startID, labelID)
-	var ret []*gmail.History
-	var h HistoryID
-	err := wrapLogRPC("gmail.Users.History.List", func() error {
-		return c.gmail.Users.History.List(email).Context(ctx).StartHistoryId(uint64(startID)).LabelId(labelID).Pages(ctx, func(r *gmail.ListHistoryResponse) error {
-			ret = append(ret, r.History...)
-			h = HistoryID(r.HistoryId)
-			return nil
-		})
-	}, "email=%q historyID=%v labelID=%q", email, startID, labelID)
-	if err != nil {
-		return nil, 0, err
-	}
-	return ret, h, nil
+	return c.backend.History(ctx, startID, labelID)
 }
 
 // ListMessages lists messages in a given label or query, with optional page token.
 func (c *CmdG) ListMessages(ctx context.Context, label, query, token string) (*Page, error) {
-	const fields = "messages,resultSizeEstimate,nextPageToken"
-	nres := int64(pageSize)
-
-	q := c.gmail.Users.Messages.List(email).
-		PageToken(token).
-		MaxResults(int64(nres)).
-		Context(ctx).
-		Fields(fields)
-	if query != "" {
-		q = q.Q(query)
-	}
-	if label != "" {
-		q = q.LabelIds(label)
-	}
-	var res *gmail.ListMessagesResponse
-	err := wrapLogRPC("gmail.Users.Messages.List", func() (err error) {
-		res, err = q.Do()
-		return
-	}, "email=%q token=%v labelID=%q query=%q size=%d fields=%q)", email, token, label, query, nres, fields)
+	res, err := c.backend.ListMessages(ctx, label, query, token, pageSize)
 	if err != nil {
 		return nil, errors.Wrap(err, "listing messages")
 	}
@@ -729,22 +652,19 @@ func (c *CmdG) ListMessages(ctx context.Context, label, query, token string) (*P
 
 // ListDrafts lists all drafts.
 func (c *CmdG) ListDrafts(ctx context.Context) ([]*Draft, error) {
+	ds, err := c.backend.ListDrafts(ctx)
+	if err != nil {
+		return nil, err
+	}
 	var ret []*Draft
-	if err := wrapLogRPC("gmail.Users.Drafts.List", func() error {
-		return c.gmail.Users.Drafts.List(email).Pages(ctx, func(r *gmail.ListDraftsResponse) error {
-			for _, d := range r.Drafts {
-				nd := NewDraft(c, d.Id)
-				ret = append(ret, nd)
-				go func() {
-					if err := nd.load(ctx, LevelMetadata); err != nil {
-						log.Errorf("Loading a draft: %v", err)
-					}
-				}()
+	for _, d := range ds {
+		nd := NewDraft(c, d.Id)
+		ret = append(ret, nd)
+		go func() {
+			if err := nd.load(ctx, LevelMetadata); err != nil {
+				log.Errorf("Loading a draft: %v", err)
 			}
-			return nil
-		})
-	}, "email=%q", email); err != nil {
-		return nil, err
+		}()
 	}
 	return ret, nil
 }
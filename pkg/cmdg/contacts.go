@@ -3,11 +3,14 @@ package cmdg
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"regexp"
 	"sort"
 	"strings"
 
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"google.golang.org/api/googleapi"
 	people "google.golang.org/api/people/v1"
 )
 
@@ -30,16 +33,106 @@ func (c *CmdG) Contacts() []string {
 	return append([]string{"me"}, c.contacts...)
 }
 
-// LoadContacts reads all contacts from the cloud.
+// contactsState is the contact cache file.
+type contactsState struct {
+	SyncToken string
+	People    []*people.Person
+}
+
+// UseContactsCache keeps contacts in a file, so that they're
+// available right away at startup, and only changes need to be
+// downloaded.
+func (c *CmdG) UseContactsCache(fn string) error {
+	c.contactsM.Lock()
+	defer c.contactsM.Unlock()
+	c.contactsFile = fn
+	var st contactsState
+	if !readJSON(fn, &st) {
+		return nil
+	}
+	ps := make(map[string]*people.Person)
+	for _, p := range st.People {
+		ps[p.ResourceName] = p
+	}
+	c.setPeople(ps, st.SyncToken)
+	log.Infof("Loaded %d contacts from cache", len(ps))
+	return nil
+}
+
+// syncTokenExpired returns true if the error means a full sync is needed.
+func syncTokenExpired(err error) bool {
+	e, ok := errors.Cause(err).(*googleapi.Error)
+	if !ok {
+		return false
+	}
+	if e.Code == http.StatusGone {
+		return true
+	}
+	// The People API says 400 FAILED_PRECONDITION, with the reason
+	// only in the details.
+	const reason = "EXPIRED_SYNC_TOKEN"
+	return e.Code == http.StatusBadRequest && (strings.Contains(e.Body, reason) || strings.Contains(fmt.Sprint(e.Details), reason))
+}
+
+// LoadContacts syncs contacts from the cloud. Only changes since the
+// last sync are downloaded.
 func (c *CmdG) LoadContacts(ctx context.Context) error {
-	co, err := c.GetContacts(ctx)
+	c.contactsM.Lock()
+	defer c.contactsM.Unlock()
+
+	c.m.RLock()
+	token := c.contactSyncToken
+	ps := make(map[string]*people.Person, len(c.people))
+	for k, v := range c.people {
+		ps[k] = v
+	}
+	c.m.RUnlock()
+
+	changes, next, err := c.backend.ListConnections(ctx, token)
+	if token != "" && syncTokenExpired(err) {
+		log.Infof("Contacts sync token expired, doing full sync")
+		token = ""
+		changes, next, err = c.backend.ListConnections(ctx, "")
+	}
 	if err != nil {
 		return err
 	}
+	if token == "" {
+		ps = make(map[string]*people.Person)
+	}
+	deleted := 0
+	for _, p := range changes {
+		if p.Metadata != nil && p.Metadata.Deleted {
+			delete(ps, p.ResourceName)
+			deleted++
+			continue
+		}
+		ps[p.ResourceName] = p
+	}
+	log.Infof("Got %d changed contacts (%d deleted, full=%v). Now %d contacts", len(changes), deleted, token == "", len(ps))
+	c.setPeople(ps, next)
+
+	if c.contactsFile != "" {
+		st := contactsState{SyncToken: next}
+		for _, p := range ps {
+			st.People = append(st.People, p)
+		}
+		writeJSON(c.contactsFile, &st)
+	}
+	return nil
+}
+
+func (c *CmdG) setPeople(ps map[string]*people.Person, token string) {
+	var list []*people.Person
+	for _, p := range ps {
+		list = append(list, p)
+	}
+	co := formatContacts(list)
 	c.m.Lock()
 	defer c.m.Unlock()
+	c.people = ps
+	c.contactSyncToken = token
 	c.contacts = co
-	return nil
 }
 
 func quoteNameIfNeeded(s string) string {
@@ -51,36 +144,39 @@ func quoteNameIfNeeded(s string) string {
 
 // GetContacts gets all contact's email addresses in "Name Name <email@example.com>" format.
 func (c *CmdG) GetContacts(ctx context.Context) ([]string, error) {
-	// TODO: get a sync token and only do incremental download.
+	ps, _, err := c.backend.ListConnections(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Got %d contacts", len(ps))
+	return formatContacts(ps), nil
+}
+
+// formatContacts turns contacts into a sorted list of addresses.
+func formatContacts(ps []*people.Person) []string {
 	var ret []string
-	if err := c.people.People.Connections.List("people/me").Context(ctx).PageSize(contactBatchSize).PersonFields("names,emailAddresses").Pages(ctx, func(r *people.ListConnectionsResponse) error {
-		log.Infof("Got batch of %d contacts, total %d", len(r.Connections), r.TotalItems)
-		for _, p := range r.Connections {
-			// Use name first listed.
-			var name string
-			if len(p.Names) > 0 {
-				name = p.Names[0].DisplayName
-			}
-			for _, e := range p.EmailAddresses {
-				if strings.Contains(e.Value, " ") {
-					// Name already there.
-					log.Warningf("Contact email address contains a space: %q", e.Value)
-					ret = append(ret, e.Value)
+	for _, p := range ps {
+		// Use name first listed.
+		var name string
+		if len(p.Names) > 0 {
+			name = p.Names[0].DisplayName
+		}
+		for _, e := range p.EmailAddresses {
+			if strings.Contains(e.Value, " ") {
+				// Name already there.
+				log.Warningf("Contact email address contains a space: %q", e.Value)
+				ret = append(ret, e.Value)
+			} else {
+				if len(name) > 0 {
+					ret = append(ret, fmt.Sprintf(`%s <%s>`, quoteNameIfNeeded(name), e.Value))
 				} else {
-					if len(name) > 0 {
-						ret = append(ret, fmt.Sprintf(`%s <%s>`, quoteNameIfNeeded(name), e.Value))
-					} else {
-						ret = append(ret, e.Value)
-					}
+					ret = append(ret, e.Value)
 				}
 			}
 		}
-		return nil
-	}); err != nil {
-		return nil, err
 	}
 	sort.Slice(ret, func(i, j int) bool {
 		return strings.TrimLeft(ret[i], `"`) < strings.TrimLeft(ret[j], `"`)
 	})
-	return ret, nil
+	return ret
 }
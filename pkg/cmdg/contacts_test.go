@@ -0,0 +1,121 @@
+package cmdg
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"google.golang.org/api/googleapi"
+	people "google.golang.org/api/people/v1"
+)
+
+// syncCountingBackend records the sync tokens contacts are listed with.
+type syncCountingBackend struct {
+	*MemBackend
+	tokens []string
+}
+
+func (b *syncCountingBackend) ListConnections(ctx context.Context, syncToken string) ([]*people.Person, string, error) {
+	b.tokens = append(b.tokens, syncToken)
+	return b.MemBackend.ListConnections(ctx, syncToken)
+}
+
+func TestContactsSync(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cmdg-contacts-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "contacts.json")
+
+	mem := NewMemBackend("me@example.com")
+	mem.AddContact("Alice", "alice@example.com")
+	mem.AddContact("Bob Smith", "bob@example.com")
+	b := &syncCountingBackend{MemBackend: mem}
+	c := NewWithBackend(b)
+	if err := c.UseContactsCache(fn); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.LoadContacts(ctx); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"me", "Alice <alice@example.com>", `"Bob Smith" <bob@example.com>`}
+	if got := c.Contacts(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Got contacts %q, want %q", got, want)
+	}
+
+	// Incremental.
+	mem.AddContact("Carol", "carol@example.com")
+	mem.DeleteContact("Alice")
+	if err := c.LoadContacts(ctx); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"me", `"Bob Smith" <bob@example.com>`, "Carol <carol@example.com>"}
+	if got := c.Contacts(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Got contacts %q after sync, want %q", got, want)
+	}
+	if got := b.tokens[1]; got == "" {
+		t.Errorf("Second sync was a full sync")
+	}
+
+	// Restart. Contacts are there before any sync, and the next
+	// sync is incremental.
+	b2 := &syncCountingBackend{MemBackend: mem}
+	c2 := NewWithBackend(b2)
+	if err := c2.UseContactsCache(fn); err != nil {
+		t.Fatal(err)
+	}
+	if got := c2.Contacts(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Got contacts %q from cache, want %q", got, want)
+	}
+	if err := c2.LoadContacts(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := b2.tokens; len(got) != 1 || got[0] == "" {
+		t.Errorf("Got sync tokens %q after restart, want one incremental", got)
+	}
+
+	// Expired token falls back to full sync.
+	c2.contactSyncToken = "999"
+	if err := c2.LoadContacts(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := b2.tokens[len(b2.tokens)-1]; got != "" {
+		t.Errorf("Expired token did not cause full sync, got token %q", got)
+	}
+	if got := c2.Contacts(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Got contacts %q after full sync, want %q", got, want)
+	}
+}
+
+func TestSyncTokenExpired(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"gone", &googleapi.Error{Code: http.StatusGone}, true},
+		{"body", &googleapi.Error{
+			Code: http.StatusBadRequest,
+			Body: `{"error": {"code": 400, "status": "FAILED_PRECONDITION", "details": [{"reason": "EXPIRED_SYNC_TOKEN"}]}}`,
+		}, true},
+		{"details", &googleapi.Error{
+			Code:    http.StatusBadRequest,
+			Details: []interface{}{map[string]interface{}{"reason": "EXPIRED_SYNC_TOKEN"}},
+		}, true},
+		{"other bad request", &googleapi.Error{Code: http.StatusBadRequest, Message: "Invalid personFields"}, false},
+		{"not googleapi", fmt.Errorf("EXPIRED_SYNC_TOKEN"), false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if got := syncTokenExpired(test.err); got != test.want {
+				t.Errorf("Got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,409 @@
+package cmdg
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// ExportFormat is the file format to export messages to.
+type ExportFormat string
+
+// Export formats.
+const (
+	// ExportMbox is an mboxrd file.
+	ExportMbox ExportFormat = "mbox"
+
+	// ExportMaildir is a Maildir directory.
+	ExportMaildir ExportFormat = "maildir"
+
+	// mboxStateSuffix is added to the mbox file name to get the
+	// file that says which messages have been exported.
+	mboxStateSuffix = ".cmdg-export"
+)
+
+var mboxFromRE = regexp.MustCompile(`(?m)^(>*From )`)
+
+// ExportProgress is how far an export has come.
+type ExportProgress struct {
+	Listed   int   // Messages listed so far.
+	Exported int   // Messages written by this run.
+	Skipped  int   // Messages already exported by an earlier run.
+	Estimate int64 // Gmail's guess of the total.
+}
+
+// exportMessage is a message to write.
+type exportMessage struct {
+	id      string
+	raw     string
+	from    string
+	time    time.Time
+	unread  bool
+	starred bool
+}
+
+// exportWriter writes messages to an export, and knows which have
+// already been written.
+type exportWriter interface {
+	has(id string) bool
+	write(m *exportMessage) error
+	close() error
+}
+
+// Export writes all messages in a label and/or matching a query to an
+// mbox file or Maildir. Messages exported by an earlier run to the same
+// destination are skipped, so an interrupted export can be resumed by
+// running it again.
+func (c *CmdG) Export(ctx context.Context, label, query string, format ExportFormat, dest string, progress func(ExportProgress)) (ExportProgress, error) {
+	var p ExportProgress
+	var w exportWriter
+	var err error
+	switch format {
+	case ExportMbox:
+		w, err = openMboxExport(dest)
+	case ExportMaildir:
+		w, err = openMaildirExport(dest)
+	default:
+		err = fmt.Errorf("unknown export format %q, want %q or %q", format, ExportMbox, ExportMaildir)
+	}
+	if err != nil {
+		return p, err
+	}
+	defer func() {
+		if err := w.close(); err != nil {
+			log.Errorf("Closing export %q: %v", dest, err)
+		}
+	}()
+	if progress == nil {
+		progress = func(ExportProgress) {}
+	}
+
+	token := ""
+	for {
+		page, err := c.ListMessages(ctx, label, query, token)
+		if err != nil {
+			return p, err
+		}
+		p.Listed += len(page.Messages)
+		p.Estimate = page.Response.ResultSizeEstimate
+		var todo []*Message
+		for _, m := range page.Messages {
+			if w.has(m.ID) {
+				p.Skipped++
+			} else {
+				todo = append(todo, m)
+			}
+		}
+		if len(todo) > 0 {
+			// For labels and dates.
+			if err := page.PreloadSubjects(ctx); err != nil {
+				return p, err
+			}
+		}
+		progress(p)
+		for _, m := range todo {
+			em, err := newExportMessage(ctx, m)
+			if err != nil {
+				return p, err
+			}
+			if err := w.write(em); err != nil {
+				return p, errors.Wrapf(err, "writing message %q to %q", m.ID, dest)
+			}
+			p.Exported++
+			progress(p)
+		}
+		token = page.Response.NextPageToken
+		if token == "" {
+			return p, nil
+		}
+	}
+}
+
+// newExportMessage loads what's needed to export a message.
+func newExportMessage(ctx context.Context, m *Message) (*exportMessage, error) {
+	if err := m.Preload(ctx, LevelMetadata); err != nil {
+		return nil, errors.Wrapf(err, "loading message %q", m.ID)
+	}
+	raw, err := m.Raw(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "getting raw message %q", m.ID)
+	}
+	em := &exportMessage{
+		id:      m.ID,
+		raw:     raw,
+		from:    "MAILER-DAEMON",
+		unread:  m.IsUnread(),
+		starred: m.HasLabel(Starred),
+	}
+	m.m.RLock()
+	if m.Response != nil && m.Response.InternalDate != 0 {
+		em.time = time.Unix(0, m.Response.InternalDate*int64(time.Millisecond))
+	}
+	m.m.RUnlock()
+	if em.time.IsZero() {
+		if t, err := m.GetOriginalTime(ctx); err == nil {
+			em.time = t
+		} else {
+			em.time = time.Now()
+		}
+	}
+	for _, h := range []string{"Return-Path", "From"} {
+		v, err := m.GetHeader(ctx, h)
+		if err != nil {
+			continue
+		}
+		if a, err := mail.ParseAddress(v); err == nil && a.Address != "" {
+			em.from = a.Address
+			break
+		}
+	}
+	return em, nil
+}
+
+// unixLines returns the message with LF line endings, ending with a newline.
+func unixLines(raw string) string {
+	s := strings.Replace(raw, "\r\n", "\n", -1)
+	if !strings.HasSuffix(s, "\n") {
+		s += "\n"
+	}
+	return s
+}
+
+// mboxExport writes an mboxrd file. Exported message IDs are saved in
+// a state file, with the size of the mbox after each message, so that a
+// partially written message can be cut off when resuming. The first
+// line has ID "-" and the size before the export started.
+type mboxExport struct {
+	f     *os.File
+	state *os.File
+	done  map[string]bool
+	size  int64
+}
+
+func openMboxExport(fn string) (*mboxExport, error) {
+	e := &mboxExport{done: make(map[string]bool)}
+	size := int64(-1)
+	if b, err := ioutil.ReadFile(fn + mboxStateSuffix); err == nil {
+		for n, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+			fs := strings.Fields(line)
+			if len(fs) == 0 {
+				continue
+			}
+			if len(fs) != 2 {
+				return nil, fmt.Errorf("%q line %d: bad state line %q", fn+mboxStateSuffix, n+1, line)
+			}
+			s, err := strconv.ParseInt(fs[1], 10, 64)
+			if err != nil {
+				return nil, errors.Wrapf(err, "%q line %d", fn+mboxStateSuffix, n+1)
+			}
+			if fs[0] != "-" {
+				e.done[fs[0]] = true
+			}
+			size = s
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	var err error
+	e.f, err = os.OpenFile(fn, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	st, err := e.f.Stat()
+	if err != nil {
+		e.f.Close()
+		return nil, err
+	}
+	e.size = st.Size()
+	if size >= 0 && size < e.size {
+		log.Infof("Cutting partially exported message from %q at %d bytes", fn, size)
+		if err := e.f.Truncate(size); err != nil {
+			e.f.Close()
+			return nil, err
+		}
+		e.size = size
+	}
+	if _, err := e.f.Seek(e.size, 0); err != nil {
+		e.f.Close()
+		return nil, err
+	}
+	e.state, err = os.OpenFile(fn+mboxStateSuffix, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		e.f.Close()
+		return nil, err
+	}
+	if size < 0 {
+		if err := e.saveState("-"); err != nil {
+			e.close()
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+func (e *mboxExport) has(id string) bool {
+	return e.done[id]
+}
+
+func (e *mboxExport) write(m *exportMessage) error {
+	w := bufio.NewWriter(e.f)
+	fmt.Fprintf(w, "From %s %s\n", m.from, m.time.UTC().Format(time.ANSIC))
+	// Status and X-Status are read by mutt and others.
+	if m.unread {
+		fmt.Fprintf(w, "Status: O\n")
+	} else {
+		fmt.Fprintf(w, "Status: RO\n")
+	}
+	if m.starred {
+		fmt.Fprintf(w, "X-Status: F\n")
+	}
+	w.WriteString(mboxFromRE.ReplaceAllString(unixLines(m.raw), ">$1"))
+	w.WriteString("\n")
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := e.f.Sync(); err != nil {
+		return err
+	}
+	st, err := e.f.Stat()
+	if err != nil {
+		return err
+	}
+	e.size = st.Size()
+	if err := e.saveState(m.id); err != nil {
+		return err
+	}
+	e.done[m.id] = true
+	return nil
+}
+
+// saveState adds a line to the state file.
+func (e *mboxExport) saveState(id string) error {
+	if _, err := fmt.Fprintf(e.state, "%s %d\n", id, e.size); err != nil {
+		return err
+	}
+	return e.state.Sync()
+}
+
+func (e *mboxExport) close() error {
+	err := e.f.Close()
+	if err2 := e.state.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// maildirExport writes a Maildir. The Gmail message ID is part of the
+// file name, so already exported messages are found by listing the
+// directory.
+type maildirExport struct {
+	dir  string
+	done map[string]bool
+	host string
+}
+
+func openMaildirExport(dir string) (*maildirExport, error) {
+	e := &maildirExport{dir: dir, done: make(map[string]bool)}
+	for _, d := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(path.Join(dir, d), 0700); err != nil {
+			return nil, err
+		}
+	}
+	for _, d := range []string{"new", "cur"} {
+		fis, err := ioutil.ReadDir(path.Join(dir, d))
+		if err != nil {
+			return nil, err
+		}
+		for _, fi := range fis {
+			if id := maildirMessageID(fi.Name()); id != "" {
+				e.done[id] = true
+			}
+		}
+	}
+	var err error
+	e.host, err = os.Hostname()
+	if err != nil {
+		e.host = "localhost"
+	}
+	// Maildir reserves these characters.
+	e.host = strings.NewReplacer("/", `\057`, ":", `\072`, ".", "_").Replace(e.host)
+	return e, nil
+}
+
+// maildirMessageID returns the Gmail message ID from an exported file
+// name, or empty if not exported by cmdg.
+func maildirMessageID(fn string) string {
+	fn = strings.SplitN(fn, ":", 2)[0]
+	parts := strings.Split(fn, ".")
+	if len(parts) != 4 || parts[2] != "cmdg" {
+		return ""
+	}
+	return parts[1]
+}
+
+// maildirFlags returns the info part of a file name.
+func maildirFlags(m *exportMessage) string {
+	var fs []string
+	if m.starred {
+		fs = append(fs, "F")
+	}
+	if !m.unread {
+		fs = append(fs, "S")
+	}
+	sort.Strings(fs)
+	return ":2," + strings.Join(fs, "")
+}
+
+func (e *maildirExport) has(id string) bool {
+	return e.done[id]
+}
+
+func (e *maildirExport) write(m *exportMessage) error {
+	base := fmt.Sprintf("%d.%s.cmdg.%s", m.time.Unix(), m.id, e.host)
+	tmp := path.Join(e.dir, "tmp", base)
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(unixLines(m.raw)); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Chtimes(tmp, m.time, m.time); err != nil {
+		log.Warningf("Setting time of %q: %v", tmp, err)
+	}
+	// Messages with flags go straight to cur.
+	if err := os.Rename(tmp, path.Join(e.dir, "cur", base+maildirFlags(m))); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	e.done[m.id] = true
+	return nil
+}
+
+func (e *maildirExport) close() error {
+	return nil
+}
@@ -0,0 +1,178 @@
+package cmdg
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func newExportTestBackend(t *testing.T) (*MemBackend, map[string]string) {
+	t.Helper()
+	b := NewMemBackend("me@example.com")
+	ids := make(map[string]string)
+	for _, m := range []struct {
+		name   string
+		raw    string
+		labels []string
+	}{
+		{"read", "From: Alice <alice@example.com>\r\nDate: Mon, 2 Jan 2006 15:04:05 +0000\r\nSubject: Read\r\n\r\nHello\r\nFrom the start\r\n>From quoted\r\n", []string{Inbox}},
+		{"unread", "From: bob@example.com\r\nSubject: Unread\r\n\r\nHi", []string{Inbox, Unread}},
+		{"starred", "From: carol@example.com\r\nSubject: Starred\r\n\r\nStar\r\n", []string{Inbox, Starred}},
+		{"other", "From: dave@example.com\r\nSubject: Elsewhere\r\n\r\nNot in inbox\r\n", nil},
+	} {
+		id, err := b.AddMessage(m.raw, "", m.labels)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[m.name] = id
+	}
+	return b, ids
+}
+
+func TestExportMbox(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cmdg-export-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "inbox.mbox")
+
+	b, _ := newExportTestBackend(t)
+	c := NewWithBackend(b)
+	var progress []ExportProgress
+	p, err := c.Export(ctx, Inbox, "", ExportMbox, fn, func(p ExportProgress) { progress = append(progress, p) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Exported != 3 || p.Skipped != 0 || p.Listed != 3 || p.Estimate != 3 {
+		t.Errorf("Got progress %+v", p)
+	}
+	if len(progress) == 0 || progress[len(progress)-1] != p {
+		t.Errorf("Progress not reported, got %+v", progress)
+	}
+
+	bs, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := string(bs)
+	if got, want := strings.Count(s, "\nFrom ")+1, 3; !strings.HasPrefix(s, "From ") || got != want {
+		t.Errorf("Got %d messages, want %d:\n%s", got, want, s)
+	}
+	for _, want := range []string{
+		"From alice@example.com Mon Jan  2 15:04:05 2006\nStatus: RO\nFrom: Alice",
+		"\n>From the start\n>>From quoted\n",
+		"From bob@example.com ",
+		"Status: O\nFrom: bob@example.com\nSubject: Unread\n\nHi\n\n",
+		"Status: RO\nX-Status: F\nFrom: carol@example.com",
+	} {
+		if !strings.Contains(s, want) {
+			t.Errorf("mbox does not contain %q:\n%s", want, s)
+		}
+	}
+	if strings.Contains(s, "\r") || strings.Contains(s, "Elsewhere") {
+		t.Errorf("Bad mbox:\n%s", s)
+	}
+
+	// Half written message, and a new one.
+	f, err := os.OpenFile(fn, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString("From partial"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if _, err := b.AddMessage("From: erin@example.com\r\nSubject: New\r\n\r\nNew\r\n", "", []string{Inbox}); err != nil {
+		t.Fatal(err)
+	}
+	p, err = c.Export(ctx, Inbox, "", ExportMbox, fn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Exported != 1 || p.Skipped != 3 {
+		t.Errorf("Got progress %+v when resuming", p)
+	}
+	bs, err = ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2 := string(bs)
+	if !strings.HasPrefix(s2, s) || strings.Contains(s2, "partial") || !strings.HasSuffix(s2, "Subject: New\n\nNew\n\n") {
+		t.Errorf("Bad mbox after resume:\n%s", s2)
+	}
+}
+
+func TestExportMaildir(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cmdg-export-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	md := path.Join(dir, "Maildir")
+
+	b, ids := newExportTestBackend(t)
+	c := NewWithBackend(b)
+	p, err := c.Export(ctx, "", "example.com", ExportMaildir, md, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Exported != 4 {
+		t.Errorf("Got progress %+v", p)
+	}
+
+	fis, err := ioutil.ReadDir(path.Join(md, "cur"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	flags := make(map[string]string)
+	for _, fi := range fis {
+		id := maildirMessageID(fi.Name())
+		flags[id] = fi.Name()[strings.Index(fi.Name(), ":"):]
+		if id == ids["unread"] {
+			bs, err := ioutil.ReadFile(path.Join(md, "cur", fi.Name()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := string(bs), "From: bob@example.com\nSubject: Unread\n\nHi\n"; got != want {
+				t.Errorf("Got message %q, want %q", got, want)
+			}
+		}
+	}
+	for name, want := range map[string]string{
+		"read":    ":2,S",
+		"unread":  ":2,",
+		"starred": ":2,FS",
+		"other":   ":2,S",
+	} {
+		if got := flags[ids[name]]; got != want {
+			t.Errorf("%s: got flags %q, want %q", name, got, want)
+		}
+	}
+	for _, d := range []string{"new", "tmp"} {
+		if fis, err := ioutil.ReadDir(path.Join(md, d)); err != nil || len(fis) != 0 {
+			t.Errorf("%s: got %d files, err %v", d, len(fis), err)
+		}
+	}
+
+	// Resume.
+	p, err = c.Export(ctx, "", "example.com", ExportMaildir, md, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Exported != 0 || p.Skipped != 4 {
+		t.Errorf("Got progress %+v when resuming", p)
+	}
+	fis, err = ioutil.ReadDir(path.Join(md, "cur"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fis) != 4 {
+		t.Errorf("Got %d files after resume, want 4", len(fis))
+	}
+}
@@ -0,0 +1,296 @@
+package cmdg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	gmail "google.golang.org/api/gmail/v1"
+)
+
+// What in a message a new filter can match on.
+const (
+	FilterByFrom    = "from"
+	FilterByList    = "list"
+	FilterBySubject = "subject"
+)
+
+// FilterExport is a filter as exported to JSON. Labels are referred
+// to by name instead of ID, so that the file can be imported into
+// another account.
+type FilterExport struct {
+	Criteria *gmail.FilterCriteria `json:"criteria"`
+	Action   FilterExportAction    `json:"action"`
+}
+
+// FilterExportAction is the action part of FilterExport.
+type FilterExportAction struct {
+	AddLabels    []string `json:"addLabels,omitempty"`
+	RemoveLabels []string `json:"removeLabels,omitempty"`
+	Forward      string   `json:"forward,omitempty"`
+}
+
+// ListFilters lists the server side filters.
+func (c *CmdG) ListFilters(ctx context.Context) ([]*gmail.Filter, error) {
+	fs, err := c.backend.ListFilters(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "listing filters")
+	}
+	return fs, nil
+}
+
+// CreateFilter creates a server side filter.
+func (c *CmdG) CreateFilter(ctx context.Context, f *gmail.Filter) (*gmail.Filter, error) {
+	ret, err := c.backend.CreateFilter(ctx, f)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating filter")
+	}
+	log.Infof("Created filter %q: %s", ret.Id, c.DescribeFilter(ret))
+	return ret, nil
+}
+
+// DeleteFilter deletes a server side filter.
+func (c *CmdG) DeleteFilter(ctx context.Context, id string) error {
+	if err := c.backend.DeleteFilter(ctx, id); err != nil {
+		return errors.Wrapf(err, "deleting filter %q", id)
+	}
+	return nil
+}
+
+// labelName returns the name of a label ID, or the ID if unknown.
+func (c *CmdG) labelName(id string) string {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	if l, found := c.labelCache[id]; found {
+		return l.Label
+	}
+	return id
+}
+
+// DescribeCriteria returns the filter criteria as a Gmail search query.
+func DescribeCriteria(cr *gmail.FilterCriteria) string {
+	if cr == nil {
+		return ""
+	}
+	var s []string
+	add := func(op, v string) {
+		if v == "" {
+			return
+		}
+		if strings.ContainsAny(v, " \t") {
+			v = fmt.Sprintf("(%s)", v)
+		}
+		s = append(s, op+v)
+	}
+	add("from:", cr.From)
+	add("to:", cr.To)
+	add("subject:", cr.Subject)
+	if cr.Query != "" {
+		s = append(s, cr.Query)
+	}
+	if cr.NegatedQuery != "" {
+		s = append(s, fmt.Sprintf("-(%s)", cr.NegatedQuery))
+	}
+	if cr.HasAttachment {
+		s = append(s, "has:attachment")
+	}
+	if cr.Size != 0 {
+		op := "larger:"
+		if cr.SizeComparison == "smaller" {
+			op = "smaller:"
+		}
+		s = append(s, fmt.Sprintf("%s%d", op, cr.Size))
+	}
+	return strings.Join(s, " ")
+}
+
+// DescribeAction returns a human readable version of the filter action.
+func (c *CmdG) DescribeAction(a *gmail.FilterAction) string {
+	if a == nil {
+		return ""
+	}
+	var s []string
+	for _, l := range a.RemoveLabelIds {
+		switch l {
+		case Inbox:
+			s = append(s, "archive")
+		case Unread:
+			s = append(s, "mark read")
+		case "SPAM":
+			s = append(s, "never spam")
+		case "IMPORTANT":
+			s = append(s, "never important")
+		default:
+			s = append(s, fmt.Sprintf("unlabel %q", c.labelName(l)))
+		}
+	}
+	for _, l := range a.AddLabelIds {
+		switch l {
+		case Trash:
+			s = append(s, "delete")
+		case Starred:
+			s = append(s, "star")
+		case "IMPORTANT":
+			s = append(s, "mark important")
+		default:
+			s = append(s, fmt.Sprintf("label %q", c.labelName(l)))
+		}
+	}
+	if a.Forward != "" {
+		s = append(s, fmt.Sprintf("forward to %s", a.Forward))
+	}
+	return strings.Join(s, ", ")
+}
+
+// DescribeFilter returns a one line description of a filter.
+func (c *CmdG) DescribeFilter(f *gmail.Filter) string {
+	return fmt.Sprintf("%s → %s", DescribeCriteria(f.Criteria), c.DescribeAction(f.Action))
+}
+
+// FilterCriteriaFromMessage returns criteria matching messages like
+// this one, by sender, mailing list, or subject.
+func FilterCriteriaFromMessage(ctx context.Context, msg *Message, by string) (*gmail.FilterCriteria, error) {
+	switch by {
+	case FilterByFrom:
+		s, err := msg.GetHeader(ctx, "From")
+		if err != nil {
+			return nil, err
+		}
+		if a, err := mail.ParseAddress(s); err == nil {
+			s = a.Address
+		}
+		return &gmail.FilterCriteria{From: s}, nil
+	case FilterByList:
+		s, err := msg.GetHeader(ctx, "List-Id")
+		if err != nil {
+			return nil, err
+		}
+		// Format is `Description <list.id.example.com>`.
+		if n := strings.LastIndex(s, "<"); n >= 0 {
+			s = strings.TrimSuffix(s[n+1:], ">")
+		}
+		s = strings.TrimSpace(s)
+		if s == "" {
+			return nil, errors.Wrapf(ErrMissing, "empty List-Id in msg %q", msg.ID)
+		}
+		return &gmail.FilterCriteria{Query: "list:" + s}, nil
+	case FilterBySubject:
+		s, err := msg.GetSubject(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return &gmail.FilterCriteria{Subject: s}, nil
+	}
+	return nil, fmt.Errorf("unknown filter field %q", by)
+}
+
+// exportFilter turns a filter into its exported form.
+func (c *CmdG) exportFilter(f *gmail.Filter) *FilterExport {
+	e := &FilterExport{Criteria: f.Criteria}
+	if f.Action != nil {
+		for _, l := range f.Action.AddLabelIds {
+			e.Action.AddLabels = append(e.Action.AddLabels, c.labelName(l))
+		}
+		for _, l := range f.Action.RemoveLabelIds {
+			e.Action.RemoveLabels = append(e.Action.RemoveLabels, c.labelName(l))
+		}
+		e.Action.Forward = f.Action.Forward
+	}
+	return e
+}
+
+// ExportFilters writes all filters as JSON.
+func (c *CmdG) ExportFilters(ctx context.Context, w io.Writer) error {
+	fs, err := c.ListFilters(ctx)
+	if err != nil {
+		return err
+	}
+	es := []*FilterExport{}
+	for _, f := range fs {
+		es = append(es, c.exportFilter(f))
+	}
+	b, err := json.MarshalIndent(es, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "marshalling filters")
+	}
+	if _, err := w.Write(append(b, '\n')); err != nil {
+		return errors.Wrap(err, "writing filters")
+	}
+	return nil
+}
+
+// importLabels turns label names into IDs, creating missing labels.
+func (c *CmdG) importLabels(ctx context.Context, names []string) ([]string, error) {
+	var ret []string
+	for _, n := range names {
+		if l := c.LabelByName(n); l != nil {
+			ret = append(ret, l.ID)
+			continue
+		}
+		l, err := c.CreateLabel(ctx, n)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, l.ID)
+	}
+	return ret, nil
+}
+
+// ImportFilters creates filters from JSON written by ExportFilters.
+// Filters that already exist are skipped, and missing labels are
+// created. Returns the number of filters created.
+func (c *CmdG) ImportFilters(ctx context.Context, r io.Reader) (int, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return 0, errors.Wrap(err, "reading filters")
+	}
+	var es []*FilterExport
+	if err := json.Unmarshal(b, &es); err != nil {
+		return 0, errors.Wrap(err, "parsing filters")
+	}
+	existing, err := c.ListFilters(ctx)
+	if err != nil {
+		return 0, err
+	}
+	have := make(map[string]bool)
+	for _, f := range existing {
+		b, err := json.Marshal(c.exportFilter(f))
+		if err != nil {
+			return 0, err
+		}
+		have[string(b)] = true
+	}
+	created := 0
+	for n, e := range es {
+		b, err := json.Marshal(e)
+		if err != nil {
+			return created, err
+		}
+		if have[string(b)] {
+			log.Infof("Filter %d already exists, skipping", n)
+			continue
+		}
+		f := &gmail.Filter{
+			Criteria: e.Criteria,
+			Action:   &gmail.FilterAction{Forward: e.Action.Forward},
+		}
+		if f.Action.AddLabelIds, err = c.importLabels(ctx, e.Action.AddLabels); err != nil {
+			return created, errors.Wrapf(err, "filter %d", n)
+		}
+		if f.Action.RemoveLabelIds, err = c.importLabels(ctx, e.Action.RemoveLabels); err != nil {
+			return created, errors.Wrapf(err, "filter %d", n)
+		}
+		if _, err := c.CreateFilter(ctx, f); err != nil {
+			return created, errors.Wrapf(err, "filter %d", n)
+		}
+		have[string(b)] = true
+		created++
+	}
+	return created, nil
+}
@@ -0,0 +1,106 @@
+package cmdg
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	gmail "google.golang.org/api/gmail/v1"
+)
+
+func TestFilters(t *testing.T) {
+	ctx := context.Background()
+	b := NewMemBackend("me@example.com")
+	id, err := b.AddMessage("From: Alice <alice@example.com>\r\nList-Id: Go nuts <golang-nuts.googlegroups.com>\r\nSubject: Generics\r\n\r\nHello\r\n", "", []string{Inbox})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewWithBackend(b)
+	if err := c.LoadLabels(ctx); err != nil {
+		t.Fatal(err)
+	}
+	msg := NewMessage(c, id)
+
+	for _, test := range []struct {
+		by   string
+		want string
+	}{
+		{FilterByFrom, "from:alice@example.com"},
+		{FilterByList, "list:golang-nuts.googlegroups.com"},
+		{FilterBySubject, "subject:Generics"},
+	} {
+		cr, err := FilterCriteriaFromMessage(ctx, msg, test.by)
+		if err != nil {
+			t.Fatalf("%s: %v", test.by, err)
+		}
+		if got := DescribeCriteria(cr); got != test.want {
+			t.Errorf("%s: got criteria %q, want %q", test.by, got, test.want)
+		}
+	}
+
+	l, err := c.CreateLabel(ctx, "Lists/Go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cr, err := FilterCriteriaFromMessage(ctx, msg, FilterByList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := c.CreateFilter(ctx, &gmail.Filter{
+		Criteria: cr,
+		Action: &gmail.FilterAction{
+			AddLabelIds:    []string{l.ID},
+			RemoveLabelIds: []string{Inbox},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c.DescribeFilter(f), `list:golang-nuts.googlegroups.com → archive, label "Lists/Go"`; got != want {
+		t.Errorf("Got description %q, want %q", got, want)
+	}
+
+	var buf bytes.Buffer
+	if err := c.ExportFilters(ctx, &buf); err != nil {
+		t.Fatal(err)
+	}
+	exported := buf.String()
+
+	// Import into the same account skips existing filter.
+	if n, err := c.ImportFilters(ctx, bytes.NewBufferString(exported)); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Errorf("Imported %d filters that already existed", n)
+	}
+
+	// Import into a new account creates labels.
+	b2 := NewMemBackend("me@example.com")
+	c2 := NewWithBackend(b2)
+	if err := c2.LoadLabels(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := c2.ImportFilters(ctx, bytes.NewBufferString(exported)); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Errorf("Imported %d filters, want 1", n)
+	}
+	if c2.LabelByName("Lists/Go") == nil {
+		t.Errorf("Import did not create label")
+	}
+	buf.Reset()
+	if err := c2.ExportFilters(ctx, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); got != exported {
+		t.Errorf("Got export after import\n%s\nwant\n%s", got, exported)
+	}
+
+	if err := c.DeleteFilter(ctx, f.Id); err != nil {
+		t.Fatal(err)
+	}
+	if fs, err := c.ListFilters(ctx); err != nil {
+		t.Fatal(err)
+	} else if len(fs) != 0 {
+		t.Errorf("Got %d filters after delete, want 0", len(fs))
+	}
+}
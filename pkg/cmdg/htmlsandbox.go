@@ -0,0 +1,257 @@
+package cmdg
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// HTMLSandboxNative runs the renderer in new namespaces without
+	// network access, without needing a setuid wrapper. It can still
+	// read and write the user's files.
+	HTMLSandboxNative = "native"
+
+	// htmlChildEnv marks a process started as the HTML renderer child.
+	htmlChildEnv = "CMDG_HTML_RENDER_CHILD"
+)
+
+var (
+	// HTMLSandbox is how HTML is isolated while rendering. Empty means
+	// the built-in renderer or Lynx runs in a child process with only
+	// CPU and memory limits. HTMLSandboxNative runs either in new
+	// namespaces. Anything else is the path to a setuid wrapper such
+	// as html-renderer/render.c, run with the arguments for lynx.
+	HTMLSandbox = ""
+
+	// HTMLInProcess runs the built-in renderer in this process,
+	// without CPU or memory limits, unless a sandbox or Lynx is
+	// set. Programs that don't start with the HTMLRenderChild check
+	// need this, since the child is the program itself.
+	HTMLInProcess = true
+
+	htmlTimeout   = flag.Duration("html_timeout", 10*time.Second, "Max time to spend rendering an HTML message.")
+	htmlCPULimit  = flag.Duration("html_cpu_limit", 5*time.Second, "Max CPU time for an HTML renderer process. Rounded up to whole seconds.")
+	htmlMemLimit  = flag.Int("html_memory_limit", 512, "Max heap memory for an HTML renderer process, in MiB.")
+	htmlMaxOutput = flag.Int("html_max_output", 1<<20, "Max bytes of rendered HTML to show.")
+
+	errHTMLTruncated = fmt.Errorf("output limit reached")
+)
+
+// htmlLimitWriter keeps at most max bytes, then cancels the render.
+type htmlLimitWriter struct {
+	m         sync.Mutex
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+	cancel    func()
+}
+
+func (w *htmlLimitWriter) Write(p []byte) (int, error) {
+	w.m.Lock()
+	defer w.m.Unlock()
+	if left := w.max - w.buf.Len(); len(p) > left {
+		w.buf.Write(p[:left])
+		w.truncated = true
+		w.cancel()
+		return left, errHTMLTruncated
+	}
+	return w.buf.Write(p)
+}
+
+func (w *htmlLimitWriter) result() (string, bool) {
+	w.m.Lock()
+	defer w.m.Unlock()
+	return w.buf.String(), w.truncated
+}
+
+// truncateHTMLOutput cuts s at -html_max_output, on a line boundary if possible.
+func truncateHTMLOutput(s string) (string, bool) {
+	if len(s) <= *htmlMaxOutput {
+		return s, false
+	}
+	s = s[:*htmlMaxOutput]
+	if n := strings.LastIndex(s, "\n"); n > 0 {
+		s = s[:n+1]
+	}
+	return s, true
+}
+
+// renderHTMLLimited renders HTML using the configured renderer and
+// sandbox, within -html_timeout. The bool is true if the output was
+// truncated.
+func renderHTMLLimited(ctx context.Context, s string, width int) (string, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, *htmlTimeout)
+	defer cancel()
+
+	if HTMLInProcess && HTMLSandbox == "" && Lynx == "" {
+		// The renderer gives up once the context is done, but
+		// parsing can't be interrupted. The UI doesn't have to wait
+		// for that.
+		type result struct {
+			out string
+			err error
+		}
+		ch := make(chan result, 1)
+		go func() {
+			out, err := renderHTML(ctx, s, width)
+			ch <- result{out, err}
+		}()
+		select {
+		case r := <-ch:
+			if r.err != nil {
+				return "", false, r.err
+			}
+			out, truncated := truncateHTMLOutput(r.out)
+			return out, truncated, nil
+		case <-ctx.Done():
+			return "", false, errors.Wrapf(ctx.Err(), "rendering HTML in-process")
+		}
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return "", false, errors.Wrapf(err, "finding own executable")
+	}
+	cpu := int((*htmlCPULimit + time.Second - 1) / time.Second)
+	args := []string{strconv.Itoa(cpu), strconv.Itoa(*htmlMemLimit), strconv.Itoa(width)}
+	cmd := exec.CommandContext(ctx, self)
+	switch HTMLSandbox {
+	case "", HTMLSandboxNative:
+		if HTMLSandbox == HTMLSandboxNative {
+			if cmd.SysProcAttr, err = htmlSandboxAttr(); err != nil {
+				return "", false, err
+			}
+		}
+		if Lynx != "" {
+			args = append(args, Lynx, "-dump", "-stdin")
+		}
+	default:
+		args = append(args, HTMLSandbox, "-dump", "-stdin")
+	}
+	cmd.Args = append(cmd.Args, args...)
+	cmd.Env = append(os.Environ(), htmlChildEnv+"=1")
+	cmd.Dir = "/"
+	cmd.Stdin = strings.NewReader(s)
+	stdout := &htmlLimitWriter{max: *htmlMaxOutput, cancel: cancel}
+	stderr := &htmlLimitWriter{max: 1000, cancel: func() {}}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Start(); err != nil {
+		return "", false, errors.Wrapf(err, "starting HTML renderer")
+	}
+
+	// A setuid wrapper may have changed user, so the renderer can't
+	// always be killed. Don't wait for it if so.
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	out, truncated := stdout.result()
+	if truncated {
+		return out, true, nil
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", false, errors.Errorf("HTML renderer timed out after %v", *htmlTimeout)
+	}
+	if err != nil {
+		if msg, _ := stderr.result(); msg != "" {
+			return "", false, errors.Wrapf(err, "HTML renderer failed (%s)", strings.TrimSpace(msg))
+		}
+		return "", false, errors.Wrapf(err, "HTML renderer failed")
+	}
+	return out, false, nil
+}
+
+// IsHTMLRenderChild returns true if this process was started to render HTML.
+func IsHTMLRenderChild() bool {
+	return os.Getenv(htmlChildEnv) != ""
+}
+
+// HTMLRenderChild is the main function of the HTML renderer child
+// process. It limits its own CPU time and memory, and then either
+// runs the command it was given, or renders stdin with the built-in
+// renderer.
+func HTMLRenderChild() int {
+	if err := htmlRenderChild(os.Args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func htmlRenderChild(args []string) error {
+	if len(args) < 3 {
+		return errors.Errorf("want at least 3 args, got %d", len(args))
+	}
+	cpu, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return errors.Wrapf(err, "parsing CPU limit %q", args[0])
+	}
+	mem, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return errors.Wrapf(err, "parsing memory limit %q", args[1])
+	}
+	width, err := strconv.Atoi(args[2])
+	if err != nil {
+		return errors.Wrapf(err, "parsing width %q", args[2])
+	}
+	// The soft limit sends SIGXCPU, and the hard limit SIGKILL a second later.
+	var lim unix.Rlimit
+	setRlimit(&lim.Cur, cpu)
+	setRlimit(&lim.Max, cpu+1)
+	if err := unix.Setrlimit(unix.RLIMIT_CPU, &lim); err != nil {
+		return errors.Wrapf(err, "setting CPU limit")
+	}
+	// Not RLIMIT_AS, since the Go runtime reserves more address space
+	// than that at startup. The data limit counts what's actually
+	// allocated.
+	setRlimit(&lim.Cur, mem<<20)
+	setRlimit(&lim.Max, mem<<20)
+	if err := unix.Setrlimit(unix.RLIMIT_DATA, &lim); err != nil {
+		return errors.Wrapf(err, "setting memory limit")
+	}
+	if len(args) > 3 {
+		bin, err := exec.LookPath(args[3])
+		if err != nil {
+			return err
+		}
+		var env []string
+		for _, e := range os.Environ() {
+			if !strings.HasPrefix(e, htmlChildEnv+"=") {
+				env = append(env, e)
+			}
+		}
+		return errors.Wrapf(syscall.Exec(bin, args[3:], env), "running %q", bin)
+	}
+	in, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return errors.Wrapf(err, "reading HTML")
+	}
+	out, err := RenderHTML(string(in), width)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.WriteString(out)
+	return err
+}
+
+// setRlimit sets an rlimit field, which is signed on some systems.
+func setRlimit[T ~int64 | ~uint64](p *T, v uint64) {
+	*p = T(v)
+}
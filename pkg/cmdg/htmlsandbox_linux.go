@@ -0,0 +1,29 @@
+package cmdg
+
+import (
+	"os"
+	"syscall"
+)
+
+// nobody is the user and group ID the native sandbox renders as,
+// inside its user namespace. Outside it maps back to the caller, so
+// file access is the same as the caller's.
+const nobody = 65534
+
+// htmlSandboxAttr puts the renderer in new namespaces, using a user
+// namespace instead of setuid. This cuts off the network and other
+// processes, but not the filesystem.
+func htmlSandboxAttr() (*syscall.SysProcAttr, error) {
+	return &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWUSER |
+			syscall.CLONE_NEWIPC |
+			syscall.CLONE_NEWNET |
+			syscall.CLONE_NEWNS |
+			syscall.CLONE_NEWPID |
+			syscall.CLONE_NEWUTS,
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: nobody, HostID: os.Getuid(), Size: 1}},
+		GidMappings: []syscall.SysProcIDMap{{ContainerID: nobody, HostID: os.Getgid(), Size: 1}},
+		Credential:  &syscall.Credential{Uid: nobody, Gid: nobody, NoSetGroups: true},
+		Pdeathsig:   syscall.SIGKILL,
+	}, nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package cmdg
+
+import (
+	"runtime"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+func htmlSandboxAttr() (*syscall.SysProcAttr, error) {
+	return nil, errors.Errorf("%q HTML sandbox not supported on %s", HTMLSandboxNative, runtime.GOOS)
+}
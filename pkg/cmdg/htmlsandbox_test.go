@@ -0,0 +1,179 @@
+package cmdg
+
+import (
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	gmail "google.golang.org/api/gmail/v1"
+)
+
+func TestMain(m *testing.M) {
+	// The sandboxed renderer runs the test binary as the child.
+	if IsHTMLRenderChild() {
+		os.Exit(HTMLRenderChild())
+	}
+	os.Exit(m.Run())
+}
+
+// setHTMLRenderer sets the renderer globals for one test.
+func setHTMLRenderer(t *testing.T, sandbox, lynx string) {
+	oldSandbox, oldLynx, oldInProcess := HTMLSandbox, Lynx, HTMLInProcess
+	oldTimeout, oldCPU, oldMem, oldMax := *htmlTimeout, *htmlCPULimit, *htmlMemLimit, *htmlMaxOutput
+	HTMLSandbox, Lynx = sandbox, lynx
+	t.Cleanup(func() {
+		HTMLSandbox, Lynx, HTMLInProcess = oldSandbox, oldLynx, oldInProcess
+		*htmlTimeout, *htmlCPULimit, *htmlMemLimit, *htmlMaxOutput = oldTimeout, oldCPU, oldMem, oldMax
+	})
+}
+
+// writeScript writes an executable shell script standing in for lynx
+// or a sandbox wrapper.
+func writeScript(t *testing.T, dir, body string) string {
+	fn := filepath.Join(dir, "render.sh")
+	if err := ioutil.WriteFile(fn, []byte("#!/bin/sh\n"+body+"\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	return fn
+}
+
+func TestRenderHTMLLimited(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cmdg-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const in = "<p>Hello <b>world</b></p>"
+	want, err := RenderHTML(in, 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name      string
+		in        string
+		child     bool
+		sandbox   string
+		lynx      string
+		script    string
+		timeout   time.Duration
+		cpu       time.Duration
+		mem       int
+		max       int
+		want      string
+		truncated bool
+		err       string
+	}{
+		{name: "in-process", want: want},
+		{name: "in-process timeout", timeout: time.Nanosecond, err: "deadline exceeded"},
+		{name: "child", child: true, want: want},
+		{name: "child memory", in: strings.Repeat("<p>Hello</p>", 1<<20), child: true, mem: 1, err: "HTML renderer failed"},
+		{name: "native", sandbox: HTMLSandboxNative, want: want},
+		{name: "native lynx", sandbox: HTMLSandboxNative, script: "echo \"$@\"", lynx: "script", want: "-dump -stdin\n"},
+		{name: "lynx", script: "tr a-z A-Z", lynx: "script", want: "<P>HELLO <B>WORLD</B></P>"},
+		{name: "wrapper", script: "echo \"$@\"; cat", sandbox: "script", want: "-dump -stdin\n" + in},
+		{name: "wrapper fails", script: "echo oops >&2; exit 1", sandbox: "script", err: "oops"},
+		{name: "missing wrapper", sandbox: "/nonexistent/render", err: "nonexistent"},
+		{name: "truncated", script: "yes", lynx: "script", max: 10, want: "y\ny\ny\ny\ny\n", truncated: true},
+		{name: "timeout", script: "exec sleep 60", lynx: "script", timeout: 200 * time.Millisecond, err: "timed out"},
+		{name: "cpu", script: "while :; do :; done", lynx: "script", cpu: time.Second, err: "CPU time limit"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			setHTMLRenderer(t, test.sandbox, test.lynx)
+			HTMLInProcess = !test.child
+			if test.script != "" {
+				fn := writeScript(t, dir, test.script)
+				if HTMLSandbox == "script" {
+					HTMLSandbox = fn
+				}
+				if Lynx == "script" {
+					Lynx = fn
+				}
+			}
+			if test.timeout != 0 {
+				*htmlTimeout = test.timeout
+			}
+			if test.cpu != 0 {
+				*htmlCPULimit = test.cpu
+			}
+			if test.mem != 0 {
+				*htmlMemLimit = test.mem
+			}
+			if test.max != 0 {
+				*htmlMaxOutput = test.max
+			}
+			input := in
+			if test.in != "" {
+				input = test.in
+			}
+			got, truncated, err := renderHTMLLimited(ctx, input, 80)
+			if test.sandbox == HTMLSandboxNative && err != nil && strings.Contains(err.Error(), "starting HTML renderer") {
+				t.Skipf("Namespaces not available: %v", err)
+			}
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Got error %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if truncated != test.truncated {
+				t.Errorf("Got truncated %v, want %v", truncated, test.truncated)
+			}
+			if test.truncated {
+				got = got[:strings.LastIndex(got, "\n")+1]
+			}
+			if got != test.want {
+				t.Errorf("Got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMakeBodyHTMLFallback(t *testing.T) {
+	ctx := context.Background()
+	setHTMLRenderer(t, "/nonexistent/render", "")
+
+	enc := func(s string) string { return base64.URLEncoding.EncodeToString([]byte(s)) }
+	html := &gmail.MessagePart{MimeType: "text/html", Body: &gmail.MessagePartBody{Data: enc("<p>html</p>")}}
+	plain := &gmail.MessagePart{MimeType: "text/plain", Body: &gmail.MessagePartBody{Data: enc("plain")}}
+	alt := &gmail.MessagePart{MimeType: "multipart/alternative", Parts: []*gmail.MessagePart{plain, html}}
+
+	for _, test := range []struct {
+		name       string
+		part       *gmail.MessagePart
+		preferHTML bool
+		want       string
+		notice     string
+	}{
+		{"single", html, false, "<p>html</p>", "Showing HTML source."},
+		{"alt prefer HTML", alt, true, "plain", "Showing other parts."},
+		{"alt prefer plain", alt, false, "plain", ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := makeBody(ctx, test.part, test.preferHTML)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasSuffix(got, test.want) {
+				t.Errorf("Got %q, want suffix %q", got, test.want)
+			}
+			if test.notice == "" {
+				if strings.Contains(got, "Rendering HTML failed") {
+					t.Errorf("Got unexpected notice in %q", got)
+				}
+			} else if !strings.Contains(got, "Rendering HTML failed") || !strings.Contains(got, test.notice) {
+				t.Errorf("Got %q, want notice %q", got, test.notice)
+			}
+		})
+	}
+}
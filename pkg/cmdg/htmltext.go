@@ -0,0 +1,681 @@
+package cmdg
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+
+	"github.com/ThomasHabets/cmdg/pkg/display"
+)
+
+const (
+	// defaultHTMLWidth is used if the terminal width is unknown.
+	defaultHTMLWidth = 80
+
+	// minHTMLWidth is the narrowest text gets wrapped to, no matter
+	// how deeply nested.
+	minHTMLWidth = 20
+
+	// tableColumnSpace is the space between data table columns.
+	tableColumnSpace = "  "
+)
+
+var (
+	// listMarkers are bullets for unordered lists, by nesting depth.
+	listMarkers = []string{"*", "+", "o", "-"}
+
+	// htmlBlocks are elements that start and end a block of text.
+	// The value is true if they also get a blank line around them.
+	htmlBlocks = map[atom.Atom]bool{
+		atom.Address:    false,
+		atom.Article:    false,
+		atom.Aside:      false,
+		atom.Blockquote: true,
+		atom.Center:     false,
+		atom.Dd:         false,
+		atom.Details:    false,
+		atom.Div:        false,
+		atom.Dl:         true,
+		atom.Dt:         false,
+		atom.Figcaption: false,
+		atom.Figure:     true,
+		atom.Footer:     false,
+		atom.Form:       false,
+		atom.H1:         true,
+		atom.H2:         true,
+		atom.H3:         true,
+		atom.H4:         true,
+		atom.H5:         true,
+		atom.H6:         true,
+		atom.Header:     false,
+		atom.Hr:         true,
+		atom.Li:         false,
+		atom.Main:       false,
+		atom.Nav:        false,
+		atom.Ol:         true,
+		atom.P:          true,
+		atom.Pre:        true,
+		atom.Section:    false,
+		atom.Summary:    false,
+		atom.Table:      true,
+		atom.Ul:         true,
+	}
+
+	// htmlSkip are elements whose contents are not shown.
+	htmlSkip = map[atom.Atom]bool{
+		atom.Head:     true,
+		atom.Script:   true,
+		atom.Style:    true,
+		atom.Template: true,
+		atom.Noscript: true,
+		atom.Title:    true,
+		atom.Select:   true,
+		atom.Object:   true,
+		atom.Iframe:   true,
+		atom.Svg:      true,
+	}
+)
+
+// htmlLinks are the links of a rendered document, numbered from 1.
+type htmlLinks struct {
+	urls  []string
+	index map[string]int
+}
+
+// add returns the number of the link, adding it if new.
+func (l *htmlLinks) add(u string) int {
+	if n, found := l.index[u]; found {
+		return n
+	}
+	l.urls = append(l.urls, u)
+	l.index[u] = len(l.urls)
+	return len(l.urls)
+}
+
+// htmlPrefix is indentation of lines, e.g. for quotes and lists.
+type htmlPrefix struct {
+	first string // For the first line, e.g. a list bullet.
+	rest  string
+	used  bool
+}
+
+// htmlRenderer renders HTML to text, like "lynx -dump".
+type htmlRenderer struct {
+	ctx       context.Context
+	width     int
+	links     *htmlLinks
+	lines     []string
+	buf       strings.Builder // Text of the current block.
+	space     bool            // Whitespace not yet written to buf.
+	blank     bool            // Want a blank line before the next line.
+	lastBlank bool
+	prefix    []*htmlPrefix
+	pre       int // Depth of <pre>.
+	lists     int // Depth of lists.
+}
+
+// htmlWidth is the width to render HTML to: the terminal width.
+func htmlWidth() int {
+	w, _, err := display.TermSize()
+	if err != nil || w <= 0 {
+		return defaultHTMLWidth
+	}
+	return w
+}
+
+// RenderHTML renders HTML as plain text wrapped to a width. Links
+// are shown as numbered references, listed at the end.
+func RenderHTML(s string, width int) (string, error) {
+	return renderHTML(context.Background(), s, width)
+}
+
+// renderHTML is RenderHTML, giving up once the context is done.
+func renderHTML(ctx context.Context, s string, width int) (string, error) {
+	doc, err := html.Parse(strings.NewReader(s))
+	if err != nil {
+		return "", err
+	}
+	if width < minHTMLWidth {
+		width = minHTMLWidth
+	}
+	r := &htmlRenderer{
+		ctx:   ctx,
+		width: width,
+		links: &htmlLinks{index: make(map[string]int)},
+	}
+	r.walk(doc)
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	lines := r.finish()
+	if len(r.links.urls) > 0 {
+		lines = append(lines, "", "References", "")
+		for n, u := range r.links.urls {
+			lines = append(lines, fmt.Sprintf("%4d. %s", n+1, u))
+		}
+	}
+	if len(lines) == 0 {
+		return "", nil
+	}
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+// finish ends the last block, and returns all lines without leading
+// or trailing blank lines.
+func (r *htmlRenderer) finish() []string {
+	r.flush()
+	lines := r.lines
+	for len(lines) > 0 && strings.TrimSpace(lines[0]) == "" {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// sub renders nodes on their own, e.g. table cells, sharing links.
+func (r *htmlRenderer) sub(n *html.Node, width int) []string {
+	s := &htmlRenderer{
+		ctx:   r.ctx,
+		width: width,
+		links: r.links,
+		lists: r.lists,
+	}
+	s.children(n)
+	return s.finish()
+}
+
+func (r *htmlRenderer) children(n *html.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		r.walk(c)
+	}
+}
+
+// htmlHidden returns true if the element is hidden, like the preview
+// text many newsletters have.
+func htmlHidden(n *html.Node) bool {
+	for _, a := range n.Attr {
+		switch a.Key {
+		case "hidden":
+			return true
+		case "style":
+			s := strings.ToLower(strings.Replace(a.Val, " ", "", -1))
+			if strings.Contains(s, "display:none") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func htmlAttr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func (r *htmlRenderer) walk(n *html.Node) {
+	if r.ctx.Err() != nil {
+		return
+	}
+	switch n.Type {
+	case html.DocumentNode:
+		r.children(n)
+		return
+	case html.TextNode:
+		r.text(n.Data)
+		return
+	case html.ElementNode:
+	default:
+		return
+	}
+	if htmlSkip[n.DataAtom] || htmlHidden(n) {
+		return
+	}
+	margin, isBlock := htmlBlocks[n.DataAtom]
+	if isBlock {
+		if (n.DataAtom == atom.Ul || n.DataAtom == atom.Ol) && r.lists > 0 {
+			// No space around nested lists.
+			margin = false
+		}
+		r.block(margin)
+		defer r.block(margin)
+	}
+
+	switch n.DataAtom {
+	case atom.Br:
+		r.buf.WriteString("\n")
+		r.space = false
+	case atom.Hr:
+		r.emit(strings.Repeat("-", r.textWidth()))
+	case atom.Img:
+		if alt := strings.TrimSpace(htmlAttr(n, "alt")); alt != "" {
+			r.text("[" + alt + "]")
+		}
+	case atom.A:
+		r.children(n)
+		href := strings.TrimSpace(stripControl(htmlAttr(n, "href")))
+		if href != "" && !strings.HasPrefix(href, "#") && !strings.HasPrefix(strings.ToLower(href), "javascript:") {
+			// Not via text(), so that a space before it is kept for after it.
+			fmt.Fprintf(&r.buf, "[%d]", r.links.add(href))
+		}
+	case atom.H1, atom.H2:
+		r.children(n)
+		width := 0
+		for _, l := range r.flush() {
+			if w := display.StringWidth(l); w > width {
+				width = w
+			}
+		}
+		if width > 0 {
+			u := "="
+			if n.DataAtom == atom.H2 {
+				u = "-"
+			}
+			r.emit(strings.Repeat(u, width))
+		}
+	case atom.Blockquote:
+		r.withPrefix(&htmlPrefix{first: "> ", rest: "> "}, n)
+	case atom.Dd:
+		r.withPrefix(&htmlPrefix{first: "    ", rest: "    "}, n)
+	case atom.Ul, atom.Ol:
+		r.list(n)
+	case atom.Pre:
+		r.pre++
+		r.children(n)
+		r.pre--
+		if r.pre == 0 {
+			r.flushPre()
+		}
+	case atom.Table:
+		r.table(n)
+	default:
+		r.children(n)
+	}
+}
+
+// withPrefix renders children with indentation.
+func (r *htmlRenderer) withPrefix(p *htmlPrefix, n *html.Node) {
+	// A blank line before belongs outside.
+	r.blankLine()
+	r.prefix = append(r.prefix, p)
+	r.children(n)
+	r.flush()
+	r.prefix = r.prefix[:len(r.prefix)-1]
+}
+
+// list renders a list, with bullets or numbers.
+func (r *htmlRenderer) list(n *html.Node) {
+	num := 1
+	if s, err := strconv.Atoi(htmlAttr(n, "start")); err == nil {
+		num = s
+	}
+	bullet := listMarkers[r.lists%len(listMarkers)]
+	r.lists++
+	defer func() { r.lists-- }()
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.ElementNode || c.DataAtom != atom.Li {
+			r.walk(c)
+			continue
+		}
+		if htmlHidden(c) {
+			continue
+		}
+		first := "  " + bullet + " "
+		if n.DataAtom == atom.Ol {
+			first = fmt.Sprintf("%3d. ", num)
+			num++
+		}
+		r.block(false)
+		r.withPrefix(&htmlPrefix{first: first, rest: strings.Repeat(" ", display.StringWidth(first))}, c)
+	}
+}
+
+// invisibleRune returns true for characters that don't show, and are
+// used to pad newsletter previews.
+func invisibleRune(c rune) bool {
+	switch c {
+	case '\u034f', '\u200b', '\u200c', '\u200d', '\u2060', '\ufeff', '\u00ad':
+		return true
+	}
+	return false
+}
+
+// stripControl drops C0 and C1 control characters other than newline
+// and tab, so that entities can't send escape sequences to the terminal.
+func stripControl(s string) string {
+	return strings.Map(func(c rune) rune {
+		if c != '\n' && c != '\t' && unicode.IsControl(c) {
+			return -1
+		}
+		return c
+	}, s)
+}
+
+// text adds text to the current block, collapsing whitespace.
+func (r *htmlRenderer) text(s string) {
+	if r.pre > 0 {
+		r.buf.WriteString(stripControl(s))
+		return
+	}
+	for _, c := range s {
+		switch {
+		case c == '\u00a0':
+			// Non-breaking space; turned into a space when output.
+			r.writeRune(c)
+		case unicode.IsSpace(c):
+			r.space = true
+		case invisibleRune(c), unicode.IsControl(c):
+		default:
+			r.writeRune(c)
+		}
+	}
+}
+
+func (r *htmlRenderer) writeRune(c rune) {
+	if r.space {
+		s := r.buf.String()
+		if s != "" && !strings.HasSuffix(s, "\n") {
+			r.buf.WriteByte(' ')
+		}
+		r.space = false
+	}
+	r.buf.WriteRune(c)
+}
+
+// block ends the current block.
+func (r *htmlRenderer) block(margin bool) {
+	r.flush()
+	if margin {
+		r.blank = true
+	}
+}
+
+// prefixes returns the prefix for the next line, and for blank lines.
+func (r *htmlRenderer) prefixes() (string, string) {
+	var first, rest []string
+	for _, p := range r.prefix {
+		if p.used {
+			first = append(first, p.rest)
+		} else {
+			first = append(first, p.first)
+		}
+		rest = append(rest, p.rest)
+	}
+	return strings.Join(first, ""), strings.Join(rest, "")
+}
+
+// textWidth is the width available for text after the prefix.
+func (r *htmlRenderer) textWidth() int {
+	first, _ := r.prefixes()
+	w := r.width - display.StringWidth(first)
+	if w < minHTMLWidth {
+		w = minHTMLWidth
+	}
+	return w
+}
+
+// blankLine outputs a blank line, if one is wanted.
+func (r *htmlRenderer) blankLine() {
+	if r.blank && len(r.lines) > 0 && !r.lastBlank {
+		_, rest := r.prefixes()
+		r.lines = append(r.lines, strings.TrimRight(rest, " "))
+		r.lastBlank = true
+	}
+	r.blank = false
+}
+
+// emit outputs a line.
+func (r *htmlRenderer) emit(s string) {
+	r.blankLine()
+	first, _ := r.prefixes()
+	r.lastBlank = false
+	r.lines = append(r.lines, strings.TrimRight(first+strings.Replace(s, "\u00a0", " ", -1), " "))
+	for _, p := range r.prefix {
+		p.used = true
+	}
+}
+
+// flush outputs the current block, wrapped, and returns the lines
+// without prefix.
+func (r *htmlRenderer) flush() []string {
+	if r.pre > 0 {
+		// Blocks inside <pre> don't end it.
+		return nil
+	}
+	s := r.buf.String()
+	r.buf.Reset()
+	r.space = false
+	var ret []string
+	paras := strings.Split(s, "\n")
+	for n, para := range paras {
+		var words []string
+		for _, w := range strings.Split(para, " ") {
+			if w != "" {
+				words = append(words, w)
+			}
+		}
+		if len(words) == 0 {
+			// Empty line from <br><br>.
+			if n > 0 && n < len(paras)-1 && len(ret) > 0 {
+				r.blank = true
+			}
+			continue
+		}
+		for _, l := range wrapWords(words, r.textWidth()) {
+			r.emit(l)
+			ret = append(ret, l)
+		}
+	}
+	return ret
+}
+
+// flushPre outputs preformatted text as is.
+func (r *htmlRenderer) flushPre() {
+	s := strings.Replace(r.buf.String(), "\r\n", "\n", -1)
+	r.buf.Reset()
+	s = strings.TrimPrefix(s, "\n")
+	s = strings.TrimRight(s, " \t\n")
+	if s == "" {
+		return
+	}
+	for _, l := range strings.Split(s, "\n") {
+		r.emit(strings.Replace(l, "\t", "        ", -1))
+	}
+}
+
+// wrapWords joins words into lines no wider than width. Words wider
+// than that, like long URLs, get their own line.
+func wrapWords(words []string, width int) []string {
+	var lines []string
+	cur := ""
+	curWidth := 0
+	for _, w := range words {
+		ww := display.StringWidth(w)
+		if cur != "" && curWidth+1+ww > width {
+			lines = append(lines, cur)
+			cur, curWidth = "", 0
+		}
+		if cur != "" {
+			cur += " "
+			curWidth++
+		}
+		cur += w
+		curWidth += ww
+	}
+	if cur != "" {
+		lines = append(lines, cur)
+	}
+	return lines
+}
+
+// tableRows returns the cells of each row in a table, not including
+// nested tables.
+func tableRows(n *html.Node) [][]*html.Node {
+	var rows [][]*html.Node
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.ElementNode || htmlHidden(c) {
+			continue
+		}
+		switch c.DataAtom {
+		case atom.Thead, atom.Tbody, atom.Tfoot:
+			rows = append(rows, tableRows(c)...)
+		case atom.Tr:
+			var cells []*html.Node
+			for cell := c.FirstChild; cell != nil; cell = cell.NextSibling {
+				if cell.Type == html.ElementNode && (cell.DataAtom == atom.Td || cell.DataAtom == atom.Th) && !htmlHidden(cell) {
+					cells = append(cells, cell)
+				}
+			}
+			rows = append(rows, cells)
+		}
+	}
+	return rows
+}
+
+// htmlCell is a rendered table cell.
+type htmlCell struct {
+	lines []string
+	span  int // Number of columns.
+}
+
+// table renders a table. Tables of short cells that fit in the width
+// are shown as columns. Anything else, like the layout tables of
+// newsletters, is shown one cell after the other.
+func (r *htmlRenderer) table(n *html.Node) {
+	rows := tableRows(n)
+	width := r.textWidth()
+	cells := make([][]htmlCell, len(rows))
+	columns := 0
+	grid := true
+	for i, row := range rows {
+		cols := 0
+		for _, c := range row {
+			span, err := strconv.Atoi(htmlAttr(c, "colspan"))
+			if err != nil || span < 1 {
+				span = 1
+			}
+			lines := r.sub(c, width)
+			if len(lines) > 1 {
+				grid = false
+			}
+			cells[i] = append(cells[i], htmlCell{lines: lines, span: span})
+			cols += span
+		}
+		if cols > columns {
+			columns = cols
+		}
+	}
+	if columns < 2 {
+		grid = false
+	}
+
+	// Column widths, from cells not spanning columns.
+	colWidths := make([]int, columns)
+	if grid {
+		for _, row := range cells {
+			col := 0
+			for _, c := range row {
+				if c.span == 1 && len(c.lines) > 0 {
+					if w := display.StringWidth(c.lines[0]); w > colWidths[col] {
+						colWidths[col] = w
+					}
+				}
+				col += c.span
+			}
+		}
+		total := len(tableColumnSpace) * (columns - 1)
+		for _, w := range colWidths {
+			total += w
+		}
+		if total > width {
+			grid = false
+		}
+	}
+
+	// Spanning cells must fit in their columns.
+	spanWidth := func(col, span int) int {
+		w := len(tableColumnSpace) * (span - 1)
+		for _, cw := range colWidths[col : col+span] {
+			w += cw
+		}
+		return w
+	}
+	if grid {
+		for _, row := range cells {
+			col := 0
+			for _, c := range row {
+				if len(c.lines) > 0 && display.StringWidth(c.lines[0]) > spanWidth(col, c.span) {
+					grid = false
+				}
+				col += c.span
+			}
+		}
+	}
+
+	if !grid {
+		for _, row := range cells {
+			for _, c := range row {
+				if len(c.lines) > 1 {
+					r.blank = true
+				}
+				for _, l := range c.lines {
+					if strings.TrimSpace(l) == "" {
+						r.blank = true
+						continue
+					}
+					r.emit(l)
+				}
+				if len(c.lines) > 1 {
+					r.blank = true
+				}
+			}
+		}
+		return
+	}
+
+	for i, row := range cells {
+		var parts []string
+		empty := true
+		col := 0
+		for _, c := range row {
+			s := ""
+			if len(c.lines) > 0 {
+				s = c.lines[0]
+				empty = false
+			}
+			parts = append(parts, s+strings.Repeat(" ", spanWidth(col, c.span)-display.StringWidth(s)))
+			col += c.span
+		}
+		if empty {
+			continue
+		}
+		r.emit(strings.Join(parts, tableColumnSpace))
+		if i == 0 && len(rows) > 1 && allHeaders(rows[0]) {
+			var seps []string
+			for _, w := range colWidths {
+				seps = append(seps, strings.Repeat("-", w))
+			}
+			r.emit(strings.Join(seps, tableColumnSpace))
+		}
+	}
+}
+
+// allHeaders returns true if all the cells are <th>.
+func allHeaders(cells []*html.Node) bool {
+	for _, c := range cells {
+		if c.DataAtom != atom.Th {
+			return false
+		}
+	}
+	return len(cells) > 0
+}
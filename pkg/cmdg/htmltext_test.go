@@ -0,0 +1,117 @@
+package cmdg
+
+import (
+	"context"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ThomasHabets/cmdg/pkg/display"
+)
+
+var updateGolden = flag.Bool("update_golden", false, "Update golden files in testdata.")
+
+// goldenHTMLWidth is narrower than a terminal, to exercise wrapping.
+const goldenHTMLWidth = 72
+
+func TestRenderHTMLGolden(t *testing.T) {
+	fns, err := filepath.Glob("testdata/html/*.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fns) == 0 {
+		t.Fatal("No test files")
+	}
+	for _, fn := range fns {
+		in, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := RenderHTML(string(in), goldenHTMLWidth)
+		if err != nil {
+			t.Fatalf("%s: %v", fn, err)
+		}
+		golden := strings.TrimSuffix(fn, ".html") + ".txt"
+		if *updateGolden {
+			if err := ioutil.WriteFile(golden, []byte(got), 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		want, err := ioutil.ReadFile(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != string(want) {
+			t.Errorf("%s: got\n%s\nwant\n%s", fn, got, want)
+		}
+		for n, l := range strings.Split(got, "\n") {
+			if strings.HasPrefix(l, "http") || strings.Contains(l, ". http") {
+				continue
+			}
+			if w := display.StringWidth(l); w > goldenHTMLWidth {
+				t.Errorf("%s: line %d is %d wide: %q", fn, n+1, w, l)
+			}
+		}
+	}
+}
+
+func TestRenderHTML(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		in    string
+		width int
+		want  string
+	}{
+		{"empty", "", 80, ""},
+		{"whitespace", "<p>  hello \n\t world  </p>", 80, "hello world\n"},
+		{"inline", "a<b>b</b>c <i>d</i> e", 80, "abc d e\n"},
+		{"paragraphs", "<p>one</p><p>two</p>two and a half<div>three</div>", 80, "one\n\ntwo\n\ntwo and a half\nthree\n"},
+		{"br", "one<br>two<br><br>three<br>", 80, "one\ntwo\n\nthree\n"},
+		{"wrap", "<p>aaa bbb ccc ddd eee fff ggg hhh iii jjj kkk lll mmm nnn</p>", 20, "aaa bbb ccc ddd eee\nfff ggg hhh iii jjj\nkkk lll mmm nnn\n"},
+		{"long word", "<p>see https://example.com/a/very/long/url/that/does/not/fit ok</p>", 20, "see\nhttps://example.com/a/very/long/url/that/does/not/fit\nok\n"},
+		{"nbsp", "<p>aaa bbb ccc ddd eee&nbsp;fff</p>", 20, "aaa bbb ccc ddd\neee fff\n"},
+		{"entities", "<p>&lt;tag&gt; &amp; &quot;q&quot; &euro;</p>", 80, "<tag> & \"q\" €\n"},
+		{"hidden", "<div style=\"display: none\">preview</div><span hidden>x</span>shown", 80, "shown\n"},
+		{"script", "<script>alert(1)</script><style>p{}</style>text", 80, "text\n"},
+		{"links", `<a href="https://a/">A</a> and <a href="https://b/">B</a> and <a href="https://a/">A again</a> <a href="#top">top</a>`, 80,
+			"A[1] and B[2] and A again[1] top\n\nReferences\n\n   1. https://a/\n   2. https://b/\n"},
+		{"image", `<img src="x.png" alt="Logo"><img src="pixel.gif" alt="">`, 80, "[Logo]\n"},
+		{"headings", "<h1>Title</h1><h2>Sub</h2><h3>Small</h3>text", 80, "Title\n=====\n\nSub\n---\n\nSmall\n\ntext\n"},
+		{"list", "<ul><li>one</li><li>two<ul><li>nested</li></ul></li></ul>after", 80, "  * one\n  * two\n      + nested\n\nafter\n"},
+		{"ordered", `<ol start="9"><li>nine</li><li>ten</li></ol>`, 80, "  9. nine\n 10. ten\n"},
+		{"list wrap", "<ul><li>aaa bbb ccc ddd eee fff</li></ul>", 24, "  * aaa bbb ccc ddd eee\n    fff\n"},
+		{"quote", "<blockquote><p>one</p><p>two</p><blockquote>three</blockquote></blockquote>", 80, "> one\n>\n> two\n>\n> > three\n"},
+		{"pre", "<pre>\n  a  b\n\tc\n</pre>", 80, "  a  b\n        c\n"},
+		{"hr", "a<hr>b", 30, "a\n\n" + strings.Repeat("-", 30) + "\n\nb\n"},
+		{"data table", "<table><tr><th>A</th><th>Bee</th></tr><tr><td>1</td><td>2</td></tr></table>", 80, "A  Bee\n-  ---\n1  2\n"},
+		{"layout table", "<table><tr><td><p>one</p><p>two</p></td><td>three</td></tr></table>", 80, "one\n\ntwo\n\nthree\n"},
+		{"colspan", `<table><tr><td>aaa</td><td>bbb</td><td>c</td></tr><tr><td colspan="2">Total</td><td>3</td></tr></table>`, 80, "aaa  bbb  c\nTotal     3\n"},
+		{"wide table", "<table><tr><td>aaaaaaaaaaaaaaa</td><td>bbbbbbbbbbbbbbb</td></tr></table>", 20, "aaaaaaaaaaaaaaa\nbbbbbbbbbbbbbbb\n"},
+		{"control pre", "<pre>x&#27;]0;pwn&#7;y\r\n\tz\u009b</pre>", 80, "x]0;pwny\n        z\n"},
+		{"control text", "<p>a&#27;[2Jb&#7;</p>", 80, "a[2Jb\n"},
+		{"control href", `<a href="https://a/&#27;[2J&#7;x">A</a>`, 80, "A[1]\n\nReferences\n\n   1. https://a/[2Jx\n"},
+		{"cjk", "<p>日本語のテキスト 日本語のテキスト</p>", 20, "日本語のテキスト\n日本語のテキスト\n"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := RenderHTML(test.in, test.width)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("Got\n%q\nwant\n%q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRenderHTMLCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	in := strings.Repeat("<table><tr><td>", 50) + "deep" + strings.Repeat("</td></tr></table>", 50)
+	if _, err := renderHTML(ctx, in, 80); err != context.Canceled {
+		t.Errorf("Got error %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,368 @@
+package cmdg
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/mail"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	// importStateSuffix is added to the source to get the file that
+	// says which messages have been imported.
+	importStateSuffix = ".cmdg-import"
+)
+
+var mboxQuotedFromRE = regexp.MustCompile(`(?m)^>(>*From )`)
+
+// ImportOptions says how to import messages.
+type ImportOptions struct {
+	// LabelIDs are added to every imported message.
+	LabelIDs []string
+
+	// MarkRead imports everything as read. Otherwise only messages
+	// marked as seen in the source are.
+	MarkRead bool
+
+	// StateFile keeps track of imported messages, for resuming.
+	// Default is the source with ".cmdg-import" added.
+	StateFile string
+}
+
+// ImportProgress is how far an import has come.
+type ImportProgress struct {
+	Read       int // Messages read from the source.
+	Imported   int // Messages imported by this run.
+	Duplicates int // Messages with a Message-ID already in Gmail.
+	Skipped    int // Messages imported by an earlier run.
+	Failed     int // Messages rejected by Gmail.
+}
+
+// importMessage is a message read from a source.
+type importMessage struct {
+	name    string
+	raw     []byte
+	seen    bool
+	flagged bool
+}
+
+// importSource reads messages, returning io.EOF at the end.
+type importSource interface {
+	next() (*importMessage, error)
+	close() error
+}
+
+// Import uploads messages from an mbox file, a Maildir, a directory
+// of .eml files, or a single .eml file. Messages whose Message-ID is
+// already in Gmail are skipped. Running it again after an interruption
+// continues where it left off.
+func (c *CmdG) Import(ctx context.Context, source string, opt ImportOptions, progress func(ImportProgress)) (ImportProgress, error) {
+	var p ImportProgress
+	if progress == nil {
+		progress = func(ImportProgress) {}
+	}
+	src, err := openImportSource(source)
+	if err != nil {
+		return p, err
+	}
+	defer src.close()
+
+	stateFile := opt.StateFile
+	if stateFile == "" {
+		stateFile = strings.TrimRight(source, "/") + importStateSuffix
+	}
+	state, err := openImportState(stateFile)
+	if err != nil {
+		return p, err
+	}
+	defer state.close()
+
+	for {
+		m, err := src.next()
+		if err == io.EOF {
+			return p, nil
+		}
+		if err != nil {
+			return p, err
+		}
+		p.Read++
+		key, msgID := importKey(m.raw)
+		if state.done[key] {
+			p.Skipped++
+			progress(p)
+			continue
+		}
+		if msgID != "" {
+			// Search spam and trash too, since importing there
+			// again would still be a duplicate.
+			res, err := c.uncachedBackend().ListMessages(ctx, "", "rfc822msgid:"+msgID+" in:anywhere", "", 1)
+			if err != nil {
+				return p, errors.Wrapf(err, "looking for duplicates of %s", m.name)
+			}
+			if len(res.Messages) > 0 {
+				log.Infof("Not importing %s: Message-ID %q already in Gmail", m.name, msgID)
+				p.Duplicates++
+				if err := state.add(key); err != nil {
+					return p, err
+				}
+				progress(p)
+				continue
+			}
+		}
+
+		labels := append([]string{}, opt.LabelIDs...)
+		if !opt.MarkRead && !m.seen {
+			labels = append(labels, Unread)
+		}
+		if m.flagged {
+			labels = append(labels, Starred)
+		}
+		if _, err := c.backend.ImportMessage(ctx, string(m.raw), labels); err != nil {
+			if importRejected(err) {
+				log.Errorf("Gmail rejected %s: %v", m.name, err)
+				p.Failed++
+				progress(p)
+				continue
+			}
+			return p, errors.Wrapf(err, "importing %s", m.name)
+		}
+		if err := state.add(key); err != nil {
+			return p, err
+		}
+		p.Imported++
+		progress(p)
+	}
+}
+
+// importRejected returns true if the error is about the message
+// itself, so that the import should go on with the next one.
+func importRejected(err error) bool {
+	e, ok := errors.Cause(err).(*googleapi.Error)
+	return ok && (e.Code == http.StatusBadRequest || e.Code == http.StatusRequestEntityTooLarge)
+}
+
+// importKey returns the key to record an imported message under, and
+// its Message-ID (without <>) if it has one.
+func importKey(raw []byte) (string, string) {
+	if m, err := mail.ReadMessage(bytes.NewReader(raw)); err == nil {
+		if id := strings.Trim(strings.TrimSpace(m.Header.Get("Message-ID")), "<>"); id != "" && !strings.ContainsAny(id, " \t") {
+			return "<" + id + ">", id
+		}
+	}
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(raw)), ""
+}
+
+// importState is the file of keys of already imported messages.
+type importState struct {
+	f    *os.File
+	done map[string]bool
+}
+
+func openImportState(fn string) (*importState, error) {
+	s := &importState{done: make(map[string]bool)}
+	if b, err := ioutil.ReadFile(fn); err == nil {
+		for _, line := range strings.Split(string(b), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				s.done[line] = true
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	var err error
+	s.f, err = os.OpenFile(fn, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *importState) add(key string) error {
+	if _, err := fmt.Fprintln(s.f, key); err != nil {
+		return err
+	}
+	s.done[key] = true
+	return s.f.Sync()
+}
+
+func (s *importState) close() error {
+	return s.f.Close()
+}
+
+// openImportSource picks the source type from what's at the path.
+func openImportSource(fn string) (importSource, error) {
+	st, err := os.Stat(fn)
+	if err != nil {
+		return nil, err
+	}
+	if !st.IsDir() {
+		if strings.EqualFold(path.Ext(fn), ".eml") {
+			return &fileSource{files: []string{fn}}, nil
+		}
+		return openMboxSource(fn)
+	}
+	if st, err := os.Stat(path.Join(fn, "cur")); err == nil && st.IsDir() {
+		return openMaildirSource(fn)
+	}
+	var files []string
+	if err := filepath.Walk(fn, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() && strings.EqualFold(path.Ext(p), ".eml") {
+			files = append(files, p)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("%q is not a Maildir, and has no .eml files", fn)
+	}
+	sort.Strings(files)
+	return &fileSource{files: files}, nil
+}
+
+// fileSource reads one message per file: .eml files, or a Maildir.
+type fileSource struct {
+	files []string
+	flags func(string) (seen, flagged bool)
+}
+
+func (s *fileSource) next() (*importMessage, error) {
+	if len(s.files) == 0 {
+		return nil, io.EOF
+	}
+	fn := s.files[0]
+	s.files = s.files[1:]
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	m := &importMessage{name: fn, raw: b}
+	if s.flags != nil {
+		m.seen, m.flagged = s.flags(fn)
+	}
+	return m, nil
+}
+
+func (s *fileSource) close() error {
+	return nil
+}
+
+func openMaildirSource(dir string) (*fileSource, error) {
+	var files []string
+	for _, d := range []string{"cur", "new"} {
+		fis, err := ioutil.ReadDir(path.Join(dir, d))
+		if err != nil {
+			return nil, err
+		}
+		for _, fi := range fis {
+			if !fi.IsDir() && !strings.HasPrefix(fi.Name(), ".") {
+				files = append(files, path.Join(dir, d, fi.Name()))
+			}
+		}
+	}
+	return &fileSource{
+		files: files,
+		flags: func(fn string) (bool, bool) {
+			if path.Base(path.Dir(fn)) == "new" {
+				return false, false
+			}
+			i := strings.LastIndex(fn, ":2,")
+			if i < 0 {
+				return false, false
+			}
+			fl := fn[i+3:]
+			return strings.Contains(fl, "S"), strings.Contains(fl, "F")
+		},
+	}, nil
+}
+
+// mboxSource reads an mbox file. Messages start with a "From " line
+// at the start of the file or after an empty line. Lines quoted as
+// ">From " are unquoted, as in mboxrd.
+type mboxSource struct {
+	fn   string
+	f    *os.File
+	r    *bufio.Reader
+	n    int
+	from string // The "From " line of the next message.
+}
+
+func openMboxSource(fn string) (*mboxSource, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	s := &mboxSource{fn: fn, f: f, r: bufio.NewReader(f)}
+	line, err := s.r.ReadString('\n')
+	if err != nil && err != io.EOF {
+		f.Close()
+		return nil, err
+	}
+	if line != "" && !strings.HasPrefix(line, "From ") {
+		f.Close()
+		return nil, fmt.Errorf("%q is not an mbox file", fn)
+	}
+	s.from = line
+	return s, nil
+}
+
+func (s *mboxSource) next() (*importMessage, error) {
+	if s.from == "" {
+		return nil, io.EOF
+	}
+	s.n++
+	var lines []string
+	s.from = ""
+	for {
+		line, err := s.r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if strings.HasPrefix(line, "From ") && len(lines) > 0 && strings.TrimRight(lines[len(lines)-1], "\r\n") == "" {
+			s.from = line
+			break
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	// The empty line before the next message is not part of this one.
+	if n := len(lines); n > 0 && strings.TrimRight(lines[n-1], "\r\n") == "" {
+		lines = lines[:n-1]
+	}
+	raw := mboxQuotedFromRE.ReplaceAllString(strings.Join(lines, ""), "$1")
+	m := &importMessage{
+		name: fmt.Sprintf("message %d in %s", s.n, s.fn),
+		raw:  []byte(raw),
+	}
+	if msg, err := mail.ReadMessage(strings.NewReader(raw)); err == nil {
+		m.seen = strings.Contains(msg.Header.Get("Status"), "R")
+		m.flagged = strings.Contains(msg.Header.Get("X-Status"), "F")
+	}
+	return m, nil
+}
+
+func (s *mboxSource) close() error {
+	return s.f.Close()
+}
@@ -0,0 +1,267 @@
+package cmdg
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// importedMessages returns subject -> labels of all messages.
+func importedMessages(t *testing.T, b *MemBackend) map[string]string {
+	t.Helper()
+	b.m.Lock()
+	defer b.m.Unlock()
+	ret := make(map[string]string)
+	for _, m := range b.messages {
+		ls := append([]string{}, m.labels...)
+		sort.Strings(ls)
+		ret[headerValue(m.payload, "Subject")] = strings.Join(ls, ",")
+	}
+	return ret
+}
+
+func TestImportMbox(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cmdg-import-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "old.mbox")
+	if err := ioutil.WriteFile(fn, []byte(`From alice@example.com Mon Jan  2 15:04:05 2006
+Status: RO
+From: alice@example.com
+Message-ID: <read@example.com>
+Subject: Read
+
+Hello
+>From the start
+>>From quoted
+
+From bob@example.com Mon Jan  2 15:04:05 2006
+Status: O
+X-Status: F
+From: bob@example.com
+Message-ID: <starred@example.com>
+Subject: Starred
+
+Star
+From here, without a blank line, is part of the body.
+
+From carol@example.com Mon Jan  2 15:04:05 2006
+From: carol@example.com
+Message-ID: <dup@example.com>
+Subject: Duplicate
+
+Already there
+
+From dave@example.com Mon Jan  2 15:04:05 2006
+this is not a header
+
+From erin@example.com Mon Jan  2 15:04:05 2006
+From: erin@example.com
+Subject: No ID
+
+No Message-ID
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	b := NewMemBackend("me@example.com")
+	if _, err := b.AddMessage("From: carol@example.com\r\nMessage-ID: <dup@example.com>\r\nSubject: Original\r\n\r\nHi\r\n", "", []string{Inbox}); err != nil {
+		t.Fatal(err)
+	}
+	c := NewWithBackend(b)
+	if err := c.LoadLabels(ctx); err != nil {
+		t.Fatal(err)
+	}
+	l, err := c.CreateLabel(ctx, "Archive/Old")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := c.Import(ctx, fn, ImportOptions{LabelIDs: []string{l.ID}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (ImportProgress{Read: 5, Imported: 3, Duplicates: 1, Failed: 1}); p != want {
+		t.Errorf("Got progress %+v, want %+v", p, want)
+	}
+	got := importedMessages(t, b)
+	for subj, want := range map[string]string{
+		"Original": Inbox,
+		"Read":     l.ID,
+		"Starred":  strings.Join([]string{l.ID, Starred, Unread}, ","),
+		"No ID":    strings.Join([]string{l.ID, Unread}, ","),
+	} {
+		if got[subj] != want {
+			t.Errorf("%q: got labels %q, want %q", subj, got[subj], want)
+		}
+	}
+	if len(got) != 4 {
+		t.Errorf("Got messages %v", got)
+	}
+	b.m.Lock()
+	for _, m := range b.messages {
+		switch headerValue(m.payload, "Subject") {
+		case "Read":
+			if !strings.HasSuffix(m.raw, "\nHello\nFrom the start\n>From quoted\n") {
+				t.Errorf("Bad unquoting: %q", m.raw)
+			}
+		case "Starred":
+			if !strings.HasSuffix(m.raw, "\n\nStar\nFrom here, without a blank line, is part of the body.\n") {
+				t.Errorf("Bad body: %q", m.raw)
+			}
+		}
+	}
+	b.m.Unlock()
+
+	// Resume.
+	p, err = c.Import(ctx, fn, ImportOptions{LabelIDs: []string{l.ID}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (ImportProgress{Read: 5, Skipped: 4, Failed: 1}); p != want {
+		t.Errorf("Got progress %+v when resuming, want %+v", p, want)
+	}
+}
+
+func TestImportRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cmdg-import-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	from, _ := newExportTestBackend(t)
+	fc := NewWithBackend(from)
+	for _, format := range []ExportFormat{ExportMbox, ExportMaildir} {
+		dest := path.Join(dir, string(format))
+		if _, err := fc.Export(ctx, "", "example.com", format, dest, nil); err != nil {
+			t.Fatal(err)
+		}
+		to := NewMemBackend("me@example.com")
+		p, err := NewWithBackend(to).Import(ctx, dest, ImportOptions{}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Imported != 4 {
+			t.Errorf("%s: got progress %+v", format, p)
+		}
+		got := importedMessages(t, to)
+		for subj, want := range map[string]string{
+			"Read":      "",
+			"Unread":    Unread,
+			"Starred":   Starred,
+			"Elsewhere": "",
+		} {
+			if l, found := got[subj]; !found || l != want {
+				t.Errorf("%s: %q got labels %q, want %q", format, subj, l, want)
+			}
+		}
+	}
+}
+
+func TestImportEML(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cmdg-import-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for n, s := range []string{"One", "Two"} {
+		fn := path.Join(dir, string(rune('a'+n))+".eml")
+		if err := ioutil.WriteFile(fn, []byte("Subject: "+s+"\r\nMessage-ID: <"+s+"@example.com>\r\n\r\nHi\r\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b := NewMemBackend("me@example.com")
+	c := NewWithBackend(b)
+
+	// A single file.
+	p, err := c.Import(ctx, path.Join(dir, "a.eml"), ImportOptions{MarkRead: true}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Imported != 1 {
+		t.Errorf("Got progress %+v", p)
+	}
+	// The directory, which has the same message again.
+	p, err = c.Import(ctx, dir, ImportOptions{MarkRead: true}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Imported != 1 || p.Duplicates != 1 {
+		t.Errorf("Got progress %+v", p)
+	}
+	if got, want := importedMessages(t, b), map[string]string{"One": "", "Two": ""}; len(got) != 2 || got["One"] != "" || got["Two"] != "" {
+		t.Errorf("Got %v, want %v", got, want)
+	}
+}
+
+func TestImportDuplicateInTrash(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cmdg-import-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	const raw = "Subject: One\r\nMessage-ID: <one@example.com>\r\n\r\nHi\r\n"
+	fn := path.Join(dir, "a.eml")
+	if err := ioutil.WriteFile(fn, []byte(raw), 0600); err != nil {
+		t.Fatal(err)
+	}
+	b := NewMemBackend("me@example.com")
+	if _, err := b.AddMessage(raw, "", []string{Trash}); err != nil {
+		t.Fatal(err)
+	}
+	c := NewWithBackend(b)
+	cache := path.Join(dir, "cache")
+	if err := c.UseDiskCache(cache); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := c.Import(ctx, fn, ImportOptions{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Imported != 0 || p.Duplicates != 1 {
+		t.Errorf("Got progress %+v", p)
+	}
+	// Duplicate checks don't go through the cache.
+	fs, err := ioutil.ReadDir(path.Join(cache, cacheListDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fs) != 0 {
+		t.Errorf("Got %d cached lists, want none", len(fs))
+	}
+}
+
+func TestImportUpload(t *testing.T) {
+	var path, uploadType, body string
+	b, done := newTestGmailBackend(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		path, uploadType, body = r.URL.Path, r.URL.Query().Get("uploadType"), string(data)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"123"}`))
+	}))
+	defer done()
+
+	const msg = "Subject: Big\r\n\r\nLarge attachment here\r\n"
+	if _, err := b.ImportMessage(context.Background(), msg, []string{Inbox}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(path, "/upload/") || uploadType == "" {
+		t.Errorf("Not uploaded as media: path %q uploadType %q", path, uploadType)
+	}
+	if !strings.Contains(body, msg) || !strings.Contains(body, "message/rfc822") {
+		t.Errorf("Message not in upload body %q", body)
+	}
+}
@@ -0,0 +1,798 @@
+package cmdg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	drive "google.golang.org/api/drive/v3"
+	gmail "google.golang.org/api/gmail/v1"
+	people "google.golang.org/api/people/v1"
+)
+
+const (
+	journalOpModify       = "modify"
+	journalOpModifyThread = "modify-thread"
+	journalOpSend         = "send"
+	journalOpDraft        = "draft"
+	journalOpSendDraft    = "send-draft"
+	journalOpDelete       = "delete"
+)
+
+var (
+	// ErrOffline is returned for reads that need the network while offline.
+	ErrOffline = errors.New("offline")
+
+	// ErrQueued is returned by ModifyMessage when the change was
+	// queued, so the resulting labels are not known.
+	ErrQueued = errors.New("queued while offline")
+
+	// How often to check if the network is back.
+	journalProbeTime = 30 * time.Second
+)
+
+// IsNetworkError returns true if the error means the API could not
+// be reached, as opposed to the API saying no.
+func IsNetworkError(err error) bool {
+	for err != nil {
+		if err == ErrOffline {
+			return true
+		}
+		// url.Error is a net.Error, but also wraps e.g. OAuth
+		// token errors. So look inside it.
+		if _, ok := err.(*url.Error); !ok {
+			if _, ok := err.(net.Error); ok {
+				return true
+			}
+		}
+		err = errors.Unwrap(err)
+	}
+	return false
+}
+
+// requestNotSent returns true if the network error happened before
+// the request could reach the API, such as when connecting.
+func requestNotSent(err error) bool {
+	for err != nil {
+		if err == ErrOffline {
+			return true
+		}
+		if e, ok := err.(*net.OpError); ok && e.Op == "dial" {
+			return true
+		}
+		if _, ok := err.(*net.DNSError); ok {
+			return true
+		}
+		err = errors.Unwrap(err)
+	}
+	return false
+}
+
+// JournalEntry is one queued operation.
+type JournalEntry struct {
+	Op   string
+	Time time.Time
+
+	// For modify, modify-thread and delete.
+	IDs    []string `json:",omitempty"`
+	Add    []string `json:",omitempty"`
+	Remove []string `json:",omitempty"`
+
+	// For send, draft and modify-thread.
+	ThreadID ThreadID `json:",omitempty"`
+	Msg      string   `json:",omitempty"`
+
+	// For send-draft.
+	DraftID string `json:",omitempty"`
+
+	// msg is read into Msg only if queued, so that messages sent
+	// directly can be streamed.
+	msg RawMessage
+}
+
+func (e *JournalEntry) String() string {
+	switch e.Op {
+	case journalOpModify:
+		return fmt.Sprintf("label change on %d messages (add %v, remove %v)", len(e.IDs), e.Add, e.Remove)
+	case journalOpModifyThread:
+		return fmt.Sprintf("label change on thread %s (add %v, remove %v)", e.ThreadID, e.Add, e.Remove)
+	case journalOpSend:
+		return "send"
+	case journalOpDraft:
+		return "save of draft"
+	case journalOpSendDraft:
+		return fmt.Sprintf("send of draft %s", e.DraftID)
+	case journalOpDelete:
+		return fmt.Sprintf("delete of %d messages", len(e.IDs))
+	}
+	return e.Op
+}
+
+// Journal is a Backend that queues label changes, sends, drafts and
+// deletes while offline, and replays them once the network is back. The queue is
+// stored on disk, so nothing is lost if cmdg exits while offline.
+//
+// Reads, and changes that can't be queued, fail with ErrOffline
+// while offline. The disk cache catches the reads.
+type Journal struct {
+	Backend
+	fn        string
+	conflicts chan error
+	replaying sync.Mutex
+
+	m       sync.Mutex
+	offline bool
+	forced  bool
+	entries []*JournalEntry
+}
+
+// NewJournal creates a journal stored in a file, wrapping another backend.
+func NewJournal(b Backend, fn string) (*Journal, error) {
+	j := &Journal{
+		Backend:   b,
+		fn:        fn,
+		conflicts: make(chan error, 100),
+	}
+	data, err := ioutil.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return j, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading journal %q", fn)
+	}
+	if err := json.Unmarshal(data, &j.entries); err != nil {
+		return nil, errors.Wrapf(err, "parsing journal %q", fn)
+	}
+	if len(j.entries) > 0 {
+		log.Infof("Journal has %d queued operations", len(j.entries))
+		// Assume offline until replay says otherwise.
+		j.offline = true
+	}
+	return j, nil
+}
+
+// UseJournal puts an offline journal in front of the current
+// backend. To have reads served from cache while offline, call this
+// before UseDiskCache.
+func (c *CmdG) UseJournal(fn string) error {
+	j, err := NewJournal(c.backend, fn)
+	if err != nil {
+		return err
+	}
+	c.backend = j
+	c.journal = j
+	return nil
+}
+
+// Offline returns if offline, and how many operations are queued.
+func (c *CmdG) Offline() (bool, int) {
+	if c.journal == nil {
+		return false, 0
+	}
+	return c.journal.Status()
+}
+
+// SetOffline forces offline mode on or off.
+func (c *CmdG) SetOffline(ctx context.Context, offline bool) {
+	if c.journal != nil {
+		c.journal.SetOffline(ctx, offline)
+	}
+}
+
+// Conflicts returns queued operations that failed when replayed.
+// The channel is nil if there's no journal.
+func (c *CmdG) Conflicts() <-chan error {
+	if c.journal == nil {
+		return nil
+	}
+	return c.journal.conflicts
+}
+
+// RunJournal replays the journal whenever the network is back, until the context is cancelled.
+func (c *CmdG) RunJournal(ctx context.Context) {
+	if c.journal != nil {
+		c.journal.Run(ctx)
+	}
+}
+
+// Status returns if offline, and how many operations are queued.
+func (j *Journal) Status() (bool, int) {
+	j.m.Lock()
+	defer j.m.Unlock()
+	return j.offline, len(j.entries)
+}
+
+// SetOffline forces offline mode on or off. Turning it off replays the journal.
+func (j *Journal) SetOffline(ctx context.Context, offline bool) {
+	j.m.Lock()
+	j.forced = offline
+	if offline {
+		j.offline = true
+	}
+	j.m.Unlock()
+	if !offline {
+		go func() {
+			if err := j.Replay(ctx); err != nil {
+				log.Warningf("Replaying journal: %v", err)
+			}
+		}()
+	}
+}
+
+// Run probes the network and replays the journal, until the context is cancelled.
+func (j *Journal) Run(ctx context.Context) {
+	t := time.NewTicker(journalProbeTime)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		j.m.Lock()
+		skip := j.forced || !j.offline
+		j.m.Unlock()
+		if skip {
+			continue
+		}
+		if err := j.Replay(ctx); err != nil {
+			log.Infof("Still offline: %v", err)
+		}
+	}
+}
+
+func (j *Journal) saveLocked() error {
+	b, err := json.Marshal(j.entries)
+	if err != nil {
+		return err
+	}
+	return errors.Wrapf(writeFileAtomic(j.fn, b), "writing journal %q", j.fn)
+}
+
+// isOffline returns true if requests should not be attempted.
+func (j *Journal) isOffline() bool {
+	j.m.Lock()
+	defer j.m.Unlock()
+	return j.offline
+}
+
+// check goes offline if the error is a network error.
+func (j *Journal) check(err error) error {
+	if IsNetworkError(err) {
+		j.m.Lock()
+		defer j.m.Unlock()
+		if !j.offline {
+			log.Warningf("Network error, going offline: %v", err)
+			j.offline = true
+		}
+	}
+	return err
+}
+
+// queue adds an entry to the journal. If online then the entry is
+// first attempted directly. Returns true if queued.
+func (j *Journal) queue(ctx context.Context, e *JournalEntry, do func() error) (bool, error) {
+	j.m.Lock()
+	// If anything is queued, then this needs to go after it.
+	direct := !j.offline && len(j.entries) == 0
+	j.m.Unlock()
+
+	if direct {
+		err := do()
+		if !IsNetworkError(err) {
+			return false, err
+		}
+		log.Warningf("Network error, going offline: %v", err)
+	}
+
+	if e.msg != nil {
+		m, err := readRawMessage(e.msg)
+		if err != nil {
+			return false, err
+		}
+		e.Msg = m
+	}
+
+	j.m.Lock()
+	defer j.m.Unlock()
+	j.offline = true
+	e.Time = time.Now()
+	j.entries = append(j.entries, e)
+	if err := j.saveLocked(); err != nil {
+		j.entries = j.entries[:len(j.entries)-1]
+		return false, err
+	}
+	log.Infof("Queued %s. %d in journal", e, len(j.entries))
+	return true, nil
+}
+
+// conflict reports an error on the conflicts channel.
+func (j *Journal) conflict(err error) {
+	select {
+	case j.conflicts <- err:
+	default:
+		log.Errorf("Conflict channel full, dropping conflict report")
+	}
+}
+
+// Replay runs all queued operations. Network errors stop the
+// replay, leaving the rest queued. Other errors are conflicts,
+// and are reported on the conflicts channel.
+//
+// A send that fails with a network error may still have been sent,
+// so it's not tried again. It's saved as a draft instead. A send of
+// a draft is just dropped, since the draft is still there if it
+// wasn't sent.
+func (j *Journal) Replay(ctx context.Context) error {
+	j.replaying.Lock()
+	defer j.replaying.Unlock()
+
+	j.m.Lock()
+	n := len(j.entries)
+	j.m.Unlock()
+	if n == 0 {
+		// Nothing queued, so just check if the network is back.
+		if _, err := j.Backend.GetProfile(ctx); err != nil {
+			return err
+		}
+	}
+	for {
+		j.m.Lock()
+		if len(j.entries) == 0 {
+			if !j.forced {
+				j.offline = false
+			}
+			j.m.Unlock()
+			log.Infof("Journal replayed. Back online")
+			return nil
+		}
+		e := j.entries[0]
+		j.m.Unlock()
+
+		err := j.replayOne(ctx, e)
+		if e.Op == journalOpSend && IsNetworkError(err) && !requestNotSent(err) {
+			log.Errorf("Queued %s may have failed: %v", e, err)
+			j.conflict(errors.Errorf("queued send from %s may or may not have been sent (%v). Will save it as a draft instead", e.Time.Format("2006-01-02 15:04"), err))
+			d := *e
+			d.Op = journalOpDraft
+			j.m.Lock()
+			j.entries[0] = &d
+			if err := j.saveLocked(); err != nil {
+				j.m.Unlock()
+				return err
+			}
+			j.m.Unlock()
+			return err
+		}
+		if e.Op == journalOpSendDraft && IsNetworkError(err) && !requestNotSent(err) {
+			log.Errorf("Queued %s may have failed: %v", e, err)
+			j.conflict(errors.Errorf("queued %s from %s may or may not have been sent (%v). Check sent mail and drafts", e, e.Time.Format("2006-01-02 15:04"), err))
+			j.m.Lock()
+			j.entries = j.entries[1:]
+			if err := j.saveLocked(); err != nil {
+				j.m.Unlock()
+				return err
+			}
+			j.m.Unlock()
+			return err
+		}
+		if IsNetworkError(err) {
+			return err
+		}
+		if err != nil {
+			log.Errorf("Queued %s failed: %v", e, err)
+			j.conflict(errors.Wrapf(err, "queued %s from %s failed", e, e.Time.Format("2006-01-02 15:04")))
+		}
+
+		j.m.Lock()
+		j.entries = j.entries[1:]
+		if err := j.saveLocked(); err != nil {
+			j.m.Unlock()
+			return err
+		}
+		j.m.Unlock()
+	}
+}
+
+func (j *Journal) replayOne(ctx context.Context, e *JournalEntry) error {
+	switch e.Op {
+	case journalOpModify:
+		return j.Backend.BatchModify(ctx, e.IDs, e.Add, e.Remove)
+	case journalOpModifyThread:
+		return j.Backend.ModifyThread(ctx, e.ThreadID, e.Add, e.Remove)
+	case journalOpSend:
+		err := j.Backend.Send(ctx, e.ThreadID, StringMessage(e.Msg))
+		if err != nil && !IsNetworkError(err) {
+			// Don't lose the message. Save it as a draft.
+			if err2 := j.Backend.CreateDraft(ctx, StringMessage(e.Msg)); err2 != nil {
+				return errors.Wrapf(err, "and saving as draft also failed (%v)", err2)
+			}
+			return errors.Wrap(err, "saved as draft instead")
+		}
+		return err
+	case journalOpDraft:
+		return j.Backend.CreateDraft(ctx, StringMessage(e.Msg))
+	case journalOpSendDraft:
+		return j.Backend.SendDraft(ctx, &gmail.Draft{Id: e.DraftID})
+	case journalOpDelete:
+		return j.Backend.BatchDelete(ctx, e.IDs)
+	}
+	return fmt.Errorf("unknown journal operation %q", e.Op)
+}
+
+// BatchModify implements Backend.
+func (j *Journal) BatchModify(ctx context.Context, ids, add, remove []string) error {
+	_, err := j.queue(ctx, &JournalEntry{
+		Op:     journalOpModify,
+		IDs:    ids,
+		Add:    add,
+		Remove: remove,
+	}, func() error {
+		return j.Backend.BatchModify(ctx, ids, add, remove)
+	})
+	return err
+}
+
+// ModifyMessage implements Backend.
+//
+// If queued, then ErrQueued is returned, since the resulting labels
+// are not known.
+func (j *Journal) ModifyMessage(ctx context.Context, id string, add, remove []string) (*gmail.Message, error) {
+	var ret *gmail.Message
+	queued, err := j.queue(ctx, &JournalEntry{
+		Op:     journalOpModify,
+		IDs:    []string{id},
+		Add:    add,
+		Remove: remove,
+	}, func() (err error) {
+		ret, err = j.Backend.ModifyMessage(ctx, id, add, remove)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	if queued {
+		return nil, ErrQueued
+	}
+	return ret, nil
+}
+
+// ModifyThread implements Backend.
+func (j *Journal) ModifyThread(ctx context.Context, id ThreadID, add, remove []string) error {
+	_, err := j.queue(ctx, &JournalEntry{
+		Op:       journalOpModifyThread,
+		ThreadID: id,
+		Add:      add,
+		Remove:   remove,
+	}, func() error {
+		return j.Backend.ModifyThread(ctx, id, add, remove)
+	})
+	return err
+}
+
+// Send implements Backend.
+//
+// If the API may have received the message before the network error,
+// then it's not queued, since that could send it twice. An error that
+// is not a network error is returned instead.
+func (j *Journal) Send(ctx context.Context, threadID ThreadID, msg RawMessage) error {
+	_, err := j.queue(ctx, &JournalEntry{
+		Op:       journalOpSend,
+		ThreadID: threadID,
+		msg:      msg,
+	}, func() error {
+		return j.unknownOutcome(j.Backend.Send(ctx, threadID, msg))
+	})
+	return err
+}
+
+// unknownOutcome turns a network error that may have happened after
+// the API got a send into a non-network error, so that it's not
+// queued.
+func (j *Journal) unknownOutcome(err error) error {
+	if IsNetworkError(err) && !requestNotSent(err) {
+		j.check(err)
+		return errors.Errorf("message may or may not have been sent, check sent mail before trying again: %v", err)
+	}
+	return err
+}
+
+// SendDraft implements Backend. Like Send, it's not queued if the
+// draft may have been sent.
+func (j *Journal) SendDraft(ctx context.Context, d *gmail.Draft) error {
+	_, err := j.queue(ctx, &JournalEntry{
+		Op:      journalOpSendDraft,
+		DraftID: d.Id,
+	}, func() error {
+		return j.unknownOutcome(j.Backend.SendDraft(ctx, d))
+	})
+	return err
+}
+
+// CreateDraft implements Backend.
+func (j *Journal) CreateDraft(ctx context.Context, msg RawMessage) error {
+	_, err := j.queue(ctx, &JournalEntry{
+		Op:  journalOpDraft,
+		msg: msg,
+	}, func() error {
+		return j.Backend.CreateDraft(ctx, msg)
+	})
+	return err
+}
+
+// BatchDelete implements Backend.
+func (j *Journal) BatchDelete(ctx context.Context, ids []string) error {
+	_, err := j.queue(ctx, &JournalEntry{
+		Op:  journalOpDelete,
+		IDs: ids,
+	}, func() error {
+		return j.Backend.BatchDelete(ctx, ids)
+	})
+	return err
+}
+
+// ListMessages implements Backend.
+func (j *Journal) ListMessages(ctx context.Context, label, query, token string, max int64) (*gmail.ListMessagesResponse, error) {
+	if j.isOffline() {
+		return nil, ErrOffline
+	}
+	ret, err := j.Backend.ListMessages(ctx, label, query, token, max)
+	return ret, j.check(err)
+}
+
+// GetMessage implements Backend.
+func (j *Journal) GetMessage(ctx context.Context, id string, level DataLevel) (*gmail.Message, error) {
+	if j.isOffline() {
+		return nil, ErrOffline
+	}
+	ret, err := j.Backend.GetMessage(ctx, id, level)
+	return ret, j.check(err)
+}
+
+// GetRawMessage implements Backend.
+func (j *Journal) GetRawMessage(ctx context.Context, id string) (*gmail.Message, error) {
+	if j.isOffline() {
+		return nil, ErrOffline
+	}
+	ret, err := j.Backend.GetRawMessage(ctx, id)
+	return ret, j.check(err)
+}
+
+// ListThreads implements Backend.
+func (j *Journal) ListThreads(ctx context.Context, label, query, token string, max int64) (*gmail.ListThreadsResponse, error) {
+	if j.isOffline() {
+		return nil, ErrOffline
+	}
+	ret, err := j.Backend.ListThreads(ctx, label, query, token, max)
+	return ret, j.check(err)
+}
+
+// GetThread implements Backend.
+func (j *Journal) GetThread(ctx context.Context, id ThreadID, level DataLevel) (*gmail.Thread, error) {
+	if j.isOffline() {
+		return nil, ErrOffline
+	}
+	ret, err := j.Backend.GetThread(ctx, id, level)
+	return ret, j.check(err)
+}
+
+// History implements Backend.
+func (j *Journal) History(ctx context.Context, startID HistoryID, labelID string) ([]*gmail.History, HistoryID, error) {
+	if j.isOffline() {
+		return nil, 0, ErrOffline
+	}
+	hs, hid, err := j.Backend.History(ctx, startID, labelID)
+	return hs, hid, j.check(err)
+}
+
+// ListLabels implements Backend.
+func (j *Journal) ListLabels(ctx context.Context) ([]*gmail.Label, error) {
+	if j.isOffline() {
+		return nil, ErrOffline
+	}
+	ret, err := j.Backend.ListLabels(ctx)
+	return ret, j.check(err)
+}
+
+// CreateLabel implements Backend. Label changes are not queued, since
+// the ID of a new label comes from the server.
+func (j *Journal) CreateLabel(ctx context.Context, l *gmail.Label) (*gmail.Label, error) {
+	if j.isOffline() {
+		return nil, ErrOffline
+	}
+	ret, err := j.Backend.CreateLabel(ctx, l)
+	return ret, j.check(err)
+}
+
+// UpdateLabel implements Backend.
+func (j *Journal) UpdateLabel(ctx context.Context, l *gmail.Label) (*gmail.Label, error) {
+	if j.isOffline() {
+		return nil, ErrOffline
+	}
+	ret, err := j.Backend.UpdateLabel(ctx, l)
+	return ret, j.check(err)
+}
+
+// DeleteLabel implements Backend.
+func (j *Journal) DeleteLabel(ctx context.Context, id string) error {
+	if j.isOffline() {
+		return ErrOffline
+	}
+	return j.check(j.Backend.DeleteLabel(ctx, id))
+}
+
+// ListFilters implements Backend.
+func (j *Journal) ListFilters(ctx context.Context) ([]*gmail.Filter, error) {
+	if j.isOffline() {
+		return nil, ErrOffline
+	}
+	ret, err := j.Backend.ListFilters(ctx)
+	return ret, j.check(err)
+}
+
+// CreateFilter implements Backend.
+func (j *Journal) CreateFilter(ctx context.Context, f *gmail.Filter) (*gmail.Filter, error) {
+	if j.isOffline() {
+		return nil, ErrOffline
+	}
+	ret, err := j.Backend.CreateFilter(ctx, f)
+	return ret, j.check(err)
+}
+
+// DeleteFilter implements Backend.
+func (j *Journal) DeleteFilter(ctx context.Context, id string) error {
+	if j.isOffline() {
+		return ErrOffline
+	}
+	return j.check(j.Backend.DeleteFilter(ctx, id))
+}
+
+// GetVacation implements Backend.
+func (j *Journal) GetVacation(ctx context.Context) (*gmail.VacationSettings, error) {
+	if j.isOffline() {
+		return nil, ErrOffline
+	}
+	ret, err := j.Backend.GetVacation(ctx)
+	return ret, j.check(err)
+}
+
+// UpdateVacation implements Backend.
+func (j *Journal) UpdateVacation(ctx context.Context, v *gmail.VacationSettings) (*gmail.VacationSettings, error) {
+	if j.isOffline() {
+		return nil, ErrOffline
+	}
+	ret, err := j.Backend.UpdateVacation(ctx, v)
+	return ret, j.check(err)
+}
+
+// ListSendAs implements Backend.
+func (j *Journal) ListSendAs(ctx context.Context) ([]*gmail.SendAs, error) {
+	if j.isOffline() {
+		return nil, ErrOffline
+	}
+	ret, err := j.Backend.ListSendAs(ctx)
+	return ret, j.check(err)
+}
+
+// ImportMessage implements Backend.
+func (j *Journal) ImportMessage(ctx context.Context, msg string, labelIDs []string) (*gmail.Message, error) {
+	if j.isOffline() {
+		return nil, ErrOffline
+	}
+	ret, err := j.Backend.ImportMessage(ctx, msg, labelIDs)
+	return ret, j.check(err)
+}
+
+// BatchGetMessages implements Backend.
+func (j *Journal) BatchGetMessages(ctx context.Context, ids []string, level DataLevel) ([]*gmail.Message, []error) {
+	if j.isOffline() {
+		errs := make([]error, len(ids))
+		for n := range errs {
+			errs[n] = ErrOffline
+		}
+		return make([]*gmail.Message, len(ids)), errs
+	}
+	msgs, errs := j.Backend.BatchGetMessages(ctx, ids, level)
+	for _, err := range errs {
+		if IsNetworkError(err) {
+			j.check(err)
+			break
+		}
+	}
+	return msgs, errs
+}
+
+// GetAttachment implements Backend.
+func (j *Journal) GetAttachment(ctx context.Context, msgID, attachmentID string) (*gmail.MessagePartBody, error) {
+	if j.isOffline() {
+		return nil, ErrOffline
+	}
+	ret, err := j.Backend.GetAttachment(ctx, msgID, attachmentID)
+	return ret, j.check(err)
+}
+
+// ListDrafts implements Backend.
+func (j *Journal) ListDrafts(ctx context.Context) ([]*gmail.Draft, error) {
+	if j.isOffline() {
+		return nil, ErrOffline
+	}
+	ret, err := j.Backend.ListDrafts(ctx)
+	return ret, j.check(err)
+}
+
+// GetDraft implements Backend.
+func (j *Journal) GetDraft(ctx context.Context, id string, level DataLevel) (*gmail.Draft, error) {
+	if j.isOffline() {
+		return nil, ErrOffline
+	}
+	ret, err := j.Backend.GetDraft(ctx, id, level)
+	return ret, j.check(err)
+}
+
+// UpdateDraft implements Backend. Not queued, since the draft may
+// be changed or sent elsewhere in the meantime.
+func (j *Journal) UpdateDraft(ctx context.Context, id string, msg RawMessage) error {
+	if j.isOffline() {
+		return ErrOffline
+	}
+	return j.check(j.Backend.UpdateDraft(ctx, id, msg))
+}
+
+// DeleteDraft implements Backend.
+func (j *Journal) DeleteDraft(ctx context.Context, id string) error {
+	if j.isOffline() {
+		return ErrOffline
+	}
+	return j.check(j.Backend.DeleteDraft(ctx, id))
+}
+
+// ListConnections implements Backend.
+func (j *Journal) ListConnections(ctx context.Context, syncToken string) ([]*people.Person, string, error) {
+	if j.isOffline() {
+		return nil, "", ErrOffline
+	}
+	ret, next, err := j.Backend.ListConnections(ctx, syncToken)
+	return ret, next, j.check(err)
+}
+
+// ListFiles implements Backend.
+func (j *Journal) ListFiles(ctx context.Context) ([]*drive.File, error) {
+	if j.isOffline() {
+		return nil, ErrOffline
+	}
+	ret, err := j.Backend.ListFiles(ctx)
+	return ret, j.check(err)
+}
+
+// DownloadFile implements Backend.
+func (j *Journal) DownloadFile(ctx context.Context, id string) ([]byte, error) {
+	if j.isOffline() {
+		return nil, ErrOffline
+	}
+	ret, err := j.Backend.DownloadFile(ctx, id)
+	return ret, j.check(err)
+}
+
+// CreateFile implements Backend.
+func (j *Journal) CreateFile(ctx context.Context, name string, contents []byte) error {
+	if j.isOffline() {
+		return ErrOffline
+	}
+	return j.check(j.Backend.CreateFile(ctx, name, contents))
+}
+
+// UpdateFile implements Backend.
+func (j *Journal) UpdateFile(ctx context.Context, id, name string, contents []byte) error {
+	if j.isOffline() {
+		return ErrOffline
+	}
+	return j.check(j.Backend.UpdateFile(ctx, id, name, contents))
+}
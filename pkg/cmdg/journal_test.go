@@ -0,0 +1,387 @@
+package cmdg
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/pkg/errors"
+	gmail "google.golang.org/api/gmail/v1"
+)
+
+// flakyBackend fails with network errors while down.
+type flakyBackend struct {
+	Backend
+	down bool
+
+	// sendErr, if set, is returned by Send.
+	sendErr error
+}
+
+func (b *flakyBackend) err() error {
+	if b.down {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("network is unreachable")}
+	}
+	return nil
+}
+
+func (b *flakyBackend) ListMessages(ctx context.Context, label, query, token string, max int64) (*gmail.ListMessagesResponse, error) {
+	if err := b.err(); err != nil {
+		return nil, err
+	}
+	return b.Backend.ListMessages(ctx, label, query, token, max)
+}
+
+func (b *flakyBackend) BatchModify(ctx context.Context, ids, add, remove []string) error {
+	if err := b.err(); err != nil {
+		return err
+	}
+	return b.Backend.BatchModify(ctx, ids, add, remove)
+}
+
+func (b *flakyBackend) Send(ctx context.Context, threadID ThreadID, msg RawMessage) error {
+	if err := b.err(); err != nil {
+		return err
+	}
+	if b.sendErr != nil {
+		return b.sendErr
+	}
+	return b.Backend.Send(ctx, threadID, msg)
+}
+
+func (b *flakyBackend) SendDraft(ctx context.Context, d *gmail.Draft) error {
+	if err := b.err(); err != nil {
+		return err
+	}
+	if b.sendErr != nil {
+		return b.sendErr
+	}
+	return b.Backend.SendDraft(ctx, d)
+}
+
+func (b *flakyBackend) CreateDraft(ctx context.Context, msg RawMessage) error {
+	if err := b.err(); err != nil {
+		return err
+	}
+	return b.Backend.CreateDraft(ctx, msg)
+}
+
+func (b *flakyBackend) BatchDelete(ctx context.Context, ids []string) error {
+	if err := b.err(); err != nil {
+		return err
+	}
+	return b.Backend.BatchDelete(ctx, ids)
+}
+
+func (b *flakyBackend) GetProfile(ctx context.Context) (*gmail.Profile, error) {
+	if err := b.err(); err != nil {
+		return nil, err
+	}
+	return b.Backend.GetProfile(ctx)
+}
+
+func TestIsNetworkError(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{errors.New("nope"), false},
+		{ErrOffline, true},
+		{errors.Wrap(ErrOffline, "listing"), true},
+		{&net.OpError{Op: "dial", Err: errors.New("refused")}, true},
+		{errors.Wrap(&net.DNSError{Err: "no such host"}, "getting"), true},
+		{notFound("message", "123"), false},
+	} {
+		if got := IsNetworkError(test.err); got != test.want {
+			t.Errorf("IsNetworkError(%v) = %v, want %v", test.err, got, test.want)
+		}
+	}
+}
+
+func TestJournal(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cmdg-journal-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mem := NewMemBackend("bob@example.com")
+	id, err := mem.AddMessage(testMultipartMessage, "", []string{Inbox, Unread})
+	if err != nil {
+		t.Fatal(err)
+	}
+	flaky := &flakyBackend{Backend: mem}
+	c := NewWithBackend(flaky)
+	if err := c.UseJournal(path.Join(dir, "journal.json")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.UseDiskCache(path.Join(dir, "cache")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Populate cache while online.
+	if _, err := c.ListMessages(ctx, Inbox, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.backend.GetMessage(ctx, id, LevelFull); err != nil {
+		t.Fatal(err)
+	}
+
+	// Go offline.
+	flaky.down = true
+	if err := c.BatchArchive(ctx, []string{id}); err != nil {
+		t.Fatalf("Archive while offline: %v", err)
+	}
+	if err := c.backend.Send(ctx, NewThread, StringMessage("Subject: hello\r\n\r\nworld\r\n")); err != nil {
+		t.Fatalf("Send while offline: %v", err)
+	}
+	if off, n := c.Offline(); !off || n != 2 {
+		t.Errorf("Got offline=%v queued=%d, want true and 2", off, n)
+	}
+	m, err := c.backend.GetMessage(ctx, id, LevelFull)
+	if err != nil {
+		t.Fatalf("Reading cached message while offline: %v", err)
+	}
+	if hasString(m.LabelIds, Inbox) {
+		t.Errorf("Cached message still in inbox after offline archive: %v", m.LabelIds)
+	}
+	page, err := c.ListMessages(ctx, Inbox, "", "")
+	if err != nil {
+		t.Fatalf("Listing while offline: %v", err)
+	}
+	if got, want := len(page.Messages), 0; got != want {
+		t.Errorf("Got %d messages in offline inbox, want %d", got, want)
+	}
+
+	// Journal survives restart.
+	j, err := NewJournal(flaky, path.Join(dir, "journal.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if off, n := j.Status(); !off || n != 2 {
+		t.Errorf("Reloaded journal: got offline=%v queued=%d, want true and 2", off, n)
+	}
+
+	// Replay fails while still down.
+	if err := j.Replay(ctx); !IsNetworkError(err) {
+		t.Errorf("Replay while down: got %v, want network error", err)
+	}
+
+	// Back online, with one operation that will conflict.
+	flaky.down = false
+	j.entries = append(j.entries, &JournalEntry{Op: journalOpModify, IDs: []string{"gone"}, Add: []string{Starred}})
+	if err := j.Replay(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if off, n := j.Status(); off || n != 0 {
+		t.Errorf("After replay: got offline=%v queued=%d, want false and 0", off, n)
+	}
+	select {
+	case err := <-j.conflicts:
+		t.Logf("Got expected conflict: %v", err)
+	default:
+		t.Errorf("Expected a conflict")
+	}
+	res, err := mem.ListMessages(ctx, Inbox, "", "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(res.Messages), 0; got != want {
+		t.Errorf("Got %d messages in inbox after replay, want %d", got, want)
+	}
+	res, err = mem.ListMessages(ctx, "SENT", "", "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(res.Messages), 1; got != want {
+		t.Errorf("Got %d sent messages after replay, want %d", got, want)
+	}
+}
+
+func TestJournalSendUnknownOutcome(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cmdg-journal-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mem := NewMemBackend("bob@example.com")
+	id, err := mem.AddMessage(testMultipartMessage, "", []string{Inbox, Unread})
+	if err != nil {
+		t.Fatal(err)
+	}
+	flaky := &flakyBackend{Backend: mem}
+	c := NewWithBackend(flaky)
+	if err := c.UseJournal(path.Join(dir, "journal.json")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.UseDiskCache(path.Join(dir, "cache")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.backend.GetMessage(ctx, id, LevelFull); err != nil {
+		t.Fatal(err)
+	}
+
+	// Connection lost after the request was sent.
+	flaky.sendErr = &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}
+	msg := StringMessage("Subject: hello\r\n\r\nworld\r\n")
+	if err := c.backend.Send(ctx, NewThread, msg); err == nil || IsNetworkError(err) {
+		t.Errorf("Got send error %v, want non-network error", err)
+	}
+	if off, n := c.Offline(); !off || n != 0 {
+		t.Errorf("Got offline=%v queued=%d, want true and 0", off, n)
+	}
+
+	// Label changes while offline say they're queued.
+	if _, err := c.backend.ModifyMessage(ctx, id, []string{Starred}, nil); errors.Cause(err) != ErrQueued {
+		t.Errorf("Got modify error %v, want %v", err, ErrQueued)
+	}
+	if m := c.backend.(*DiskCache).get(id, string(LevelFull)); !hasString(m.LabelIds, Starred) {
+		t.Errorf("Queued label not in cache: %v", m.LabelIds)
+	}
+
+	// Replaying a queued send with unknown outcome saves a draft instead.
+	if err := c.backend.Send(ctx, NewThread, msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.journal.Replay(ctx); !IsNetworkError(err) {
+		t.Errorf("Replay: got %v, want network error", err)
+	}
+	select {
+	case err := <-c.Conflicts():
+		t.Logf("Got expected conflict: %v", err)
+	default:
+		t.Errorf("Expected a conflict")
+	}
+	if got, want := c.journal.entries[0].Op, journalOpDraft; got != want {
+		t.Errorf("Got queued op %q, want %q", got, want)
+	}
+	flaky.sendErr = nil
+	if err := c.journal.Replay(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if ds, err := mem.ListDrafts(ctx); err != nil || len(ds) != 1 {
+		t.Errorf("Got drafts %v %v, want one", ds, err)
+	}
+	res, err := mem.ListMessages(ctx, "SENT", "", "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(res.Messages), 0; got != want {
+		t.Errorf("Got %d sent messages, want %d", got, want)
+	}
+}
+
+func TestJournalDraftsAndDeletes(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cmdg-journal-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mem := NewMemBackend("bob@example.com")
+	id, err := mem.AddMessage(testMultipartMessage, "", []string{Inbox})
+	if err != nil {
+		t.Fatal(err)
+	}
+	draft := StringMessage("Subject: draft\r\n\r\nworld\r\n")
+	if err := mem.CreateDraft(ctx, draft); err != nil {
+		t.Fatal(err)
+	}
+	ds, err := mem.ListDrafts(ctx)
+	if err != nil || len(ds) != 1 {
+		t.Fatalf("Got drafts %v %v, want one", ds, err)
+	}
+	flaky := &flakyBackend{Backend: mem}
+	j, err := NewJournal(flaky, path.Join(dir, "journal.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Queued while offline.
+	j.SetOffline(ctx, true)
+	if err := j.BatchDelete(ctx, []string{id}); err != nil {
+		t.Errorf("Delete while offline: %v", err)
+	}
+	if err := j.SendDraft(ctx, ds[0]); err != nil {
+		t.Errorf("Send draft while offline: %v", err)
+	}
+	if err := j.CreateDraft(ctx, draft); err != nil {
+		t.Errorf("Save draft while offline: %v", err)
+	}
+	if off, n := j.Status(); !off || n != 3 {
+		t.Errorf("Got offline=%v queued=%d, want true and 3", off, n)
+	}
+	if _, err := mem.GetMessage(ctx, id, LevelMinimal); err != nil {
+		t.Errorf("Message deleted while offline: %v", err)
+	}
+
+	// The rest are refused.
+	if err := j.UpdateDraft(ctx, ds[0].Id, draft); err != ErrOffline {
+		t.Errorf("Got update draft error %v, want %v", err, ErrOffline)
+	}
+	if err := j.DeleteDraft(ctx, ds[0].Id); err != ErrOffline {
+		t.Errorf("Got delete draft error %v, want %v", err, ErrOffline)
+	}
+	if _, err := j.GetAttachment(ctx, id, "1"); err != ErrOffline {
+		t.Errorf("Got attachment error %v, want %v", err, ErrOffline)
+	}
+	if err := j.CreateFile(ctx, "signature.txt", nil); err != ErrOffline {
+		t.Errorf("Got create file error %v, want %v", err, ErrOffline)
+	}
+
+	// Not SetOffline, since that replays in the background.
+	j.forced = false
+	if err := j.Replay(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mem.GetMessage(ctx, id, LevelMinimal); err == nil {
+		t.Errorf("Message not deleted on replay")
+	}
+	res, err := mem.ListMessages(ctx, "SENT", "", "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(res.Messages), 1; got != want {
+		t.Errorf("Got %d sent messages after replay, want %d", got, want)
+	}
+	if ds, err = mem.ListDrafts(ctx); err != nil || len(ds) != 1 {
+		t.Fatalf("Got drafts %v %v after replay, want one", ds, err)
+	}
+
+	// A draft send of unknown outcome is not queued.
+	flaky.sendErr = &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}
+	if err := j.SendDraft(ctx, ds[0]); err == nil || IsNetworkError(err) {
+		t.Errorf("Got send draft error %v, want non-network error", err)
+	}
+	if off, n := j.Status(); !off || n != 0 {
+		t.Errorf("Got offline=%v queued=%d, want true and 0", off, n)
+	}
+
+	// And if it's replayed, it's dropped.
+	if err := j.SendDraft(ctx, ds[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Replay(ctx); !IsNetworkError(err) {
+		t.Errorf("Replay: got %v, want network error", err)
+	}
+	select {
+	case err := <-j.conflicts:
+		t.Logf("Got expected conflict: %v", err)
+	default:
+		t.Errorf("Expected a conflict")
+	}
+	if _, n := j.Status(); n != 0 {
+		t.Errorf("Got %d queued, want 0", n)
+	}
+	if ds, err := mem.ListDrafts(ctx); err != nil || len(ds) != 1 {
+		t.Errorf("Got drafts %v %v, want one", ds, err)
+	}
+}
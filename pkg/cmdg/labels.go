@@ -0,0 +1,212 @@
+package cmdg
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	gmail "google.golang.org/api/gmail/v1"
+)
+
+const (
+	// LabelSeparator separates parent and child in nested label names.
+	LabelSeparator = "/"
+)
+
+var (
+	// LabelPalette is the colors Gmail allows for labels, both for
+	// text and background.
+	LabelPalette = []string{
+		"#000000", "#434343", "#666666", "#999999", "#cccccc", "#efefef", "#f3f3f3", "#ffffff",
+		"#fb4c2f", "#ffad47", "#fad165", "#16a766", "#43d692", "#4a86e8", "#a479e2", "#f691b3",
+		"#f6c5be", "#ffe6c7", "#fef1d1", "#b9e4d0", "#c6f3de", "#c9daf8", "#e4d7f5", "#fcdee8",
+		"#efa093", "#ffd6a2", "#fce8b3", "#89d3b2", "#a0eac9", "#a4c2f4", "#d0bcf1", "#fbc8d9",
+		"#e66550", "#ffbc6b", "#fcda83", "#44b984", "#68dfa9", "#6d9eeb", "#b694e8", "#f7a7c0",
+		"#cc3a21", "#eaa041", "#f2c960", "#149e60", "#3dc789", "#3c78d8", "#8e63ce", "#e07798",
+		"#ac2b16", "#cf8933", "#d5ae49", "#0b804b", "#2a9c68", "#285bac", "#653e9b", "#b65775",
+		"#822111", "#a46a21", "#aa8831", "#076239", "#1a764d", "#1c4587", "#41236d", "#83334c",
+	}
+)
+
+// IsSystem returns true for labels like INBOX, that can't be changed.
+func (l *Label) IsSystem() bool {
+	l.m.Lock()
+	defer l.m.Unlock()
+	return l.Response != nil && l.Response.Type == "system"
+}
+
+// LabelColorSample returns a string showing what a label with the given colors looks like.
+func LabelColorSample(fg, bg, text string) string {
+	return fmt.Sprintf("%s%s\033[0m", colorMap(fg, bg), text)
+}
+
+// setLabel updates the label cache with a label from the API.
+func (c *CmdG) setLabel(l *gmail.Label) *Label {
+	c.m.Lock()
+	defer c.m.Unlock()
+	nl, found := c.labelCache[l.Id]
+	if !found {
+		nl = &Label{ID: l.Id}
+		c.labelCache[l.Id] = nl
+	}
+	nl.m.Lock()
+	defer nl.m.Unlock()
+	nl.Label = l.Name
+	nl.Response = l
+	return nl
+}
+
+// LabelByName returns the label with the given name, or nil.
+func (c *CmdG) LabelByName(name string) *Label {
+	for _, l := range c.Labels() {
+		l.m.Lock()
+		match := l.Label == name
+		l.m.Unlock()
+		if match {
+			return l
+		}
+	}
+	return nil
+}
+
+// CreateLabel creates a label. For nested labels ("Parent/Child")
+// any missing parents are created first, so that it shows up nested
+// in Gmail.
+func (c *CmdG) CreateLabel(ctx context.Context, name string) (*Label, error) {
+	name = strings.Trim(name, LabelSeparator)
+	if name == "" {
+		return nil, fmt.Errorf("empty label name")
+	}
+	if l := c.LabelByName(name); l != nil {
+		return nil, fmt.Errorf("label %q already exists", name)
+	}
+	parts := strings.Split(name, LabelSeparator)
+	for n := 1; n < len(parts); n++ {
+		parent := strings.Join(parts[:n], LabelSeparator)
+		if c.LabelByName(parent) != nil {
+			continue
+		}
+		if _, err := c.createLabel(ctx, parent); err != nil {
+			return nil, errors.Wrapf(err, "creating parent label %q", parent)
+		}
+	}
+	return c.createLabel(ctx, name)
+}
+
+func (c *CmdG) createLabel(ctx context.Context, name string) (*Label, error) {
+	l, err := c.backend.CreateLabel(ctx, &gmail.Label{
+		Name:                  name,
+		LabelListVisibility:   "labelShow",
+		MessageListVisibility: "show",
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "creating label %q", name)
+	}
+	log.Infof("Created label %q with ID %q", name, l.Id)
+	return c.setLabel(l), nil
+}
+
+// updateLabel changes a user label, and updates the cache.
+func (c *CmdG) updateLabel(ctx context.Context, id string, f func(*gmail.Label)) error {
+	c.m.RLock()
+	l, found := c.labelCache[id]
+	c.m.RUnlock()
+	if !found {
+		return fmt.Errorf("unknown label ID %q", id)
+	}
+	l.m.Lock()
+	if l.Response == nil {
+		l.m.Unlock()
+		return fmt.Errorf("unknown label ID %q", id)
+	}
+	if l.Response.Type == "system" {
+		l.m.Unlock()
+		return fmt.Errorf("%q is a system label, and can't be changed", l.Label)
+	}
+	// Copy the slices too, so f can't change the cached label.
+	nl := *l.Response
+	nl.ForceSendFields = append([]string(nil), nl.ForceSendFields...)
+	nl.NullFields = append([]string(nil), nl.NullFields...)
+	l.m.Unlock()
+	f(&nl)
+	ret, err := c.backend.UpdateLabel(ctx, &nl)
+	if err != nil {
+		return errors.Wrapf(err, "updating label %q", nl.Name)
+	}
+	c.setLabel(ret)
+	return nil
+}
+
+// RenameLabel renames a label. Nested labels under it are renamed too.
+func (c *CmdG) RenameLabel(ctx context.Context, id, name string) error {
+	name = strings.Trim(name, LabelSeparator)
+	if name == "" {
+		return fmt.Errorf("empty label name")
+	}
+	c.m.RLock()
+	l, found := c.labelCache[id]
+	c.m.RUnlock()
+	if !found {
+		return fmt.Errorf("unknown label ID %q", id)
+	}
+	l.m.Lock()
+	old := l.Label
+	l.m.Unlock()
+	if err := c.updateLabel(ctx, id, func(l *gmail.Label) { l.Name = name }); err != nil {
+		return err
+	}
+	for _, child := range c.Labels() {
+		if !strings.HasPrefix(child.Label, old+LabelSeparator) {
+			continue
+		}
+		nn := name + strings.TrimPrefix(child.Label, old)
+		if err := c.updateLabel(ctx, child.ID, func(l *gmail.Label) { l.Name = nn }); err != nil {
+			return errors.Wrapf(err, "renaming nested label %q", child.Label)
+		}
+	}
+	return nil
+}
+
+// SetLabelColor sets text and background color of a label. Both
+// must be in LabelPalette. Empty strings remove the color.
+func (c *CmdG) SetLabelColor(ctx context.Context, id, fg, bg string) error {
+	if (fg == "") != (bg == "") {
+		return fmt.Errorf("both or neither of text and background color must be set")
+	}
+	for _, col := range []string{fg, bg} {
+		if col != "" && !hasString(LabelPalette, col) {
+			return fmt.Errorf("color %q not allowed by Gmail", col)
+		}
+	}
+	return c.updateLabel(ctx, id, func(l *gmail.Label) {
+		if fg == "" {
+			l.Color = nil
+			l.NullFields = append(l.NullFields, "Color")
+			return
+		}
+		l.Color = &gmail.LabelColor{
+			TextColor:       fg,
+			BackgroundColor: bg,
+		}
+	})
+}
+
+// DeleteLabel deletes a label. Messages keep existing, but lose the
+// label. Nested labels under it are not deleted.
+func (c *CmdG) DeleteLabel(ctx context.Context, id string) error {
+	c.m.RLock()
+	l, found := c.labelCache[id]
+	c.m.RUnlock()
+	if found && l.IsSystem() {
+		return fmt.Errorf("%q is a system label, and can't be deleted", l.Label)
+	}
+	if err := c.backend.DeleteLabel(ctx, id); err != nil {
+		return errors.Wrapf(err, "deleting label %q", id)
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	delete(c.labelCache, id)
+	return nil
+}
@@ -0,0 +1,94 @@
+package cmdg
+
+import (
+	"context"
+	"testing"
+)
+
+func TestLabelManagement(t *testing.T) {
+	ctx := context.Background()
+	b := NewMemBackend("me@example.com")
+	c := NewWithBackend(b)
+	if err := c.LoadLabels(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nested create also creates parent.
+	child, err := c.CreateLabel(ctx, "Work/Project")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent := c.LabelByName("Work")
+	if parent == nil {
+		t.Fatalf("Parent label not created")
+	}
+	if _, err := c.CreateLabel(ctx, "Work"); err == nil {
+		t.Errorf("Creating existing label succeeded")
+	}
+
+	id, err := b.AddMessage("From: alice@example.com\r\nSubject: Hi\r\n\r\nHello\r\n", "", []string{Inbox, child.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rename cascades to nested labels, and is visible without reload.
+	if err := c.RenameLabel(ctx, parent.ID, "Job"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := child.Label, "Job/Project"; got != want {
+		t.Errorf("Got nested label name %q after rename, want %q", got, want)
+	}
+	if l, err := b.GetLabel(ctx, child.ID); err != nil {
+		t.Fatal(err)
+	} else if got, want := l.Name, "Job/Project"; got != want {
+		t.Errorf("Got backend label name %q, want %q", got, want)
+	}
+
+	// Color.
+	if err := c.SetLabelColor(ctx, child.ID, "#000000", "#fb4c2f"); err != nil {
+		t.Fatal(err)
+	}
+	if child.LabelColor() == "" {
+		t.Errorf("Label has no color after setting it")
+	}
+	if err := c.SetLabelColor(ctx, child.ID, "#000000", "#123456"); err == nil {
+		t.Errorf("Setting color not in palette succeeded")
+	}
+	// Removing the color must not write to the cached label's fields.
+	nullFields := make([]string, 0, 1)
+	child.m.Lock()
+	child.Response.NullFields = nullFields
+	child.m.Unlock()
+	if err := c.SetLabelColor(ctx, child.ID, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if got := nullFields[:1][0]; got != "" {
+		t.Errorf("Cached label NullFields changed to %q", got)
+	}
+	if got := child.LabelColor(); got != "" {
+		t.Errorf("Label has color %q after removing it", got)
+	}
+
+	// System labels can't be changed.
+	if err := c.RenameLabel(ctx, Inbox, "Foo"); err == nil {
+		t.Errorf("Renaming system label succeeded")
+	}
+	if err := c.DeleteLabel(ctx, Inbox); err == nil {
+		t.Errorf("Deleting system label succeeded")
+	}
+
+	// Delete removes it from messages and the cache.
+	if err := c.DeleteLabel(ctx, child.ID); err != nil {
+		t.Fatal(err)
+	}
+	if c.LabelByName("Job/Project") != nil {
+		t.Errorf("Deleted label still in cache")
+	}
+	m, err := b.GetMessage(ctx, id, LevelMinimal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hasString(m.LabelIds, child.ID) {
+		t.Errorf("Message still has deleted label: %q", m.LabelIds)
+	}
+}
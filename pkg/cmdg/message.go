@@ -1,17 +1,12 @@
 package cmdg
 
 import (
-	"bytes"
 	"context"
 	"encoding/base64"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"mime"
-	"mime/multipart"
-	"mime/quotedprintable"
 	"net/mail"
-	"os/exec"
+	"path"
 	"regexp"
 	"runtime/debug"
 	"strings"
@@ -21,6 +16,7 @@ import (
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding"
 	gmail "google.golang.org/api/gmail/v1"
 
 	"github.com/ThomasHabets/cmdg/pkg/display"
@@ -47,7 +43,8 @@ var (
 	GPG *gpg.GPG
 
 	// Lynx is the executable to use as web browser to use to render HTML to text.
-	Lynx = "lynx"
+	// If empty, the built-in renderer is used.
+	Lynx = ""
 
 	// Openssl is the executable is used to verify some signatures.
 	Openssl = "openssl"
@@ -79,7 +76,9 @@ type Attachment struct {
 	ID       string
 	MsgID    string
 	conn     *CmdG
+	msg      *Message
 	contents []byte
+	secret   bool
 	Part     *gmail.MessagePart
 }
 
@@ -88,11 +87,12 @@ func (a *Attachment) Download(ctx context.Context) ([]byte, error) {
 	if a.contents != nil {
 		return a.contents, nil
 	}
-	var body *gmail.MessagePartBody
-	err := wrapLogRPC("gmail.Users.Messages.Attachments.Get", func() (err error) {
-		body, err = a.conn.gmail.Users.Messages.Attachments.Get(email, a.MsgID, a.ID).Context(ctx).Do()
-		return
-	}, "email=%q msg=%v attachment=%v", email, a.MsgID, a.ID)
+	if a.ID == "" {
+		// Gmail may expand an attached message into parts,
+		// without giving it an attachment ID.
+		return a.fromRaw(ctx)
+	}
+	body, err := a.conn.backend.GetAttachment(ctx, a.MsgID, a.ID)
 	if err != nil {
 		return nil, err
 	}
@@ -103,6 +103,94 @@ func (a *Attachment) Download(ctx context.Context) ([]byte, error) {
 	return []byte(d), nil
 }
 
+// fromRaw extracts the attachment from the raw message it's in.
+func (a *Attachment) fromRaw(ctx context.Context) ([]byte, error) {
+	raw, err := a.msg.Raw(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "getting raw message for attachment %q", a.Name())
+	}
+	root, err := parseRawMessage(raw)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing raw message for attachment %q", a.Name())
+	}
+	p := findPart(root, a.Part.PartId)
+	if p == nil {
+		return nil, fmt.Errorf("attachment %q: part %q not in raw message", a.Name(), a.Part.PartId)
+	}
+	d, err := MIMEDecode(p.Body.Data)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(d), nil
+}
+
+// findPart returns the part with a part ID, or nil.
+func findPart(p *gmail.MessagePart, id string) *gmail.MessagePart {
+	if p.PartId == id {
+		return p
+	}
+	for _, sub := range p.Parts {
+		if f := findPart(sub, id); f != nil {
+			return f
+		}
+	}
+	return nil
+}
+
+// Secret returns true if the attachment was decrypted, and so should
+// only be written to disk if the user explicitly saves it.
+func (a *Attachment) Secret() bool {
+	return a.secret
+}
+
+// IsMessage returns true if the attachment is an email message.
+func (a *Attachment) IsMessage() bool {
+	return a.Part.MimeType == "message/rfc822" || strings.EqualFold(path.Ext(a.Part.Filename), ".eml")
+}
+
+// Name returns the attachment file name. Attached messages without a
+// file name are named after their subject.
+func (a *Attachment) Name() string {
+	if a.Part.Filename != "" || !a.IsMessage() {
+		return a.Part.Filename
+	}
+	for _, p := range a.Part.Parts {
+		if s := headerValue(p, "Subject"); s != "" {
+			return subjectStripRE.ReplaceAllString(s, "") + ".eml"
+		}
+	}
+	return ""
+}
+
+// Message parses an attached email message. The message is not in the
+// mailbox, so it has no labels, and can't be modified.
+func (a *Attachment) Message(ctx context.Context) (*Message, error) {
+	data, err := a.Download(ctx)
+	if err != nil {
+		return nil, err
+	}
+	raw := string(data)
+	part, err := parseRawMessage(raw)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing attached message %q", a.Name())
+	}
+	msg := &Message{
+		conn:   a.conn,
+		ID:     fmt.Sprintf("%s/%s", a.MsgID, a.Part.PartId),
+		raw:    raw,
+		parent: a.msg,
+		secret: a.secret,
+	}
+	if err := msg.setResponse(ctx, &gmail.Message{
+		Id:           msg.ID,
+		Payload:      part,
+		SizeEstimate: int64(len(raw)),
+	}, LevelFull); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
 // Message is an email message.
 type Message struct {
 	m       sync.RWMutex
@@ -119,6 +207,17 @@ type Message struct {
 
 	raw         string
 	attachments []*Attachment
+
+	// parent is the message this message is attached to, if any.
+	parent *Message
+
+	// decrypted is the decrypted content of a PGP/MIME message.
+	decrypted *gmail.MessagePart
+
+	// secret is set if the message was encrypted, or attached to one.
+	// Its attachments must then not be written to disk unless the user
+	// asks for it.
+	secret bool
 }
 
 // ThreadID returns the thread ID of the message.
@@ -163,11 +262,7 @@ func (msg *Message) rawNoLock(ctx context.Context) (string, error) {
 		return msg.raw, nil
 	}
 
-	var m *gmail.Message
-	err := wrapLogRPC("gmail.Users.Messages.Get", func() (err error) {
-		m, err = msg.conn.gmail.Users.Messages.Get(email, msg.ID).Format(levelRaw).Context(ctx).Do()
-		return
-	}, "email=%q msg=%v level=%s", email, msg.ID, levelRaw)
+	m, err := msg.conn.backend.GetRawMessage(ctx, msg.ID)
 	if err != nil {
 		return "", err
 	}
@@ -179,20 +274,57 @@ func (msg *Message) rawNoLock(ctx context.Context) (string, error) {
 	return msg.raw, nil
 }
 
+// Parent returns the message this message is attached to, or nil if
+// it's a message in the mailbox.
+func (msg *Message) Parent() *Message {
+	return msg.parent
+}
+
+// attachmentParts returns the attachments among the parts, looking
+// inside multiparts but not inside attached messages.
+func attachmentParts(parts []*gmail.MessagePart) []*gmail.MessagePart {
+	var ret []*gmail.MessagePart
+	for _, p := range parts {
+		if partIsAttachment(p) {
+			ret = append(ret, p)
+		} else if strings.HasPrefix(p.MimeType, "multipart/") {
+			ret = append(ret, attachmentParts(p.Parts)...)
+		}
+	}
+	return ret
+}
+
 // called with lock held
 func (msg *Message) annotateAttachments() error {
+	root := msg.Response.Payload
+	if msg.decrypted != nil {
+		// Decrypted attachments replace the encrypted data.
+		root = msg.decrypted
+	}
 	var bodystr []string
-	for _, p := range msg.Response.Payload.Parts {
-		if !partIsAttachment(p) {
-			continue
+	for _, p := range attachmentParts(root.Parts) {
+		a := &Attachment{
+			MsgID:  msg.ID,
+			ID:     p.Body.AttachmentId,
+			Part:   p,
+			conn:   msg.conn,
+			msg:    msg,
+			secret: msg.secret,
+		}
+		if a.ID == "" && p.Body.Data != "" {
+			// Some backends give us the data inline.
+			d, err := MIMEDecode(p.Body.Data)
+			if err != nil {
+				return errors.Wrapf(err, "decoding inline attachment %q", p.Filename)
+			}
+			a.contents = []byte(d)
+		}
+		msg.attachments = append(msg.attachments, a)
+		if a.IsMessage() {
+			bodystr = append(bodystr, fmt.Sprintf("%s\n<<<Attached message %q; press 't' to view>>>", display.Bold, a.Name()))
+		} else {
+			bodystr = append(bodystr, fmt.Sprintf("%s\n<<<Attachment %q; press 't' to view>>>", display.Bold, p.Filename))
 		}
-		msg.attachments = append(msg.attachments, &Attachment{
-			MsgID: msg.ID,
-			ID:    p.Body.AttachmentId,
-			Part:  p,
-			conn:  msg.conn,
-		})
-		bodystr = append(bodystr, fmt.Sprintf("%s\n<<<Attachment %q; press 't' to view>>>", display.Bold, p.Filename))
 	}
 	msg.body += strings.Join(bodystr, "\n")
 	return nil
@@ -262,14 +394,12 @@ func (msg *Message) HasLabel(labelID string) bool {
 
 // RemoveLabelID removes a label.
 func (msg *Message) RemoveLabelID(ctx context.Context, labelID string) error {
-	var nm *gmail.Message
 	st := time.Now()
-	err := wrapLogRPC("gmail.Users.Messages.Modify", func() (err error) {
-		nm, err = msg.conn.gmail.Users.Messages.Modify(email, msg.ID, &gmail.ModifyMessageRequest{
-			RemoveLabelIds: []string{labelID},
-		}).Context(ctx).Do()
-		return
-	}, "%q msg=%v remove_labelID=%v", email, msg.ID, labelID)
+	nm, err := msg.conn.backend.ModifyMessage(ctx, msg.ID, nil, []string{labelID})
+	if errors.Cause(err) == ErrQueued {
+		msg.RemoveLabelIDLocal(labelID)
+		return nil
+	}
 	if err != nil {
 		return errors.Wrapf(err, "removing label ID %q from %q", labelID, msg.ID)
 	}
@@ -327,16 +457,24 @@ func (msg *Message) LocalLabels() []string {
 	return msg.Response.LabelIds
 }
 
+// setLabels replaces the label IDs, keeping everything else.
+func (msg *Message) setLabels(ids []string) {
+	msg.m.Lock()
+	defer msg.m.Unlock()
+	if msg.Response == nil {
+		return
+	}
+	msg.Response.LabelIds = ids
+}
+
 // AddLabelID adds a label to a message.
 func (msg *Message) AddLabelID(ctx context.Context, labelID string) error {
 	st := time.Now()
-	var nm *gmail.Message
-	err := wrapLogRPC("gmail.Users.Messages.Modify", func() (err error) {
-		nm, err = msg.conn.gmail.Users.Messages.Modify(email, msg.ID, &gmail.ModifyMessageRequest{
-			AddLabelIds: []string{labelID},
-		}).Context(ctx).Do()
-		return
-	}, "email=%q msg=%v add_labelID=%v", email, msg.ID, labelID)
+	nm, err := msg.conn.backend.ModifyMessage(ctx, msg.ID, []string{labelID}, nil)
+	if errors.Cause(err) == ErrQueued {
+		msg.AddLabelIDLocal(labelID)
+		return nil
+	}
 	if err != nil {
 		return errors.Wrapf(err, "removing label ID %q from %q", labelID, msg.ID)
 	}
@@ -563,11 +701,7 @@ func (msg *Message) GetLabels(ctx context.Context, withUnread bool) ([]*Label, e
 		// Not loaded. Load it.
 		if l3.Response == nil {
 			log.Infof("Late loading of label ID %q", l)
-			var l4 *gmail.Label
-			err := wrapLogRPC("gmail.Users.Messages.Labels.Get", func() (err error) {
-				l4, err = msg.conn.gmail.Users.Labels.Get(email, l).Context(ctx).Do()
-				return
-			}, "email=%q labelID=%v", email, l)
+			l4, err := msg.conn.backend.GetLabel(ctx, l)
 			if err != nil {
 				log.Errorf("Failed to fetch label ID %q: %v", l, err)
 			}
@@ -759,12 +893,62 @@ func MIMEDecode(s string) (string, error) {
 	return string(data), err
 }
 
+// partText returns the body of a text part, converted to UTF-8.
+func partText(p *gmail.MessagePart) (string, error) {
+	dec, err := MIMEDecode(p.Body.Data)
+	if err != nil {
+		return "", err
+	}
+	ct := headerValue(p, "Content-Type")
+	if ct == "" {
+		ct = p.MimeType
+	}
+	return toUTF8(ct, dec), nil
+}
+
+// toUTF8 converts text to UTF-8 from the charset given in its
+// Content-Type, or for HTML in a <meta> tag. Non-text, and text with
+// unknown charsets, is returned as is.
+func toUTF8(ct, s string) string {
+	mt, params, err := mime.ParseMediaType(ct)
+	if err != nil && err != mime.ErrInvalidMediaParameter {
+		return s
+	}
+	if !strings.HasPrefix(mt, "text/") {
+		return s
+	}
+	cs := strings.TrimSpace(params["charset"])
+	var e encoding.Encoding
+	switch {
+	case cs != "":
+		e, _ = charset.Lookup(cs)
+		if e == nil {
+			log.Warningf("No decoder for charset %q", cs)
+			return s
+		}
+	case mt == "text/html":
+		e, cs, _ = charset.DetermineEncoding([]byte(s), ct)
+	default:
+		return s
+	}
+	ret, err := e.NewDecoder().String(s)
+	if err != nil {
+		log.Warningf("Decoding charset %q: %v", cs, err)
+		return s
+	}
+	return ret
+}
+
 var unprintableRE = regexp.MustCompile(`[\033\r]`)
 
 func stripUnprintable(s string) string {
 	return unprintableRE.ReplaceAllString(s, "")
 }
 func partIsAttachment(p *gmail.MessagePart) bool {
+	if p.MimeType == "message/rfc822" {
+		// Viewed as a message of its own, not as part of the body.
+		return true
+	}
 	for _, head := range p.Headers {
 		if head.Name == "Content-Disposition" {
 			// TODO: Is this the correct way? Maybe check "attachment" instead?
@@ -775,16 +959,22 @@ func partIsAttachment(p *gmail.MessagePart) bool {
 }
 
 func htmlRender(ctx context.Context, s string) (string, error) {
-	var stdout bytes.Buffer
 	st := time.Now()
-	cmd := exec.CommandContext(ctx, Lynx, "-dump", "-stdin")
-	cmd.Stdin = strings.NewReader(s)
-	cmd.Stdout = &stdout
-	if err := cmd.Run(); err != nil {
+	out, truncated, err := renderHTMLLimited(ctx, s, htmlWidth())
+	if err != nil {
 		return "", err
 	}
 	log.Infof("Rendered HTML in %v", time.Since(st))
-	return fmt.Sprintf("%sRendered HTML%s\n%s", display.Blue, display.Reset, stdout.String()), nil
+	if truncated {
+		out = fmt.Sprintf("%s\n%sRendered HTML truncated at %d bytes%s\n", out, display.Red, *htmlMaxOutput, display.Reset)
+	}
+	return fmt.Sprintf("%sRendered HTML%s\n%s", display.Blue, display.Reset, out), nil
+}
+
+// htmlFailed is the notice shown above the fallback when HTML can't be rendered.
+func htmlFailed(err error, showing string) string {
+	log.Warningf("Rendering HTML: %v", err)
+	return fmt.Sprintf("%sRendering HTML failed: %v. Showing %s.%s\n", display.Red, err, showing, display.Reset)
 }
 
 var errNoUsablePart = fmt.Errorf("could not find message part usable as message body")
@@ -799,20 +989,26 @@ func makeBodyAlt(ctx context.Context, part *gmail.MessagePart, preferHTML bool)
 
 	var ret []string
 	var alt []string
+	var failed []string
+	var renderErr error
 	for _, p := range part.Parts {
 		if partIsAttachment(p) {
 			continue
 		}
-		dec, err := MIMEDecode(string(p.Body.Data))
+		dec, err := partText(p)
 		if err != nil {
 			return "", err
 		}
 
 		if p.MimeType == "text/html" {
-			dec, err = htmlRender(ctx, dec)
+			r, err := htmlRender(ctx, dec)
 			if err != nil {
-				return "", errors.Wrapf(err, "rendering HTML")
+				// Prefer any other part over the HTML source.
+				renderErr = err
+				failed = append(failed, stripUnprintable(dec))
+				continue
 			}
+			dec = r
 		}
 
 		log.Debugf("Alt mimetype: %q", p.MimeType)
@@ -825,7 +1021,7 @@ func makeBodyAlt(ctx context.Context, part *gmail.MessagePart, preferHTML bool)
 			if len(strings.Trim(dec, "\n\r \t")) > 0 {
 				alt = append(alt, dec)
 			}
-		case "multipart/alternative", "multipart/related", "multipart/signed", "multipart/mixed", "message/rfc822":
+		case "multipart/alternative", "multipart/related", "multipart/signed", "multipart/mixed", "multipart/report":
 			t, err := makeBodyAlt(ctx, p, preferHTML)
 			if err != nil {
 				return "", err
@@ -833,33 +1029,50 @@ func makeBodyAlt(ctx context.Context, part *gmail.MessagePart, preferHTML bool)
 			// However it was rendered it should be rendered.
 			ret = append(ret, t)
 			alt = append(alt, t)
+		case "message/delivery-status", "text/rfc822-headers":
+			// Parts of bounce reports.
+			ret = append(ret, dec)
+			alt = append(alt, dec)
 		case "application/pkcs7-signature":
 			// Ignored for now.
 		default:
 			log.Warningf("Unknown mimetype in alt: %q", p.MimeType)
 		}
 	}
+	notice := ""
 	if len(ret) > 0 {
-		return strings.Join(ret, "\n"), nil
+		if renderErr != nil && preferHTML {
+			notice = htmlFailed(renderErr, "other parts")
+		}
+		return notice + strings.Join(ret, "\n"), nil
+	}
+	if len(alt) > 0 {
+		if renderErr != nil {
+			notice = htmlFailed(renderErr, "other parts")
+		}
+		return notice + strings.Join(alt, "\n"), nil
+	}
+	if renderErr != nil {
+		notice = htmlFailed(renderErr, "HTML source")
 	}
-	return strings.Join(alt, "\n"), nil
+	return notice + strings.Join(failed, "\n"), nil
 }
 
 func makeBody(ctx context.Context, part *gmail.MessagePart, preferHTML bool) (string, error) {
 	if len(part.Parts) == 0 {
 		log.Infof("Single part body of type %q with input len %d", part.MimeType, len(part.Body.Data))
-		data, err := MIMEDecode(string(part.Body.Data))
+		data, err := partText(part)
 		if err != nil {
 			return "", err
 		}
 
 		data = stripUnprintable(data)
 		if part.MimeType == "text/html" {
-			var err error
-			data, err = htmlRender(ctx, data)
+			r, err := htmlRender(ctx, data)
 			if err != nil {
-				return "", errors.Wrapf(err, "rendering HTML")
+				return htmlFailed(err, "HTML source") + data, nil
 			}
+			return r, nil
 		}
 		return data, nil
 	}
@@ -895,14 +1108,7 @@ func (msg *Message) GetUnpatchedBody(ctx context.Context) (string, error) {
 // ReloadLabels reloads label data for the message.
 func (msg *Message) ReloadLabels(ctx context.Context) error {
 	log.Debugf("Reloading labels of %q %s", msg.ID, string(debug.Stack()))
-	var msg2 *gmail.Message
-	err := wrapLogRPC("gmail.Users.Messages.Get", func() (err error) {
-		msg2, err = msg.conn.gmail.Users.Messages.Get(email, msg.ID).
-			Format(string(LevelMinimal)).
-			Context(ctx).
-			Do()
-		return
-	}, "email=%q msgID=%v level=%s", email, msg.ID, LevelMinimal)
+	msg2, err := msg.conn.backend.GetMessage(ctx, msg.ID, LevelMinimal)
 	if err != nil {
 		return err
 	}
@@ -958,11 +1164,7 @@ func (msg *Message) trySigned(ctx context.Context) error {
 	}
 
 	// Fetch attachment.
-	var body *gmail.MessagePartBody
-	err := wrapLogRPC("gmail.Users.Messages.Attachments.Get", func() (err error) {
-		body, err = msg.conn.gmail.Users.Messages.Attachments.Get(email, msg.ID, partSig.Body.AttachmentId).Context(ctx).Do()
-		return err
-	}, "email=%q msgID=%v attachmentID=%v", email, msg.ID, partSig.Body.AttachmentId)
+	body, err := msg.conn.backend.GetAttachment(ctx, msg.ID, partSig.Body.AttachmentId)
 	if err != nil {
 		return errors.Wrap(err, "failed to download signature attachment")
 	}
@@ -1022,19 +1224,19 @@ func (msg *Message) tryGPGEncrypted(ctx context.Context) error {
 		}
 	}
 	if partMeta == nil || partData == nil {
-		log.Warningf("Encrypted packet missing either meta or data")
+		return errors.Errorf("encrypted packet missing either meta or data")
 	}
 
 	// Fetch data attachment.
-	var body *gmail.MessagePartBody
-	err := wrapLogRPC("gmail.Users.Messages.Attachments.Get", func() (err error) {
-		body, err = msg.conn.gmail.Users.Messages.Attachments.Get(email, msg.ID, partData.Body.AttachmentId).Context(ctx).Do()
-		return
-	}, "email=%q msgID=%v attachmentID=%v", email, msg.ID, partData.Body.AttachmentId)
-	if err != nil {
-		return errors.Wrap(err, "failed to download encrypted data attachment")
+	data := partData.Body.Data
+	if data == "" {
+		body, err := msg.conn.backend.GetAttachment(ctx, msg.ID, partData.Body.AttachmentId)
+		if err != nil {
+			return errors.Wrap(err, "failed to download encrypted data attachment")
+		}
+		data = body.Data
 	}
-	dec, err := MIMEDecode(body.Data)
+	dec, err := MIMEDecode(data)
 	if err != nil {
 		return errors.Wrap(err, "failed to MIME decode encrypted data attachment")
 	}
@@ -1045,84 +1247,26 @@ func (msg *Message) tryGPGEncrypted(ctx context.Context) error {
 		return err
 	}
 
-	msg2, err := mail.ReadMessage(strings.NewReader(dec2))
+	// The decrypted message is only kept in memory, attachments included.
+	part, err := parseRawMessage(dec2)
 	if err != nil {
-		return err
+		return errors.Wrap(err, "parsing decrypted message")
 	}
-
-	mediaType, params, err := mime.ParseMediaType(msg2.Header.Get("Content-Type"))
-	if err != nil {
-		return err
+	msg.decrypted = part
+	msg.secret = true
+	msg.body, err = makeBody(ctx, part, false)
+	if err != nil && err != errNoUsablePart {
+		return errors.Wrap(err, "failed to decrypt")
 	}
-	if strings.HasPrefix(mediaType, "multipart/") {
-		log.Infof("Multipart encrypted with media type %q", mediaType)
-		mr := multipart.NewReader(msg2.Body, params["boundary"])
-		for {
-			p, err := mr.NextPart()
-			if err == io.EOF {
-				break
-			}
-			if err != nil {
-				return errors.Wrap(err, "failed to get mime part")
-			}
-			dec, err := toUTF8Reader(map[string][]string(p.Header), p)
-			t, err := ioutil.ReadAll(dec)
-			if err != nil {
-				return errors.Wrap(err, "utf8reading mime part")
-			}
-			ct := p.Header.Get("Content-Type")
-			mt, _, err := mime.ParseMediaType(ct)
-			if err != nil {
-				return errors.Wrapf(err, "parsing content-type %q", ct)
-			}
-			if p.FileName() == "" {
-				np := &gmail.MessagePart{
-					MimeType: mt,
-					Body: &gmail.MessagePartBody{
-						Data: MIMEEncode(string(t)),
-					},
-				}
-				msg.body, err = makeBody(ctx, np, false)
-				if err != nil {
-					return errors.Wrap(err, "failed to decrypt")
-				}
-			} else {
-				// TODO: handle attachment.
-			}
-		}
-
-	} else {
-		r, err := toUTF8Reader(map[string][]string(msg2.Header), msg2.Body)
-		t, err := ioutil.ReadAll(r)
-		if err != nil {
-			return err
-		}
-		msg.body = string(t)
+	msg.bodyHTML, err = makeBody(ctx, part, true)
+	if err != nil && err != errNoUsablePart {
+		return errors.Wrap(err, "failed to decrypt")
 	}
 
 	msg.gpgStatus = status
 	return nil
 }
 
-func toUTF8Reader(header mail.Header, r io.Reader) (io.Reader, error) {
-	_, params, err := mime.ParseMediaType(header.Get("Content-Type"))
-	if err != nil {
-		return nil, err
-	}
-	switch header.Get("Content-Transfer-Encoding") {
-	case "quoted-printable":
-		r = quotedprintable.NewReader(r)
-	case "base64":
-		r = base64.NewDecoder(base64.StdEncoding, r)
-	}
-	e, _ := charset.Lookup(params["charset"])
-	if e != nil {
-		return e.NewDecoder().Reader(r), nil
-	}
-	log.Printf("No decoder for charset %q", params["charset"])
-	return r, nil
-}
-
 // Reload unconditionally reloads the message.
 func (msg *Message) Reload(ctx context.Context, level DataLevel) error {
 	return msg.load(ctx, level)
@@ -1139,21 +1283,27 @@ func (msg *Message) Preload(ctx context.Context, level DataLevel) error {
 func (msg *Message) load(ctx context.Context, level DataLevel) error {
 	st := time.Now()
 	log.Debugf("Loading message %q at level %v, stack %s", msg.ID, level, string(debug.Stack()))
-	var msg2 *gmail.Message
-	err := wrapLogRPC("gmail.Users.Messages.Get", func() (err error) {
-		msg2, err = msg.conn.gmail.Users.Messages.Get(email, msg.ID).
-			Format(string(level)).
-			Context(ctx).
-			Do()
-		return
-	}, "email=%q msgID=%v level=%s", email, msg.ID, level)
+	msg2, err := msg.conn.backend.GetMessage(ctx, msg.ID, level)
 	if err != nil {
 		return err
 	}
 	log.Debugf("Downloading message %q level %q took %v", msg.ID, level, time.Since(st))
+	return msg.setResponse(ctx, msg2, level)
+}
 
+// setResponse fills in the message from an API response.
+func (msg *Message) setResponse(ctx context.Context, msg2 *gmail.Message, level DataLevel) error {
+	var err error
 	msg.m.Lock()
 	defer msg.m.Unlock()
+	if msg.Response != nil && msg.level != level && hasData(msg.level, level) {
+		// Already loaded at a better level, e.g. by a full load
+		// that finished before a batch preload.
+		if msg2.HistoryId >= msg.Response.HistoryId {
+			msg.Response.LabelIds = msg2.LabelIds
+		}
+		return nil
+	}
 	msg.Response = msg2
 	msg.level = level
 	msg.headers = make(map[string]string)
@@ -1239,11 +1389,8 @@ func (d *Draft) load(ctx context.Context, level DataLevel) error {
 		return nil
 	}
 	log.Debugf("Loading draft %q at level %v %s", d.ID, level, string(debug.Stack()))
-	var r *gmail.Draft
-	if err := wrapLogRPC("gmail.User.Drafts.Get", func() (err error) {
-		r, err = d.conn.gmail.Users.Drafts.Get(email, d.ID).Context(ctx).Format(string(level)).Do()
-		return
-	}, "email=%q msgID=%v level=%v", email, d.ID, level); err != nil {
+	r, err := d.conn.backend.GetDraft(ctx, d.ID, level)
+	if err != nil {
 		return err
 	}
 	d.m.Lock()
@@ -1255,7 +1402,6 @@ func (d *Draft) load(ctx context.Context, level DataLevel) error {
 		d.headers[strings.ToLower(h.Name)] = h.Value
 	}
 	if level == LevelFull {
-		var err error
 		d.body, err = makeBody(ctx, d.Response.Message.Payload, false)
 		if err != nil {
 			return errors.Wrap(err, "rendering draft body")
@@ -1280,14 +1426,7 @@ func (d *Draft) UpdateParts(ctx context.Context, head mail.Header, parts []*Part
 
 // Update the draft.
 func (d *Draft) Update(ctx context.Context, content string) error {
-	if err := wrapLogRPC("gmail.Users.Drafts.Update", func() error {
-		_, err := d.conn.gmail.Users.Drafts.Update(email, d.ID, &gmail.Draft{
-			Message: &gmail.Message{
-				Raw: MIMEEncode(content),
-			},
-		}).Context(ctx).Do()
-		return err
-	}, "email=%q msgID=%v contents=%q", email, d.ID, content); err != nil {
+	if err := d.conn.backend.UpdateDraft(ctx, d.ID, StringMessage(content)); err != nil {
 		return err
 	}
 
@@ -1303,15 +1442,10 @@ func (d *Draft) Send(ctx context.Context) error {
 	if err := d.load(ctx, LevelFull); err != nil {
 		return errors.Wrap(err, "downloading draft for send")
 	}
-	return wrapLogRPC("gmail.USers.Drafts.Send", func() error {
-		_, err := d.conn.gmail.Users.Drafts.Send(email, d.Response).Context(ctx).Do()
-		return err
-	}, "email=%q draftID=%v", email, d.ID)
+	return d.conn.backend.SendDraft(ctx, d.Response)
 }
 
 // Delete deletes the draft.
 func (d *Draft) Delete(ctx context.Context) error {
-	return wrapLogRPC("gmail.Users.Drafts.Delete", func() error {
-		return d.conn.gmail.Users.Drafts.Delete(email, d.ID).Context(ctx).Do()
-	}, "email=%q draftID=%v", email, d.ID)
+	return d.conn.backend.DeleteDraft(ctx, d.ID)
 }
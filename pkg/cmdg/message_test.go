@@ -0,0 +1,497 @@
+package cmdg
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	gmail "google.golang.org/api/gmail/v1"
+
+	"github.com/ThomasHabets/cmdg/pkg/gpg"
+)
+
+func TestMakeBodyCharset(t *testing.T) {
+	ctx := context.Background()
+	for _, test := range []struct {
+		name       string
+		raw        string
+		preferHTML bool
+		want       string
+	}{
+		{
+			name: "utf-8",
+			raw:  "Content-Type: text/plain; charset=utf-8\r\n\r\nGrüße, 日本語\r\n",
+			want: "Grüße, 日本語",
+		},
+		{
+			name: "no charset",
+			raw:  "Subject: plain\r\n\r\nhello\r\n",
+			want: "hello",
+		},
+		{
+			name: "iso-8859-1 quoted-printable",
+			raw: "Content-Type: text/plain; charset=\"ISO-8859-1\"\r\n" +
+				"Content-Transfer-Encoding: quoted-printable\r\n\r\n" +
+				"Gr=FC=DFe aus K=F6ln, =E0 bient=F4t\r\n",
+			want: "Grüße aus Köln, à bientôt",
+		},
+		{
+			name: "windows-1252 quoted-printable",
+			raw: "Content-Type: text/plain; charset=windows-1252\r\n" +
+				"Content-Transfer-Encoding: Quoted-Printable\r\n\r\n" +
+				"=93Smart quotes=94 cost =8050 =96 ok?\r\n",
+			want: "“Smart quotes” cost €50 – ok?",
+		},
+		{
+			name: "shift_jis base64",
+			raw: "Content-Type: text/plain; charset=Shift_JIS\r\n" +
+				"Content-Transfer-Encoding: base64\r\n\r\n" +
+				"gqiQophigsmCyILBgsSCqILogtyCt4FC\r\n",
+			want: "お世話になっております。",
+		},
+		{
+			name: "iso-2022-jp 7bit",
+			raw: "Content-Type: text/plain; charset=ISO-2022-JP\r\n" +
+				"Content-Transfer-Encoding: 7bit\r\n\r\n" +
+				"\x1b$BF|K\\8l\x1b(B\r\n",
+			want: "日本語",
+		},
+		{
+			name: "koi8-r 8bit",
+			raw: "Content-Type: text/plain; charset=koi8-r\r\n" +
+				"Content-Transfer-Encoding: 8bit\r\n\r\n" +
+				"\xf0\xd2\xc9\xd7\xc5\xd4, \xcd\xc9\xd2\r\n",
+			want: "Привет, мир",
+		},
+		{
+			name: "gbk base64",
+			raw: "Content-Type: text/plain; charset=GB2312\r\n" +
+				"Content-Transfer-Encoding: base64\r\n\r\n" +
+				"xPq6w6OsysC95w==\r\n",
+			want: "您好，世界",
+		},
+		{
+			name: "euc-kr base64",
+			raw: "Content-Type: text/plain; charset=ks_c_5601-1987\r\n" +
+				"Content-Transfer-Encoding: base64\r\n\r\n" +
+				"vsiz58fPvLy/5A==\r\n",
+			want: "안녕하세요",
+		},
+		{
+			name: "big5 base64",
+			raw: "Content-Type: text/plain; charset=big5\r\n" +
+				"Content-Transfer-Encoding: base64\r\n\r\n" +
+				"wWPF6aSkpOU=\r\n",
+			want: "繁體中文",
+		},
+		{
+			name: "base64 with spaces",
+			raw: "Content-Type: text/plain; charset=iso-8859-1\r\n" +
+				"Content-Transfer-Encoding: BASE64\r\n\r\n" +
+				"Y2Fm 6Q==\r\n",
+			want: "café",
+		},
+		{
+			name: "binary",
+			raw:  "Content-Type: application/octet-stream\r\n\r\n\xe9\xff\r\n",
+			want: "\xe9\xff",
+		},
+		{
+			name: "unknown charset",
+			raw:  "Content-Type: text/plain; charset=x-unknown\r\n\r\nsame \xff bytes\r\n",
+			want: "same \xff bytes",
+		},
+		{
+			name: "html header charset",
+			raw: "Content-Type: text/html; charset=iso-8859-1\r\n" +
+				"Content-Transfer-Encoding: quoted-printable\r\n\r\n" +
+				"<p>Caf=E9 cr=E8me</p>\r\n",
+			want: "Café crème",
+		},
+		{
+			name: "html meta charset",
+			raw: "Content-Type: text/html\r\n" +
+				"Content-Transfer-Encoding: quoted-printable\r\n\r\n" +
+				"<html><head><meta http-equiv=3D\"Content-Type\" content=3D\"text/html; charset=3Dkoi8-r\">" +
+				"</head><body>=F0=D2=C9=D7=C5=D4</body></html>\r\n",
+			want: "Привет",
+		},
+		{
+			name: "alternative, each with its own charset",
+			raw: "Content-Type: multipart/alternative; boundary=b\r\n\r\n" +
+				"--b\r\n" +
+				"Content-Type: text/plain; charset=koi8-r\r\n\r\n" +
+				"\xf0\xd2\xc9\xd7\xc5\xd4\r\n" +
+				"--b\r\n" +
+				"Content-Type: text/html; charset=windows-1252\r\n\r\n" +
+				"<p>\x93html\x94</p>\r\n" +
+				"--b--\r\n",
+			want: "Привет",
+		},
+		{
+			name: "alternative, prefer HTML",
+			raw: "Content-Type: multipart/alternative; boundary=b\r\n\r\n" +
+				"--b\r\n" +
+				"Content-Type: text/plain; charset=koi8-r\r\n\r\n" +
+				"\xf0\xd2\xc9\xd7\xc5\xd4\r\n" +
+				"--b\r\n" +
+				"Content-Type: text/html; charset=windows-1252\r\n\r\n" +
+				"<p>\x93html\x94</p>\r\n" +
+				"--b--\r\n",
+			preferHTML: true,
+			want:       "“html”",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			part, err := parseRawMessage(test.raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := makeBody(ctx, part, test.preferHTML)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(got, test.want) {
+				t.Errorf("Got %q, want it to contain %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestAttachedMessage(t *testing.T) {
+	ctx := context.Background()
+	inner := "From: Alice <alice@example.com>\r\n" +
+		"To: Bob <bob@example.com>\r\n" +
+		"Subject: Original\r\n" +
+		"Date: Tue, 1 Oct 2019 10:00:00 +0000\r\n" +
+		"Content-Type: multipart/mixed; boundary=inner\r\n\r\n" +
+		"--inner\r\n" +
+		"Content-Type: text/plain; charset=iso-8859-1\r\n\r\n" +
+		"Hall\xe5 d\xe4r\r\n" +
+		"--inner\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"Content-Disposition: attachment; filename=notes.txt\r\n\r\n" +
+		"notes\r\n" +
+		"--inner--\r\n"
+	b := NewMemBackend("carol@example.com")
+	for _, test := range []struct {
+		name     string
+		raw      string
+		body     string
+		attached string
+	}{
+		{
+			name: "forwarded",
+			raw: "From: Bob <bob@example.com>\r\n" +
+				"Subject: Fwd: Original\r\n" +
+				"Content-Type: multipart/mixed; boundary=outer\r\n\r\n" +
+				"--outer\r\n" +
+				"Content-Type: text/plain\r\n\r\n" +
+				"See below.\r\n" +
+				"--outer\r\n" +
+				"Content-Type: message/rfc822\r\n" +
+				"Content-Disposition: attachment; filename=original.eml\r\n\r\n" +
+				inner +
+				"--outer--\r\n",
+			body:     "See below.",
+			attached: "original.eml",
+		},
+		{
+			name: "bounce",
+			raw: "From: Mail Delivery System <MAILER-DAEMON@example.com>\r\n" +
+				"Subject: Undelivered Mail Returned to Sender\r\n" +
+				"Content-Type: multipart/report; report-type=delivery-status; boundary=report\r\n\r\n" +
+				"--report\r\n" +
+				"Content-Type: text/plain\r\n\r\n" +
+				"I'm sorry to have to inform you...\r\n" +
+				"--report\r\n" +
+				"Content-Type: message/delivery-status\r\n\r\n" +
+				"Final-Recipient: rfc822; bob@example.com\r\n" +
+				"Action: failed\r\n" +
+				"--report\r\n" +
+				"Content-Type: message/rfc822\r\n\r\n" +
+				inner +
+				"--report--\r\n",
+			body:     "Action: failed",
+			attached: "Original.eml",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			id, err := b.AddMessage(test.raw, "", []string{Inbox})
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := NewWithBackend(b)
+			msg := NewMessage(c, id)
+			body, err := msg.GetBody(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(body, test.body) {
+				t.Errorf("Body %q does not contain %q", body, test.body)
+			}
+			if strings.Contains(body, "Hallå där") {
+				t.Errorf("Attached message flattened into body %q", body)
+			}
+			if want := fmt.Sprintf("<<<Attached message %q", test.attached); !strings.Contains(body, want) {
+				t.Errorf("Body %q does not contain %q", body, want)
+			}
+
+			as, err := msg.Attachments(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(as) != 1 {
+				t.Fatalf("Got %d attachments, want 1", len(as))
+			}
+			a := as[0]
+			if !a.IsMessage() {
+				t.Errorf("Attachment is not a message")
+			}
+			if got, want := a.Name(), test.attached; got != want {
+				t.Errorf("Got name %q, want %q", got, want)
+			}
+
+			m, err := a.Message(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.Parent() != msg {
+				t.Errorf("Wrong parent %v", m.Parent())
+			}
+			if msg.Parent() != nil {
+				t.Errorf("Mailbox message has parent %v", msg.Parent())
+			}
+			if got, err := m.GetSubject(ctx); err != nil || got != "Original" {
+				t.Errorf("Got subject %q, %v", got, err)
+			}
+			if got, err := m.GetFrom(ctx); err != nil || got != "Alice" {
+				t.Errorf("Got from %q, %v", got, err)
+			}
+			if got, err := m.GetBody(ctx); err != nil || !strings.Contains(got, "Hallå där") {
+				t.Errorf("Got body %q, %v", got, err)
+			}
+			// The last CRLF belongs to the boundary.
+			if got, err := m.Raw(ctx); err != nil || got != strings.TrimSuffix(inner, "\r\n") {
+				t.Errorf("Got raw %q, %v", got, err)
+			}
+			if ls, err := m.GetLabels(ctx, true); err != nil || len(ls) != 0 {
+				t.Errorf("Got labels %v, %v", ls, err)
+			}
+			as, err = m.Attachments(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(as) != 1 || as[0].Name() != "notes.txt" || as[0].IsMessage() {
+				t.Fatalf("Got attachments %v, want notes.txt", as)
+			}
+			if data, err := as[0].Download(ctx); err != nil || string(data) != "notes" {
+				t.Errorf("Got attachment %q, %v", data, err)
+			}
+		})
+	}
+}
+
+// noDataBackend drops the data of message/rfc822 parts, like Gmail
+// does when it expands them.
+type noDataBackend struct {
+	Backend
+}
+
+func (b *noDataBackend) GetMessage(ctx context.Context, id string, level DataLevel) (*gmail.Message, error) {
+	m, err := b.Backend.GetMessage(ctx, id, level)
+	if err != nil || m.Payload == nil {
+		return m, err
+	}
+	var strip func(*gmail.MessagePart) *gmail.MessagePart
+	strip = func(p *gmail.MessagePart) *gmail.MessagePart {
+		c := *p
+		if c.MimeType == "message/rfc822" {
+			c.Body = &gmail.MessagePartBody{Size: p.Body.Size}
+		}
+		c.Parts = nil
+		for _, sub := range p.Parts {
+			c.Parts = append(c.Parts, strip(sub))
+		}
+		return &c
+	}
+	ret := *m
+	ret.Payload = strip(m.Payload)
+	return &ret, nil
+}
+
+func TestAttachedMessageFromRaw(t *testing.T) {
+	ctx := context.Background()
+	mem := NewMemBackend("carol@example.com")
+	id, err := mem.AddMessage("Subject: Fwd\r\n"+
+		"Content-Type: multipart/mixed; boundary=outer\r\n\r\n"+
+		"--outer\r\n"+
+		"Content-Type: text/plain\r\n\r\n"+
+		"See below.\r\n"+
+		"--outer\r\n"+
+		"Content-Type: message/rfc822\r\n\r\n"+
+		"Subject: Original\r\n\r\n"+
+		"Hello\r\n"+
+		"--outer--\r\n", "", []string{Inbox})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := NewMessage(NewWithBackend(&noDataBackend{Backend: mem}), id)
+	as, err := msg.Attachments(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(as) != 1 || as[0].ID != "" || as[0].contents != nil {
+		t.Fatalf("Got attachments %+v, want one without ID or data", as)
+	}
+	m, err := as[0].Message(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := m.GetBody(ctx); err != nil || !strings.Contains(got, "Hello") {
+		t.Errorf("Got body %q, %v", got, err)
+	}
+}
+
+func TestGPGEncryptedAttachments(t *testing.T) {
+	ctx := context.Background()
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skipf("gpg not installed: %v", err)
+	}
+	dir, err := ioutil.TempDir("", "cmdg-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	home := filepath.Join(dir, "gnupg")
+	tmp := filepath.Join(dir, "tmp")
+	for _, d := range []string{home, tmp} {
+		if err := os.Mkdir(d, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for k, v := range map[string]string{"GNUPGHOME": home, "TMPDIR": tmp} {
+		old, found := os.LookupEnv(k)
+		os.Setenv(k, v)
+		if found {
+			defer os.Setenv(k, old)
+		} else {
+			defer os.Unsetenv(k)
+		}
+	}
+	defer exec.Command("gpgconf", "--kill", "gpg-agent").Run()
+
+	const passphrase = "abc123"
+	oldGPG := GPG
+	defer func() { GPG = oldGPG }()
+	GPG = gpg.New("gpg")
+	GPG.Passphrase = passphrase
+
+	secret := "\x00\x01binary\xff"
+	plain := "Content-Type: multipart/mixed; boundary=plain\r\n\r\n" +
+		"--plain\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n\r\n" +
+		"The secret plans.\r\n" +
+		"--plain\r\n" +
+		"Content-Type: application/octet-stream; name=plans.bin\r\n" +
+		"Content-Disposition: attachment; filename=plans.bin\r\n" +
+		"Content-Transfer-Encoding: base64\r\n\r\n" +
+		base64.StdEncoding.EncodeToString([]byte(secret)) + "\r\n" +
+		"--plain\r\n" +
+		"Content-Type: message/rfc822\r\n" +
+		"Content-Disposition: attachment; filename=old.eml\r\n\r\n" +
+		"Subject: Old plans\r\n" +
+		"Content-Type: multipart/mixed; boundary=old\r\n\r\n" +
+		"--old\r\n" +
+		"Content-Type: text/plain\r\n\r\n" +
+		"Older plans.\r\n" +
+		"--old\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"Content-Disposition: attachment; filename=old.txt\r\n\r\n" +
+		"old\r\n" +
+		"--old--\r\n" +
+		"\r\n" +
+		"--plain--\r\n"
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("gpg", "--batch", "--armor", "--symmetric", "--pinentry-mode", "loopback", "--passphrase", passphrase)
+	cmd.Stdin = strings.NewReader(plain)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Encrypting: %v: %s", err, stderr.String())
+	}
+
+	b := NewMemBackend("bob@example.com")
+	id, err := b.AddMessage("From: Alice <alice@example.com>\r\n"+
+		"Subject: Encrypted\r\n"+
+		"Content-Type: multipart/encrypted; protocol=\"application/pgp-encrypted\"; boundary=enc\r\n\r\n"+
+		"--enc\r\n"+
+		"Content-Type: application/pgp-encrypted\r\n\r\n"+
+		"Version: 1\r\n"+
+		"--enc\r\n"+
+		"Content-Type: application/octet-stream; name=encrypted.asc\r\n"+
+		"Content-Disposition: inline; filename=encrypted.asc\r\n\r\n"+
+		strings.Replace(stdout.String(), "\n", "\r\n", -1)+
+		"--enc--\r\n", "", []string{Inbox})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := NewMessage(NewWithBackend(b), id)
+	body, err := msg.GetBody(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(body, "The secret plans.") {
+		t.Fatalf("Body not decrypted: %q", body)
+	}
+	for _, want := range []string{`<<<Attachment "plans.bin"`, `<<<Attached message "old.eml"`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Body %q does not contain %q", body, want)
+		}
+	}
+
+	as, err := msg.Attachments(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(as) != 2 {
+		t.Fatalf("Got %d attachments, want 2", len(as))
+	}
+	for _, a := range as {
+		if !a.Secret() {
+			t.Errorf("Attachment %q not secret", a.Name())
+		}
+	}
+	if got, want := as[0].Name(), "plans.bin"; got != want {
+		t.Errorf("Got name %q, want %q", got, want)
+	}
+	if data, err := as[0].Download(ctx); err != nil || string(data) != secret {
+		t.Errorf("Got attachment %q, %v; want %q", data, err, secret)
+	}
+
+	m, err := as[1].Message(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := m.GetBody(ctx); err != nil || !strings.Contains(got, "Older plans.") {
+		t.Errorf("Got attached body %q, %v", got, err)
+	}
+	if nas, err := m.Attachments(ctx); err != nil || len(nas) != 1 || !nas[0].Secret() {
+		t.Errorf("Got attached message attachments %v, %v", nas, err)
+	}
+
+	// Nothing decrypted may be written to disk.
+	if fs, err := ioutil.ReadDir(tmp); err != nil {
+		t.Error(err)
+	} else if len(fs) != 0 {
+		t.Errorf("Tempfiles written: %v", fs)
+	}
+}
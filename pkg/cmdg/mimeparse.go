@@ -0,0 +1,160 @@
+package cmdg
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	gmail "google.golang.org/api/gmail/v1"
+)
+
+// parseRawMessage turns an RFC822 message into the same structure as
+// the Gmail API returns for format=full. Bodies are always inline,
+// never referenced by attachment ID.
+func parseRawMessage(raw string) (*gmail.MessagePart, error) {
+	m, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing message")
+	}
+	return parseMIMEPart("", textproto.MIMEHeader(m.Header), m.Body)
+}
+
+// headerValue returns the first value of a header in a part, or empty.
+func headerValue(p *gmail.MessagePart, name string) string {
+	for _, h := range p.Headers {
+		if strings.EqualFold(h.Name, name) {
+			return h.Value
+		}
+	}
+	return ""
+}
+
+// headerList turns a header map into the Gmail API header list.
+// Go uses maps for headers, so original order is lost. Sort to at least be stable.
+func headerList(h textproto.MIMEHeader) []*gmail.MessagePartHeader {
+	var keys []string
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var ret []*gmail.MessagePartHeader
+	for _, k := range keys {
+		for _, v := range h[k] {
+			ret = append(ret, &gmail.MessagePartHeader{
+				Name:  k,
+				Value: v,
+			})
+		}
+	}
+	return ret
+}
+
+// decodeTransfer undoes the Content-Transfer-Encoding.
+func decodeTransfer(h textproto.MIMEHeader, r io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(h.Get("Content-Transfer-Encoding"))) {
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, &skipSpace{r: r})
+	}
+	return r
+}
+
+// skipSpace is a reader that drops whitespace, because the base64
+// decoder only tolerates \r and \n.
+type skipSpace struct {
+	r io.Reader
+}
+
+func (s *skipSpace) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	o := 0
+	for _, b := range p[:n] {
+		switch b {
+		case ' ', '\t':
+		default:
+			p[o] = b
+			o++
+		}
+	}
+	return o, err
+}
+
+func parseMIMEPart(partID string, h textproto.MIMEHeader, body io.Reader) (*gmail.MessagePart, error) {
+	ct := h.Get("Content-Type")
+	if ct == "" {
+		ct = "text/plain"
+	}
+	mt, params, err := mime.ParseMediaType(ct)
+	if err != nil {
+		// Treat unparsable content types as opaque data.
+		mt, params = "application/octet-stream", nil
+	}
+	ret := &gmail.MessagePart{
+		PartId:   partID,
+		MimeType: mt,
+		Headers:  headerList(h),
+		Body:     &gmail.MessagePartBody{},
+	}
+	if _, dp, err := mime.ParseMediaType(h.Get("Content-Disposition")); err == nil && dp["filename"] != "" {
+		ret.Filename = dp["filename"]
+	} else if params["name"] != "" {
+		ret.Filename = params["name"]
+	}
+
+	subID := func(n int) string {
+		if partID == "" {
+			return fmt.Sprint(n)
+		}
+		return fmt.Sprintf("%s.%d", partID, n)
+	}
+
+	switch {
+	case strings.HasPrefix(mt, "multipart/"):
+		mr := multipart.NewReader(body, params["boundary"])
+		for n := 0; ; n++ {
+			p, err := mr.NextRawPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, errors.Wrapf(err, "reading part %d of %q", n, mt)
+			}
+			sub, err := parseMIMEPart(subID(n), p.Header, p)
+			if err != nil {
+				return nil, err
+			}
+			ret.Parts = append(ret.Parts, sub)
+		}
+	case mt == "message/rfc822":
+		b, err := ioutil.ReadAll(decodeTransfer(h, body))
+		if err != nil {
+			return nil, errors.Wrap(err, "reading attached message")
+		}
+		ret.Body.Data = MIMEEncode(string(b))
+		ret.Body.Size = int64(len(b))
+		if m, err := mail.ReadMessage(bytes.NewReader(b)); err == nil {
+			if sub, err := parseMIMEPart(subID(0), textproto.MIMEHeader(m.Header), m.Body); err == nil {
+				ret.Parts = []*gmail.MessagePart{sub}
+			}
+		}
+	default:
+		b, err := ioutil.ReadAll(decodeTransfer(h, body))
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading body of %q", mt)
+		}
+		ret.Body.Data = MIMEEncode(string(b))
+		ret.Body.Size = int64(len(b))
+	}
+	return ret, nil
+}
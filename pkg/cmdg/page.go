@@ -3,7 +3,9 @@ package cmdg
 import (
 	"context"
 	"sync"
+	"time"
 
+	log "github.com/sirupsen/logrus"
 	gmail "google.golang.org/api/gmail/v1"
 )
 
@@ -24,25 +26,36 @@ func (p *Page) Next(ctx context.Context) (*Page, error) {
 	return p.conn.ListMessages(ctx, p.Label, p.Query, p.Response.NextPageToken)
 }
 
-// PreloadSubjects async loads message basic info.
+// PreloadSubjects loads message basic info for the whole page, using batch requests.
+//
+// Messages that fail to load are only logged, and left for the
+// caller to load individually.
 func (p *Page) PreloadSubjects(ctx context.Context) error {
-	conc := 100
-	sem := make(chan struct{}, conc)
-	num := len(p.Response.Messages)
-	errs := make([]error, num, num)
-	for n := 0; n < len(p.Response.Messages); n++ {
-		n := n
-		sem <- struct{}{}
-		go func() {
-			defer func() { <-sem }()
-
-			if err := p.Messages[n].Preload(ctx, LevelMetadata); err != nil {
-				errs[n] = err
-			}
-		}()
+	var ids []string
+	var msgs []*Message
+	for _, m := range p.Messages {
+		if !m.HasData(LevelMetadata) {
+			ids = append(ids, m.ID)
+			msgs = append(msgs, m)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
 	}
-	for t := 0; t < conc; t++ {
-		sem <- struct{}{}
+	st := time.Now()
+	resps, errs := p.conn.backend.BatchGetMessages(ctx, ids, LevelMetadata)
+	failed := 0
+	for n, m := range msgs {
+		if errs[n] != nil {
+			log.Warningf("Failed to preload message %q: %v", m.ID, errs[n])
+			failed++
+			continue
+		}
+		if err := m.setResponse(ctx, resps[n], LevelMetadata); err != nil {
+			log.Warningf("Failed to preload message %q: %v", m.ID, err)
+			failed++
+		}
 	}
+	log.Infof("Preloaded %d messages (%d failed) in %v", len(ids), failed, time.Since(st))
 	return nil
 }
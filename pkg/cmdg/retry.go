@@ -0,0 +1,203 @@
+package cmdg
+
+import (
+	"context"
+	"flag"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/api/googleapi"
+)
+
+var (
+	rpcAttempts    = flag.Int("rpc_attempts", 5, "Max attempts for idempotent RPCs that fail with rate limiting or server errors.")
+	rpcBackoffBase = flag.Duration("rpc_backoff_base", 250*time.Millisecond, "Backoff before the first RPC retry. Doubled for every retry.")
+	rpcBackoffMax  = flag.Duration("rpc_backoff_max", 30*time.Second, "Max backoff between RPC retries, including Retry-After from the server.")
+
+	// RPCs that are safe to retry. Sending email or creating things
+	// is not, since the first attempt may have succeeded even though
+	// the reply was an error.
+	idempotentRPCs = map[string]bool{
+		"drive.Files.Get":                      true,
+		"drive.Files.List":                     true,
+		"drive.Files.Update":                   true,
+		"gmail.Batch.Messages.Get":             true,
+		"gmail.Users.Drafts.Get":               true,
+		"gmail.Users.Drafts.List":              true,
+		"gmail.Users.Drafts.Update":            true,
+		"gmail.Users.GetProfile":               true,
+		"gmail.Users.History.List":             true,
+		"gmail.Users.Labels.Get":               true,
+		"gmail.Users.Labels.List":              true,
+		"gmail.Users.Labels.Update":            true,
+		"gmail.Users.Messages.Attachments.Get": true,
+		"gmail.Users.Messages.BatchDelete":     true,
+		"gmail.Users.Settings.Filters.List":    true,
+		"gmail.Users.Settings.GetVacation":     true,
+		"gmail.Users.Settings.SendAs.List":     true,
+		"gmail.Users.Settings.UpdateVacation":  true,
+		"gmail.Users.Messages.BatchModify":     true,
+		"gmail.Users.Messages.Get":             true,
+		"gmail.Users.Messages.List":            true,
+		"gmail.Users.Messages.Modify":          true,
+		"gmail.Users.Threads.Get":              true,
+		"gmail.Users.Threads.List":             true,
+		"gmail.Users.Threads.Modify":           true,
+		"people.People.Connections.List":       true,
+	}
+
+	// Overridden by tests.
+	retrySleep = func(ctx context.Context, d time.Duration) error {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+			return nil
+		}
+	}
+
+	rpcCountersM sync.Mutex
+	rpcCounters  = map[string]*RPCCounter{}
+)
+
+// RPCCounter is stats for one RPC method.
+type RPCCounter struct {
+	Method   string
+	Calls    int64 // Calls from the app.
+	Retries  int64 // Extra attempts made.
+	Failures int64 // Calls that failed in the end.
+
+	// Request and response body bytes, including retries.
+	BytesSent     int64
+	BytesReceived int64
+
+	// Latency of calls, including retries. Percentiles are of
+	// recent calls.
+	Total         time.Duration
+	Max           time.Duration
+	P50, P90, P99 time.Duration
+
+	latencies   []time.Duration
+	nextLatency int
+}
+
+// RPCCounters returns a snapshot of the RPC stats, sorted by method.
+func RPCCounters() []RPCCounter {
+	rpcCountersM.Lock()
+	defer rpcCountersM.Unlock()
+	var ret []RPCCounter
+	for _, c := range rpcCounters {
+		ret = append(ret, c.snapshot())
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Method < ret[j].Method })
+	return ret
+}
+
+func countRPC(fn string, f func(*RPCCounter)) {
+	rpcCountersM.Lock()
+	defer rpcCountersM.Unlock()
+	c, found := rpcCounters[fn]
+	if !found {
+		c = &RPCCounter{Method: fn}
+		rpcCounters[fn] = c
+	}
+	f(c)
+}
+
+// retryable returns true if the error is worth trying again.
+//
+// Network errors are not retried here. If the network is down then
+// the offline journal takes over.
+func retryable(err error) bool {
+	e, ok := errors.Cause(err).(*googleapi.Error)
+	if !ok {
+		return false
+	}
+	switch e.Code {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	case http.StatusForbidden:
+		for _, i := range e.Errors {
+			if i.Reason == "rateLimitExceeded" || i.Reason == "userRateLimitExceeded" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// retryAfter returns the delay the server asked for, if any.
+func retryAfter(err error) (time.Duration, bool) {
+	e, ok := errors.Cause(err).(*googleapi.Error)
+	if !ok || e.Header == nil {
+		return 0, false
+	}
+	s := e.Header.Get("Retry-After")
+	if s == "" {
+		return 0, false
+	}
+	if n, err := strconv.Atoi(s); err == nil && n >= 0 {
+		return time.Duration(n) * time.Second, true
+	}
+	if t, err := http.ParseTime(s); err == nil {
+		d := time.Until(t)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
+
+// backoff returns how long to wait before retry number n (starting at 0).
+// Full jitter: a random time between zero and the exponential backoff.
+func backoff(n int) time.Duration {
+	d := *rpcBackoffBase << uint(n)
+	if d <= 0 || d > *rpcBackoffMax {
+		d = *rpcBackoffMax
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// withRetry runs the callback, retrying idempotent methods on rate
+// limiting and server errors.
+func withRetry(ctx context.Context, fn string, cb func() error) error {
+	countRPC(fn, func(c *RPCCounter) { c.Calls++ })
+	attempts := 1
+	if idempotentRPCs[fn] && *rpcAttempts > 1 {
+		attempts = *rpcAttempts
+	}
+	var err error
+	for n := 0; n < attempts; n++ {
+		if n > 0 {
+			countRPC(fn, func(c *RPCCounter) { c.Retries++ })
+		}
+		err = cb()
+		if err == nil || !retryable(err) || n == attempts-1 {
+			break
+		}
+		d := backoff(n)
+		if ra, ok := retryAfter(err); ok {
+			d = ra
+			if d > *rpcBackoffMax {
+				d = *rpcBackoffMax
+			}
+		}
+		log.Warningf("RPC %s failed (attempt %d of %d), retrying in %v: %v", fn, n+1, attempts, d, err)
+		if serr := retrySleep(ctx, d); serr != nil {
+			break
+		}
+	}
+	if err != nil {
+		countRPC(fn, func(c *RPCCounter) { c.Failures++ })
+	}
+	return err
+}
@@ -0,0 +1,187 @@
+package cmdg
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+// redirector is a RoundTripper that sends all requests to a test server.
+type redirector struct {
+	base *url.URL
+}
+
+func (r *redirector) RoundTrip(req *http.Request) (*http.Response, error) {
+	r2 := req.Clone(req.Context())
+	r2.URL.Scheme = r.base.Scheme
+	r2.URL.Host = r.base.Host
+	return http.DefaultTransport.RoundTrip(r2)
+}
+
+// failingServer fails the first requests with the given status codes, then succeeds.
+type failingServer struct {
+	m          sync.Mutex
+	fails      []int
+	retryAfter string
+	requests   int
+}
+
+func (s *failingServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.requests++
+	w.Header().Set("Content-Type", "application/json")
+	if len(s.fails) > 0 {
+		code := s.fails[0]
+		s.fails = s.fails[1:]
+		if s.retryAfter != "" {
+			w.Header().Set("Retry-After", s.retryAfter)
+		}
+		w.WriteHeader(code)
+		fmt.Fprintf(w, `{"error":{"code":%d,"message":"injected failure"}}`, code)
+		return
+	}
+	fmt.Fprintf(w, `{"id":"123","threadId":"456","labelIds":["INBOX"]}`)
+}
+
+func newTestGmailBackend(t *testing.T, h http.Handler) (*gmailBackend, func()) {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := newGmailBackend(&http.Client{Transport: &redirector{base: u}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, srv.Close
+}
+
+func TestRetry(t *testing.T) {
+	var sleeps []time.Duration
+	oldSleep := retrySleep
+	defer func() { retrySleep = oldSleep }()
+	retrySleep = func(ctx context.Context, d time.Duration) error {
+		sleeps = append(sleeps, d)
+		return nil
+	}
+	ctx := context.Background()
+
+	for _, test := range []struct {
+		name       string
+		fails      []int
+		retryAfter string
+		send       bool
+		wantErr    bool
+		wantReqs   int
+		wantSleeps []time.Duration // Only checked if set.
+	}{
+		{name: "ok", wantReqs: 1},
+		{name: "transient", fails: []int{503, 500}, wantReqs: 3},
+		{name: "rate limit", fails: []int{429}, retryAfter: "7", wantReqs: 2, wantSleeps: []time.Duration{7 * time.Second}},
+		{name: "retry-after capped", fails: []int{429}, retryAfter: "3600", wantReqs: 2, wantSleeps: []time.Duration{*rpcBackoffMax}},
+		{name: "gives up", fails: []int{503, 503, 503, 503, 503, 503}, wantErr: true, wantReqs: *rpcAttempts},
+		{name: "permanent", fails: []int{400}, wantErr: true, wantReqs: 1},
+		{name: "not found", fails: []int{404}, wantErr: true, wantReqs: 1},
+		{name: "send not retried", fails: []int{503}, send: true, wantErr: true, wantReqs: 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			sleeps = nil
+			fs := &failingServer{fails: test.fails, retryAfter: test.retryAfter}
+			b, done := newTestGmailBackend(t, fs)
+			defer done()
+
+			method := "gmail.Users.Messages.Get"
+			var err error
+			if test.send {
+				method = "gmail.Users.Messages.Send"
+				err = b.Send(ctx, NewThread, StringMessage("Subject: hi\r\n\r\nbody\r\n"))
+			} else {
+				_, err = b.GetMessage(ctx, "123", LevelMinimal)
+			}
+			var counter RPCCounter
+			for _, c := range RPCCounters() {
+				if c.Method == method {
+					counter = c
+				}
+			}
+			if (err != nil) != test.wantErr {
+				t.Errorf("Got err %v, want error: %v", err, test.wantErr)
+			}
+			if fs.requests != test.wantReqs {
+				t.Errorf("Got %d requests, want %d", fs.requests, test.wantReqs)
+			}
+			if got, want := len(sleeps), test.wantReqs-1; got != want {
+				t.Errorf("Slept %d times, want %d", got, want)
+			}
+			if test.wantSleeps != nil {
+				for n := range test.wantSleeps {
+					if n >= len(sleeps) || sleeps[n] != test.wantSleeps[n] {
+						t.Errorf("Got sleeps %v, want %v", sleeps, test.wantSleeps)
+						break
+					}
+				}
+			}
+			for _, d := range sleeps {
+				if d < 0 || d > *rpcBackoffMax {
+					t.Errorf("Sleep %v out of range", d)
+				}
+			}
+			if counter.Calls == 0 {
+				t.Errorf("No calls counted for %q", method)
+			}
+		})
+	}
+}
+
+func TestRetryCounters(t *testing.T) {
+	oldSleep := retrySleep
+	defer func() { retrySleep = oldSleep }()
+	retrySleep = func(context.Context, time.Duration) error { return nil }
+
+	get := func() RPCCounter {
+		for _, c := range RPCCounters() {
+			if c.Method == "gmail.Users.Messages.Get" {
+				return c
+			}
+		}
+		return RPCCounter{}
+	}
+	before := get()
+	b, done := newTestGmailBackend(t, &failingServer{fails: []int{503, 503}})
+	defer done()
+	if _, err := b.GetMessage(context.Background(), "123", LevelMinimal); err != nil {
+		t.Fatal(err)
+	}
+	after := get()
+	if got, want := after.Calls-before.Calls, int64(1); got != want {
+		t.Errorf("Got %d calls, want %d", got, want)
+	}
+	if got, want := after.Retries-before.Retries, int64(2); got != want {
+		t.Errorf("Got %d retries, want %d", got, want)
+	}
+	if got, want := after.Failures-before.Failures, int64(0); got != want {
+		t.Errorf("Got %d failures, want %d", got, want)
+	}
+}
+
+func TestRetryContextCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	n := 0
+	err := withRetry(ctx, "gmail.Users.Messages.Get", func() error {
+		n++
+		return &googleapi.Error{Code: http.StatusServiceUnavailable}
+	})
+	if err == nil || n != 1 {
+		t.Errorf("Got err %v after %d attempts, want error after 1", err, n)
+	}
+}
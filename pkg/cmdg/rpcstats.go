@@ -0,0 +1,218 @@
+package cmdg
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	// Latencies kept per method, for percentiles.
+	rpcLatencySamples = 1000
+
+	// Calls kept for the trace.
+	rpcTraceLen = 200
+
+	// Max length of the args in a trace entry.
+	rpcTraceArgsLen = 200
+)
+
+var (
+	rpcTraceM sync.Mutex
+	rpcTrace  []RPCTraceEntry
+	rpcTraceN int
+)
+
+// RPCTraceEntry is one finished call from the app, including retries.
+type RPCTraceEntry struct {
+	Start         time.Time
+	Method        string
+	Args          string
+	Duration      time.Duration
+	BytesSent     int64
+	BytesReceived int64
+	Err           error
+}
+
+// rpcBytes counts bytes of one call, across retries.
+type rpcBytes struct {
+	sent, received int64
+}
+
+type rpcBytesKey struct{}
+
+// withRPCBytes returns a context that makes countingTransport count
+// bytes of requests made with it.
+func withRPCBytes(ctx context.Context) (context.Context, *rpcBytes) {
+	b := &rpcBytes{}
+	return context.WithValue(ctx, rpcBytesKey{}, b), b
+}
+
+// countingTransport counts request and response body bytes of RPCs.
+type countingTransport struct {
+	base http.RoundTripper
+}
+
+type countingReader struct {
+	io.ReadCloser
+	n *int64
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	atomic.AddInt64(r.n, int64(n))
+	return n, err
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	c, ok := req.Context().Value(rpcBytesKey{}).(*rpcBytes)
+	if !ok {
+		return base.RoundTrip(req)
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		req = req.Clone(req.Context())
+		req.Body = &countingReader{ReadCloser: req.Body, n: &c.sent}
+	}
+	resp, err := base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = &countingReader{ReadCloser: resp.Body, n: &c.received}
+	return resp, nil
+}
+
+// recordRPC adds a finished call to the stats and the trace.
+func recordRPC(fn string, st time.Time, b *rpcBytes, err error, af string, args ...interface{}) {
+	d := time.Since(st)
+	sent, received := atomic.LoadInt64(&b.sent), atomic.LoadInt64(&b.received)
+	countRPC(fn, func(c *RPCCounter) {
+		c.BytesSent += sent
+		c.BytesReceived += received
+		c.Total += d
+		if d > c.Max {
+			c.Max = d
+		}
+		if len(c.latencies) < rpcLatencySamples {
+			c.latencies = append(c.latencies, d)
+		} else {
+			c.latencies[c.nextLatency] = d
+			c.nextLatency = (c.nextLatency + 1) % rpcLatencySamples
+		}
+	})
+
+	a := fmt.Sprintf(af, args...)
+	if len(a) > rpcTraceArgsLen {
+		a = a[:rpcTraceArgsLen] + "…"
+	}
+	e := RPCTraceEntry{
+		Start:         st,
+		Method:        fn,
+		Args:          a,
+		Duration:      d,
+		BytesSent:     sent,
+		BytesReceived: received,
+		Err:           err,
+	}
+	rpcTraceM.Lock()
+	defer rpcTraceM.Unlock()
+	if len(rpcTrace) < rpcTraceLen {
+		rpcTrace = append(rpcTrace, e)
+	} else {
+		rpcTrace[rpcTraceN] = e
+		rpcTraceN = (rpcTraceN + 1) % rpcTraceLen
+	}
+}
+
+// RPCTrace returns the most recent calls, oldest first.
+func RPCTrace() []RPCTraceEntry {
+	rpcTraceM.Lock()
+	defer rpcTraceM.Unlock()
+	var ret []RPCTraceEntry
+	ret = append(ret, rpcTrace[rpcTraceN:]...)
+	return append(ret, rpcTrace[:rpcTraceN]...)
+}
+
+// percentile returns the p:th percentile of sorted durations.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	n := (len(sorted)*p+99)/100 - 1
+	if n < 0 {
+		n = 0
+	}
+	return sorted[n]
+}
+
+// snapshot returns a copy with percentiles filled in.
+func (c *RPCCounter) snapshot() RPCCounter {
+	ret := *c
+	ret.latencies = nil
+	ret.nextLatency = 0
+	l := append([]time.Duration(nil), c.latencies...)
+	sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+	ret.P50 = percentile(l, 50)
+	ret.P90 = percentile(l, 90)
+	ret.P99 = percentile(l, 99)
+	return ret
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1fG", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fM", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fk", float64(n)/(1<<10))
+	}
+	return fmt.Sprint(n)
+}
+
+func formatLatency(d time.Duration) string {
+	switch {
+	case d >= time.Second:
+		return d.Round(10 * time.Millisecond).String()
+	case d >= time.Millisecond:
+		return d.Round(100 * time.Microsecond).String()
+	}
+	return d.Round(time.Microsecond).String()
+}
+
+// FormatRPCStats formats RPC stats as a table.
+func FormatRPCStats(cs []RPCCounter) string {
+	var b bytes.Buffer
+	w := tabwriter.NewWriter(&b, 0, 0, 1, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(w, "Method\tCalls\tErrors\tRetries\tp50\tp90\tp99\tMax\tTotal\tSent\tReceived\t\n")
+	for _, c := range cs {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t\n",
+			c.Method, c.Calls, c.Failures, c.Retries,
+			formatLatency(c.P50), formatLatency(c.P90), formatLatency(c.P99), formatLatency(c.Max),
+			formatLatency(c.Total), formatBytes(c.BytesSent), formatBytes(c.BytesReceived))
+	}
+	w.Flush()
+	return b.String()
+}
+
+// FormatRPCTraceEntry formats a trace entry as one line.
+func FormatRPCTraceEntry(e RPCTraceEntry) string {
+	s := fmt.Sprintf("%s %8s %7s/%-7s %s(%s)",
+		e.Start.Format("15:04:05.000"), formatLatency(e.Duration),
+		formatBytes(e.BytesSent), formatBytes(e.BytesReceived), e.Method, e.Args)
+	if e.Err != nil {
+		s += " => " + e.Err.Error()
+	}
+	return s
+}
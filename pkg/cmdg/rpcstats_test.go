@@ -0,0 +1,123 @@
+package cmdg
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPercentile(t *testing.T) {
+	var l []time.Duration
+	for n := 1; n <= 200; n++ {
+		l = append(l, time.Duration(n)*time.Millisecond)
+	}
+	for _, test := range []struct {
+		p    int
+		want time.Duration
+	}{
+		{50, 100 * time.Millisecond},
+		{90, 180 * time.Millisecond},
+		{99, 198 * time.Millisecond},
+		{100, 200 * time.Millisecond},
+	} {
+		if got := percentile(l, test.p); got != test.want {
+			t.Errorf("percentile(%d) = %v, want %v", test.p, got, test.want)
+		}
+	}
+	if got := percentile(nil, 50); got != 0 {
+		t.Errorf("percentile of nothing = %v, want 0", got)
+	}
+	if got := percentile(l[:1], 99); got != time.Millisecond {
+		t.Errorf("percentile of one = %v, want 1ms", got)
+	}
+}
+
+func TestRPCStats(t *testing.T) {
+	const method = "gmail.Users.Messages.Modify"
+	const reply = `{"id":"123","threadId":"456","labelIds":["INBOX"]}`
+	get := func() RPCCounter {
+		for _, c := range RPCCounters() {
+			if c.Method == method {
+				return c
+			}
+		}
+		return RPCCounter{}
+	}
+
+	srv := httptest.NewServer(&failingServer{})
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := newGmailBackend(&http.Client{Transport: &countingTransport{base: &redirector{base: u}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := get()
+	for n := 0; n < 3; n++ {
+		if _, err := b.ModifyMessage(context.Background(), "123", []string{"INBOX"}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	after := get()
+	if got, want := after.Calls-before.Calls, int64(3); got != want {
+		t.Errorf("Got %d calls, want %d", got, want)
+	}
+	if after.BytesSent-before.BytesSent == 0 {
+		t.Errorf("No bytes sent counted")
+	}
+	if got, want := after.BytesReceived-before.BytesReceived, int64(3*len(reply)); got != want {
+		t.Errorf("Got %d bytes received, want %d", got, want)
+	}
+	if after.P50 <= 0 || after.P50 > after.P99 || after.P99 > after.Max || after.Total < after.Max {
+		t.Errorf("Bad latencies p50=%v p99=%v max=%v total=%v", after.P50, after.P99, after.Max, after.Total)
+	}
+
+	trace := RPCTrace()
+	if len(trace) == 0 {
+		t.Fatal("Empty trace")
+	}
+	last := trace[len(trace)-1]
+	if last.Method != method || !strings.Contains(last.Args, "msg=123") || last.BytesReceived != int64(len(reply)) || last.Err != nil {
+		t.Errorf("Bad last trace entry %+v", last)
+	}
+	if s := FormatRPCStats(RPCCounters()); !strings.Contains(s, method) {
+		t.Errorf("Method not in stats table:\n%s", s)
+	}
+
+	// Calls whose request is built by the backend must count bytes too.
+	if _, err := b.ListMessages(context.Background(), "INBOX", "", "", 10); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.ListThreads(context.Background(), "INBOX", "", "", 10); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range RPCTrace()[len(RPCTrace())-2:] {
+		if e.BytesReceived != int64(len(reply)) {
+			t.Errorf("%s: got %d bytes received, want %d", e.Method, e.BytesReceived, len(reply))
+		}
+	}
+}
+
+func TestRPCTraceWraps(t *testing.T) {
+	for n := 0; n < rpcTraceLen+10; n++ {
+		recordRPC("test.Wrap", time.Now(), &rpcBytes{}, nil, "n=%d", n)
+	}
+	trace := RPCTrace()
+	if got, want := len(trace), rpcTraceLen; got != want {
+		t.Fatalf("Got %d trace entries, want %d", got, want)
+	}
+	if got, want := trace[len(trace)-1].Args, fmt.Sprintf("n=%d", rpcTraceLen+9); got != want {
+		t.Errorf("Newest entry is %q, want %q", got, want)
+	}
+	if got, want := trace[0].Args, "n=10"; got != want {
+		t.Errorf("Oldest entry is %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,440 @@
+package cmdg
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/oauth2"
+	"golang.org/x/sys/unix"
+	"golang.org/x/term"
+)
+
+const (
+	// PassphraseEnv is the environment variable to take the token
+	// file passphrase from, instead of asking.
+	PassphraseEnv = "CMDG_PASSPHRASE"
+
+	secretFileVersion = 1
+
+	// scrypt parameters recommended for interactive logins in 2017.
+	scryptN      = 1 << 15
+	scryptR      = 8
+	scryptP      = 1
+	scryptKeyLen = 32
+	saltLen      = 16
+	nonceLen     = 24
+)
+
+var (
+	secretCommand      = flag.String("secret_command", "", "With -configure: store OAuth secrets outside the config, and get them by running this shell command. E.g. 'pass show cmdg/work'.")
+	secretStoreCommand = flag.String("secret_store_command", "", "With -configure and -secret_command: shell command that stores the OAuth secrets JSON given on stdin. E.g. 'pass insert -m -f cmdg/work'.")
+	secretFile         = flag.String("secret_file", "", "With -configure: store OAuth secrets outside the config, in this passphrase encrypted file. Relative to the config directory.")
+
+	// PassphraseFunc asks the user for the passphrase of an
+	// encrypted token file.
+	PassphraseFunc = askPassphrase
+
+	// Process wide, so that the passphrase is only asked for once.
+	secretFilesM sync.Mutex
+	secretFiles  = make(map[string]*secretFileStore)
+
+	// confM serializes writes to the config file. Other processes
+	// are kept out by lockFile.
+	confM sync.Mutex
+)
+
+// Secrets are the parts of an account config that give access to the
+// mailbox.
+type Secrets struct {
+	ClientSecret string    `json:",omitempty"`
+	RefreshToken string    `json:",omitempty"`
+	AccessToken  string    `json:",omitempty"`
+	Expiry       time.Time `json:",omitzero"`
+}
+
+// ConfigSecrets says where secrets are stored, if not in the config file.
+type ConfigSecrets struct {
+	// Command is a shell command that prints the secrets as JSON.
+	Command string `json:",omitempty"`
+
+	// StoreCommand is a shell command that stores the secrets JSON
+	// given on stdin. If not set, refreshed access tokens are not
+	// saved.
+	StoreCommand string `json:",omitempty"`
+
+	// File is a passphrase encrypted file with secrets for one or
+	// more accounts. Relative to the config directory.
+	File string `json:",omitempty"`
+}
+
+// SecretStore loads and saves secrets for one account.
+type SecretStore interface {
+	Get() (*Secrets, error)
+	Put(*Secrets) error
+}
+
+// configSecretFlags returns the secret storage asked for on the command line, or nil.
+func configSecretFlags() *ConfigSecrets {
+	if *secretCommand == "" && *secretFile == "" {
+		return nil
+	}
+	return &ConfigSecrets{
+		Command:      *secretCommand,
+		StoreCommand: *secretStoreCommand,
+		File:         *secretFile,
+	}
+}
+
+// newSecretStore returns the secret store for an account.
+func newSecretStore(fn, account string, oc *ConfigOAuth) (SecretStore, error) {
+	switch {
+	case oc.Secrets == nil:
+		return &configSecretStore{fn: fn, account: account}, nil
+	case oc.Secrets.Command != "":
+		return &commandSecretStore{get: oc.Secrets.Command, put: oc.Secrets.StoreCommand}, nil
+	case oc.Secrets.File != "":
+		f := oc.Secrets.File
+		if !path.IsAbs(f) {
+			f = path.Join(path.Dir(fn), f)
+		}
+		return &secretFileAccount{file: getSecretFile(f), account: account}, nil
+	}
+	return nil, fmt.Errorf("account %q has no command or file for secrets", account)
+}
+
+// configSecretStore is the old way: secrets are in the config file.
+type configSecretStore struct {
+	fn      string
+	account string
+}
+
+// Get implements SecretStore.
+func (s *configSecretStore) Get() (*Secrets, error) {
+	conf, err := readConf(s.fn)
+	if err != nil {
+		return nil, err
+	}
+	oc, found := conf.account(s.account)
+	if !found {
+		return nil, fmt.Errorf("account %q not in %q", s.account, s.fn)
+	}
+	return oc.secrets(), nil
+}
+
+// Put implements SecretStore.
+func (s *configSecretStore) Put(sec *Secrets) error {
+	confM.Lock()
+	defer confM.Unlock()
+	unlock, err := lockFile(s.fn)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	conf, err := readConf(s.fn)
+	if err != nil {
+		return err
+	}
+	oc, found := conf.account(s.account)
+	if !found {
+		return fmt.Errorf("account %q not in %q", s.account, s.fn)
+	}
+	oc.setSecrets(sec)
+	conf.setAccount(s.account, oc)
+	return writeConf(s.fn, &conf)
+}
+
+// commandSecretStore runs external commands like `pass` or `gpg`.
+type commandSecretStore struct {
+	get, put string
+}
+
+func runShell(cmdline string, stdin io.Reader) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("/bin/sh", "-c", cmdline)
+	cmd.Stdin = stdin
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, errors.Wrapf(err, "running %q: %q", cmdline, stderr.String())
+	}
+	return stdout.Bytes(), nil
+}
+
+// Get implements SecretStore.
+func (s *commandSecretStore) Get() (*Secrets, error) {
+	b, err := runShell(s.get, os.Stdin)
+	if err != nil {
+		return nil, err
+	}
+	var sec Secrets
+	if err := json.Unmarshal(b, &sec); err != nil {
+		return nil, errors.Wrapf(err, "parsing output of %q", s.get)
+	}
+	return &sec, nil
+}
+
+// Put implements SecretStore.
+func (s *commandSecretStore) Put(sec *Secrets) error {
+	if s.put == "" {
+		log.Debugf("No secret store command, not saving secrets")
+		return nil
+	}
+	b, err := json.Marshal(sec)
+	if err != nil {
+		return err
+	}
+	_, err = runShell(s.put, bytes.NewReader(b))
+	return err
+}
+
+// secretFileStore is a passphrase encrypted file of secrets, by account.
+type secretFileStore struct {
+	fn string
+
+	m          sync.Mutex
+	passphrase []byte
+}
+
+// secretFileData is the on disk format of secretFileStore.
+type secretFileData struct {
+	Version int
+	Salt    []byte
+	Nonce   []byte
+	Data    []byte
+}
+
+// secretFileAccount is one account in a secretFileStore.
+type secretFileAccount struct {
+	file    *secretFileStore
+	account string
+}
+
+func getSecretFile(fn string) *secretFileStore {
+	secretFilesM.Lock()
+	defer secretFilesM.Unlock()
+	f, found := secretFiles[fn]
+	if !found {
+		f = &secretFileStore{fn: fn}
+		secretFiles[fn] = f
+	}
+	return f
+}
+
+func askPassphrase(prompt string) ([]byte, error) {
+	if p := os.Getenv(PassphraseEnv); p != "" {
+		return []byte(p), nil
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	defer fmt.Fprintln(os.Stderr)
+	return term.ReadPassword(int(os.Stdin.Fd()))
+}
+
+// lockFile takes an exclusive lock for changing a file, shared with
+// other cmdg processes, so that their read-modify-writes don't
+// clobber each other. Call the returned function to unlock.
+func lockFile(fn string) (func(), error) {
+	if err := os.MkdirAll(path.Dir(fn), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(fn+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening lock file for %q", fn)
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "locking %q", fn)
+	}
+	return func() { f.Close() }, nil
+}
+
+func deriveKey(passphrase, salt []byte) (*[scryptKeyLen]byte, error) {
+	k, err := scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, scryptKeyLen)
+	if err != nil {
+		return nil, err
+	}
+	var key [scryptKeyLen]byte
+	copy(key[:], k)
+	return &key, nil
+}
+
+// getPassphraseLocked returns the passphrase, asking for it if needed.
+// For a new file it's asked for twice, to catch typos.
+func (f *secretFileStore) getPassphraseLocked(newFile bool) ([]byte, error) {
+	if f.passphrase == nil {
+		p, err := PassphraseFunc(fmt.Sprintf("Passphrase for %s: ", f.fn))
+		if err != nil {
+			return nil, errors.Wrap(err, "reading passphrase")
+		}
+		if newFile {
+			p2, err := PassphraseFunc(fmt.Sprintf("Repeat passphrase for %s: ", f.fn))
+			if err != nil {
+				return nil, errors.Wrap(err, "reading passphrase")
+			}
+			if !bytes.Equal(p, p2) {
+				return nil, fmt.Errorf("passphrases for %q don't match", f.fn)
+			}
+		}
+		f.passphrase = p
+	}
+	return f.passphrase, nil
+}
+
+// readLocked decrypts the file. A missing file is empty.
+func (f *secretFileStore) readLocked() (map[string]*Secrets, error) {
+	ret := make(map[string]*Secrets)
+	b, err := ioutil.ReadFile(f.fn)
+	if os.IsNotExist(err) {
+		return ret, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var d secretFileData
+	if err := json.Unmarshal(b, &d); err != nil {
+		return nil, errors.Wrapf(err, "parsing %q", f.fn)
+	}
+	if d.Version != secretFileVersion || len(d.Nonce) != nonceLen {
+		return nil, fmt.Errorf("%q: unsupported version %d", f.fn, d.Version)
+	}
+	p, err := f.getPassphraseLocked(false)
+	if err != nil {
+		return nil, err
+	}
+	key, err := deriveKey(p, d.Salt)
+	if err != nil {
+		return nil, err
+	}
+	var nonce [nonceLen]byte
+	copy(nonce[:], d.Nonce)
+	plain, ok := secretbox.Open(nil, d.Data, &nonce, key)
+	if !ok {
+		// Ask again next time.
+		f.passphrase = nil
+		return nil, fmt.Errorf("wrong passphrase for %q", f.fn)
+	}
+	if err := json.Unmarshal(plain, &ret); err != nil {
+		return nil, errors.Wrapf(err, "parsing decrypted %q", f.fn)
+	}
+	return ret, nil
+}
+
+// writeLocked encrypts and writes the file, with a new salt and nonce.
+func (f *secretFileStore) writeLocked(secs map[string]*Secrets) error {
+	plain, err := json.Marshal(secs)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stat(f.fn)
+	p, err := f.getPassphraseLocked(os.IsNotExist(err))
+	if err != nil {
+		return err
+	}
+	d := secretFileData{
+		Version: secretFileVersion,
+		Salt:    make([]byte, saltLen),
+		Nonce:   make([]byte, nonceLen),
+	}
+	if _, err := io.ReadFull(rand.Reader, d.Salt); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(rand.Reader, d.Nonce); err != nil {
+		return err
+	}
+	key, err := deriveKey(p, d.Salt)
+	if err != nil {
+		return err
+	}
+	var nonce [nonceLen]byte
+	copy(nonce[:], d.Nonce)
+	d.Data = secretbox.Seal(nil, plain, &nonce, key)
+	b, err := json.Marshal(&d)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(f.fn), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(f.fn, b)
+}
+
+// Get implements SecretStore.
+func (s *secretFileAccount) Get() (*Secrets, error) {
+	s.file.m.Lock()
+	defer s.file.m.Unlock()
+	secs, err := s.file.readLocked()
+	if err != nil {
+		return nil, err
+	}
+	sec, found := secs[s.account]
+	if !found {
+		return nil, fmt.Errorf("account %q not in %q", s.account, s.file.fn)
+	}
+	return sec, nil
+}
+
+// Put implements SecretStore.
+func (s *secretFileAccount) Put(sec *Secrets) error {
+	s.file.m.Lock()
+	defer s.file.m.Unlock()
+	unlock, err := lockFile(s.file.fn)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	secs, err := s.file.readLocked()
+	if err != nil {
+		return err
+	}
+	secs[s.account] = sec
+	return s.file.writeLocked(secs)
+}
+
+// persistingTokenSource saves the token when it's refreshed, so that
+// the next start doesn't need to get a new one.
+type persistingTokenSource struct {
+	src   oauth2.TokenSource
+	store SecretStore
+	sec   Secrets
+
+	m    sync.Mutex
+	last string
+}
+
+// Token implements oauth2.TokenSource.
+func (ts *persistingTokenSource) Token() (*oauth2.Token, error) {
+	t, err := ts.src.Token()
+	if err != nil {
+		return nil, err
+	}
+	ts.m.Lock()
+	defer ts.m.Unlock()
+	if t.AccessToken == ts.last {
+		return t, nil
+	}
+	ts.last = t.AccessToken
+	sec := ts.sec
+	sec.AccessToken = t.AccessToken
+	sec.Expiry = t.Expiry
+	if t.RefreshToken != "" {
+		sec.RefreshToken = t.RefreshToken
+	}
+	if err := ts.store.Put(&sec); err != nil {
+		log.Errorf("Failed to save refreshed access token: %v", err)
+	} else {
+		log.Infof("Saved refreshed access token, valid until %v", t.Expiry)
+	}
+	return t, nil
+}
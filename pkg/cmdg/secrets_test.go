@@ -0,0 +1,256 @@
+package cmdg
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestSecretFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cmdg-secrets-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	passphrase := "correct horse"
+	asked := 0
+	defer func(f func(string) ([]byte, error)) { PassphraseFunc = f }(PassphraseFunc)
+	PassphraseFunc = func(string) ([]byte, error) {
+		asked++
+		return []byte(passphrase), nil
+	}
+
+	fn := path.Join(dir, "cmdg.conf")
+	oc := &ConfigOAuth{Secrets: &ConfigSecrets{File: "tokens"}}
+	work, err := newSecretStore(fn, "work", oc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	home, err := newSecretStore(fn, "home", oc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiry := time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := work.Put(&Secrets{RefreshToken: "work-refresh", AccessToken: "work-access", Expiry: expiry}); err != nil {
+		t.Fatal(err)
+	}
+	if err := home.Put(&Secrets{RefreshToken: "home-refresh"}); err != nil {
+		t.Fatal(err)
+	}
+	// Once, and once more to confirm it for the new file.
+	if asked != 2 {
+		t.Errorf("Asked for passphrase %d times, want 2", asked)
+	}
+
+	b, err := ioutil.ReadFile(path.Join(dir, "tokens"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "refresh") {
+		t.Errorf("Token file is not encrypted: %s", b)
+	}
+
+	sec, err := work.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sec.RefreshToken != "work-refresh" || sec.AccessToken != "work-access" || !sec.Expiry.Equal(expiry) {
+		t.Errorf("Got work secrets %+v", sec)
+	}
+	sec, err = home.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sec.RefreshToken != "home-refresh" {
+		t.Errorf("Got home secrets %+v", sec)
+	}
+	other, err := newSecretStore(fn, "other", oc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Get(); err == nil {
+		t.Errorf("Got secrets for unknown account")
+	}
+
+	// Wrong passphrase, as if started anew.
+	f := getSecretFile(path.Join(dir, "tokens"))
+	f.passphrase = nil
+	passphrase = "wrong"
+	if _, err := work.Get(); err == nil {
+		t.Errorf("Decrypted with wrong passphrase")
+	}
+	passphrase = "correct horse"
+	if _, err := work.Get(); err != nil {
+		t.Errorf("Asking again after wrong passphrase: %v", err)
+	}
+}
+
+func TestSecretFilePassphraseMismatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cmdg-secrets-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	answers := []string{"correct horse", "correct hose", "correct horse", "correct horse"}
+	defer func(f func(string) ([]byte, error)) { PassphraseFunc = f }(PassphraseFunc)
+	PassphraseFunc = func(string) ([]byte, error) {
+		a := answers[0]
+		answers = answers[1:]
+		return []byte(a), nil
+	}
+
+	fn := path.Join(dir, "cmdg.conf")
+	s, err := newSecretStore(fn, "work", &ConfigOAuth{Secrets: &ConfigSecrets{File: "tokens"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(&Secrets{RefreshToken: "refresh"}); err == nil || !strings.Contains(err.Error(), "don't match") {
+		t.Errorf("Got %v, want mismatch error", err)
+	}
+	if _, err := os.Stat(path.Join(dir, "tokens")); !os.IsNotExist(err) {
+		t.Errorf("Token file written despite mismatch: %v", err)
+	}
+	if err := s.Put(&Secrets{RefreshToken: "refresh"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(answers) != 0 {
+		t.Errorf("%d passphrase answers left", len(answers))
+	}
+}
+
+func TestLockFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cmdg-secrets-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := path.Join(dir, "cmdg.conf")
+	unlock, err := lockFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locked := make(chan struct{})
+	go func() {
+		unlock, err := lockFile(fn)
+		if err != nil {
+			t.Error(err)
+		} else {
+			unlock()
+		}
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("Got lock while held")
+	case <-time.After(100 * time.Millisecond):
+	}
+	unlock()
+	<-locked
+}
+
+func TestSecretCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cmdg-secrets-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "secrets.json")
+	if err := ioutil.WriteFile(fn, []byte(`{"RefreshToken":"refresh"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := newSecretStore("", "", &ConfigOAuth{Secrets: &ConfigSecrets{
+		Command:      "cat " + fn,
+		StoreCommand: "cat > " + fn,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sec, err := s.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sec.RefreshToken != "refresh" {
+		t.Errorf("Got secrets %+v", sec)
+	}
+	sec.AccessToken = "access"
+	if err := s.Put(sec); err != nil {
+		t.Fatal(err)
+	}
+	sec, err = s.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sec.RefreshToken != "refresh" || sec.AccessToken != "access" {
+		t.Errorf("Got secrets %+v after store", sec)
+	}
+
+	if _, err := (&commandSecretStore{get: "false"}).Get(); err == nil {
+		t.Errorf("Failing command succeeded")
+	}
+}
+
+type staticTokenSource struct {
+	token *oauth2.Token
+}
+
+func (s *staticTokenSource) Token() (*oauth2.Token, error) {
+	return s.token, nil
+}
+
+func TestPersistingTokenSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cmdg-secrets-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "cmdg.conf")
+	var conf Config
+	conf.setAccount("work", ConfigOAuth{ClientID: "id", RefreshToken: "refresh"})
+	if err := writeConf(fn, &conf); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := newSecretStore(fn, "work", &ConfigOAuth{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sec, err := store.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiry := time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+	src := &staticTokenSource{token: &oauth2.Token{AccessToken: "access", Expiry: expiry}}
+	ts := &persistingTokenSource{src: src, store: store, sec: *sec, last: sec.AccessToken}
+	if _, err := ts.Token(); err != nil {
+		t.Fatal(err)
+	}
+
+	conf, err = readConf(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oc, _ := conf.account("work")
+	if oc.ClientID != "id" || oc.RefreshToken != "refresh" || oc.AccessToken != "access" || !oc.Expiry.Equal(expiry) {
+		t.Errorf("Got config %+v after refresh", oc)
+	}
+
+	// Same token again is not saved.
+	if err := os.Remove(fn); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.Token(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(fn); !os.IsNotExist(err) {
+		t.Errorf("Unchanged token was saved")
+	}
+}
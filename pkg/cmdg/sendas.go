@@ -0,0 +1,121 @@
+package cmdg
+
+import (
+	"context"
+	"net/mail"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/html"
+	gmail "google.golang.org/api/gmail/v1"
+)
+
+// LoadSendAs loads the addresses the user can send as.
+func (c *CmdG) LoadSendAs(ctx context.Context) error {
+	ss, err := c.backend.ListSendAs(ctx)
+	if err != nil {
+		return errors.Wrap(err, "listing send-as aliases")
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.sendAs = ss
+	return nil
+}
+
+// SendAs returns the addresses the user can send as, default first.
+func (c *CmdG) SendAs() []*gmail.SendAs {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	var ret []*gmail.SendAs
+	for _, s := range c.sendAs {
+		if s.IsDefault {
+			ret = append([]*gmail.SendAs{s}, ret...)
+		} else {
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
+
+// DefaultSendAs returns the alias to send new messages as, or nil if
+// not known.
+func (c *CmdG) DefaultSendAs() *gmail.SendAs {
+	ss := c.SendAs()
+	if s := c.GetDefaultSender(); s != "" {
+		if a, err := mail.ParseAddress(s); err == nil {
+			if alias := findSendAs(ss, a.Address); alias != nil {
+				return alias
+			}
+		}
+	}
+	if len(ss) == 0 {
+		return nil
+	}
+	return ss[0]
+}
+
+func findSendAs(ss []*gmail.SendAs, addr string) *gmail.SendAs {
+	for _, s := range ss {
+		if strings.EqualFold(s.SendAsEmail, addr) {
+			return s
+		}
+	}
+	return nil
+}
+
+// ReplySendAs returns the alias that msg was sent to, or the default
+// alias if none of them were.
+func (c *CmdG) ReplySendAs(ctx context.Context, msg *Message) *gmail.SendAs {
+	ss := c.SendAs()
+	for _, h := range []string{"To", "Cc", "Delivered-To", "X-Original-To"} {
+		v, err := msg.GetHeader(ctx, h)
+		if err != nil {
+			continue
+		}
+		as, err := mail.ParseAddressList(v)
+		if err != nil {
+			continue
+		}
+		for _, a := range as {
+			if alias := findSendAs(ss, a.Address); alias != nil {
+				return alias
+			}
+		}
+	}
+	return c.DefaultSendAs()
+}
+
+// FormatSendAs returns the alias as a From header value.
+func FormatSendAs(s *gmail.SendAs) string {
+	if s.DisplayName == "" {
+		return s.SendAsEmail
+	}
+	return (&mail.Address{Name: s.DisplayName, Address: s.SendAsEmail}).String()
+}
+
+// SendAsSignature returns the alias signature as plain text. Gmail
+// stores them as HTML.
+func SendAsSignature(s *gmail.SendAs) string {
+	if s == nil || s.Signature == "" {
+		return ""
+	}
+	var b strings.Builder
+	z := html.NewTokenizer(strings.NewReader(s.Signature))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return strings.TrimSpace(b.String())
+		case html.TextToken:
+			b.Write(z.Text())
+		case html.StartTagToken, html.SelfClosingTagToken:
+			if name, _ := z.TagName(); string(name) == "br" {
+				b.WriteString("\n")
+			}
+		case html.EndTagToken:
+			switch name, _ := z.TagName(); string(name) {
+			case "p", "div", "li", "tr":
+				b.WriteString("\n")
+			}
+		}
+	}
+}
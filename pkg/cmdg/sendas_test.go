@@ -0,0 +1,55 @@
+package cmdg
+
+import (
+	"context"
+	"testing"
+
+	gmail "google.golang.org/api/gmail/v1"
+)
+
+func TestSendAs(t *testing.T) {
+	ctx := context.Background()
+	b := NewMemBackend("me@example.com")
+	b.AddSendAs(&gmail.SendAs{
+		SendAsEmail: "support@example.com",
+		DisplayName: "Example Support",
+		Signature:   "<div>Example Support</div><div>Call us: 555&nbsp;1234<br>Mon&ndash;Fri</div>",
+	})
+	id, err := b.AddMessage("From: alice@example.org\r\nTo: Support <SUPPORT@example.com>\r\nSubject: Help\r\n\r\nHelp!\r\n", "", []string{Inbox})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := b.AddMessage("From: alice@example.org\r\nTo: list@example.org\r\nSubject: Hi\r\n\r\nHi all\r\n", "", []string{Inbox})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewWithBackend(b)
+	if err := c.LoadSendAs(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(c.SendAs()), 2; got != want {
+		t.Fatalf("Got %d aliases, want %d", got, want)
+	}
+	if got, want := c.DefaultSendAs().SendAsEmail, "me@example.com"; got != want {
+		t.Errorf("Got default %q, want %q", got, want)
+	}
+	c.SetDefaultSender("Support <support@example.com>")
+	if got, want := c.DefaultSendAs().SendAsEmail, "support@example.com"; got != want {
+		t.Errorf("Got default %q with sender setting, want %q", got, want)
+	}
+	c.SetDefaultSender("")
+
+	s := c.ReplySendAs(ctx, NewMessage(c, id))
+	if got, want := s.SendAsEmail, "support@example.com"; got != want {
+		t.Errorf("Got reply alias %q, want %q", got, want)
+	}
+	if got, want := FormatSendAs(s), `"Example Support" <support@example.com>`; got != want {
+		t.Errorf("Got From %q, want %q", got, want)
+	}
+	if got, want := SendAsSignature(s), "Example Support\nCall us: 555\u00a01234\nMon\u2013Fri"; got != want {
+		t.Errorf("Got signature %q, want %q", got, want)
+	}
+	if got, want := c.ReplySendAs(ctx, NewMessage(c, other)).SendAsEmail, "me@example.com"; got != want {
+		t.Errorf("Got reply alias %q for list mail, want default %q", got, want)
+	}
+}
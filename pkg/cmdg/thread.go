@@ -0,0 +1,315 @@
+package cmdg
+
+import (
+	"context"
+	"net/mail"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	gmail "google.golang.org/api/gmail/v1"
+)
+
+const (
+	// Threads.Get has no batch helper, so preload threads in parallel.
+	threadPreloadConcurrency = 10
+)
+
+// Thread is a conversation. Label changes apply to every message in it.
+type Thread struct {
+	ID ThreadID
+
+	m        sync.RWMutex
+	conn     *CmdG
+	level    DataLevel
+	messages []*Message // Oldest first.
+}
+
+// Thread returns a thread. Nothing is loaded until asked for.
+func (c *CmdG) Thread(id ThreadID) *Thread {
+	return &Thread{
+		ID:    id,
+		conn:  c,
+		level: LevelEmpty,
+	}
+}
+
+// HasData returns if the thread has at least the given level.
+func (t *Thread) HasData(level DataLevel) bool {
+	t.m.RLock()
+	defer t.m.RUnlock()
+	return hasData(t.level, level)
+}
+
+// Preload loads the thread, unless it's already loaded.
+func (t *Thread) Preload(ctx context.Context, level DataLevel) error {
+	if t.HasData(level) {
+		return nil
+	}
+	return t.load(ctx, level)
+}
+
+// Reload unconditionally reloads the thread.
+func (t *Thread) Reload(ctx context.Context, level DataLevel) error {
+	return t.load(ctx, level)
+}
+
+func (t *Thread) load(ctx context.Context, level DataLevel) error {
+	st := time.Now()
+	resp, err := t.conn.backend.GetThread(ctx, t.ID, level)
+	if err != nil {
+		return errors.Wrapf(err, "loading thread %q", t.ID)
+	}
+	log.Debugf("Downloading thread %q level %q took %v", t.ID, level, time.Since(st))
+	return t.setResponse(ctx, resp, level)
+}
+
+// setResponse fills in the thread from an API response. Messages
+// already loaded at this level or better only get their labels
+// updated.
+func (t *Thread) setResponse(ctx context.Context, resp *gmail.Thread, level DataLevel) error {
+	var msgs []*Message
+	for _, r := range resp.Messages {
+		m := NewMessage(t.conn, r.Id)
+		if m.HasData(level) {
+			m.setLabels(r.LabelIds)
+		} else if err := m.setResponse(ctx, r, level); err != nil {
+			return errors.Wrapf(err, "thread %q message %q", t.ID, r.Id)
+		}
+		msgs = append(msgs, m)
+	}
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.messages = msgs
+	t.level = level
+	return nil
+}
+
+// Messages returns the messages in the thread, oldest first.
+func (t *Thread) Messages() []*Message {
+	t.m.RLock()
+	defer t.m.RUnlock()
+	return append([]*Message{}, t.messages...)
+}
+
+// Len returns the number of messages in the thread.
+func (t *Thread) Len() int {
+	t.m.RLock()
+	defer t.m.RUnlock()
+	return len(t.messages)
+}
+
+// Last returns the newest message in the thread, or nil if not loaded.
+func (t *Thread) Last() *Message {
+	t.m.RLock()
+	defer t.m.RUnlock()
+	if len(t.messages) == 0 {
+		return nil
+	}
+	return t.messages[len(t.messages)-1]
+}
+
+// GetSubject returns the subject of the first message.
+func (t *Thread) GetSubject(ctx context.Context) (string, error) {
+	if err := t.Preload(ctx, LevelMetadata); err != nil {
+		return "", err
+	}
+	ms := t.Messages()
+	if len(ms) == 0 {
+		return "", errors.Wrapf(ErrMissing, "thread %q has no messages", t.ID)
+	}
+	return ms[0].GetSubject(ctx)
+}
+
+// GetFrom returns the names of everyone who wrote in the thread,
+// in the order they first did.
+func (t *Thread) GetFrom(ctx context.Context) (string, error) {
+	if err := t.Preload(ctx, LevelMetadata); err != nil {
+		return "", err
+	}
+	var names []string
+	seen := make(map[string]bool)
+	for _, m := range t.Messages() {
+		s, err := m.GetHeader(ctx, "From")
+		if err != nil {
+			return "", err
+		}
+		name, addr := s, s
+		if a, err := mail.ParseAddress(s); err == nil {
+			name, addr = a.Name, a.Address
+			if name == "" {
+				name = addr
+			}
+		}
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		// First name only, or the list gets long fast.
+		if f := strings.Fields(name); len(f) > 0 && len(names) > 0 {
+			name = f[0]
+		}
+		names = append(names, name)
+	}
+	return strings.Join(names, ", "), nil
+}
+
+// IsUnread returns if any message in the thread is unread.
+func (t *Thread) IsUnread() bool {
+	return t.HasLabel(Unread)
+}
+
+// HasLabel returns if any message in the thread has the label.
+func (t *Thread) HasLabel(labelID string) bool {
+	for _, m := range t.Messages() {
+		if m.HasLabel(labelID) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetLabels returns the labels that any message in the thread has.
+func (t *Thread) GetLabels(ctx context.Context, withUnread bool) ([]*Label, error) {
+	var ret []*Label
+	seen := make(map[string]bool)
+	for _, m := range t.Messages() {
+		ls, err := m.GetLabels(ctx, withUnread)
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range ls {
+			if !seen[l.ID] {
+				seen[l.ID] = true
+				ret = append(ret, l)
+			}
+		}
+	}
+	return ret, nil
+}
+
+// GetLabelsString returns labels as a printable string. With colors, but without "UNREAD".
+func (t *Thread) GetLabelsString(ctx context.Context) (string, error) {
+	ls, err := t.GetLabels(ctx, false)
+	if err != nil {
+		return "", err
+	}
+	var s []string
+	for _, l := range ls {
+		s = append(s, l.LabelString())
+	}
+	return strings.Join(s, ", "), nil
+}
+
+// GetLabelColors is like Message.GetLabelColors, but for all labels in the thread.
+func (t *Thread) GetLabelColors(ctx context.Context, exclude string) (string, string, error) {
+	ls, err := t.GetLabels(ctx, false)
+	if err != nil {
+		return "", "", err
+	}
+	var ret1, ret2 []string
+	for _, l := range ls {
+		if l.ID == exclude {
+			continue
+		}
+		if lc := l.LabelColorChar(); lc != "" {
+			ret1 = append(ret1, lc)
+			ret2 = append(ret2, l.LabelString())
+		}
+	}
+	return strings.Join(ret1, ""), strings.Join(ret2, " "), nil
+}
+
+// AddLabelIDLocal adds a label to all messages in the local cache *only*.
+func (t *Thread) AddLabelIDLocal(labelID string) {
+	for _, m := range t.Messages() {
+		m.AddLabelIDLocal(labelID)
+	}
+}
+
+// RemoveLabelIDLocal removes a label from all messages in the local cache *only*.
+func (t *Thread) RemoveLabelIDLocal(labelID string) {
+	for _, m := range t.Messages() {
+		m.RemoveLabelIDLocal(labelID)
+	}
+}
+
+// AddLabelID adds a label to all messages in the thread.
+func (t *Thread) AddLabelID(ctx context.Context, labelID string) error {
+	if err := t.conn.backend.ModifyThread(ctx, t.ID, []string{labelID}, nil); err != nil {
+		return errors.Wrapf(err, "adding label ID %q to thread %q", labelID, t.ID)
+	}
+	t.AddLabelIDLocal(labelID)
+	return nil
+}
+
+// RemoveLabelID removes a label from all messages in the thread.
+func (t *Thread) RemoveLabelID(ctx context.Context, labelID string) error {
+	if err := t.conn.backend.ModifyThread(ctx, t.ID, nil, []string{labelID}); err != nil {
+		return errors.Wrapf(err, "removing label ID %q from thread %q", labelID, t.ID)
+	}
+	t.RemoveLabelIDLocal(labelID)
+	return nil
+}
+
+// ThreadPage is one page of threads.
+type ThreadPage struct {
+	Label string
+	Query string
+
+	conn     *CmdG
+	Threads  []*Thread
+	Response *gmail.ListThreadsResponse
+}
+
+// ListThreads lists threads in a given label or query, with optional page token.
+func (c *CmdG) ListThreads(ctx context.Context, label, query, token string) (*ThreadPage, error) {
+	res, err := c.backend.ListThreads(ctx, label, query, token, pageSize)
+	if err != nil {
+		return nil, errors.Wrap(err, "listing threads")
+	}
+	p := &ThreadPage{
+		conn:     c,
+		Label:    label,
+		Query:    query,
+		Response: res,
+	}
+	for _, t := range res.Threads {
+		p.Threads = append(p.Threads, c.Thread(ThreadID(t.Id)))
+	}
+	return p, nil
+}
+
+// Next returns the next page.
+func (p *ThreadPage) Next(ctx context.Context) (*ThreadPage, error) {
+	return p.conn.ListThreads(ctx, p.Label, p.Query, p.Response.NextPageToken)
+}
+
+// PreloadSubjects loads message headers for all threads on the page.
+//
+// Like Page.PreloadSubjects, failures are only logged.
+func (p *ThreadPage) PreloadSubjects(ctx context.Context) error {
+	st := time.Now()
+	sem := make(chan struct{}, threadPreloadConcurrency)
+	var wg sync.WaitGroup
+	for _, t := range p.Threads {
+		if t.HasData(LevelMetadata) {
+			continue
+		}
+		t := t
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := t.load(ctx, LevelMetadata); err != nil {
+				log.Warningf("Failed to preload thread %q: %v", t.ID, err)
+			}
+		}()
+	}
+	wg.Wait()
+	log.Infof("Preloaded %d threads in %v", len(p.Threads), time.Since(st))
+	return nil
+}
@@ -0,0 +1,84 @@
+package cmdg
+
+import (
+	"context"
+	"testing"
+)
+
+func TestThreads(t *testing.T) {
+	ctx := context.Background()
+	b := NewMemBackend("bob@example.com")
+	first, err := b.AddMessage("From: Alice Smith <alice@example.com>\r\nSubject: Lunch?\r\n\r\nTomorrow?\r\n", "", []string{Inbox})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.AddMessage("From: Bob Jones <bob@example.com>\r\nSubject: Other\r\n\r\nUnrelated\r\n", "", []string{Inbox}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.AddMessage("From: Bob Jones <bob@example.com>\r\nSubject: Re: Lunch?\r\n\r\nSure\r\n", first, []string{Inbox, Unread}); err != nil {
+		t.Fatal(err)
+	}
+	c := NewWithBackend(b)
+
+	page, err := c.ListThreads(ctx, Inbox, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(page.Threads), 2; got != want {
+		t.Fatalf("Got %d threads, want %d", got, want)
+	}
+	if err := page.PreloadSubjects(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// Newest activity first.
+	th := page.Threads[0]
+	if got, want := th.ID, ThreadID(first); got != want {
+		t.Fatalf("Got first thread %q, want %q", got, want)
+	}
+	if got, want := th.Len(), 2; got != want {
+		t.Errorf("Got %d messages in thread, want %d", got, want)
+	}
+	if subj, err := th.GetSubject(ctx); err != nil {
+		t.Error(err)
+	} else if got, want := subj, "Lunch?"; got != want {
+		t.Errorf("Got subject %q, want %q", got, want)
+	}
+	if from, err := th.GetFrom(ctx); err != nil {
+		t.Error(err)
+	} else if got, want := from, "Alice Smith, Bob"; got != want {
+		t.Errorf("Got from %q, want %q", got, want)
+	}
+	if !th.IsUnread() {
+		t.Errorf("Thread with unread message not unread")
+	}
+	if page.Threads[1].IsUnread() {
+		t.Errorf("Thread with no unread messages is unread")
+	}
+
+	// Archive the whole thread.
+	if err := th.RemoveLabelID(ctx, Inbox); err != nil {
+		t.Fatal(err)
+	}
+	if th.HasLabel(Inbox) {
+		t.Errorf("Thread still has inbox label locally")
+	}
+	page, err = c.ListThreads(ctx, Inbox, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(page.Threads), 1; got != want {
+		t.Fatalf("Got %d threads after archive, want %d", got, want)
+	}
+	if err := th.Reload(ctx, LevelMinimal); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range th.Messages() {
+		if m.HasLabel(Inbox) {
+			t.Errorf("Message %q still in inbox", m.ID)
+		}
+		// Reloading at a lower level must not throw away headers.
+		if !m.HasData(LevelMetadata) {
+			t.Errorf("Message %q lost its metadata", m.ID)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package cmdg
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	// uploadChunkSize is the chunk size for resumable uploads. Messages
+	// bigger than this are uploaded in chunks, each retried on its own.
+	// Must be a multiple of googleapi.MinUploadChunkSize.
+	uploadChunkSize = 4 * googleapi.MinUploadChunkSize
+
+	// partHeaderEstimate is roughly the bytes of boundary and headers
+	// of a part, for Size().
+	partHeaderEstimate = 200
+
+	// base64LineLength is the max line length of base64 encoded parts,
+	// per RFC 2045.
+	base64LineLength = 76
+
+	// sniffLen is how much of a file http.DetectContentType looks at.
+	sniffLen = 512
+)
+
+// RawMessage is an RFC822 message to send or save as a draft. It's
+// opened once per upload attempt, so that attachments can be streamed
+// from disk instead of being kept in memory.
+type RawMessage interface {
+	// Open returns a reader of the whole message.
+	Open() (io.ReadCloser, error)
+
+	// Size returns the size of the message, or an estimate of it.
+	Size() int64
+}
+
+// StringMessage is a RawMessage already in memory.
+type StringMessage string
+
+// Open implements RawMessage.
+func (m StringMessage) Open() (io.ReadCloser, error) {
+	return ioutil.NopCloser(strings.NewReader(string(m))), nil
+}
+
+// Size implements RawMessage.
+func (m StringMessage) Size() int64 {
+	return int64(len(m))
+}
+
+// readRawMessage reads a whole message into memory.
+func readRawMessage(m RawMessage) (string, error) {
+	if s, ok := m.(StringMessage); ok {
+		return string(s), nil
+	}
+	r, err := m.Open()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	return string(b), err
+}
+
+// partsMessage is a multipart message, assembled while it's read.
+type partsMessage struct {
+	head     string // Message headers, including the empty line.
+	boundary string
+	parts    []*Part
+}
+
+// Open implements RawMessage.
+func (m *partsMessage) Open() (io.ReadCloser, error) {
+	// Fail early if an attachment is gone.
+	for _, p := range m.parts {
+		if p.File != "" {
+			if _, err := os.Stat(p.File); err != nil {
+				return nil, err
+			}
+		}
+	}
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(m.write(w))
+	}()
+	return r, nil
+}
+
+func (m *partsMessage) write(w io.Writer) error {
+	if _, err := io.WriteString(w, m.head); err != nil {
+		return err
+	}
+	mw := multipart.NewWriter(w)
+	if err := mw.SetBoundary(m.boundary); err != nil {
+		return err
+	}
+	for _, p := range m.parts {
+		pw, err := mw.CreatePart(p.Header)
+		if err != nil {
+			return err
+		}
+		if err := p.writeContents(pw); err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
+
+// Size implements RawMessage.
+func (m *partsMessage) Size() int64 {
+	n := int64(len(m.head))
+	for _, p := range m.parts {
+		n += p.size() + partHeaderEstimate
+	}
+	return n
+}
+
+// NewAttachmentPart creates a part attaching a file, which is read
+// when sending. The content type is guessed from the file name, or
+// else from the contents. Contents are base64 encoded.
+func NewAttachmentPart(fn, name string) (*Part, error) {
+	ct := mime.TypeByExtension(filepath.Ext(name))
+	if ct == "" {
+		f, err := os.Open(fn)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		b := make([]byte, sniffLen)
+		n, err := io.ReadFull(f, b)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, errors.Wrapf(err, "reading %q", fn)
+		}
+		ct = http.DetectContentType(b[:n])
+	}
+	mt, params, err := mime.ParseMediaType(ct)
+	if err != nil {
+		mt, params = "application/octet-stream", nil
+	}
+	if params == nil {
+		params = make(map[string]string)
+	}
+	// Non-ASCII names are RFC 2231 encoded.
+	params["name"] = name
+	return &Part{
+		Header: map[string][]string{
+			"Content-Type":              {mime.FormatMediaType(mt, params)},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": name})},
+			"Content-Transfer-Encoding": {"base64"},
+		},
+		File: fn,
+	}, nil
+}
+
+// writeContents writes the part contents, from the file if there is
+// one, base64 encoded if the header says so.
+func (p *Part) writeContents(w io.Writer) error {
+	var r io.Reader = strings.NewReader(p.Contents)
+	if p.File != "" {
+		f, err := os.Open(p.File)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	if !strings.EqualFold(p.Header.Get("Content-Transfer-Encoding"), "base64") {
+		_, err := io.Copy(w, r)
+		return err
+	}
+	lw := &lineWrapper{w: w, max: base64LineLength}
+	enc := base64.NewEncoder(base64.StdEncoding, lw)
+	if _, err := io.Copy(enc, r); err != nil {
+		return err
+	}
+	// The multipart writer ends the last line.
+	return enc.Close()
+}
+
+// size returns the size of the part contents, as sent.
+func (p *Part) size() int64 {
+	n := int64(len(p.Contents))
+	if p.File != "" {
+		st, err := os.Stat(p.File)
+		if err != nil {
+			return 0
+		}
+		n = st.Size()
+	}
+	if strings.EqualFold(p.Header.Get("Content-Transfer-Encoding"), "base64") {
+		n = int64(base64.StdEncoding.EncodedLen(int(n)))
+		n += 2 * (n / base64LineLength)
+	}
+	return n
+}
+
+// lineWrapper breaks lines after max bytes, with CRLF.
+type lineWrapper struct {
+	w   io.Writer
+	max int
+	n   int // Bytes on the current line.
+}
+
+func (l *lineWrapper) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if l.n == l.max {
+			if _, err := io.WriteString(l.w, "\r\n"); err != nil {
+				return written, err
+			}
+			l.n = 0
+		}
+		chunk := p
+		if len(chunk) > l.max-l.n {
+			chunk = chunk[:l.max-l.n]
+		}
+		n, err := l.w.Write(chunk)
+		written += n
+		l.n += n
+		if err != nil {
+			return written, err
+		}
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+type uploadProgressKey struct{}
+
+// WithUploadProgress returns a context that reports how many bytes of
+// a message have been uploaded, when sending it or saving a draft.
+// Total is RawMessage.Size(), so may be an estimate. Only messages big
+// enough to be uploaded in chunks report progress.
+func WithUploadProgress(ctx context.Context, cb func(sent, total int64)) context.Context {
+	return context.WithValue(ctx, uploadProgressKey{}, cb)
+}
+
+// uploadProgress returns the progress callback of the context, if any.
+func uploadProgress(ctx context.Context, msg RawMessage) googleapi.ProgressUpdater {
+	cb, ok := ctx.Value(uploadProgressKey{}).(func(int64, int64))
+	if !ok {
+		return nil
+	}
+	total := msg.Size()
+	return func(current, _ int64) {
+		cb(current, total)
+	}
+}
+
+// uploadOptions are the media options for uploading a message.
+func uploadOptions() []googleapi.MediaOption {
+	return []googleapi.MediaOption{
+		googleapi.ContentType("message/rfc822"),
+		googleapi.ChunkSize(uploadChunkSize),
+	}
+}
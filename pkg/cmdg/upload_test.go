@@ -0,0 +1,337 @@
+package cmdg
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// uploadServer accepts multipart and resumable media uploads.
+type uploadServer struct {
+	m           sync.Mutex
+	uploadTypes []string
+	chunks      int
+	media       bytes.Buffer
+}
+
+func (s *uploadServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	if r.URL.Path == "/session" {
+		s.chunks++
+		if _, err := s.media.ReadFrom(r.Body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if strings.HasSuffix(r.Header.Get("Content-Range"), "/*") {
+			// Google's way of saying "308 resume incomplete".
+			w.Header().Set("X-HTTP-Status-Code-Override", "308")
+			w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", s.media.Len()-1))
+			return
+		}
+		fmt.Fprintf(w, `{"id":"123"}`)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, "/upload/") {
+		http.Error(w, "not an upload: "+r.URL.Path, http.StatusBadRequest)
+		return
+	}
+	t := r.URL.Query().Get("uploadType")
+	s.uploadTypes = append(s.uploadTypes, t)
+	switch t {
+	case "resumable":
+		if got, want := r.Header.Get("X-Upload-Content-Type"), "message/rfc822"; got != want {
+			http.Error(w, "bad content type "+got, http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Location", "http://upload.invalid/session")
+	case "multipart":
+		_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mr := multipart.NewReader(r.Body, params["boundary"])
+		if _, err := mr.NextPart(); err != nil { // Metadata.
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		p, err := mr.NextPart()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if got, want := p.Header.Get("Content-Type"), "message/rfc822"; got != want {
+			http.Error(w, "bad content type "+got, http.StatusBadRequest)
+			return
+		}
+		s.media.ReadFrom(p)
+	}
+	fmt.Fprintf(w, `{"id":"123"}`)
+}
+
+func TestPartsMessage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cmdg-upload-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "data.bin")
+	data := make([]byte, 100000)
+	rand.New(rand.NewSource(1)).Read(data)
+	if err := ioutil.WriteFile(fn, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := newPartsMessage("mixed", mail.Header{
+		"To":      {"Alice <alice@example.com>"},
+		"Subject": {"Hi"},
+	}, []*Part{
+		{Header: map[string][]string{"Content-Type": {"text/plain"}}, Contents: "Hello\r\n"},
+		{Header: map[string][]string{"Content-Type": {"application/octet-stream"}}, File: fn},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, min := m.Size(), int64(len(data)); got < min || got > min+1000 {
+		t.Errorf("Got size %d, want about %d", got, min)
+	}
+
+	// Opening twice gives the same message.
+	raw, err := readRawMessage(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw2, err := readRawMessage(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw != raw2 {
+		t.Errorf("Message changed between reads")
+	}
+
+	msg, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := msg.Header.Get("To"), `"Alice" <alice@example.com>`; got != want {
+		t.Errorf("Got To %q, want %q", got, want)
+	}
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for n, want := range []string{"Hello\r\n", string(data)} {
+		p, err := mr.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != want {
+			t.Errorf("Part %d: got %d bytes, want %d", n, len(b), len(want))
+		}
+	}
+
+	// Attachment gone.
+	os.Remove(fn)
+	if _, err := m.Open(); err == nil {
+		t.Errorf("Opening message with missing attachment succeeded")
+	}
+}
+
+func TestParseUserMessageEncoding(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		body string
+		cte  string
+	}{
+		{"ascii", "Hello\n", "7bit"},
+		{"non-ascii", "Hallå där\n", "quoted-printable"},
+		{"long line", strings.Repeat("x", 1000) + "\n", "quoted-printable"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, part, err := ParseUserMessage("To: bob@example.com\nSubject: Hi\n\n" + test.body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := part.Header.Get("Content-Transfer-Encoding"); got != test.cte {
+				t.Errorf("Got encoding %q, want %q", got, test.cte)
+			}
+			got := part.Contents
+			if test.cte == "quoted-printable" {
+				b, err := ioutil.ReadAll(quotedprintable.NewReader(strings.NewReader(got)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = strings.ReplaceAll(string(b), "\r\n", "\n")
+			}
+			if got != test.body {
+				t.Errorf("Got body %q, want %q", got, test.body)
+			}
+		})
+	}
+}
+
+func TestUpload(t *testing.T) {
+	ctx := context.Background()
+	big := make([]byte, 5*uploadChunkSize/2)
+	rand.New(rand.NewSource(1)).Read(big)
+	for _, test := range []struct {
+		name       string
+		msg        string
+		uploadType string
+		chunks     int
+	}{
+		{"small", "Subject: hi\r\n\r\nbody\r\n", "multipart", 0},
+		{"big", "Subject: big\r\n\r\n" + string(big), "resumable", 3},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := &uploadServer{}
+			b, done := newTestGmailBackend(t, s)
+			defer done()
+
+			var progress []int64
+			ctx := WithUploadProgress(ctx, func(n, _ int64) { progress = append(progress, n) })
+			if err := b.Send(ctx, NewThread, StringMessage(test.msg)); err != nil {
+				t.Fatal(err)
+			}
+			if err := b.CreateDraft(ctx, StringMessage(test.msg)); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := strings.Join(s.uploadTypes, ","), test.uploadType+","+test.uploadType; got != want {
+				t.Errorf("Got upload types %q, want %q", got, want)
+			}
+			if got, want := s.media.String(), test.msg+test.msg; got != want {
+				t.Errorf("Got %d bytes uploaded, want %d", len(got), len(want))
+			}
+			if s.chunks != 2*test.chunks {
+				t.Errorf("Got %d chunks, want %d", s.chunks, 2*test.chunks)
+			}
+			if test.chunks > 0 {
+				if len(progress) == 0 || progress[len(progress)-1] != int64(len(test.msg)) {
+					t.Errorf("Got progress %v", progress)
+				}
+			}
+		})
+	}
+}
+
+func TestAttachmentPart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cmdg-upload-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	binary := make([]byte, 1000)
+	rand.New(rand.NewSource(1)).Read(binary)
+	binary = append(binary, "\r\n\x00\n\r"...)
+
+	var parts []*Part
+	tests := []struct {
+		name     string
+		data     string
+		wantType string
+	}{
+		{"photo.png", "\x89PNG\r\n\x1a\n" + string(binary), "image/png"},
+		{"report", "%PDF-1.4\n" + string(binary), "application/pdf"},
+		{"blob", string(binary), "application/octet-stream"},
+		{"notes", "Just some text\r\n", "text/plain"},
+		{"empty.bin", "", "application/octet-stream"},
+		{"Résumé ü.txt", "Hej\n", "text/plain"},
+		{"日本語.pdf", string(binary), "application/pdf"},
+	}
+	for n, test := range tests {
+		fn := path.Join(dir, fmt.Sprint(n))
+		if err := ioutil.WriteFile(fn, []byte(test.data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		p, err := NewAttachmentPart(fn, test.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, p)
+	}
+	m, err := newPartsMessage("mixed", mail.Header{"Subject": {"Files"}}, parts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := readRawMessage(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := m.Size(), int64(len(raw)); got < want*9/10 || got > want*11/10 {
+		t.Errorf("Got size %d, want about %d", got, want)
+	}
+	for _, line := range strings.Split(raw, "\r\n") {
+		if len(line) > 998 || strings.ContainsAny(line, "\r\n\x00") {
+			t.Errorf("Bad line %q", line)
+		}
+	}
+
+	msg, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for _, test := range tests {
+		p, err := mr.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := p.FileName(); got != test.name {
+			t.Errorf("Got file name %q, want %q", got, test.name)
+		}
+		if cd := p.Header.Get("Content-Disposition"); strings.ContainsAny(test.name, "éü日") && !strings.Contains(cd, "filename*=utf-8''") {
+			t.Errorf("%s: not RFC 2231 encoded: %q", test.name, cd)
+		}
+		ct, params, err := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ct != test.wantType || params["name"] != test.name {
+			t.Errorf("%s: got Content-Type %q", test.name, p.Header.Get("Content-Type"))
+		}
+		// multipart.Reader decodes only quoted-printable, so do base64 here.
+		if got, want := p.Header.Get("Content-Transfer-Encoding"), "base64"; got != want {
+			t.Errorf("%s: got encoding %q, want %q", test.name, got, want)
+		}
+		enc, err := ioutil.ReadAll(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range strings.Split(string(enc), "\r\n") {
+			if len(line) > base64LineLength {
+				t.Errorf("%s: line too long: %q", test.name, line)
+			}
+		}
+		b, err := ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, &skipSpace{r: bytes.NewReader(enc)}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != test.data {
+			t.Errorf("%s: got %d bytes back, want %d", test.name, len(b), len(test.data))
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package cmdg
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	gmail "google.golang.org/api/gmail/v1"
+)
+
+const (
+	vacationDateFormat = "2006-01-02"
+)
+
+// Vacation gets the vacation responder settings.
+func (c *CmdG) Vacation(ctx context.Context) (*gmail.VacationSettings, error) {
+	v, err := c.backend.GetVacation(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting vacation settings")
+	}
+	return v, nil
+}
+
+// UpdateVacation replaces the vacation responder settings.
+func (c *CmdG) UpdateVacation(ctx context.Context, v *gmail.VacationSettings) (*gmail.VacationSettings, error) {
+	// Update replaces everything, so false must be sent too.
+	v.ForceSendFields = []string{"EnableAutoReply", "RestrictToContacts", "RestrictToDomain"}
+	ret, err := c.backend.UpdateVacation(ctx, v)
+	if err != nil {
+		return nil, errors.Wrap(err, "updating vacation settings")
+	}
+	return ret, nil
+}
+
+// SetVacationEnabled turns the vacation responder on or off, keeping
+// the other settings.
+func (c *CmdG) SetVacationEnabled(ctx context.Context, on bool) (*gmail.VacationSettings, error) {
+	v, err := c.Vacation(ctx)
+	if err != nil {
+		return nil, err
+	}
+	v.EnableAutoReply = on
+	return c.UpdateVacation(ctx, v)
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// vacationDate formats a start time, or the last day before an end time.
+func vacationDate(ms int64, end bool) string {
+	if ms == 0 {
+		return ""
+	}
+	if end {
+		ms--
+	}
+	return time.Unix(0, ms*int64(time.Millisecond)).Local().Format(vacationDateFormat)
+}
+
+// DescribeVacation returns a human readable summary of the settings.
+func DescribeVacation(v *gmail.VacationSettings) string {
+	if !v.EnableAutoReply {
+		return "Vacation responder is off"
+	}
+	s := fmt.Sprintf("Vacation responder is on: %q", v.ResponseSubject)
+	if d := vacationDate(v.StartTime, false); d != "" {
+		s += " from " + d
+	}
+	if d := vacationDate(v.EndTime, true); d != "" {
+		s += " until " + d
+	}
+	if v.RestrictToContacts {
+		s += ", contacts only"
+	}
+	if v.RestrictToDomain {
+		s += ", domain only"
+	}
+	return s
+}
+
+// FormatVacation turns settings into text for editing. Dates are
+// days in local time, and the end date is the last day of vacation.
+// The body is the plain text one, or if there is none, the HTML one
+// with a "Format: html" line saying so.
+func FormatVacation(v *gmail.VacationSettings) string {
+	body := v.ResponseBodyPlainText
+	format := ""
+	if body == "" && v.ResponseBodyHtml != "" {
+		body = v.ResponseBodyHtml
+		format = "Format: html\n"
+	}
+	return fmt.Sprintf(`Enabled: %s
+Subject: %s
+Start: %s
+End: %s
+Contacts-Only: %s
+Domain-Only: %s
+%s
+%s`,
+		yesNo(v.EnableAutoReply),
+		v.ResponseSubject,
+		vacationDate(v.StartTime, false),
+		vacationDate(v.EndTime, true),
+		yesNo(v.RestrictToContacts),
+		yesNo(v.RestrictToDomain),
+		format,
+		body)
+}
+
+// ParseVacation parses text written by FormatVacation.
+func ParseVacation(s string) (*gmail.VacationSettings, error) {
+	v := &gmail.VacationSettings{}
+	r := bufio.NewReader(strings.NewReader(s))
+	parseBool := func(k, s string) (bool, error) {
+		switch strings.ToLower(s) {
+		case "yes", "y", "true", "on":
+			return true, nil
+		case "no", "n", "false", "off", "":
+			return false, nil
+		}
+		return false, fmt.Errorf("bad value %q for %q, want yes or no", s, k)
+	}
+	parseDate := func(k, s string, end bool) (int64, error) {
+		if s == "" {
+			return 0, nil
+		}
+		t, err := time.ParseInLocation(vacationDateFormat, s, time.Local)
+		if err != nil {
+			return 0, errors.Wrapf(err, "bad date for %q", k)
+		}
+		if end {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t.UnixNano() / int64(time.Millisecond), nil
+	}
+	html := false
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("no empty line between settings and body")
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("bad settings line %q", line)
+		}
+		k, val := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		switch strings.ToLower(k) {
+		case "enabled":
+			v.EnableAutoReply, err = parseBool(k, val)
+		case "subject":
+			v.ResponseSubject = val
+		case "start":
+			v.StartTime, err = parseDate(k, val, false)
+		case "end":
+			v.EndTime, err = parseDate(k, val, true)
+		case "contacts-only":
+			v.RestrictToContacts, err = parseBool(k, val)
+		case "domain-only":
+			v.RestrictToDomain, err = parseBool(k, val)
+		case "format":
+			switch strings.ToLower(val) {
+			case "html":
+				html = true
+			case "text", "":
+				html = false
+			default:
+				err = fmt.Errorf("bad format %q, want text or html", val)
+			}
+		default:
+			err = fmt.Errorf("unknown setting %q", k)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	rest, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	body := strings.TrimRight(string(rest), "\n")
+	if html {
+		v.ResponseBodyHtml = body
+	} else {
+		v.ResponseBodyPlainText = body
+	}
+	if v.StartTime != 0 && v.EndTime != 0 && v.EndTime <= v.StartTime {
+		return nil, fmt.Errorf("vacation ends before it starts")
+	}
+	return v, nil
+}
+
+// ParseVacationEdit parses settings edited from FormatVacation(old).
+// An HTML body that wasn't shown for editing is kept, unless the
+// plain text one was changed.
+func ParseVacationEdit(old *gmail.VacationSettings, s string) (*gmail.VacationSettings, error) {
+	v, err := ParseVacation(s)
+	if err != nil {
+		return nil, err
+	}
+	if v.ResponseBodyHtml == "" && old.ResponseBodyPlainText != "" && v.ResponseBodyPlainText == strings.TrimRight(old.ResponseBodyPlainText, "\n") {
+		v.ResponseBodyPlainText = old.ResponseBodyPlainText
+		v.ResponseBodyHtml = old.ResponseBodyHtml
+	}
+	return v, nil
+}
@@ -0,0 +1,113 @@
+package cmdg
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	gmail "google.golang.org/api/gmail/v1"
+)
+
+func TestVacationFormat(t *testing.T) {
+	in := `Enabled: yes
+Subject: Out of office
+Start: 2026-10-20
+End: 2026-10-27
+Contacts-Only: no
+Domain-Only: yes
+
+I'm away.
+
+Back on the 28th.
+`
+	v, err := ParseVacation(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !v.EnableAutoReply || v.RestrictToContacts || !v.RestrictToDomain {
+		t.Errorf("Wrong flags: %+v", v)
+	}
+	if got, want := v.ResponseBodyPlainText, "I'm away.\n\nBack on the 28th."; got != want {
+		t.Errorf("Got body %q, want %q", got, want)
+	}
+	if got, want := v.EndTime-v.StartTime, int64(8*24*3600*1000); got < want-3600*1000 || got > want+3600*1000 {
+		t.Errorf("Got vacation length %dms, want about %dms", got, want)
+	}
+	if got, want := FormatVacation(v), in[:len(in)-1]; got != want {
+		t.Errorf("Round trip failed. Got\n%s\nwant\n%s", got, want)
+	}
+
+	for _, bad := range []string{
+		"Subject: foo\nBody without separator",
+		"Enabled: maybe\n\nbody",
+		"Start: 2026-10-27\nEnd: 2026-10-20\n\nbody",
+		"Color: blue\n\nbody",
+	} {
+		if _, err := ParseVacation(bad); err == nil {
+			t.Errorf("Parsing %q succeeded", bad)
+		}
+	}
+}
+
+func TestVacationHTML(t *testing.T) {
+	old := &gmail.VacationSettings{ResponseSubject: "Away", ResponseBodyHtml: "<p>I'm <b>away</b>.</p>"}
+	s := FormatVacation(old)
+	if !strings.Contains(s, "\nFormat: html\n\n<p>") {
+		t.Errorf("No HTML format line in\n%s", s)
+	}
+	v, err := ParseVacationEdit(old, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.ResponseBodyHtml != old.ResponseBodyHtml || v.ResponseBodyPlainText != "" {
+		t.Errorf("Got HTML %q plain %q", v.ResponseBodyHtml, v.ResponseBodyPlainText)
+	}
+
+	// With both, the HTML is kept only if the plain text is unchanged.
+	old = &gmail.VacationSettings{ResponseSubject: "Away", ResponseBodyPlainText: "I'm away.", ResponseBodyHtml: "<p>I'm away.</p>"}
+	s = FormatVacation(old)
+	v, err = ParseVacationEdit(old, strings.Replace(s, "Subject: Away", "Subject: Gone", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.ResponseSubject != "Gone" || v.ResponseBodyHtml != old.ResponseBodyHtml || v.ResponseBodyPlainText != old.ResponseBodyPlainText {
+		t.Errorf("Unchanged body not kept: %+v", v)
+	}
+	v, err = ParseVacationEdit(old, strings.Replace(s, "away", "back", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.ResponseBodyHtml != "" || v.ResponseBodyPlainText != "I'm back." {
+		t.Errorf("Got HTML %q plain %q after editing", v.ResponseBodyHtml, v.ResponseBodyPlainText)
+	}
+}
+
+func TestVacationEnable(t *testing.T) {
+	ctx := context.Background()
+	c := NewWithBackend(NewMemBackend("me@example.com"))
+	want := &gmail.VacationSettings{
+		ResponseSubject:       "Away",
+		ResponseBodyPlainText: "Gone fishing",
+		RestrictToContacts:    true,
+	}
+	if _, err := c.UpdateVacation(ctx, want); err != nil {
+		t.Fatal(err)
+	}
+	v, err := c.SetVacationEnabled(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want.EnableAutoReply = true
+	if !reflect.DeepEqual(v, want) {
+		t.Errorf("Got %+v after enable, want %+v", v, want)
+	}
+	if got, want := DescribeVacation(v), `Vacation responder is on: "Away", contacts only`; got != want {
+		t.Errorf("Got description %q, want %q", got, want)
+	}
+	if v, err = c.SetVacationEnabled(ctx, false); err != nil {
+		t.Fatal(err)
+	} else if v.EnableAutoReply || v.ResponseSubject != "Away" {
+		t.Errorf("Got %+v after disable", v)
+	}
+}
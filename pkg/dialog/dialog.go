@@ -95,6 +95,21 @@ func messageErr(title, message string, keys *input.Input) error {
 	}
 }
 
+// Status shows a message without waiting for a key, e.g. progress of
+// something slow. It stays until something else is drawn.
+func Status(title, message string) error {
+	screen, err := display.NewScreen()
+	if err != nil {
+		return errors.Wrap(err, "failed to create screen")
+	}
+	startLine, lines := printBox(screen, title, message)
+	for n, l := range lines {
+		screen.Printlnf(startLine+n, "%s", l)
+	}
+	screen.Draw()
+	return nil
+}
+
 // Question asks the user a multiple-choice question.
 // ^C is always a valid option, and returns ErrAborted.
 // Example: `Should I send that email now?`
@@ -225,17 +240,50 @@ func Entry(prompt string, keys *input.Input) (string, error) {
 	}
 }
 
+// selectionMode is what a Selection dialog accepts.
+type selectionMode int
+
+const (
+	// selectFixed only accepts the listed options.
+	selectFixed selectionMode = iota
+	// selectFree accepts any input.
+	selectFree
+	// selectOrNew prefers the listed options, but accepts new input
+	// if nothing matches, or the user deselects everything.
+	selectOrNew
+)
+
 // Selection asks the user for a choice, with populated suggestions that can be searched in.
 // If `free` is `true` then the user can input anything. If `false` then the options listed are the only valid ones.
 // Example: Email recipient choice.
 func Selection(opts []*Option, prompt string, free bool, keys *input.Input) (*Option, error) {
+	mode := selectFixed
+	if free {
+		mode = selectFree
+	}
+	o, _, err := selection(opts, prompt, mode, keys)
+	return o, err
+}
+
+// SelectionOrNew is like Selection, but if what's typed doesn't
+// match any option then it's returned as a new option, and the bool
+// return value is true.
+// Example: Choosing a label, creating it if it doesn't exist.
+func SelectionOrNew(opts []*Option, prompt string, keys *input.Input) (*Option, bool, error) {
+	return selection(opts, prompt, selectOrNew, keys)
+}
+
+func selection(opts []*Option, prompt string, mode selectionMode, keys *input.Input) (*Option, bool, error) {
 	screen, err := display.NewScreen()
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	cur := ""
 	last := ""
 	selected := -1
+	if mode == selectOrNew && len(opts) > 0 {
+		selected = 0
+	}
 	scroll := 0 // TODO, implement scrolling.
 	visible := opts
 	keys.PastePush(false)
@@ -254,10 +302,13 @@ func Selection(opts []*Option, prompt string, free bool, keys *input.Input) (*Op
 			screen.Printlnf(n+start, "%s%s %s", prefix, sstr, o)
 		}
 
-		// Clear the area.
-		for n := len(visible); n < len(opts); n++ {
+		// Clear the area, including any hint line.
+		for n := len(visible); n <= len(opts); n++ {
 			screen.Printlnf(n+start, "")
 		}
+		if mode == selectOrNew && selected < 0 && cur != "" {
+			screen.Printlnf(len(visible)+start, "%s%s  <enter> to create %q%s", prefix, display.Bold, cur, display.Reset)
+		}
 
 		screen.Draw()
 
@@ -265,15 +316,15 @@ func Selection(opts []*Option, prompt string, free bool, keys *input.Input) (*Op
 		switch key {
 		case input.Enter, input.Right:
 			if selected < 0 {
-				if !free {
+				if mode == selectFixed || (mode == selectOrNew && cur == "") {
 					continue
 				}
 				return &Option{
 					Key:   cur,
 					Label: cur,
-				}, nil
+				}, mode == selectOrNew, nil
 			}
-			return visible[selected], nil
+			return visible[selected], false, nil
 		case input.CtrlN, input.Down:
 			selected++
 			if selected >= len(visible) {
@@ -282,12 +333,12 @@ func Selection(opts []*Option, prompt string, free bool, keys *input.Input) (*Op
 		case input.CtrlP, input.Up:
 			if selected > -1 {
 				selected--
-				if selected < 0 && !free {
+				if selected < 0 && mode == selectFixed {
 					selected = 0
 				}
 			}
 		case input.CtrlC:
-			return nil, ErrAborted
+			return nil, false, ErrAborted
 		case input.Backspace, input.CtrlH:
 			cur = TrimOneChar(cur)
 		case input.CtrlU:
@@ -298,7 +349,7 @@ func Selection(opts []*Option, prompt string, free bool, keys *input.Input) (*Op
 		if last != cur {
 			selected = -1
 			visible = filterSubmatch(opts, cur)
-			if !free && len(visible) > 0 {
+			if mode != selectFree && len(visible) > 0 {
 				selected = 0
 			}
 		}
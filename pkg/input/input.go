@@ -26,6 +26,7 @@ const (
 
 	CtrlC     = "\x03"
 	CtrlH     = "\x08"
+	Tab       = "\x09"
 	Return    = "\x0a"
 	CtrlL     = "\x0c"
 	Enter     = "\x0d"